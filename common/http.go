@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -15,6 +16,10 @@ import (
 type APIServer struct {
 	Addr   string
 	Logger *zap.Logger
+	// RequestTimeout bounds how long a handler may run, zero means no limit.
+	RequestTimeout time.Duration
+	// Lifecycle runs the server, a default one is used when it's nil.
+	Lifecycle *Lifecycle
 }
 
 type HttpError struct {
@@ -33,9 +38,22 @@ type RequestInfoKey string
 func (s APIServer) MakeHTTPHandler(f APIFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		ctx := context.WithValue(context.Background(), RequestInfoKey("RequestId"), uuid.NewString())
+		// The request context is cancelled when the client goes away, which
+		// also aborts any query still running on its behalf.
+		ctx := r.Context()
+		if s.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.RequestTimeout)
+			defer cancel()
+		}
+		ctx = context.WithValue(ctx, RequestInfoKey("RequestId"), uuid.NewString())
+
 		if err := f(ctx, w, r); err != nil {
 			msgErr := &HttpError{StatusCode: 500}
+			if errors.Is(err, context.DeadlineExceeded) {
+				msgErr = &HttpError{Message: "request timed out", StatusCode: http.StatusGatewayTimeout}
+				err = msgErr
+			}
 			if errors.As(err, &msgErr) {
 				if err := WriteJSON(w, msgErr.StatusCode, msgErr); err != nil {
 					panic(err)
@@ -53,9 +71,16 @@ func (s APIServer) MakeHTTPHandler(f APIFunc) http.HandlerFunc {
 	}
 }
 
+// Run serves router along with the health routes until the process is asked
+// to terminate.
 func (s APIServer) Run(router *mux.Router) error {
-	s.Logger.Info("server is running", zap.String("address", s.Addr))
-	return http.ListenAndServe(s.Addr, router)
+	lifecycle := s.Lifecycle
+	if lifecycle == nil {
+		lifecycle = NewLifecycle(s.Logger, 0)
+	}
+	lifecycle.RegisterHealthRoutes(router)
+	lifecycle.AddHTTPServer("http", &http.Server{Addr: s.Addr, Handler: router})
+	return lifecycle.Run()
 }
 
 func WriteJSON(w http.ResponseWriter, statusCode int, v any) error {
@@ -0,0 +1,278 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	defaultDrainTimeout = 15 * time.Second
+	defaultHookTimeout  = 10 * time.Second
+)
+
+// CheckFunc reports whether a dependency is usable.
+type CheckFunc func(ctx context.Context) error
+
+type lifecycleServer struct {
+	name     string
+	addr     string
+	serve    func() error
+	shutdown func(ctx context.Context) error
+}
+
+type lifecycleHook struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// Lifecycle runs the HTTP and gRPC servers of a service until it receives
+// SIGINT or SIGTERM, then stops accepting requests, lets in-flight ones
+// finish within the drain timeout and releases resources such as database
+// clients.
+type Lifecycle struct {
+	Logger       *zap.Logger
+	DrainTimeout time.Duration
+	// HookTimeout bounds each shutdown hook. Hooks don't share the drain
+	// timeout, which slow requests may have used up entirely.
+	HookTimeout time.Duration
+
+	mu           sync.Mutex
+	servers      []*lifecycleServer
+	hooks        []*lifecycleHook
+	checks       map[string]CheckFunc
+	shuttingDown atomic.Bool
+}
+
+func NewLifecycle(logger *zap.Logger, drainTimeout time.Duration) *Lifecycle {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	return &Lifecycle{
+		Logger:       logger,
+		DrainTimeout: drainTimeout,
+		HookTimeout:  defaultHookTimeout,
+		checks:       map[string]CheckFunc{},
+	}
+}
+
+func (l *Lifecycle) AddHTTPServer(name string, srv *http.Server) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.servers = append(l.servers, &lifecycleServer{
+		name: name,
+		addr: srv.Addr,
+		serve: func() error {
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+		shutdown: srv.Shutdown,
+	})
+}
+
+// AddGRPCServer serves srv on addr. It also registers the standard gRPC
+// health service, which reports NOT_SERVING as soon as shutdown starts.
+func (l *Lifecycle) AddGRPCServer(name, addr string, srv *grpc.Server) {
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.servers = append(l.servers, &lifecycleServer{
+		name: name,
+		addr: addr,
+		serve: func() error {
+			listen, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			return srv.Serve(listen)
+		},
+		shutdown: func(ctx context.Context) error {
+			healthServer.Shutdown()
+
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				srv.Stop()
+				return ctx.Err()
+			}
+		},
+	})
+}
+
+// OnShutdown registers f to run after all servers have stopped. Hooks run in
+// the reverse order of registration, like deferred calls, so a resource
+// registered first is released last.
+func (l *Lifecycle) OnShutdown(name string, f func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, &lifecycleHook{name: name, f: f})
+}
+
+// AddReadinessCheck makes /readyz fail while check returns an error.
+func (l *Lifecycle) AddReadinessCheck(name string, check CheckFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.checks[name] = check
+}
+
+// RegisterHealthRoutes adds /healthz, which only tells that the process is
+// alive, and /readyz, which also checks every dependency.
+func (l *Lifecycle) RegisterHealthRoutes(router *mux.Router) {
+	router.HandleFunc("/healthz", l.healthHandler).Methods("GET")
+	router.HandleFunc("/readyz", l.readyHandler).Methods("GET")
+}
+
+func (l *Lifecycle) healthHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (l *Lifecycle) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if l.shuttingDown.Load() {
+		WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	l.mu.Lock()
+	checks := make(map[string]CheckFunc, len(l.checks))
+	for name, check := range l.checks {
+		checks[name] = check
+	}
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	results := map[string]string{}
+	ready := true
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check CheckFunc) {
+			defer wg.Done()
+			result := "ok"
+			if err := check(ctx); err != nil {
+				result = err.Error()
+			}
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			results[name] = result
+			if result != "ok" {
+				ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	if !ready {
+		WriteJSON(w, http.StatusServiceUnavailable, results)
+		return
+	}
+	WriteJSON(w, http.StatusOK, results)
+}
+
+// Run starts every server and blocks until a termination signal arrives or
+// one of the servers fails.
+func (l *Lifecycle) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	l.mu.Lock()
+	servers := append([]*lifecycleServer{}, l.servers...)
+	l.mu.Unlock()
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *lifecycleServer) {
+			l.Logger.Info("server is running", zap.String("server", srv.name), zap.String("address", srv.addr))
+			if err := srv.serve(); err != nil {
+				errCh <- fmt.Errorf("%s: %w", srv.name, err)
+			}
+		}(srv)
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		l.Logger.Info("received termination signal, shutting down")
+	case runErr = <-errCh:
+		l.Logger.Error("server failed, shutting down", zap.Error(runErr))
+	}
+
+	l.Shutdown()
+	return runErr
+}
+
+// Shutdown stops the servers and runs the shutdown hooks. It's called by Run
+// and only needs to be called directly when the servers were never started.
+func (l *Lifecycle) Shutdown() {
+	if l.shuttingDown.Swap(true) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.DrainTimeout)
+	defer cancel()
+
+	l.mu.Lock()
+	servers := append([]*lifecycleServer{}, l.servers...)
+	hooks := append([]*lifecycleHook{}, l.hooks...)
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *lifecycleServer) {
+			defer wg.Done()
+			if err := srv.shutdown(ctx); err != nil {
+				l.Logger.Error("failed to stop server gracefully", zap.String("server", srv.name), zap.Error(err))
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		l.runHook(hooks[i])
+	}
+	l.Logger.Info("shutdown completed")
+}
+
+func (l *Lifecycle) runHook(hook *lifecycleHook) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.HookTimeout)
+	defer cancel()
+
+	if err := hook.f(ctx); err != nil {
+		l.Logger.Error("shutdown hook failed", zap.String("hook", hook.name), zap.Error(err))
+	}
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func readyStatus(router *mux.Router) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w.Code
+}
+
+func TestReadiness(t *testing.T) {
+	lifecycle := NewLifecycle(nil, time.Second)
+	router := mux.NewRouter()
+	lifecycle.RegisterHealthRoutes(router)
+
+	var failing atomic.Bool
+	lifecycle.AddReadinessCheck("db", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	assert.Equal(t, http.StatusOK, readyStatus(router))
+
+	failing.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, readyStatus(router))
+	failing.Store(false)
+	assert.Equal(t, http.StatusOK, readyStatus(router))
+
+	var readyWhileDraining int
+	lifecycle.OnShutdown("db", func(ctx context.Context) error {
+		readyWhileDraining = readyStatus(router)
+		return nil
+	})
+	lifecycle.Shutdown()
+	assert.Equal(t, http.StatusServiceUnavailable, readyWhileDraining)
+	assert.Equal(t, http.StatusServiceUnavailable, readyStatus(router))
+
+	// Liveness doesn't depend on draining.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestShutdownHooks(t *testing.T) {
+	lifecycle := NewLifecycle(nil, 50*time.Millisecond)
+
+	// A server that uses up the whole drain timeout.
+	lifecycle.servers = append(lifecycle.servers, &lifecycleServer{
+		name: "slow",
+		shutdown: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	order := []string{}
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		lifecycle.OnShutdown(name, func(ctx context.Context) error {
+			assert.Nil(t, ctx.Err())
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline)
+			order = append(order, name)
+			return nil
+		})
+	}
+	lifecycle.Shutdown()
+	assert.Equal(t, []string{"third", "second", "first"}, order)
+
+	// Shutting down again doesn't rerun the hooks.
+	lifecycle.Shutdown()
+	assert.Len(t, order, 3)
+}
+
+func TestRunStopsOnSignal(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listen.Addr().String()
+	listen.Close()
+
+	lifecycle := NewLifecycle(nil, time.Second)
+	router := mux.NewRouter()
+	lifecycle.RegisterHealthRoutes(router)
+	lifecycle.AddHTTPServer("http", &http.Server{Addr: addr, Handler: router})
+	var closed atomic.Bool
+	lifecycle.OnShutdown("db", func(ctx context.Context) error {
+		closed.Store(true)
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- lifecycle.Run()
+	}()
+
+	// The server only starts after Run listens for signals.
+	assert.Eventually(t, func() bool {
+		res, err := http.Get("http://" + addr + "/healthz")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after SIGTERM")
+	}
+	assert.True(t, closed.Load())
+
+	_, err = http.Get("http://" + addr + "/healthz")
+	assert.NotNil(t, err)
+}
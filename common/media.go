@@ -0,0 +1,16 @@
+package web
+
+import (
+	"net/url"
+	"strings"
+)
+
+// IsMediaURL reports whether rawURL points to a file served by the media
+// service published at baseURL.
+func IsMediaURL(baseURL, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery != "" || u.Fragment != "" || strings.Contains(u.Path, "..") {
+		return false
+	}
+	return strings.HasPrefix(rawURL, strings.TrimSuffix(baseURL, "/")+"/")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"net/netip"
 
 	"github.com/gorilla/mux"
 	web "github.com/sina-am/social-media/common"
@@ -13,9 +14,17 @@ type APIServer struct {
 	Storage Storage
 	Addr    string
 	Router  *mux.Router
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For is
+	// believed.
+	TrustedProxies []netip.Prefix
 }
 
 func (s *APIServer) Run() error {
+	s.registerRoutes()
+	return s.APIServer.Run(s.Router)
+}
+
+func (s *APIServer) registerRoutes() {
 	s.Router.HandleFunc("/accounts", s.MakeHTTPHandler(s.RegisterHandler)).Methods("POST")
 	s.Router.HandleFunc("/accounts", s.MakeHTTPHandler(s.GetUserByIDHandler)).Methods("GET").Queries("id", "{id}")
 	s.Router.HandleFunc("/accounts", s.MakeHTTPHandler(s.GetAllAccountHandler)).Methods("GET")
@@ -29,7 +38,20 @@ func (s *APIServer) Run() error {
 	s.Router.HandleFunc("/accounts/follow", s.MakeHTTPHandler(s.NewFollowerHandler)).Methods("POST")
 	s.Router.HandleFunc("/accounts/follow", s.MakeHTTPHandler(s.UnFollowerHandler)).Methods("DELETE")
 
+	s.Router.HandleFunc("/accounts/me/tokens", s.MakeHTTPHandler(s.CreateAPITokenHandler)).Methods("POST")
+	s.Router.HandleFunc("/accounts/me/tokens", s.MakeHTTPHandler(s.GetMyAPITokensHandler)).Methods("GET")
+	s.Router.HandleFunc("/accounts/me/tokens/{id}", s.MakeHTTPHandler(s.RevokeAPITokenHandler)).Methods("DELETE")
+
+	s.Router.HandleFunc("/accounts/me/sessions", s.MakeHTTPHandler(s.GetMySessionsHandler)).Methods("GET")
+	s.Router.HandleFunc("/accounts/me/sessions", s.MakeHTTPHandler(s.RevokeOtherSessionsHandler)).Methods("DELETE")
+	s.Router.HandleFunc("/accounts/me/sessions/{id}", s.MakeHTTPHandler(s.RevokeSessionHandler)).Methods("DELETE")
+
+	s.Router.HandleFunc("/accounts/me/service-accounts", s.MakeHTTPHandler(s.CreateServiceAccountHandler)).Methods("POST")
+	s.Router.HandleFunc("/accounts/me/service-accounts", s.MakeHTTPHandler(s.GetMyServiceAccountsHandler)).Methods("GET")
+	s.Router.HandleFunc("/accounts/me/service-accounts/{id}/tokens", s.MakeHTTPHandler(s.CreateServiceAccountTokenHandler)).Methods("POST")
+	s.Router.HandleFunc("/accounts/me/service-accounts/{id}/tokens", s.MakeHTTPHandler(s.GetServiceAccountTokensHandler)).Methods("GET")
+	s.Router.HandleFunc("/accounts/me/service-accounts/{id}/tokens/{token_id}", s.MakeHTTPHandler(s.RevokeServiceAccountTokenHandler)).Methods("DELETE")
+
 	s.Router.HandleFunc("/obtain", s.MakeHTTPHandler(s.LoginHandler)).Methods("POST")
 	s.Router.HandleFunc("/refresh", s.MakeHTTPHandler(s.RefreshTokenHandler)).Methods("POST")
-	return s.APIServer.Run(s.Router)
 }
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
+const apiTokenPrefix = "smt_"
+
 func HashPassword(plainPassword string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(plainPassword), 4)
 	return string(bytes), err
@@ -13,3 +20,20 @@ func VerifyPassword(plainPassword, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(password), []byte(plainPassword))
 	return err == nil
 }
+
+// GenerateAPIToken returns a random token with a recognizable prefix so it
+// can be told apart from a JWT.
+func GenerateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIToken uses a plain SHA-256 since tokens are high-entropy and must be
+// looked up by their hash.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
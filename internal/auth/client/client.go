@@ -3,16 +3,25 @@ package client
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/sina-am/social-media/internal/auth/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type GRPCClient interface {
 	ObtainAccountRPC(ctx context.Context, jwtToken *types.JWTToken) (*types.Account, error)
 	GetAccountByIdRPC(ctx context.Context, accountId string) (*types.Account, error)
+	// GetAccountsByIdsRPC returns the accounts which exist, unknown ids are
+	// left out.
+	GetAccountsByIdsRPC(ctx context.Context, accountIds []string) ([]*types.Account, error)
+	// GetRelationshipRPC tells whether accountId follows otherId and the
+	// other way around.
+	GetRelationshipRPC(ctx context.Context, accountId, otherId string) (*types.Relationship, error)
+	CheckHealthRPC(ctx context.Context) error
 }
 
 type gRPCClient struct {
@@ -61,22 +70,126 @@ func (c *gRPCClient) GetAccountByIdRPC(ctx context.Context, accountId string) (*
 	return account, nil
 }
 
+func (c *gRPCClient) GetAccountsByIdsRPC(ctx context.Context, accountIds []string) ([]*types.Account, error) {
+	conn, err := grpc.Dial(c.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	authClient := types.NewAuthenticationClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	res, err := authClient.GetAccountsByIDs(ctx, &types.GetAccountsRequest{
+		AccountIds: accountIds,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Accounts, nil
+}
+
+func (c *gRPCClient) GetRelationshipRPC(ctx context.Context, accountId, otherId string) (*types.Relationship, error) {
+	conn, err := grpc.Dial(c.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	authClient := types.NewAuthenticationClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return authClient.GetRelationship(ctx, &types.GetRelationshipRequest{
+		AccountId: accountId,
+		OtherId:   otherId,
+	})
+}
+
+// CheckHealthRPC asks the auth server's standard gRPC health service whether
+// it's serving.
+func (c *gRPCClient) CheckHealthRPC(ctx context.Context) error {
+	conn, err := grpc.Dial(c.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	res, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("auth service is %s", res.Status)
+	}
+	return nil
+}
+
 type fakeGRPCClient struct {
 	accounts []*types.Account
+	// follows holds "follower:account" pairs.
+	follows map[string]bool
+
+	mu      sync.Mutex
+	revoked map[string]bool
+	scopes  map[string][]string
 }
 
 func NewFakeGRPCClient(accounts []*types.Account) *fakeGRPCClient {
 	return &fakeGRPCClient{
-		accounts,
+		accounts: accounts,
+		follows:  map[string]bool{},
+		revoked:  map[string]bool{},
+		scopes:   map[string][]string{},
 	}
 }
 
+// Follow makes followerId follow accountId.
+func (c *fakeGRPCClient) Follow(followerId, accountId string) {
+	c.follows[followerId+":"+accountId] = true
+}
+
+// Revoke makes the token invalid, like revoking the session it belongs to.
+func (c *fakeGRPCClient) Revoke(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revoked[token] = true
+}
+
+// Grant limits the token to scopes, like an API token. Other tokens hold
+// every scope, like sessions.
+func (c *fakeGRPCClient) Grant(token string, scopes ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scopes[token] = scopes
+}
+
 func (c *fakeGRPCClient) ObtainAccountRPC(ctx context.Context, jwtToken *types.JWTToken) (*types.Account, error) {
-	if jwtToken.Token == "" {
+	c.mu.Lock()
+	revoked := c.revoked[jwtToken.Token]
+	scopes, granted := c.scopes[jwtToken.Token]
+	c.mu.Unlock()
+	if jwtToken.Token == "" || revoked {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	return c.GetAccountByIdRPC(ctx, jwtToken.Token)
+	account, err := c.GetAccountByIdRPC(ctx, jwtToken.Token)
+	if err != nil {
+		return nil, err
+	}
+	if !granted {
+		scopes = []string{types.ScopeRead, types.ScopeWrite}
+	}
+	return &types.Account{
+		Id:       account.Id,
+		Username: account.Username,
+		Name:     account.Name,
+		Email:    account.Email,
+		Avatar:   account.Avatar,
+		Scopes:   scopes,
+	}, nil
 }
 
 func (c *fakeGRPCClient) GetAccountByIdRPC(ctx context.Context, accountId string) (*types.Account, error) {
@@ -87,3 +200,24 @@ func (c *fakeGRPCClient) GetAccountByIdRPC(ctx context.Context, accountId string
 	}
 	return nil, fmt.Errorf("invalid account id")
 }
+
+func (c *fakeGRPCClient) GetAccountsByIdsRPC(ctx context.Context, accountIds []string) ([]*types.Account, error) {
+	accounts := []*types.Account{}
+	for _, accountId := range accountIds {
+		if account, err := c.GetAccountByIdRPC(ctx, accountId); err == nil {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (c *fakeGRPCClient) GetRelationshipRPC(ctx context.Context, accountId, otherId string) (*types.Relationship, error) {
+	return &types.Relationship{
+		Following:  c.follows[accountId+":"+otherId],
+		FollowedBy: c.follows[otherId+":"+accountId],
+	}, nil
+}
+
+func (c *fakeGRPCClient) CheckHealthRPC(ctx context.Context) error {
+	return nil
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"net"
 
 	"github.com/google/uuid"
 	"github.com/sina-am/social-media/internal/auth/types"
@@ -17,12 +17,11 @@ type GRPCServer struct {
 }
 
 func (s *GRPCServer) ObtainAccount(ctx context.Context, in *types.JWTToken) (*types.Account, error) {
-	log.Printf("Received: %v", in.GetToken())
 	token := &JWTToken{
 		Token: in.GetToken(),
 		Type:  in.GetType(),
 	}
-	account, err := s.Service.VerifyToken(token)
+	account, scopes, err := s.Service.VerifyToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
@@ -32,6 +31,7 @@ func (s *GRPCServer) ObtainAccount(ctx context.Context, in *types.JWTToken) (*ty
 		Username: account.Username,
 		Name:     account.Name,
 		Email:    account.Email,
+		Scopes:   scopes,
 	}, nil
 }
 func (s *GRPCServer) GetAccountByID(ctx context.Context, in *types.GetAccountRequest) (*types.Account, error) {
@@ -39,7 +39,7 @@ func (s *GRPCServer) GetAccountByID(ctx context.Context, in *types.GetAccountReq
 	if err != nil {
 		return nil, err
 	}
-	account, err := s.Service.GetAccountByID(accountId)
+	account, err := s.Service.GetAccountByID(ctx, accountId)
 	if err != nil {
 		return nil, err
 	}
@@ -52,12 +52,59 @@ func (s *GRPCServer) GetAccountByID(ctx context.Context, in *types.GetAccountReq
 	}, nil
 }
 
-func (s *GRPCServer) Run() error {
-	listen, err := net.Listen("tcp", s.Addr)
+// maxAccountIds is the most accounts asked for in one GetAccountsByIDs call.
+const maxAccountIds = 1000
+
+func (s *GRPCServer) GetAccountsByIDs(ctx context.Context, in *types.GetAccountsRequest) (*types.GetAccountsResponse, error) {
+	if len(in.AccountIds) > maxAccountIds {
+		return nil, fmt.Errorf("at most %d account ids are allowed", maxAccountIds)
+	}
+	accountIds := make([]uuid.UUID, len(in.AccountIds))
+	for i, id := range in.AccountIds {
+		accountId, err := uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		accountIds[i] = accountId
+	}
+	accounts, err := s.Service.GetAccountsByIDs(ctx, accountIds)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	res := &types.GetAccountsResponse{}
+	for _, account := range accounts {
+		res.Accounts = append(res.Accounts, &types.Account{
+			Id:       string(account.ID.String()),
+			Username: account.Username,
+			Name:     account.Name,
+			Email:    account.Email,
+		})
 	}
+	return res, nil
+}
+
+func (s *GRPCServer) GetRelationship(ctx context.Context, in *types.GetRelationshipRequest) (*types.Relationship, error) {
+	accountId, err := uuid.Parse(in.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	otherId, err := uuid.Parse(in.OtherId)
+	if err != nil {
+		return nil, err
+	}
+	relationship, err := s.Service.GetRelationship(ctx, accountId, otherId)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Relationship{
+		Following:  relationship.Following,
+		FollowedBy: relationship.FollowedBy,
+	}, nil
+}
+
+func (s *GRPCServer) NewServer() *grpc.Server {
 	grpcServer := grpc.NewServer()
 	types.RegisterAuthenticationServer(grpcServer, s)
-	return grpcServer.Serve(listen)
+	return grpcServer
 }
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -15,8 +18,49 @@ func (s *APIServer) getJWTToken(r *http.Request) *JWTToken {
 	return &JWTToken{Token: tokenStr, Type: "bearer"}
 }
 
+// clientIP is the address the request came from. X-Forwarded-For is only
+// honored when the request came through a trusted proxy, anyone else could
+// put anything in it. Proxies append to it, so the client is the last
+// address that isn't a trusted proxy.
+func (s *APIServer) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !s.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+func (s *APIServer) isTrustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *APIServer) GetAllAccountHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.Storage.GetAllAccount()
+	accounts, err := s.Storage.GetAllAccount(ctx)
 	if err != nil {
 		return err
 	}
@@ -29,7 +73,7 @@ func (s *APIServer) GetUserByIDHandler(ctx context.Context, w http.ResponseWrite
 	if err != nil {
 		return err
 	}
-	account, err := s.Storage.GetByID(accountId)
+	account, err := s.Storage.GetByID(ctx, accountId)
 	if err != nil {
 		return err
 	}
@@ -37,9 +81,12 @@ func (s *APIServer) GetUserByIDHandler(ctx context.Context, w http.ResponseWrite
 }
 
 func (s *APIServer) GetMyUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	jwtToken := s.getJWTToken(r)
-	account, err := s.Service.VerifyToken(jwtToken)
+	accountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), ScopeRead)
+	if err != nil {
+		return err
+	}
 
+	account, err := s.Service.GetAccountByID(ctx, accountId)
 	if err != nil {
 		return err
 	}
@@ -49,7 +96,7 @@ func (s *APIServer) GetMyUserHandler(ctx context.Context, w http.ResponseWriter,
 func (s *APIServer) UpdateMyUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
 	jwtToken := s.getJWTToken(r)
-	accountId, err := s.Service.GetAccountIdFromToken(jwtToken)
+	accountId, err := s.Service.GetAccountIdWithScope(ctx, jwtToken, ScopeWrite)
 	if err != nil {
 		return err
 	}
@@ -60,7 +107,7 @@ func (s *APIServer) UpdateMyUserHandler(ctx context.Context, w http.ResponseWrit
 		return err
 	}
 
-	err = s.Service.Update(accountId, updateReq)
+	err = s.Service.Update(ctx, accountId, updateReq)
 	if err != nil {
 		return err
 	}
@@ -86,7 +133,7 @@ func (s *APIServer) RegisterHandler(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
-	if err := s.Service.Register(newAccount); err != nil {
+	if err := s.Service.Register(ctx, newAccount); err != nil {
 		return err
 	}
 
@@ -102,12 +149,22 @@ func (s *APIServer) LoginHandler(ctx context.Context, w http.ResponseWriter, r *
 		return err
 	}
 
-	account, err := s.Service.Authenticate(authReq.Username, authReq.Password)
+	account, err := s.Service.Authenticate(ctx, authReq.Username, authReq.Password)
 	if err != nil {
 		return err
 	}
 
-	jwtToken, err := s.Service.ObtainToken(account)
+	session := &Session{
+		AccountID: account.ID,
+		Device:    authReq.Device,
+		UserAgent: r.UserAgent(),
+		IP:        s.clientIP(r),
+	}
+	if err := s.Service.CreateSession(ctx, session); err != nil {
+		return err
+	}
+
+	jwtToken, err := s.Service.ObtainToken(ctx, account, session)
 	if err != nil {
 		return err
 	}
@@ -123,13 +180,11 @@ func (s *APIServer) RefreshTokenHandler(ctx context.Context, w http.ResponseWrit
 	if err != nil {
 		return err
 	}
-
-	account, err := s.Service.VerifyToken(tokenReq)
-	if err != nil {
-		return err
+	if IsAPIToken(tokenReq) {
+		return web.Errorf(http.StatusBadRequest, "API tokens can't be refreshed")
 	}
 
-	tokenRes, err := s.Service.ObtainToken(account)
+	tokenRes, err := s.Service.RefreshToken(ctx, tokenReq)
 	if err != nil {
 		return err
 	}
@@ -142,7 +197,7 @@ func (s *APIServer) GetUserFollowersHandler(ctx context.Context, w http.Response
 		return err
 	}
 
-	accounts, err := s.Storage.GetAccountFollowers(accountId)
+	accounts, err := s.Storage.GetAccountFollowers(ctx, accountId)
 	if err != nil {
 		return err
 	}
@@ -150,12 +205,12 @@ func (s *APIServer) GetUserFollowersHandler(ctx context.Context, w http.Response
 	return web.WriteJSON(w, http.StatusOK, accounts)
 }
 func (s *APIServer) GetMyFollowersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	myAccountId, err := s.Service.GetAccountIdFromToken(s.getJWTToken(r))
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), ScopeRead)
 	if err != nil {
 		return err
 	}
 
-	accounts, err := s.Storage.GetAccountFollowers(myAccountId)
+	accounts, err := s.Storage.GetAccountFollowers(ctx, myAccountId)
 	if err != nil {
 		return err
 	}
@@ -166,7 +221,7 @@ func (s *APIServer) GetMyFollowersHandler(ctx context.Context, w http.ResponseWr
 func (s *APIServer) NewFollowerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
 
-	myAccountId, err := s.Service.GetAccountIdFromToken(s.getJWTToken(r))
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), ScopeWrite)
 	if err != nil {
 		return err
 	}
@@ -177,7 +232,7 @@ func (s *APIServer) NewFollowerHandler(ctx context.Context, w http.ResponseWrite
 		return err
 	}
 
-	err = s.Storage.InsertAccountFollower(reqBody.AccountId, myAccountId)
+	err = s.Storage.InsertAccountFollower(ctx, reqBody.AccountId, myAccountId)
 	if err != nil {
 		return err
 	}
@@ -188,7 +243,7 @@ func (s *APIServer) NewFollowerHandler(ctx context.Context, w http.ResponseWrite
 func (s *APIServer) UnFollowerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
 
-	myAccountId, err := s.Service.GetAccountIdFromToken(s.getJWTToken(r))
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), ScopeWrite)
 	if err != nil {
 		return err
 	}
@@ -199,10 +254,217 @@ func (s *APIServer) UnFollowerHandler(ctx context.Context, w http.ResponseWriter
 		return err
 	}
 
-	err = s.Storage.DeleteAccountFollower(reqBody.AccountId, myAccountId)
+	err = s.Storage.DeleteAccountFollower(ctx, reqBody.AccountId, myAccountId)
 	if err != nil {
 		return err
 	}
 
 	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "deleted"})
 }
+
+func (s *APIServer) CreateAPITokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return err
+	}
+
+	tokenReq := &APITokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(tokenReq); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	token, err := s.Service.CreateAPIToken(ctx, myAccountId, tokenReq)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, token)
+}
+
+func (s *APIServer) GetMyAPITokensHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := s.Service.GetAPITokens(ctx, myAccountId)
+	if err != nil {
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (s *APIServer) RevokeAPITokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return err
+	}
+
+	tokenId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid token id")
+	}
+
+	if err := s.Service.RevokeAPIToken(ctx, myAccountId, tokenId); err != nil {
+		return web.Errorf(http.StatusNotFound, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "revoked"})
+}
+
+func (s *APIServer) CreateServiceAccountHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return err
+	}
+
+	accountReq := &ServiceAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(accountReq); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	account, err := s.Service.CreateServiceAccount(ctx, myAccountId, accountReq)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, account)
+}
+
+func (s *APIServer) GetMyServiceAccountsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := s.Service.GetServiceAccounts(ctx, myAccountId)
+	if err != nil {
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, accounts)
+}
+
+// getMyServiceAccount resolves the {id} path variable to a service account
+// owned by the caller.
+func (s *APIServer) getMyServiceAccount(ctx context.Context, r *http.Request) (*Account, error) {
+	myAccountId, err := s.Service.GetAccountIdWithScope(ctx, s.getJWTToken(r), scopeSession)
+	if err != nil {
+		return nil, err
+	}
+
+	accountId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, web.Errorf(http.StatusBadRequest, "invalid account id")
+	}
+
+	account, err := s.Service.GetServiceAccount(ctx, myAccountId, accountId)
+	if err != nil {
+		return nil, web.Errorf(http.StatusNotFound, "service account not found")
+	}
+	return account, nil
+}
+
+func (s *APIServer) CreateServiceAccountTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	defer r.Body.Close()
+
+	account, err := s.getMyServiceAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	tokenReq := &APITokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(tokenReq); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	token, err := s.Service.CreateAPIToken(ctx, account.ID, tokenReq)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, token)
+}
+
+func (s *APIServer) GetServiceAccountTokensHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getMyServiceAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := s.Service.GetAPITokens(ctx, account.ID)
+	if err != nil {
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (s *APIServer) RevokeServiceAccountTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.getMyServiceAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	tokenId, err := uuid.Parse(mux.Vars(r)["token_id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid token id")
+	}
+
+	if err := s.Service.RevokeAPIToken(ctx, account.ID, tokenId); err != nil {
+		return web.Errorf(http.StatusNotFound, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "revoked"})
+}
+
+func (s *APIServer) GetMySessionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	session, err := s.Service.GetSessionFromToken(ctx, s.getJWTToken(r))
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.Service.GetSessions(ctx, session.AccountID, session.ID)
+	if err != nil {
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, sessions)
+}
+
+func (s *APIServer) RevokeSessionHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	session, err := s.Service.GetSessionFromToken(ctx, s.getJWTToken(r))
+	if err != nil {
+		return err
+	}
+
+	sessionId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid session id")
+	}
+
+	if err := s.Service.RevokeSession(ctx, session.AccountID, sessionId); err != nil {
+		return web.Errorf(http.StatusNotFound, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "revoked"})
+}
+
+// RevokeOtherSessionsHandler logs out every other device.
+func (s *APIServer) RevokeOtherSessionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	session, err := s.Service.GetSessionFromToken(ctx, s.getJWTToken(r))
+	if err != nil {
+		return err
+	}
+
+	if err := s.Service.RevokeOtherSessions(ctx, session.AccountID, session.ID); err != nil {
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "revoked"})
+}
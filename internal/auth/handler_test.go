@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gorilla/mux"
+	web "github.com/sina-am/social-media/common"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newTestServer(t *testing.T) (*APIServer, *localAuthService, *memoryStorage) {
+	service, storage := newTestService(t)
+	server := &APIServer{
+		APIServer: web.APIServer{Logger: zap.NewNop()},
+		Service:   service,
+		Storage:   storage,
+		Router:    mux.NewRouter(),
+	}
+	server.registerRoutes()
+	return server, service, storage
+}
+
+func request(t *testing.T, server *APIServer, method, url, token string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		assert.Nil(t, json.NewEncoder(&buf).Encode(body))
+	}
+	r := httptest.NewRequest(method, url, &buf)
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPITokenHandlers(t *testing.T) {
+	server, service, _ := newTestServer(t)
+	alice, session := register(t, service, "alice")
+	bob, _ := register(t, service, "bob")
+
+	w := request(t, server, http.MethodPost, "/accounts/me/tokens", session.Token, &APITokenRequest{Name: "reader", Scopes: []string{ScopeRead}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := &APITokenResponse{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(created))
+	assert.NotEmpty(t, created.Token)
+
+	t.Run("plain token shown once", func(t *testing.T) {
+		w := request(t, server, http.MethodGet, "/accounts/me/tokens", session.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), created.Token)
+		assert.NotContains(t, w.Body.String(), HashAPIToken(created.Token))
+		assert.Contains(t, w.Body.String(), created.ID.String())
+	})
+	t.Run("read token reads", func(t *testing.T) {
+		w := request(t, server, http.MethodGet, "/accounts/me", created.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), alice.ID.String())
+	})
+	t.Run("read token can't write", func(t *testing.T) {
+		w := request(t, server, http.MethodPost, "/accounts/follow", created.Token, &FollowRequest{AccountId: bob.ID})
+		assert.NotEqual(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), ScopeWrite)
+
+		followed, _ := server.Storage.IsFollower(context.Background(), bob.ID, alice.ID)
+		assert.False(t, followed)
+	})
+	t.Run("tokens can't manage tokens", func(t *testing.T) {
+		w := request(t, server, http.MethodPost, "/accounts/me/tokens", created.Token, &APITokenRequest{Name: "more", Scopes: []string{ScopeWrite}})
+		assert.NotEqual(t, http.StatusCreated, w.Code)
+	})
+	t.Run("revoked token", func(t *testing.T) {
+		w := request(t, server, http.MethodDelete, "/accounts/me/tokens/"+created.ID.String(), session.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = request(t, server, http.MethodGet, "/accounts/me", created.Token, nil)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestServiceAccountHandlers(t *testing.T) {
+	server, service, _ := newTestServer(t)
+	alice, aliceSession := register(t, service, "alice")
+	_, bobSession := register(t, service, "bob")
+
+	w := request(t, server, http.MethodPost, "/accounts/me/service-accounts", aliceSession.Token, &ServiceAccountRequest{Username: "alice-bot", Name: "Bot"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	bot := &Account{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(bot))
+	assert.Equal(t, alice.ID, *bot.OwnerID)
+
+	tokensURL := "/accounts/me/service-accounts/" + bot.ID.String() + "/tokens"
+	t.Run("only the owner", func(t *testing.T) {
+		w := request(t, server, http.MethodPost, tokensURL, bobSession.Token, &APITokenRequest{Name: "ci", Scopes: []string{ScopeWrite}})
+		assert.NotEqual(t, http.StatusCreated, w.Code)
+
+		w = request(t, server, http.MethodGet, "/accounts/me/service-accounts", bobSession.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), bot.ID.String())
+	})
+	t.Run("acts as the service account", func(t *testing.T) {
+		w := request(t, server, http.MethodPost, tokensURL, aliceSession.Token, &APITokenRequest{Name: "ci", Scopes: []string{ScopeRead}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		created := &APITokenResponse{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(created))
+
+		w = request(t, server, http.MethodGet, "/accounts/me", created.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), bot.ID.String())
+	})
+}
+
+func TestSessionHandlers(t *testing.T) {
+	server, service, _ := newTestServer(t)
+	register(t, service, "alice")
+
+	login := func(device string) *JWTToken {
+		w := request(t, server, http.MethodPost, "/obtain", "", &AccountAuthenticationRequest{Username: "alice", Password: "password", Device: device})
+		assert.Equal(t, http.StatusOK, w.Code)
+		token := &JWTToken{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(token))
+		return token
+	}
+	listSessions := func(token *JWTToken) []*Session {
+		w := request(t, server, http.MethodGet, "/accounts/me/sessions", token.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		sessions := []*Session{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&sessions))
+		return sessions
+	}
+
+	phone := login("phone")
+	tablet := login("tablet")
+	sessions := listSessions(phone)
+	// The one register started and the two logins.
+	assert.Len(t, sessions, 3)
+	var phoneSession *Session
+	for _, session := range sessions {
+		if session.Current {
+			phoneSession = session
+		}
+	}
+	assert.Equal(t, "phone", phoneSession.Device)
+	assert.Equal(t, "192.0.2.1", phoneSession.IP)
+
+	t.Run("revoke one", func(t *testing.T) {
+		w := request(t, server, http.MethodDelete, "/accounts/me/sessions/"+phoneSession.ID.String(), tablet.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = request(t, server, http.MethodGet, "/accounts/me", phone.Token, nil)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+		assert.Len(t, listSessions(tablet), 2)
+	})
+	t.Run("revoke others", func(t *testing.T) {
+		w := request(t, server, http.MethodDelete, "/accounts/me/sessions", tablet.Token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		sessions := listSessions(tablet)
+		assert.Len(t, sessions, 1)
+		assert.True(t, sessions[0].Current)
+	})
+	t.Run("API tokens have no session", func(t *testing.T) {
+		w := request(t, server, http.MethodPost, "/accounts/me/tokens", tablet.Token, &APITokenRequest{Name: "bot", Scopes: []string{ScopeRead, ScopeWrite}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		created := &APITokenResponse{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(created))
+
+		w = request(t, server, http.MethodDelete, "/accounts/me/sessions", created.Token, nil)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	server := &APIServer{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"spoofed header", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"ipv6 proxy", "[::1]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client spoofs through proxy", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"repeated header", "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"proxy without header", "10.0.0.2:5000", nil, "10.0.0.2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			assert.Equal(t, test.want, server.clientIP(r))
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/Netflix/go-env"
 	"github.com/gorilla/mux"
@@ -14,12 +17,18 @@ import (
 )
 
 type Settings struct {
-	PostgresUsername string `env:"POSTGRES_USERNAME,default=postgres"`
-	PostgresPassword string `env:"POSTGRES_PASSWORD,default=1234"`
-	PostgresHostname string `env:"POSTGRES_HOSTNAME,default=localhost"`
-	PostgresDatabase string `env:"POSTGRES_DATABASE,default=auth"`
-	HTTPAddress      string `env:"HTTP_ADDRESS,default=:8000"`
-	GRPCAddress      string `env:"GRPC_ADDRESS,default=:5000"`
+	PostgresUsername string        `env:"POSTGRES_USERNAME,default=postgres"`
+	PostgresPassword string        `env:"POSTGRES_PASSWORD,default=1234"`
+	PostgresHostname string        `env:"POSTGRES_HOSTNAME,default=localhost"`
+	PostgresDatabase string        `env:"POSTGRES_DATABASE,default=auth"`
+	HTTPAddress      string        `env:"HTTP_ADDRESS,default=:8000"`
+	GRPCAddress      string        `env:"GRPC_ADDRESS,default=:5000"`
+	MediaURL         string        `env:"MEDIA_URL,default=http://localhost:8090/media"`
+	RequestTimeout   time.Duration `env:"REQUEST_TIMEOUT,default=10s"`
+	DrainTimeout     time.Duration `env:"DRAIN_TIMEOUT,default=15s"`
+	// TrustedProxies are the comma separated addresses or CIDRs of the
+	// reverse proxies in front of the service.
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
 }
 
 func (s *Settings) GetDatabaseConnStr() string {
@@ -42,6 +51,31 @@ func OverwriteWithSettingFromCli(settings *Settings) {
 	}
 }
 
+// parseTrustedProxies parses the comma separated addresses and CIDRs.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	proxies := []netip.Prefix{}
+	for _, proxy := range strings.Split(s, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
 func main() {
 	var settings Settings
 	_, err := env.UnmarshalFromEnviron(&settings)
@@ -58,16 +92,28 @@ func main() {
 		log.Fatal(err)
 	}
 
+	lifecycle := web.NewLifecycle(logger, settings.DrainTimeout)
+	lifecycle.AddReadinessCheck("postgres", storage.Ping)
+	lifecycle.OnShutdown("postgres", storage.Close)
+
+	trustedProxies, err := parseTrustedProxies(settings.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	reg := prometheus.NewRegistry()
-	service := NewMonitorAuthService(NewLocalAuthService(storage, "verysecretkey"), reg)
+	service := NewMonitorAuthService(NewLocalAuthService(storage, "verysecretkey", settings.MediaURL), reg)
 	apiServer := APIServer{
 		APIServer: web.APIServer{
-			Addr:   settings.HTTPAddress,
-			Logger: logger,
+			Addr:           settings.HTTPAddress,
+			Logger:         logger,
+			RequestTimeout: settings.RequestTimeout,
+			Lifecycle:      lifecycle,
 		},
-		Service: service,
-		Storage: storage,
-		Router:  mux.NewRouter(),
+		Service:        service,
+		Storage:        storage,
+		Router:         mux.NewRouter(),
+		TrustedProxies: trustedProxies,
 	}
 	apiServer.Router.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 
@@ -75,12 +121,7 @@ func main() {
 		Service: service,
 		Addr:    settings.GRPCAddress,
 	}
-	go func() {
-		logger.Info("gRPC server is running")
-		if err := grpcServer.Run(); err != nil {
-			log.Fatal(err)
-		}
-	}()
+	lifecycle.AddGRPCServer("grpc", grpcServer.Addr, grpcServer.NewServer())
 	if err := apiServer.Run(); err != nil {
 		log.Fatal(err)
 	}
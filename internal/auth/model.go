@@ -1,21 +1,32 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/sina-am/social-media/internal/auth/types"
 )
 
 type Account struct {
-	ID        uuid.UUID `json:"id" sql:"type:uuid"`
-	Username  string    `json:"username"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	LastLogin time.Time `json:"last_login"`
-	CreatedAt time.Time `json:"created_at"`
-	Avatar    string    `json:"avatar"`
-	Deleted   bool      `json:"-"`
+	ID        uuid.UUID  `json:"id" sql:"type:uuid"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Password  string     `json:"-"`
+	LastLogin time.Time  `json:"last_login"`
+	CreatedAt time.Time  `json:"created_at"`
+	Avatar    string     `json:"avatar"`
+	IsService bool       `json:"is_service"`
+	OwnerID   *uuid.UUID `json:"owner_id,omitempty"`
+	Deleted   bool       `json:"-"`
+}
+
+// Relationship is how an account and another one follow each other, from
+// the account's side.
+type Relationship struct {
+	Following  bool `json:"following"`
+	FollowedBy bool `json:"followed_by"`
 }
 
 func (a *Account) VerifyPassword(plainPassword string) bool {
@@ -40,6 +51,21 @@ type AccountUpdateRequest struct {
 type AccountAuthenticationRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Device   string `json:"device"`
+}
+
+// Session is a login on one device. Every token issued for it, including
+// refreshed ones, carries the session id so revoking it logs the device out.
+type Session struct {
+	ID             uuid.UUID `json:"id"`
+	AccountID      uuid.UUID `json:"account_id"`
+	Device         string    `json:"device"`
+	UserAgent      string    `json:"user_agent"`
+	IP             string    `json:"ip"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	Revoked        bool      `json:"-"`
+	Current        bool      `json:"current"`
 }
 
 type JWTToken struct {
@@ -47,6 +73,82 @@ type JWTToken struct {
 	Type  string `json:"type"`
 }
 
+// Scopes an API token can be granted. Password sessions implicitly hold
+// every scope, including scopeSession which is never granted to a token.
+const (
+	ScopeRead    = types.ScopeRead
+	ScopeWrite   = types.ScopeWrite
+	scopeSession = "session"
+)
+
+var tokenScopes = map[string]bool{
+	ScopeRead:  true,
+	ScopeWrite: true,
+}
+
+// APIToken is a named, revocable credential for scripts and service
+// accounts. Only the hash of the token is ever stored.
+type APIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	AccountID  uuid.UUID  `json:"account_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Revoked    bool       `json:"-"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for i := range t.Scopes {
+		if t.Scopes[i] == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *APIToken) IsExpired() bool {
+	return t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now())
+}
+
+type APITokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (r *APITokenRequest) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("token name is required")
+	}
+	if len(r.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range r.Scopes {
+		if !tokenScopes[scope] {
+			return fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+	if r.ExpiresAt != nil && r.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("expiration time is in the past")
+	}
+	return nil
+}
+
+// APITokenResponse is returned once on creation; the plain token can't be
+// recovered afterwards.
+type APITokenResponse struct {
+	*APIToken
+	Token string `json:"token"`
+}
+
+type ServiceAccountRequest struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
 type FollowRequest struct {
 	AccountId uuid.UUID `json:"account_id"`
 }
@@ -68,3 +170,17 @@ func NewAccount(username, plainPassword, name, email string) (*Account, error) {
 		Deleted:   false,
 	}, nil
 }
+
+// NewServiceAccount creates an account for machine-to-machine calls. It has
+// no usable password and can only authenticate with API tokens.
+func NewServiceAccount(ownerId uuid.UUID, username, name string) *Account {
+	return &Account{
+		Username:  username,
+		Name:      name,
+		Email:     fmt.Sprintf("%s@service.local", username),
+		LastLogin: time.Now(),
+		CreatedAt: time.Now(),
+		IsService: true,
+		OwnerID:   &ownerId,
+	}
+}
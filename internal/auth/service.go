@@ -1,59 +1,89 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	web "github.com/sina-am/social-media/common"
 )
 
 type AuthService interface {
-	Authenticate(username, plainPassword string) (*Account, error)
-	Register(*Account) error
-	ObtainToken(*Account) (*JWTToken, error)
-	VerifyToken(*JWTToken) (*Account, error)
-	GetAccountIdFromToken(*JWTToken) (uuid.UUID, error)
-	Update(uuid.UUID, *AccountUpdateRequest) error
-	GetAccountByID(uuid.UUID) (*Account, error)
-	AddFollower(accountId uuid.UUID, followerId uuid.UUID) error
+	Authenticate(ctx context.Context, username, plainPassword string) (*Account, error)
+	Register(ctx context.Context, account *Account) error
+	ObtainToken(ctx context.Context, account *Account, session *Session) (*JWTToken, error)
+	RefreshToken(ctx context.Context, t *JWTToken) (*JWTToken, error)
+	// VerifyToken returns the account of the token and the scopes it was
+	// granted, sessions hold every scope a token can be granted.
+	VerifyToken(ctx context.Context, t *JWTToken) (*Account, []string, error)
+	GetAccountIdFromToken(ctx context.Context, t *JWTToken) (uuid.UUID, error)
+	Update(ctx context.Context, accountId uuid.UUID, updateReq *AccountUpdateRequest) error
+	GetAccountByID(ctx context.Context, accountId uuid.UUID) (*Account, error)
+	GetAccountsByIDs(ctx context.Context, accountIds []uuid.UUID) ([]*Account, error)
+	AddFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error
+	GetRelationship(ctx context.Context, accountId uuid.UUID, otherId uuid.UUID) (*Relationship, error)
+	GetAccountIdWithScope(ctx context.Context, t *JWTToken, scope string) (uuid.UUID, error)
+
+	CreateAPIToken(ctx context.Context, accountId uuid.UUID, req *APITokenRequest) (*APITokenResponse, error)
+	GetAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error)
+	RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error
+
+	CreateServiceAccount(ctx context.Context, ownerId uuid.UUID, req *ServiceAccountRequest) (*Account, error)
+	GetServiceAccount(ctx context.Context, ownerId uuid.UUID, accountId uuid.UUID) (*Account, error)
+	GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error)
+
+	CreateSession(ctx context.Context, session *Session) error
+	GetSessionFromToken(ctx context.Context, t *JWTToken) (*Session, error)
+	GetSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) ([]*Session, error)
+	RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error
+	RevokeOtherSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) error
 }
 
 type localAuthService struct {
 	Storer    Storage
 	secretKey []byte
+	mediaURL  string
 }
 
-func NewLocalAuthService(storer Storage, secretKey string) *localAuthService {
+// NewLocalAuthService creates the service. Avatars must be uploaded to the
+// media service published at mediaURL.
+func NewLocalAuthService(storer Storage, secretKey string, mediaURL string) *localAuthService {
 	return &localAuthService{
 		Storer:    storer,
 		secretKey: []byte(secretKey),
+		mediaURL:  mediaURL,
 	}
 }
 
-func (a *localAuthService) Register(account *Account) error {
-	return a.Storer.InsertAccount(account)
+func (a *localAuthService) Register(ctx context.Context, account *Account) error {
+	return a.Storer.InsertAccount(ctx, account)
 }
-func (a *localAuthService) Authenticate(username, plainPassword string) (*Account, error) {
-	account, err := a.Storer.GetByUsername(username)
+func (a *localAuthService) Authenticate(ctx context.Context, username, plainPassword string) (*Account, error) {
+	account, err := a.Storer.GetByUsername(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	if !account.VerifyPassword(plainPassword) {
+	if account.IsService || !account.VerifyPassword(plainPassword) {
 		return nil, fmt.Errorf("invalid credentials")
 	}
 	// TODO: Update lastlogin
 	return account, nil
 }
 
-func (a *localAuthService) Update(accountId uuid.UUID, updateReq *AccountUpdateRequest) error {
-	account, err := a.Storer.GetByID(accountId)
+func (a *localAuthService) Update(ctx context.Context, accountId uuid.UUID, updateReq *AccountUpdateRequest) error {
+	account, err := a.Storer.GetByID(ctx, accountId)
 	if err != nil {
 		return err
 	}
 	if updateReq.Avatar != "" {
+		if !web.IsMediaURL(a.mediaURL, updateReq.Avatar) {
+			return fmt.Errorf("avatar must be uploaded to the media service")
+		}
 		account.Avatar = updateReq.Avatar
 	}
 	if updateReq.Email != "" {
@@ -69,22 +99,41 @@ func (a *localAuthService) Update(accountId uuid.UUID, updateReq *AccountUpdateR
 		}
 	}
 
-	return a.Storer.Update(account)
+	return a.Storer.Update(ctx, account)
 }
 
-func (a *localAuthService) AddFollower(accountId uuid.UUID, followerId uuid.UUID) error {
+func (a *localAuthService) AddFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error {
 	log.Printf("Fire notification for new follower")
-	return a.Storer.InsertAccountFollower(accountId, followerId)
+	return a.Storer.InsertAccountFollower(ctx, accountId, followerId)
+}
+
+func (a *localAuthService) GetRelationship(ctx context.Context, accountId uuid.UUID, otherId uuid.UUID) (*Relationship, error) {
+	following, err := a.Storer.IsFollower(ctx, otherId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	followedBy, err := a.Storer.IsFollower(ctx, accountId, otherId)
+	if err != nil {
+		return nil, err
+	}
+	return &Relationship{Following: following, FollowedBy: followedBy}, nil
+}
+
+func (a *localAuthService) GetAccountByID(ctx context.Context, accountId uuid.UUID) (*Account, error) {
+	return a.Storer.GetByID(ctx, accountId)
 }
 
-func (a *localAuthService) GetAccountByID(accountId uuid.UUID) (*Account, error) {
-	return a.Storer.GetByID(accountId)
+func (a *localAuthService) GetAccountsByIDs(ctx context.Context, accountIds []uuid.UUID) ([]*Account, error) {
+	return a.Storer.GetByIDs(ctx, accountIds)
 }
 
-func (a *localAuthService) ObtainToken(account *Account) (*JWTToken, error) {
+func (a *localAuthService) ObtainToken(ctx context.Context, account *Account, session *Session) (*JWTToken, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"account_id": account.ID.String(),
-		"expired_at": time.Now().Add(time.Hour * 24).Format(time.RFC822),
+		"session_id": session.ID.String(),
+		// RFC822 only has zone abbreviations, which don't parse back
+		// unless they're UTC.
+		"expired_at": time.Now().UTC().Add(time.Hour * 24).Format(time.RFC822),
 	})
 
 	tokenStr, err := token.SignedString(a.secretKey)
@@ -98,22 +147,279 @@ func (a *localAuthService) ObtainToken(account *Account) (*JWTToken, error) {
 	}, nil
 }
 
-func (a *localAuthService) VerifyToken(t *JWTToken) (*Account, error) {
-	accountID, err := a.GetAccountIdFromToken(t)
+func (a *localAuthService) VerifyToken(ctx context.Context, t *JWTToken) (*Account, []string, error) {
+	accountID, scopes, err := a.verify(ctx, t)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return a.Storer.GetByID(accountID)
+	account, err := a.Storer.GetByID(ctx, accountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, scopes, nil
+}
+
+func (a *localAuthService) GetAccountIdFromToken(ctx context.Context, t *JWTToken) (uuid.UUID, error) {
+	accountID, _, err := a.verify(ctx, t)
+	return accountID, err
 }
 
-func (a *localAuthService) GetAccountIdFromToken(t *JWTToken) (uuid.UUID, error) {
+// verify returns the account id of the token and the scopes it was granted.
+func (a *localAuthService) verify(ctx context.Context, t *JWTToken) (uuid.UUID, []string, error) {
+	if IsAPIToken(t) {
+		token, err := a.verifyAPIToken(ctx, t)
+		if err != nil {
+			return uuid.Nil, nil, err
+		}
+		return token.AccountID, token.Scopes, nil
+	}
+
 	claims, err := a.decodeToken(t)
 	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	if _, ok := claims["session_id"]; !ok {
+		accountId, err := legacyTokenAccountId(claims)
+		return accountId, []string{ScopeRead, ScopeWrite}, err
+	}
+
+	session, err := a.sessionFromClaims(ctx, claims)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	return session.AccountID, []string{ScopeRead, ScopeWrite}, nil
+}
+
+// legacyTokenAccountId accepts tokens issued before sessions were tracked,
+// which have no session_id, until they expire rather than logging everyone
+// out. They can't be revoked, but refreshing one starts a session.
+func legacyTokenAccountId(claims jwt.MapClaims) (uuid.UUID, error) {
+	expiredAt, ok := claims["expired_at"].(string)
+	if !ok {
+		return uuid.Nil, fmt.Errorf("invalid token")
+	}
+	if err := IsExpired(expiredAt); err != nil {
 		return uuid.Nil, err
 	}
+	accountId, ok := claims["account_id"].(string)
+	if !ok {
+		return uuid.Nil, fmt.Errorf("invalid token")
+	}
+	return uuid.Parse(accountId)
+}
+
+// GetAccountIdWithScope is like GetAccountIdFromToken but rejects API tokens
+// that weren't granted the scope. Password sessions hold every scope.
+func (a *localAuthService) GetAccountIdWithScope(ctx context.Context, t *JWTToken, scope string) (uuid.UUID, error) {
+	if !IsAPIToken(t) {
+		return a.GetAccountIdFromToken(ctx, t)
+	}
+
+	token, err := a.verifyAPIToken(ctx, t)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if !token.HasScope(scope) {
+		return uuid.Nil, fmt.Errorf("token doesn't have the %q scope", scope)
+	}
+	return token.AccountID, nil
+}
+
+func IsAPIToken(t *JWTToken) bool {
+	return strings.HasPrefix(t.Token, apiTokenPrefix)
+}
+
+func (a *localAuthService) verifyAPIToken(ctx context.Context, t *JWTToken) (*APIToken, error) {
+	token, err := a.Storer.GetAPITokenByHash(ctx, HashAPIToken(t.Token))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if token.Revoked || token.IsExpired() {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if err := a.Storer.UpdateAPITokenLastUsed(ctx, token.ID, time.Now()); err != nil {
+		log.Printf("failed to update token last usage: %v", err)
+	}
+	return token, nil
+}
+
+func (a *localAuthService) CreateAPIToken(ctx context.Context, accountId uuid.UUID, req *APITokenRequest) (*APITokenResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	plainToken, err := GenerateAPIToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token := &APIToken{
+		AccountID: accountId,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		TokenHash: HashAPIToken(plainToken),
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := a.Storer.InsertAPIToken(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return &APITokenResponse{APIToken: token, Token: plainToken}, nil
+}
+
+func (a *localAuthService) GetAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error) {
+	return a.Storer.GetAccountAPITokens(ctx, accountId)
+}
+
+func (a *localAuthService) RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error {
+	return a.Storer.RevokeAPIToken(ctx, accountId, tokenId)
+}
+
+func (a *localAuthService) CreateServiceAccount(ctx context.Context, ownerId uuid.UUID, req *ServiceAccountRequest) (*Account, error) {
+	if req.Username == "" {
+		return nil, fmt.Errorf("username is required")
+	}
+
+	owner, err := a.Storer.GetByID(ctx, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	if owner.IsService {
+		return nil, fmt.Errorf("service accounts can't own other service accounts")
+	}
+
+	account := NewServiceAccount(ownerId, req.Username, req.Name)
+	if err := a.Storer.InsertAccount(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (a *localAuthService) GetServiceAccount(ctx context.Context, ownerId uuid.UUID, accountId uuid.UUID) (*Account, error) {
+	account, err := a.Storer.GetByID(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	if !account.IsService || account.OwnerID == nil || *account.OwnerID != ownerId {
+		return nil, fmt.Errorf("service account not found")
+	}
+	return account, nil
+}
+
+func (a *localAuthService) GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error) {
+	return a.Storer.GetServiceAccounts(ctx, ownerId)
+}
+
+// RefreshToken issues a new token for the same session so the device keeps
+// showing up as a single entry.
+func (a *localAuthService) RefreshToken(ctx context.Context, t *JWTToken) (*JWTToken, error) {
+	claims, err := a.decodeToken(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var session *Session
+	if _, ok := claims["session_id"]; ok {
+		session, err = a.sessionFromClaims(ctx, claims)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		accountId, err := legacyTokenAccountId(claims)
+		if err != nil {
+			return nil, err
+		}
+		session = &Session{AccountID: accountId}
+		if err := a.CreateSession(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+
+	account, err := a.Storer.GetByID(ctx, session.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	return a.ObtainToken(ctx, account, session)
+}
+
+func (a *localAuthService) CreateSession(ctx context.Context, session *Session) error {
+	session.CreatedAt = time.Now()
+	session.LastActivityAt = session.CreatedAt
+	return a.Storer.InsertSession(ctx, session)
+}
+
+// GetSessionFromToken returns the session a JWT was issued for, rejecting
+// tokens whose session was revoked.
+func (a *localAuthService) GetSessionFromToken(ctx context.Context, t *JWTToken) (*Session, error) {
+	if IsAPIToken(t) {
+		return nil, fmt.Errorf("API tokens don't belong to a session")
+	}
 
-	return uuid.Parse(claims["account_id"].(string))
+	claims, err := a.decodeToken(t)
+	if err != nil {
+		return nil, err
+	}
+	return a.sessionFromClaims(ctx, claims)
+}
+
+func (a *localAuthService) sessionFromClaims(ctx context.Context, claims jwt.MapClaims) (*Session, error) {
+	sessionIdStr, ok := claims["session_id"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	expiredAt, ok := claims["expired_at"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if err := IsExpired(expiredAt); err != nil {
+		return nil, err
+	}
+	sessionId, err := uuid.Parse(sessionIdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	session, err := a.Storer.GetSession(ctx, sessionId)
+	if err != nil || session.Revoked {
+		return nil, fmt.Errorf("session is revoked")
+	}
+	if claims["account_id"] != session.AccountID.String() {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// Writing on every request is wasteful, a minute of precision is enough.
+	if now := time.Now(); now.Sub(session.LastActivityAt) > time.Minute {
+		if err := a.Storer.UpdateSessionActivity(ctx, session.ID, now); err != nil {
+			log.Printf("failed to update session activity: %v", err)
+		}
+		session.LastActivityAt = now
+	}
+	return session, nil
+}
+
+func (a *localAuthService) GetSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) ([]*Session, error) {
+	sessions, err := a.Storer.GetAccountSessions(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == currentSessionId
+	}
+	return sessions, nil
+}
+
+func (a *localAuthService) RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error {
+	return a.Storer.RevokeSession(ctx, accountId, sessionId)
+}
+
+// RevokeOtherSessions logs the account out everywhere but the current
+// session.
+func (a *localAuthService) RevokeOtherSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) error {
+	return a.Storer.RevokeAccountSessions(ctx, accountId, currentSessionId)
 }
 
 func (a *localAuthService) decodeToken(t *JWTToken) (jwt.MapClaims, error) {
@@ -140,7 +446,7 @@ func IsExpired(t string) error {
 	if err != nil {
 		return err
 	}
-	if expiredAt.After(time.Now()) {
+	if !expiredAt.After(time.Now()) {
 		return fmt.Errorf("expired token: %v", expiredAt)
 	}
 	return nil
@@ -191,16 +497,16 @@ func NewMonitorAuthService(next AuthService, reg prometheus.Registerer) *monitor
 	return &monitorAuthService{next: next, metrics: newMetrics(reg)}
 }
 
-func (a *monitorAuthService) Register(account *Account) error {
-	err := a.next.Register(account)
+func (a *monitorAuthService) Register(ctx context.Context, account *Account) error {
+	err := a.next.Register(ctx, account)
 	if err == nil {
 		a.metrics.newRegister.With(prometheus.Labels{"auth": "register"}).Inc()
 	}
 	return err
 }
 
-func (a *monitorAuthService) Authenticate(username, plainPassword string) (*Account, error) {
-	account, err := a.next.Authenticate(username, plainPassword)
+func (a *monitorAuthService) Authenticate(ctx context.Context, username, plainPassword string) (*Account, error) {
+	account, err := a.next.Authenticate(ctx, username, plainPassword)
 	if err != nil {
 		a.metrics.loginFauilures.With(prometheus.Labels{"auth": "failed_login"}).Inc()
 	} else {
@@ -209,26 +515,86 @@ func (a *monitorAuthService) Authenticate(username, plainPassword string) (*Acco
 	return account, err
 }
 
-func (a *monitorAuthService) ObtainToken(account *Account) (*JWTToken, error) {
-	return a.next.ObtainToken(account)
+func (a *monitorAuthService) ObtainToken(ctx context.Context, account *Account, session *Session) (*JWTToken, error) {
+	return a.next.ObtainToken(ctx, account, session)
+}
+
+func (a *monitorAuthService) RefreshToken(ctx context.Context, t *JWTToken) (*JWTToken, error) {
+	return a.next.RefreshToken(ctx, t)
+}
+
+func (a *monitorAuthService) VerifyToken(ctx context.Context, t *JWTToken) (*Account, []string, error) {
+	return a.next.VerifyToken(ctx, t)
+}
+
+func (a *monitorAuthService) GetAccountIdFromToken(ctx context.Context, t *JWTToken) (uuid.UUID, error) {
+	return a.next.GetAccountIdFromToken(ctx, t)
+}
+
+func (a *monitorAuthService) Update(ctx context.Context, accountId uuid.UUID, updateReq *AccountUpdateRequest) error {
+	return a.next.Update(ctx, accountId, updateReq)
+}
+
+func (a *monitorAuthService) AddFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error {
+	return a.next.AddFollower(ctx, accountId, followerId)
+}
+
+func (a *monitorAuthService) GetRelationship(ctx context.Context, accountId uuid.UUID, otherId uuid.UUID) (*Relationship, error) {
+	return a.next.GetRelationship(ctx, accountId, otherId)
+}
+
+func (a *monitorAuthService) GetAccountByID(ctx context.Context, accountId uuid.UUID) (*Account, error) {
+	return a.next.GetAccountByID(ctx, accountId)
+}
+
+func (a *monitorAuthService) GetAccountsByIDs(ctx context.Context, accountIds []uuid.UUID) ([]*Account, error) {
+	return a.next.GetAccountsByIDs(ctx, accountIds)
+}
+
+func (a *monitorAuthService) GetAccountIdWithScope(ctx context.Context, t *JWTToken, scope string) (uuid.UUID, error) {
+	return a.next.GetAccountIdWithScope(ctx, t, scope)
+}
+
+func (a *monitorAuthService) CreateAPIToken(ctx context.Context, accountId uuid.UUID, req *APITokenRequest) (*APITokenResponse, error) {
+	return a.next.CreateAPIToken(ctx, accountId, req)
+}
+
+func (a *monitorAuthService) GetAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error) {
+	return a.next.GetAPITokens(ctx, accountId)
+}
+
+func (a *monitorAuthService) RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error {
+	return a.next.RevokeAPIToken(ctx, accountId, tokenId)
+}
+
+func (a *monitorAuthService) CreateServiceAccount(ctx context.Context, ownerId uuid.UUID, req *ServiceAccountRequest) (*Account, error) {
+	return a.next.CreateServiceAccount(ctx, ownerId, req)
+}
+
+func (a *monitorAuthService) GetServiceAccount(ctx context.Context, ownerId uuid.UUID, accountId uuid.UUID) (*Account, error) {
+	return a.next.GetServiceAccount(ctx, ownerId, accountId)
+}
+
+func (a *monitorAuthService) GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error) {
+	return a.next.GetServiceAccounts(ctx, ownerId)
 }
 
-func (a *monitorAuthService) VerifyToken(t *JWTToken) (*Account, error) {
-	return a.next.VerifyToken(t)
+func (a *monitorAuthService) CreateSession(ctx context.Context, session *Session) error {
+	return a.next.CreateSession(ctx, session)
 }
 
-func (a *monitorAuthService) GetAccountIdFromToken(t *JWTToken) (uuid.UUID, error) {
-	return a.next.GetAccountIdFromToken(t)
+func (a *monitorAuthService) GetSessionFromToken(ctx context.Context, t *JWTToken) (*Session, error) {
+	return a.next.GetSessionFromToken(ctx, t)
 }
 
-func (a *monitorAuthService) Update(accountId uuid.UUID, updateReq *AccountUpdateRequest) error {
-	return a.next.Update(accountId, updateReq)
+func (a *monitorAuthService) GetSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) ([]*Session, error) {
+	return a.next.GetSessions(ctx, accountId, currentSessionId)
 }
 
-func (a *monitorAuthService) AddFollower(accountId uuid.UUID, followerId uuid.UUID) error {
-	return a.next.AddFollower(accountId, followerId)
+func (a *monitorAuthService) RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error {
+	return a.next.RevokeSession(ctx, accountId, sessionId)
 }
 
-func (a *monitorAuthService) GetAccountByID(accountId uuid.UUID) (*Account, error) {
-	return a.next.GetAccountByID(accountId)
+func (a *monitorAuthService) RevokeOtherSessions(ctx context.Context, accountId uuid.UUID, currentSessionId uuid.UUID) error {
+	return a.next.RevokeOtherSessions(ctx, accountId, currentSessionId)
 }
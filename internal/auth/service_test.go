@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestService(t *testing.T) (*localAuthService, *memoryStorage) {
+	storage := newMemoryStorage()
+	return NewLocalAuthService(storage, "secret", "http://media.test/media"), storage
+}
+
+// register creates an account and logs it in, returning its session token.
+func register(t *testing.T, service *localAuthService, username string) (*Account, *JWTToken) {
+	ctx := context.Background()
+	account, err := NewAccount(username, "password", username, username+"@test.com")
+	assert.Nil(t, err)
+	assert.Nil(t, service.Register(ctx, account))
+
+	session := &Session{AccountID: account.ID, Device: "laptop"}
+	assert.Nil(t, service.CreateSession(ctx, session))
+	token, err := service.ObtainToken(ctx, account, session)
+	assert.Nil(t, err)
+	return account, token
+}
+
+func TestAPITokens(t *testing.T) {
+	service, storage := newTestService(t)
+	ctx := context.Background()
+	account, _ := register(t, service, "alice")
+
+	created, err := service.CreateAPIToken(ctx, account.ID, &APITokenRequest{Name: "bot", Scopes: []string{ScopeRead}})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(created.Token, apiTokenPrefix))
+
+	t.Run("stored hashed", func(t *testing.T) {
+		stored, err := storage.GetAPITokenByHash(ctx, HashAPIToken(created.Token))
+		assert.Nil(t, err)
+		assert.Equal(t, created.ID, stored.ID)
+		assert.NotContains(t, stored.TokenHash, created.Token)
+
+		_, err = storage.GetAPITokenByHash(ctx, created.Token)
+		assert.NotNil(t, err)
+	})
+	t.Run("plain token shown once", func(t *testing.T) {
+		tokens, err := service.GetAPITokens(ctx, account.ID)
+		assert.Nil(t, err)
+		assert.Len(t, tokens, 1)
+		assert.Equal(t, created.ID, tokens[0].ID)
+		// Listing only has the token itself, which never holds the plain one.
+		assert.NotEqual(t, created.Token, tokens[0].TokenHash)
+	})
+	t.Run("verify", func(t *testing.T) {
+		verified, scopes, err := service.VerifyToken(ctx, &JWTToken{Token: created.Token})
+		assert.Nil(t, err)
+		assert.Equal(t, account.ID, verified.ID)
+		assert.Equal(t, []string{ScopeRead}, scopes)
+
+		stored, _ := storage.GetAPITokenByHash(ctx, HashAPIToken(created.Token))
+		assert.NotNil(t, stored.LastUsedAt)
+	})
+	t.Run("scopes", func(t *testing.T) {
+		id, err := service.GetAccountIdWithScope(ctx, &JWTToken{Token: created.Token}, ScopeRead)
+		assert.Nil(t, err)
+		assert.Equal(t, account.ID, id)
+
+		_, err = service.GetAccountIdWithScope(ctx, &JWTToken{Token: created.Token}, ScopeWrite)
+		assert.NotNil(t, err)
+		_, err = service.GetAccountIdWithScope(ctx, &JWTToken{Token: created.Token}, scopeSession)
+		assert.NotNil(t, err)
+	})
+	t.Run("bad requests", func(t *testing.T) {
+		_, err := service.CreateAPIToken(ctx, account.ID, &APITokenRequest{Name: "bot", Scopes: []string{scopeSession}})
+		assert.NotNil(t, err)
+
+		expiresAt := time.Now().Add(-time.Minute)
+		_, err = service.CreateAPIToken(ctx, account.ID, &APITokenRequest{Name: "old", Scopes: []string{ScopeRead}, ExpiresAt: &expiresAt})
+		assert.NotNil(t, err)
+	})
+	t.Run("unknown token", func(t *testing.T) {
+		_, _, err := service.VerifyToken(ctx, &JWTToken{Token: apiTokenPrefix + "unknown"})
+		assert.NotNil(t, err)
+	})
+	t.Run("expired", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Minute)
+		expired, err := service.CreateAPIToken(ctx, account.ID, &APITokenRequest{Name: "old", Scopes: []string{ScopeRead}, ExpiresAt: &expiresAt})
+		assert.Nil(t, err)
+		_, _, err = service.VerifyToken(ctx, &JWTToken{Token: expired.Token})
+		assert.Nil(t, err)
+
+		expiresAt = time.Now().Add(-time.Minute)
+		storage.tokens[expired.ID].ExpiresAt = &expiresAt
+		_, _, err = service.VerifyToken(ctx, &JWTToken{Token: expired.Token})
+		assert.NotNil(t, err)
+	})
+	t.Run("revoked", func(t *testing.T) {
+		revoked, err := service.CreateAPIToken(ctx, account.ID, &APITokenRequest{Name: "gone", Scopes: []string{ScopeWrite}})
+		assert.Nil(t, err)
+		// Only the owner can revoke it.
+		assert.NotNil(t, service.RevokeAPIToken(ctx, uuid.New(), revoked.ID))
+		assert.Nil(t, service.RevokeAPIToken(ctx, account.ID, revoked.ID))
+
+		_, _, err = service.VerifyToken(ctx, &JWTToken{Token: revoked.Token})
+		assert.NotNil(t, err)
+		assert.NotNil(t, service.RevokeAPIToken(ctx, account.ID, revoked.ID))
+	})
+}
+
+func TestSessionScopes(t *testing.T) {
+	service, _ := newTestService(t)
+	ctx := context.Background()
+	account, token := register(t, service, "alice")
+
+	verified, scopes, err := service.VerifyToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Equal(t, account.ID, verified.ID)
+	assert.ElementsMatch(t, []string{ScopeRead, ScopeWrite}, scopes)
+
+	for _, scope := range []string{ScopeRead, ScopeWrite, scopeSession} {
+		id, err := service.GetAccountIdWithScope(ctx, token, scope)
+		assert.Nil(t, err)
+		assert.Equal(t, account.ID, id)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	service, _ := newTestService(t)
+	ctx := context.Background()
+	owner, _ := register(t, service, "alice")
+	other, _ := register(t, service, "bob")
+
+	bot, err := service.CreateServiceAccount(ctx, owner.ID, &ServiceAccountRequest{Username: "alice-bot", Name: "Bot"})
+	assert.Nil(t, err)
+	assert.True(t, bot.IsService)
+	assert.Equal(t, owner.ID, *bot.OwnerID)
+
+	found, err := service.GetServiceAccount(ctx, owner.ID, bot.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, bot.ID, found.ID)
+	_, err = service.GetServiceAccount(ctx, other.ID, bot.ID)
+	assert.NotNil(t, err)
+	_, err = service.GetServiceAccount(ctx, owner.ID, other.ID)
+	assert.NotNil(t, err)
+
+	accounts, err := service.GetServiceAccounts(ctx, owner.ID)
+	assert.Nil(t, err)
+	assert.Len(t, accounts, 1)
+	accounts, err = service.GetServiceAccounts(ctx, other.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, accounts)
+
+	t.Run("no password login", func(t *testing.T) {
+		_, err := service.Authenticate(ctx, "alice-bot", "")
+		assert.NotNil(t, err)
+	})
+	t.Run("can't own service accounts", func(t *testing.T) {
+		_, err := service.CreateServiceAccount(ctx, bot.ID, &ServiceAccountRequest{Username: "bot-bot"})
+		assert.NotNil(t, err)
+	})
+	t.Run("tokens", func(t *testing.T) {
+		created, err := service.CreateAPIToken(ctx, bot.ID, &APITokenRequest{Name: "ci", Scopes: []string{ScopeWrite}})
+		assert.Nil(t, err)
+		verified, _, err := service.VerifyToken(ctx, &JWTToken{Token: created.Token})
+		assert.Nil(t, err)
+		assert.Equal(t, bot.ID, verified.ID)
+	})
+}
+
+func signToken(t *testing.T, claims jwt.MapClaims) *JWTToken {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	assert.Nil(t, err)
+	return &JWTToken{Token: token, Type: "bearer"}
+}
+
+func TestSessions(t *testing.T) {
+	service, storage := newTestService(t)
+	ctx := context.Background()
+	account, laptop := register(t, service, "alice")
+
+	phoneSession := &Session{AccountID: account.ID, Device: "phone"}
+	assert.Nil(t, service.CreateSession(ctx, phoneSession))
+	phone, err := service.ObtainToken(ctx, account, phoneSession)
+	assert.Nil(t, err)
+
+	current, err := service.GetSessionFromToken(ctx, laptop)
+	assert.Nil(t, err)
+	assert.Equal(t, "laptop", current.Device)
+
+	sessions, err := service.GetSessions(ctx, account.ID, current.ID)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 2)
+	for _, session := range sessions {
+		assert.Equal(t, session.ID == current.ID, session.Current)
+	}
+
+	t.Run("refresh keeps the session", func(t *testing.T) {
+		refreshed, err := service.RefreshToken(ctx, laptop)
+		assert.Nil(t, err)
+		session, err := service.GetSessionFromToken(ctx, refreshed)
+		assert.Nil(t, err)
+		assert.Equal(t, current.ID, session.ID)
+	})
+	t.Run("revoke one", func(t *testing.T) {
+		assert.NotNil(t, service.RevokeSession(ctx, uuid.New(), phoneSession.ID))
+		assert.Nil(t, service.RevokeSession(ctx, account.ID, phoneSession.ID))
+
+		_, err := service.GetSessionFromToken(ctx, phone)
+		assert.NotNil(t, err)
+		_, _, err = service.VerifyToken(ctx, phone)
+		assert.NotNil(t, err)
+		_, err = service.RefreshToken(ctx, phone)
+		assert.NotNil(t, err)
+		_, err = service.GetSessionFromToken(ctx, laptop)
+		assert.Nil(t, err)
+	})
+	t.Run("revoke others", func(t *testing.T) {
+		tablet := &Session{AccountID: account.ID, Device: "tablet"}
+		assert.Nil(t, service.CreateSession(ctx, tablet))
+		assert.Nil(t, service.RevokeOtherSessions(ctx, account.ID, current.ID))
+
+		sessions, err := service.GetSessions(ctx, account.ID, current.ID)
+		assert.Nil(t, err)
+		assert.Len(t, sessions, 1)
+		assert.Equal(t, current.ID, sessions[0].ID)
+		stored, _ := storage.GetSession(ctx, tablet.ID)
+		assert.True(t, stored.Revoked)
+	})
+	t.Run("expired", func(t *testing.T) {
+		expired := signToken(t, jwt.MapClaims{
+			"account_id": account.ID.String(),
+			"session_id": current.ID.String(),
+			"expired_at": time.Now().UTC().Add(-time.Minute).Format(time.RFC822),
+		})
+		_, err := service.GetSessionFromToken(ctx, expired)
+		assert.NotNil(t, err)
+		_, _, err = service.VerifyToken(ctx, expired)
+		assert.NotNil(t, err)
+	})
+	t.Run("another account's session", func(t *testing.T) {
+		forged := signToken(t, jwt.MapClaims{
+			"account_id": uuid.NewString(),
+			"session_id": current.ID.String(),
+			"expired_at": time.Now().UTC().Add(time.Hour).Format(time.RFC822),
+		})
+		_, err := service.GetSessionFromToken(ctx, forged)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestLegacyTokens(t *testing.T) {
+	service, _ := newTestService(t)
+	ctx := context.Background()
+	account, _ := register(t, service, "alice")
+
+	// Tokens issued before sessions didn't have a session_id.
+	legacy := signToken(t, jwt.MapClaims{
+		"account_id": account.ID.String(),
+		"expired_at": time.Now().UTC().Add(time.Hour).Format(time.RFC822),
+	})
+	verified, scopes, err := service.VerifyToken(ctx, legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, account.ID, verified.ID)
+	assert.ElementsMatch(t, []string{ScopeRead, ScopeWrite}, scopes)
+
+	_, err = service.GetSessionFromToken(ctx, legacy)
+	assert.NotNil(t, err)
+
+	refreshed, err := service.RefreshToken(ctx, legacy)
+	assert.Nil(t, err)
+	session, err := service.GetSessionFromToken(ctx, refreshed)
+	assert.Nil(t, err)
+	assert.Equal(t, account.ID, session.AccountID)
+
+	expired := signToken(t, jwt.MapClaims{
+		"account_id": account.ID.String(),
+		"expired_at": time.Now().UTC().Add(-time.Minute).Format(time.RFC822),
+	})
+	_, _, err = service.VerifyToken(ctx, expired)
+	assert.NotNil(t, err)
+	_, err = service.RefreshToken(ctx, expired)
+	assert.NotNil(t, err)
+}
@@ -1,21 +1,40 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Storage interface {
-	InsertAccount(*Account) error
-	GetAllAccount() ([]*Account, error)
-	GetByUsername(username string) (*Account, error)
-	GetByID(id uuid.UUID) (*Account, error)
-	Update(*Account) error
-	InsertAccountFollower(accountId uuid.UUID, followerId uuid.UUID) error
-	DeleteAccountFollower(accountId uuid.UUID, followerId uuid.UUID) error
-	GetAccountFollowers(uuid.UUID) ([]*Account, error)
+	InsertAccount(ctx context.Context, account *Account) error
+	GetAllAccount(ctx context.Context) ([]*Account, error)
+	GetByUsername(ctx context.Context, username string) (*Account, error)
+	GetByID(ctx context.Context, id uuid.UUID) (*Account, error)
+	GetByIDs(ctx context.Context, ids []uuid.UUID) ([]*Account, error)
+	Update(ctx context.Context, account *Account) error
+	InsertAccountFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error
+	DeleteAccountFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error
+	GetAccountFollowers(ctx context.Context, accountId uuid.UUID) ([]*Account, error)
+	IsFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) (bool, error)
+	GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error)
+
+	InsertAPIToken(ctx context.Context, token *APIToken) error
+	GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	GetAccountAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error)
+	RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error
+	UpdateAPITokenLastUsed(ctx context.Context, tokenId uuid.UUID, lastUsed time.Time) error
+
+	InsertSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, sessionId uuid.UUID) (*Session, error)
+	GetAccountSessions(ctx context.Context, accountId uuid.UUID) ([]*Session, error)
+	RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error
+	RevokeAccountSessions(ctx context.Context, accountId uuid.UUID, exceptId uuid.UUID) error
+	UpdateSessionActivity(ctx context.Context, sessionId uuid.UUID, lastActivity time.Time) error
 }
 
 type postgresStorage struct {
@@ -55,6 +74,40 @@ func migrate(db *sql.DB) error {
 
 			PRIMARY KEY (account_id, follower_id)
 		);
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS is_service boolean DEFAULT 'f';
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS owner_id uuid
+			REFERENCES accounts (id) ON DELETE CASCADE;
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id uuid DEFAULT uuid_generate_v4 (),
+			account_id uuid NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			revoked boolean DEFAULT 'f',
+
+			FOREIGN KEY (account_id) REFERENCES accounts (id)
+				ON DELETE CASCADE,
+
+			PRIMARY KEY (id)
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			id uuid DEFAULT uuid_generate_v4 (),
+			account_id uuid NOT NULL,
+			device VARCHAR(255) NOT NULL,
+			user_agent VARCHAR(512) NOT NULL,
+			ip VARCHAR(64) NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			last_activity_at TIMESTAMP NOT NULL,
+			revoked boolean DEFAULT 'f',
+
+			FOREIGN KEY (account_id) REFERENCES accounts (id)
+				ON DELETE CASCADE,
+
+			PRIMARY KEY (id)
+		);
 	`)
 	if err != nil {
 		return err
@@ -78,40 +131,49 @@ func NewPostgresStorage(connStr string) (*postgresStorage, error) {
 	}, nil
 }
 
-func (s *postgresStorage) InsertAccount(account *Account) error {
+func (s *postgresStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresStorage) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func (s *postgresStorage) InsertAccount(ctx context.Context, account *Account) error {
 	query := `
 		INSERT INTO 
 			accounts(
 				username, password, name, 
 				email, last_login, created_at, 
-				avatar
+				avatar, is_service, owner_id
 			)
-			VALUES ($1, $2, $3, $4, $5, $6, $7);
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id;
 	`
 
-	_, err := s.db.Exec(
-		query, account.Username,
+	return s.db.QueryRowContext(
+		ctx, query, account.Username,
 		account.Password, account.Name,
 		account.Email, account.LastLogin,
 		account.CreatedAt, account.Avatar,
-	)
-
-	return err
+		account.IsService, account.OwnerID,
+	).Scan(&account.ID)
 }
-func (s *postgresStorage) GetAllAccount() ([]*Account, error) {
+func (s *postgresStorage) GetAllAccount(ctx context.Context) ([]*Account, error) {
 	query := `
 		SELECT 
 			id, username, password, name,
 			email, last_login, created_at,
-			avatar
+			avatar, is_service, owner_id
 		FROM accounts
 		WHERE deleted = false;
 	`
 
-	result, err := s.db.Query(query)
+	result, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
 
 	accounts := []*Account{}
 
@@ -126,6 +188,8 @@ func (s *postgresStorage) GetAllAccount() ([]*Account, error) {
 			&account.LastLogin,
 			&account.CreatedAt,
 			&account.Avatar,
+			&account.IsService,
+			&account.OwnerID,
 		)
 
 		if err != nil {
@@ -135,21 +199,21 @@ func (s *postgresStorage) GetAllAccount() ([]*Account, error) {
 		account.Deleted = false
 		accounts = append(accounts, account)
 	}
-	return accounts, nil
+	return accounts, result.Err()
 }
 
-func (s *postgresStorage) GetByUsername(username string) (*Account, error) {
+func (s *postgresStorage) GetByUsername(ctx context.Context, username string) (*Account, error) {
 	query := `
 		SELECT
 			id, username, password, name,
 			email, last_login, created_at,
-			avatar
+			avatar, is_service, owner_id
 		FROM accounts 
 		WHERE deleted = false AND username = $1
 	`
 
 	account := &Account{}
-	err := s.db.QueryRow(query, username).Scan(
+	err := s.db.QueryRowContext(ctx, query, username).Scan(
 		&account.ID,
 		&account.Username,
 		&account.Password,
@@ -158,6 +222,8 @@ func (s *postgresStorage) GetByUsername(username string) (*Account, error) {
 		&account.LastLogin,
 		&account.CreatedAt,
 		&account.Avatar,
+		&account.IsService,
+		&account.OwnerID,
 	)
 	if err != nil {
 		return nil, err
@@ -165,18 +231,18 @@ func (s *postgresStorage) GetByUsername(username string) (*Account, error) {
 
 	return account, nil
 }
-func (s *postgresStorage) GetByID(id uuid.UUID) (*Account, error) {
+func (s *postgresStorage) GetByID(ctx context.Context, id uuid.UUID) (*Account, error) {
 	query := `
 		SELECT
 			id, username, password, name,
 			email, last_login, created_at,
-			avatar
+			avatar, is_service, owner_id
 		FROM accounts 
 		WHERE deleted = false AND id = $1
 	`
 
 	account := &Account{}
-	err := s.db.QueryRow(query, id).Scan(
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
 		&account.ID,
 		&account.Username,
 		&account.Password,
@@ -185,6 +251,8 @@ func (s *postgresStorage) GetByID(id uuid.UUID) (*Account, error) {
 		&account.LastLogin,
 		&account.CreatedAt,
 		&account.Avatar,
+		&account.IsService,
+		&account.OwnerID,
 	)
 	if err != nil {
 		return nil, err
@@ -193,7 +261,49 @@ func (s *postgresStorage) GetByID(id uuid.UUID) (*Account, error) {
 	return account, nil
 }
 
-func (s *postgresStorage) Update(account *Account) error {
+func (s *postgresStorage) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]*Account, error) {
+	query := `
+		SELECT
+			id, username, password, name,
+			email, last_login, created_at,
+			avatar, is_service, owner_id
+		FROM accounts
+		WHERE deleted = false AND id = ANY($1::uuid[])
+	`
+	strIds := make([]string, len(ids))
+	for i, id := range ids {
+		strIds[i] = id.String()
+	}
+	result, err := s.db.QueryContext(ctx, query, pq.Array(strIds))
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	accounts := []*Account{}
+	for result.Next() {
+		account := &Account{}
+		err := result.Scan(
+			&account.ID,
+			&account.Username,
+			&account.Password,
+			&account.Name,
+			&account.Email,
+			&account.LastLogin,
+			&account.CreatedAt,
+			&account.Avatar,
+			&account.IsService,
+			&account.OwnerID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, result.Err()
+}
+
+func (s *postgresStorage) Update(ctx context.Context, account *Account) error {
 	query := `
 		UPDATE accounts
 		SET 
@@ -206,8 +316,8 @@ func (s *postgresStorage) Update(account *Account) error {
 		WHERE id=$7 AND deleted  = false;
 	`
 
-	_, err := s.db.Exec(
-		query,
+	_, err := s.db.ExecContext(
+		ctx, query,
 		account.Name,
 		account.Email,
 		account.Password,
@@ -220,38 +330,39 @@ func (s *postgresStorage) Update(account *Account) error {
 	return err
 }
 
-func (s *postgresStorage) InsertAccountFollower(accountId, followerId uuid.UUID) error {
+func (s *postgresStorage) InsertAccountFollower(ctx context.Context, accountId, followerId uuid.UUID) error {
 	query := `
 		INSERT INTO followers(account_id, follower_id)
 		VALUES ($1, $2)	
 	`
 
-	_, err := s.db.Exec(query, accountId.String(), followerId.String())
+	_, err := s.db.ExecContext(ctx, query, accountId.String(), followerId.String())
 	return err
 }
 
-func (s *postgresStorage) DeleteAccountFollower(accountId uuid.UUID, followerId uuid.UUID) error {
+func (s *postgresStorage) DeleteAccountFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error {
 	query := `
 		DELETE FROM followers
 		WHERE (account_id = $1 AND follower_id = $2)
 	`
-	_, err := s.db.Exec(query, accountId.String(), followerId.String())
+	_, err := s.db.ExecContext(ctx, query, accountId.String(), followerId.String())
 	return err
 }
 
-func (s *postgresStorage) GetAccountFollowers(accountId uuid.UUID) ([]*Account, error) {
+func (s *postgresStorage) GetAccountFollowers(ctx context.Context, accountId uuid.UUID) ([]*Account, error) {
 	query := `
 		SELECT
 			id, username, password, name,
 			email, last_login, created_at,
-			avatar
+			avatar, is_service, owner_id
 		FROM accounts JOIN followers ON accounts.id = followers.follower_id
 		WHERE (followers.account_id = $1);
 	`
-	result, err := s.db.Query(query, accountId.String())
+	result, err := s.db.QueryContext(ctx, query, accountId.String())
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
 
 	accounts := []*Account{}
 
@@ -266,6 +377,8 @@ func (s *postgresStorage) GetAccountFollowers(accountId uuid.UUID) ([]*Account,
 			&account.LastLogin,
 			&account.CreatedAt,
 			&account.Avatar,
+			&account.IsService,
+			&account.OwnerID,
 		)
 
 		if err != nil {
@@ -275,5 +388,297 @@ func (s *postgresStorage) GetAccountFollowers(accountId uuid.UUID) ([]*Account,
 		account.Deleted = false
 		accounts = append(accounts, account)
 	}
-	return accounts, nil
+	return accounts, result.Err()
+}
+
+func (s *postgresStorage) IsFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM followers
+			WHERE (account_id = $1 AND follower_id = $2)
+		)
+	`
+	var exists bool
+	err := s.db.QueryRowContext(ctx, query, accountId.String(), followerId.String()).Scan(&exists)
+	return exists, err
+}
+
+func (s *postgresStorage) GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error) {
+	query := `
+		SELECT
+			id, username, password, name,
+			email, last_login, created_at,
+			avatar, is_service, owner_id
+		FROM accounts
+		WHERE deleted = false AND is_service = true AND owner_id = $1;
+	`
+	result, err := s.db.QueryContext(ctx, query, ownerId.String())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	accounts := []*Account{}
+
+	for result.Next() {
+		account := &Account{}
+		err := result.Scan(
+			&account.ID,
+			&account.Username,
+			&account.Password,
+			&account.Name,
+			&account.Email,
+			&account.LastLogin,
+			&account.CreatedAt,
+			&account.Avatar,
+			&account.IsService,
+			&account.OwnerID,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+	return accounts, result.Err()
+}
+
+func (s *postgresStorage) InsertAPIToken(ctx context.Context, token *APIToken) error {
+	query := `
+		INSERT INTO
+			api_tokens(
+				account_id, name, token_hash,
+				scopes, created_at, expires_at
+			)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id;
+	`
+
+	return s.db.QueryRowContext(
+		ctx, query, token.AccountID.String(),
+		token.Name, token.TokenHash,
+		pq.Array(token.Scopes), token.CreatedAt,
+		token.ExpiresAt,
+	).Scan(&token.ID)
+}
+
+func (s *postgresStorage) GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	query := `
+		SELECT
+			id, account_id, name, token_hash, scopes,
+			created_at, last_used_at, expires_at, revoked
+		FROM api_tokens
+		WHERE token_hash = $1
+	`
+
+	token := &APIToken{}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(
+		&token.ID,
+		&token.AccountID,
+		&token.Name,
+		&token.TokenHash,
+		pq.Array(&token.Scopes),
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.ExpiresAt,
+		&token.Revoked,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (s *postgresStorage) GetAccountAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error) {
+	query := `
+		SELECT
+			id, account_id, name, token_hash, scopes,
+			created_at, last_used_at, expires_at, revoked
+		FROM api_tokens
+		WHERE account_id = $1 AND revoked = false
+		ORDER BY created_at;
+	`
+	result, err := s.db.QueryContext(ctx, query, accountId.String())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	tokens := []*APIToken{}
+
+	for result.Next() {
+		token := &APIToken{}
+		err := result.Scan(
+			&token.ID,
+			&token.AccountID,
+			&token.Name,
+			&token.TokenHash,
+			pq.Array(&token.Scopes),
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.ExpiresAt,
+			&token.Revoked,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+	return tokens, result.Err()
+}
+
+func (s *postgresStorage) RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error {
+	query := `
+		UPDATE api_tokens
+		SET revoked = true
+		WHERE id = $1 AND account_id = $2 AND revoked = false;
+	`
+	result, err := s.db.ExecContext(ctx, query, tokenId.String(), accountId.String())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+func (s *postgresStorage) UpdateAPITokenLastUsed(ctx context.Context, tokenId uuid.UUID, lastUsed time.Time) error {
+	query := `
+		UPDATE api_tokens
+		SET last_used_at = $1
+		WHERE id = $2;
+	`
+	_, err := s.db.ExecContext(ctx, query, lastUsed, tokenId.String())
+	return err
+}
+
+func (s *postgresStorage) InsertSession(ctx context.Context, session *Session) error {
+	query := `
+		INSERT INTO
+			sessions(
+				account_id, device, user_agent,
+				ip, created_at, last_activity_at
+			)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id;
+	`
+
+	return s.db.QueryRowContext(
+		ctx, query, session.AccountID.String(),
+		session.Device, session.UserAgent,
+		session.IP, session.CreatedAt,
+		session.LastActivityAt,
+	).Scan(&session.ID)
+}
+
+func (s *postgresStorage) GetSession(ctx context.Context, sessionId uuid.UUID) (*Session, error) {
+	query := `
+		SELECT
+			id, account_id, device, user_agent, ip,
+			created_at, last_activity_at, revoked
+		FROM sessions
+		WHERE id = $1
+	`
+
+	session := &Session{}
+	err := s.db.QueryRowContext(ctx, query, sessionId.String()).Scan(
+		&session.ID,
+		&session.AccountID,
+		&session.Device,
+		&session.UserAgent,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastActivityAt,
+		&session.Revoked,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *postgresStorage) GetAccountSessions(ctx context.Context, accountId uuid.UUID) ([]*Session, error) {
+	query := `
+		SELECT
+			id, account_id, device, user_agent, ip,
+			created_at, last_activity_at, revoked
+		FROM sessions
+		WHERE account_id = $1 AND revoked = false
+		ORDER BY last_activity_at DESC;
+	`
+	result, err := s.db.QueryContext(ctx, query, accountId.String())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	sessions := []*Session{}
+
+	for result.Next() {
+		session := &Session{}
+		err := result.Scan(
+			&session.ID,
+			&session.AccountID,
+			&session.Device,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastActivityAt,
+			&session.Revoked,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+	return sessions, result.Err()
+}
+
+func (s *postgresStorage) RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error {
+	query := `
+		UPDATE sessions
+		SET revoked = true
+		WHERE id = $1 AND account_id = $2 AND revoked = false;
+	`
+	result, err := s.db.ExecContext(ctx, query, sessionId.String(), accountId.String())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+// RevokeAccountSessions revokes every session of the account but exceptId.
+func (s *postgresStorage) RevokeAccountSessions(ctx context.Context, accountId uuid.UUID, exceptId uuid.UUID) error {
+	query := `
+		UPDATE sessions
+		SET revoked = true
+		WHERE account_id = $1 AND id <> $2 AND revoked = false;
+	`
+	_, err := s.db.ExecContext(ctx, query, accountId.String(), exceptId.String())
+	return err
+}
+
+func (s *postgresStorage) UpdateSessionActivity(ctx context.Context, sessionId uuid.UUID, lastActivity time.Time) error {
+	query := `
+		UPDATE sessions
+		SET last_activity_at = $1
+		WHERE id = $2;
+	`
+	_, err := s.db.ExecContext(ctx, query, lastActivity, sessionId.String())
+	return err
 }
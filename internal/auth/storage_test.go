@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryStorage keeps everything in maps for the tests, ids are assigned
+// on insert like Postgres does.
+type memoryStorage struct {
+	mu        sync.Mutex
+	accounts  map[uuid.UUID]*Account
+	followers map[uuid.UUID]map[uuid.UUID]bool
+	tokens    map[uuid.UUID]*APIToken
+	sessions  map[uuid.UUID]*Session
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		accounts:  map[uuid.UUID]*Account{},
+		followers: map[uuid.UUID]map[uuid.UUID]bool{},
+		tokens:    map[uuid.UUID]*APIToken{},
+		sessions:  map[uuid.UUID]*Session{},
+	}
+}
+
+func (s *memoryStorage) InsertAccount(ctx context.Context, account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.accounts {
+		if stored.Username == account.Username {
+			return fmt.Errorf("username is taken")
+		}
+	}
+	account.ID = uuid.New()
+	stored := *account
+	s.accounts[account.ID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetAllAccount(ctx context.Context) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := []*Account{}
+	for _, stored := range s.accounts {
+		copied := *stored
+		accounts = append(accounts, &copied)
+	}
+	return accounts, nil
+}
+
+func (s *memoryStorage) GetByUsername(ctx context.Context, username string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.accounts {
+		if stored.Username == username {
+			copied := *stored
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("account not found")
+}
+
+func (s *memoryStorage) GetByID(ctx context.Context, id uuid.UUID) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.accounts[id]
+	if !found {
+		return nil, fmt.Errorf("account not found")
+	}
+	copied := *stored
+	return &copied, nil
+}
+
+func (s *memoryStorage) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]*Account, error) {
+	accounts := []*Account{}
+	for _, id := range ids {
+		if account, err := s.GetByID(ctx, id); err == nil {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (s *memoryStorage) Update(ctx context.Context, account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *account
+	s.accounts[account.ID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) InsertAccountFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.followers[accountId] == nil {
+		s.followers[accountId] = map[uuid.UUID]bool{}
+	}
+	s.followers[accountId][followerId] = true
+	return nil
+}
+
+func (s *memoryStorage) DeleteAccountFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.followers[accountId], followerId)
+	return nil
+}
+
+func (s *memoryStorage) GetAccountFollowers(ctx context.Context, accountId uuid.UUID) ([]*Account, error) {
+	s.mu.Lock()
+	ids := []uuid.UUID{}
+	for id := range s.followers[accountId] {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	return s.GetByIDs(ctx, ids)
+}
+
+func (s *memoryStorage) IsFollower(ctx context.Context, accountId uuid.UUID, followerId uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.followers[accountId][followerId], nil
+}
+
+func (s *memoryStorage) GetServiceAccounts(ctx context.Context, ownerId uuid.UUID) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := []*Account{}
+	for _, stored := range s.accounts {
+		if stored.IsService && stored.OwnerID != nil && *stored.OwnerID == ownerId {
+			copied := *stored
+			accounts = append(accounts, &copied)
+		}
+	}
+	return accounts, nil
+}
+
+func (s *memoryStorage) InsertAPIToken(ctx context.Context, token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token.ID = uuid.New()
+	stored := *token
+	s.tokens[token.ID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.tokens {
+		if stored.TokenHash == hash {
+			copied := *stored
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("token not found")
+}
+
+func (s *memoryStorage) GetAccountAPITokens(ctx context.Context, accountId uuid.UUID) ([]*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := []*APIToken{}
+	for _, stored := range s.tokens {
+		if stored.AccountID == accountId && !stored.Revoked {
+			copied := *stored
+			tokens = append(tokens, &copied)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (s *memoryStorage) RevokeAPIToken(ctx context.Context, accountId uuid.UUID, tokenId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.tokens[tokenId]
+	if !found || stored.AccountID != accountId || stored.Revoked {
+		return fmt.Errorf("token not found")
+	}
+	stored.Revoked = true
+	return nil
+}
+
+func (s *memoryStorage) UpdateAPITokenLastUsed(ctx context.Context, tokenId uuid.UUID, lastUsed time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, found := s.tokens[tokenId]; found {
+		stored.LastUsedAt = &lastUsed
+	}
+	return nil
+}
+
+func (s *memoryStorage) InsertSession(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.ID = uuid.New()
+	stored := *session
+	s.sessions[session.ID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetSession(ctx context.Context, sessionId uuid.UUID) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.sessions[sessionId]
+	if !found {
+		return nil, fmt.Errorf("session not found")
+	}
+	copied := *stored
+	return &copied, nil
+}
+
+func (s *memoryStorage) GetAccountSessions(ctx context.Context, accountId uuid.UUID) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := []*Session{}
+	for _, stored := range s.sessions {
+		if stored.AccountID == accountId && !stored.Revoked {
+			copied := *stored
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActivityAt.After(sessions[j].LastActivityAt)
+	})
+	return sessions, nil
+}
+
+func (s *memoryStorage) RevokeSession(ctx context.Context, accountId uuid.UUID, sessionId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.sessions[sessionId]
+	if !found || stored.AccountID != accountId || stored.Revoked {
+		return fmt.Errorf("session not found")
+	}
+	stored.Revoked = true
+	return nil
+}
+
+func (s *memoryStorage) RevokeAccountSessions(ctx context.Context, accountId uuid.UUID, exceptId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.sessions {
+		if stored.AccountID == accountId && stored.ID != exceptId {
+			stored.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) UpdateSessionActivity(ctx context.Context, sessionId uuid.UUID, lastActivity time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, found := s.sessions[sessionId]; found {
+		stored.LastActivityAt = lastActivity
+	}
+	return nil
+}
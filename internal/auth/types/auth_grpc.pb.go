@@ -24,6 +24,9 @@ const _ = grpc.SupportPackageIsVersion7
 type AuthenticationClient interface {
 	ObtainAccount(ctx context.Context, in *JWTToken, opts ...grpc.CallOption) (*Account, error)
 	GetAccountByID(ctx context.Context, in *GetAccountRequest, opts ...grpc.CallOption) (*Account, error)
+	// GetAccountsByIDs returns the accounts which exist, unknown ids are left out.
+	GetAccountsByIDs(ctx context.Context, in *GetAccountsRequest, opts ...grpc.CallOption) (*GetAccountsResponse, error)
+	GetRelationship(ctx context.Context, in *GetRelationshipRequest, opts ...grpc.CallOption) (*Relationship, error)
 }
 
 type authenticationClient struct {
@@ -52,12 +55,33 @@ func (c *authenticationClient) GetAccountByID(ctx context.Context, in *GetAccoun
 	return out, nil
 }
 
+func (c *authenticationClient) GetAccountsByIDs(ctx context.Context, in *GetAccountsRequest, opts ...grpc.CallOption) (*GetAccountsResponse, error) {
+	out := new(GetAccountsResponse)
+	err := c.cc.Invoke(ctx, "/types.Authentication/GetAccountsByIDs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authenticationClient) GetRelationship(ctx context.Context, in *GetRelationshipRequest, opts ...grpc.CallOption) (*Relationship, error) {
+	out := new(Relationship)
+	err := c.cc.Invoke(ctx, "/types.Authentication/GetRelationship", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AuthenticationServer is the server API for Authentication service.
 // All implementations must embed UnimplementedAuthenticationServer
 // for forward compatibility
 type AuthenticationServer interface {
 	ObtainAccount(context.Context, *JWTToken) (*Account, error)
 	GetAccountByID(context.Context, *GetAccountRequest) (*Account, error)
+	// GetAccountsByIDs returns the accounts which exist, unknown ids are left out.
+	GetAccountsByIDs(context.Context, *GetAccountsRequest) (*GetAccountsResponse, error)
+	GetRelationship(context.Context, *GetRelationshipRequest) (*Relationship, error)
 	mustEmbedUnimplementedAuthenticationServer()
 }
 
@@ -71,6 +95,12 @@ func (UnimplementedAuthenticationServer) ObtainAccount(context.Context, *JWTToke
 func (UnimplementedAuthenticationServer) GetAccountByID(context.Context, *GetAccountRequest) (*Account, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetAccountByID not implemented")
 }
+func (UnimplementedAuthenticationServer) GetAccountsByIDs(context.Context, *GetAccountsRequest) (*GetAccountsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAccountsByIDs not implemented")
+}
+func (UnimplementedAuthenticationServer) GetRelationship(context.Context, *GetRelationshipRequest) (*Relationship, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRelationship not implemented")
+}
 func (UnimplementedAuthenticationServer) mustEmbedUnimplementedAuthenticationServer() {}
 
 // UnsafeAuthenticationServer may be embedded to opt out of forward compatibility for this service.
@@ -120,6 +150,42 @@ func _Authentication_GetAccountByID_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Authentication_GetAccountsByIDs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAccountsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthenticationServer).GetAccountsByIDs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Authentication/GetAccountsByIDs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthenticationServer).GetAccountsByIDs(ctx, req.(*GetAccountsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Authentication_GetRelationship_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRelationshipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthenticationServer).GetRelationship(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Authentication/GetRelationship",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthenticationServer).GetRelationship(ctx, req.(*GetRelationshipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Authentication_ServiceDesc is the grpc.ServiceDesc for Authentication service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -135,6 +201,14 @@ var Authentication_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetAccountByID",
 			Handler:    _Authentication_GetAccountByID_Handler,
 		},
+		{
+			MethodName: "GetAccountsByIDs",
+			Handler:    _Authentication_GetAccountsByIDs_Handler,
+		},
+		{
+			MethodName: "GetRelationship",
+			Handler:    _Authentication_GetRelationship_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "auth.proto",
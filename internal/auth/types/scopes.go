@@ -0,0 +1,30 @@
+package types
+
+import "net/http"
+
+// Scopes of the accounts ObtainAccount returns. API tokens may be granted
+// only some of them, sessions hold all.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// HasScope tells whether the token the account was obtained with was
+// granted scope.
+func (x *Account) HasScope(scope string) bool {
+	for _, granted := range x.GetScopes() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// MethodScope is the scope a request with the HTTP method needs, reads need
+// ScopeRead and everything else ScopeWrite.
+func MethodScope(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -11,6 +17,8 @@ import (
 	web "github.com/sina-am/social-media/common"
 	"github.com/sina-am/social-media/internal/auth/client"
 	"github.com/sina-am/social-media/internal/auth/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type APIServer struct {
@@ -19,111 +27,1444 @@ type APIServer struct {
 	Upgrader websocket.Upgrader
 	Service  Service
 	Storage  Storage
+	// MediaURL is where the media service serves uploads, group avatars
+	// have to be uploaded there.
+	MediaURL string
+	// SessionCheckInterval is how often open sockets check the session they
+	// were opened in is still valid, they're closed once it isn't. Zero
+	// disables the checks.
+	SessionCheckInterval time.Duration
+
+	connections connections
+}
+
+const (
+	// socketProtocol is the subprotocol of the chat socket. Clients offer it
+	// along with "bearer.<token>" or "ticket.<ticket>" to authenticate while
+	// opening the socket, which keeps credentials out of URLs and so out of
+	// access logs.
+	socketProtocol = "chat"
+	// authTimeout is how long clients which didn't authenticate while
+	// opening the socket have to send an auth envelope.
+	authTimeout = 10 * time.Second
+)
+
+// checkOrigin lets sockets be opened from pages of the service's own host
+// and of the allowed origins. Clients other than browsers don't send an
+// Origin.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, allowedOrigin := range allowed {
+			if strings.EqualFold(origin, allowedOrigin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// connections keeps track of open WebSockets, which http.Server.Shutdown
+// doesn't know about since they're hijacked, so they can be drained.
+type connections struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (c *connections) add(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = map[*websocket.Conn]struct{}{}
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+}
+
+func (c *connections) remove(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.conns[conn]; found {
+		delete(c.conns, conn)
+		c.wg.Done()
+	}
+}
+
+// closeAll asks every client to go away and waits for their handlers to
+// return. Connections still open when ctx is done are closed abruptly.
+func (c *connections) closeAll(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+
+	c.mu.Lock()
+	for conn := range c.conns {
+		conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	c.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for conn := range c.conns {
+			conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// authenticate returns the account of the request's token, which needs the
+// write scope unless the request only reads.
+func (s *APIServer) authenticate(ctx context.Context, r *http.Request) (*types.Account, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return nil, web.Errorf(http.StatusUnauthorized, "unauthorized user")
+	}
+
+	account, err := s.Auth.ObtainAccountRPC(
+		ctx,
+		&types.JWTToken{Token: token, Type: "bearer"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if scope := types.MethodScope(r.Method); !account.HasScope(scope) {
+		return nil, web.Errorf(http.StatusForbidden, "token doesn't have the %q scope", scope)
+	}
+	return account, nil
+}
+
+func (s *APIServer) createChat(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method != http.MethodPost {
+		return web.Errorf(http.StatusMethodNotAllowed, "method is not allowed")
+	}
+
+	defer r.Body.Close()
+
+	chatIn := &ChatIn{}
+	if err := json.NewDecoder(r.Body).Decode(chatIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := chatIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if chatIn.Avatar != "" && !web.IsMediaURL(s.MediaURL, chatIn.Avatar) {
+		return web.Errorf(http.StatusBadRequest, "avatar must be uploaded to the media service")
+	}
+
+	chat, err := s.Service.CreateChat(ctx, uuid.MustParse(account.Id), chatIn)
+	if err != nil {
+		return chatError(err)
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, chat)
+}
+
+// getDirectChat returns the private chat with another account, creating it
+// the first time. The encrypted one is asked for with encrypted=true.
+func (s *APIServer) getDirectChat(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	otherId, err := uuid.Parse(mux.Vars(r)["account_id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid account id")
+	}
+
+	encrypted := r.URL.Query().Get("encrypted") == "true"
+	chat, created, err := s.Service.GetDirectChat(ctx, uuid.MustParse(account.Id), otherId, encrypted)
+	if err != nil {
+		return chatError(err)
+	}
+	if created {
+		return web.WriteJSON(w, http.StatusCreated, chat)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+func (s *APIServer) getMessages(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	chatId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid chat id")
+	}
+
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return web.Errorf(http.StatusBadRequest, "invalid limit")
+		}
+	}
+
+	// The device gets its own ciphertexts of encrypted messages.
+	deviceId := r.URL.Query().Get("device")
+	page, err := s.Service.GetMessages(ctx, uuid.MustParse(account.Id), deviceId, chatId, r.URL.Query().Get("before"), limit)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, page)
+}
+
+// search finds messages by the words in q, in the chat_id chat only if
+// it's given.
+func (s *APIServer) search(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	chatId := uuid.Nil
+	if chatIdStr := query.Get("chat_id"); chatIdStr != "" {
+		chatId, err = uuid.Parse(chatIdStr)
+		if err != nil {
+			return web.Errorf(http.StatusBadRequest, "invalid chat id")
+		}
+	}
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return web.Errorf(http.StatusBadRequest, "invalid limit")
+		}
+	}
+
+	page, err := s.Service.Search(ctx, uuid.MustParse(account.Id), query.Get("q"), chatId, query.Get("cursor"), limit)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, page)
+}
+
+// messageVars parses the chat and message ids of the route.
+func messageVars(r *http.Request) (uuid.UUID, uuid.UUID, error) {
+	chatId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, web.Errorf(http.StatusBadRequest, "invalid chat id")
+	}
+	messageId, err := uuid.Parse(mux.Vars(r)["message_id"])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, web.Errorf(http.StatusBadRequest, "invalid message id")
+	}
+	return chatId, messageId, nil
+}
+
+func (s *APIServer) editMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, messageId, err := messageVars(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	editIn := &MessageEditIn{}
+	if err := json.NewDecoder(r.Body).Decode(editIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := editIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	msg, err := s.Service.EditMessage(ctx, uuid.MustParse(account.Id), "", chatId, messageId, editIn.Text, editIn.Entities)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, msg)
+}
+
+// deleteMessage deletes the message for the requesting member only, unless
+// for_everyone=true is given.
+func (s *APIServer) deleteMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, messageId, err := messageVars(r)
+	if err != nil {
+		return err
+	}
+
+	forEveryone := r.URL.Query().Get("for_everyone") == "true"
+	err = s.Service.DeleteMessage(ctx, uuid.MustParse(account.Id), "", chatId, messageId, forEveryone)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "deleted"})
+}
+
+// react adds a reaction with PUT and removes it with DELETE.
+func (s *APIServer) react(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, messageId, err := messageVars(r)
+	if err != nil {
+		return err
+	}
+
+	remove := r.Method == http.MethodDelete
+	err = s.Service.React(ctx, uuid.MustParse(account.Id), "", chatId, messageId, mux.Vars(r)["emoji"], remove)
+	if err != nil {
+		return chatError(err)
+	}
+	if remove {
+		return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "removed"})
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "added"})
+}
+
+// chatVar parses the chat id of the route.
+func chatVar(r *http.Request) (uuid.UUID, error) {
+	chatId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return uuid.Nil, web.Errorf(http.StatusBadRequest, "invalid chat id")
+	}
+	return chatId, nil
+}
+
+func (s *APIServer) getReceipts(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	receipts, err := s.Service.GetReceipts(ctx, uuid.MustParse(account.Id), chatId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, receipts)
+}
+
+// markRead is the REST counterpart of the read envelope.
+func (s *APIServer) markRead(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	readIn := &ReadIn{}
+	if err := json.NewDecoder(r.Body).Decode(readIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	readIn.ChatId = chatId
+	if err := readIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	if err := s.Service.MarkRead(ctx, uuid.MustParse(account.Id), "", chatId, readIn.Seq); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "read"})
+}
+
+func (s *APIServer) getInbox(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := s.Service.GetInbox(ctx, uuid.MustParse(account.Id))
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, inbox)
+}
+
+func (s *APIServer) getMessageRequests(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	requests, err := s.Service.GetMessageRequests(ctx, uuid.MustParse(account.Id))
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, requests)
+}
+
+func (s *APIServer) acceptRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	chat, err := s.Service.AcceptRequest(ctx, uuid.MustParse(account.Id), chatId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+func (s *APIServer) declineRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Service.DeclineRequest(ctx, uuid.MustParse(account.Id), chatId); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "declined"})
+}
+
+// maxPresenceIds is the most accounts whose presence is asked at once.
+const maxPresenceIds = 100
+
+// getPresence returns the presence of the comma separated account ids.
+func (s *APIServer) getPresence(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	ids := strings.Split(r.URL.Query().Get("ids"), ",")
+	if len(ids) > maxPresenceIds {
+		return web.Errorf(http.StatusBadRequest, "at most %d ids are allowed", maxPresenceIds)
+	}
+	accountIds := make([]uuid.UUID, len(ids))
+	for i, id := range ids {
+		if accountIds[i], err = uuid.Parse(id); err != nil {
+			return web.Errorf(http.StatusBadRequest, "invalid account id %q", id)
+		}
+	}
+
+	presences, err := s.Service.GetPresence(ctx, uuid.MustParse(account.Id), accountIds)
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, presences)
+}
+
+func (s *APIServer) getPrivacySettings(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	settings, err := s.Service.GetPrivacySettings(ctx, uuid.MustParse(account.Id))
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, settings)
+}
+
+func (s *APIServer) updatePrivacySettings(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	settings := &PrivacySettings{}
+	if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := settings.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	if err := s.Service.UpdatePrivacySettings(ctx, uuid.MustParse(account.Id), settings); err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, settings)
+}
+
+// memberVars parses the chat and account ids of the route.
+func memberVars(r *http.Request) (uuid.UUID, uuid.UUID, error) {
+	chatId, err := chatVar(r)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	memberId, err := uuid.Parse(mux.Vars(r)["account_id"])
+	if err != nil {
+		return uuid.Nil, uuid.Nil, web.Errorf(http.StatusBadRequest, "invalid account id")
+	}
+	return chatId, memberId, nil
+}
+
+// updateChatInfo renames the group or changes its description or avatar.
+func (s *APIServer) updateChatInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	infoIn := &ChatInfoIn{}
+	if err := json.NewDecoder(r.Body).Decode(infoIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := infoIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if infoIn.Avatar != nil && *infoIn.Avatar != "" && !web.IsMediaURL(s.MediaURL, *infoIn.Avatar) {
+		return web.Errorf(http.StatusBadRequest, "avatar must be uploaded to the media service")
+	}
+
+	chat, err := s.Service.UpdateChatInfo(ctx, uuid.MustParse(account.Id), chatId, infoIn)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+// updateRetention sets how long the chat keeps its messages and the timer
+// of disappearing messages.
+func (s *APIServer) updateRetention(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	retentionIn := &RetentionIn{}
+	if err := json.NewDecoder(r.Body).Decode(retentionIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := retentionIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	chat, err := s.Service.UpdateRetention(ctx, uuid.MustParse(account.Id), chatId, retentionIn)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+// scheduleMessage schedules a message to the chat, the device passed as
+// device isn't told about it.
+func (s *APIServer) scheduleMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	scheduledIn := &ScheduledMessageIn{}
+	if err := json.NewDecoder(r.Body).Decode(scheduledIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := scheduledIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	deviceId := r.URL.Query().Get("device")
+	msg, err := s.Service.ScheduleMessage(ctx, uuid.MustParse(account.Id), deviceId, chatId, scheduledIn)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusCreated, msg)
+}
+
+// getScheduledMessages returns the account's scheduled messages, of the
+// chat if the route has one.
+func (s *APIServer) getScheduledMessages(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId := uuid.Nil
+	if _, ok := mux.Vars(r)["id"]; ok {
+		chatId, err = chatVar(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	messages, err := s.Service.GetScheduledMessages(ctx, uuid.MustParse(account.Id), chatId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, messages)
+}
+
+func scheduledVar(r *http.Request) (uuid.UUID, error) {
+	id, err := uuid.Parse(mux.Vars(r)["scheduled_id"])
+	if err != nil {
+		return uuid.Nil, web.Errorf(http.StatusBadRequest, "invalid scheduled message id")
+	}
+	return id, nil
+}
+
+func (s *APIServer) updateScheduledMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	id, err := scheduledVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	scheduledIn := &ScheduledMessageIn{}
+	if err := json.NewDecoder(r.Body).Decode(scheduledIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := scheduledIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	deviceId := r.URL.Query().Get("device")
+	msg, err := s.Service.UpdateScheduledMessage(ctx, uuid.MustParse(account.Id), deviceId, id, scheduledIn)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, msg)
+}
+
+func (s *APIServer) cancelScheduledMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	id, err := scheduledVar(r)
+	if err != nil {
+		return err
+	}
+
+	deviceId := r.URL.Query().Get("device")
+	if err := s.Service.CancelScheduledMessage(ctx, uuid.MustParse(account.Id), deviceId, id); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "scheduled message canceled"})
+}
+
+// saveDraft replaces the account's draft of the chat, deleting it clears
+// the draft. The device passed as device isn't told about it.
+func (s *APIServer) saveDraft(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	draftIn := &DraftIn{}
+	if r.Method != http.MethodDelete {
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(draftIn); err != nil {
+			return web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		if err := draftIn.Validate(); err != nil {
+			return web.Errorf(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	deviceId := r.URL.Query().Get("device")
+	draft, err := s.Service.SaveDraft(ctx, uuid.MustParse(account.Id), deviceId, chatId, draftIn)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, draft)
+}
+
+func (s *APIServer) getDrafts(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	drafts, err := s.Service.GetDrafts(ctx, uuid.MustParse(account.Id))
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, drafts)
+}
+
+func (s *APIServer) addMembers(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	membersIn := &MembersIn{}
+	if err := json.NewDecoder(r.Body).Decode(membersIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := membersIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	chat, err := s.Service.AddMembers(ctx, uuid.MustParse(account.Id), chatId, membersIn.Members)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+func (s *APIServer) removeMember(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, memberId, err := memberVars(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Service.RemoveMember(ctx, uuid.MustParse(account.Id), chatId, memberId); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "removed"})
 }
 
-func (s *APIServer) createChat(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		return web.Errorf(http.StatusUnauthorized, "unauthorized user")
+func (s *APIServer) leaveChat(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
 	}
 
-	account, err := s.Auth.ObtainAccountRPC(
-		ctx,
-		&types.JWTToken{Token: token, Type: "bearer"},
-	)
+	if err := s.Service.LeaveChat(ctx, uuid.MustParse(account.Id), chatId); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "left"})
+}
+
+func (s *APIServer) setRole(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, memberId, err := memberVars(r)
 	if err != nil {
 		return err
 	}
 
-	if r.Method != http.MethodPost {
-		return web.Errorf(http.StatusMethodNotAllowed, "method is not allowed")
+	defer r.Body.Close()
+	roleIn := &RoleIn{}
+	if err := json.NewDecoder(r.Body).Decode(roleIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := roleIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	chat, err := s.Service.SetRole(ctx, uuid.MustParse(account.Id), chatId, memberId, roleIn.Role)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+func (s *APIServer) transferOwnership(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
 	}
 
 	defer r.Body.Close()
+	ownerIn := &OwnerIn{}
+	if err := json.NewDecoder(r.Body).Decode(ownerIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := ownerIn.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
 
-	chatIn := &ChatIn{}
-	if err := json.NewDecoder(r.Body).Decode(chatIn); err != nil {
+	chat, err := s.Service.TransferOwnership(ctx, uuid.MustParse(account.Id), chatId, ownerIn.AccountId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+func (s *APIServer) createInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+	inviteIn := &InviteIn{}
+	if err := json.NewDecoder(r.Body).Decode(inviteIn); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := inviteIn.Validate(); err != nil {
 		return web.Errorf(http.StatusBadRequest, err.Error())
 	}
 
-	chat, err := s.Service.CreateChat(ctx, uuid.MustParse(account.Id), chatIn)
+	ttl := time.Duration(inviteIn.ExpiresIn) * time.Second
+	invite, err := s.Service.CreateInvite(ctx, uuid.MustParse(account.Id), chatId, ttl)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusCreated, invite)
+}
+
+func (s *APIServer) getInvites(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
 	if err != nil {
+		return err
+	}
+
+	invites, err := s.Service.GetInvites(ctx, uuid.MustParse(account.Id), chatId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, invites)
+}
+
+func (s *APIServer) revokeInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	chatId, err := chatVar(r)
+	if err != nil {
+		return err
+	}
+
+	err = s.Service.RevokeInvite(ctx, uuid.MustParse(account.Id), chatId, mux.Vars(r)["code"])
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "revoked"})
+}
+
+func (s *APIServer) joinChat(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	chat, err := s.Service.JoinChat(ctx, uuid.MustParse(account.Id), mux.Vars(r)["code"])
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, chat)
+}
+
+// chatError maps the service's errors to HTTP errors.
+func chatError(err error) error {
+	switch {
+	case errors.Is(err, ErrChatNotFound), errors.Is(err, ErrMessageNotFound),
+		errors.Is(err, ErrNoSuchMember), errors.Is(err, ErrInviteNotFound), errors.Is(err, ErrNoRequest),
+		errors.Is(err, ErrNoDeviceKeys), errors.Is(err, ErrScheduledNotFound):
+		return web.Errorf(http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrNotMember), errors.Is(err, ErrNotAuthor),
+		errors.Is(err, ErrNotAdmin), errors.Is(err, ErrNotOwner), errors.Is(err, ErrRequestDeclined),
+		errors.Is(err, ErrKeysForbidden), errors.Is(err, ErrAddForbidden):
+		return web.Errorf(http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrTooManyClaims):
+		return web.Errorf(http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, ErrInviteExpired):
+		return web.Errorf(http.StatusGone, err.Error())
+	case errors.Is(err, ErrChatExists), errors.Is(err, ErrMismatchedDevices), errors.Is(err, ErrScheduledClaimed):
+		return web.Errorf(http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidReply), errors.Is(err, ErrDeleted),
+		errors.Is(err, ErrSystemMessage), errors.Is(err, ErrNotGroup), errors.Is(err, ErrOwner),
+		errors.Is(err, ErrOwnerCantLeave), errors.Is(err, ErrUnknownMember), errors.Is(err, ErrDirectChat),
+		errors.Is(err, ErrRequestPending), errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrUnknownMedia),
+		errors.Is(err, ErrInvalidAttachment), errors.Is(err, ErrInvalidEntity), errors.Is(err, ErrInvalidEmoji),
+		errors.Is(err, ErrTooManyReactions), errors.Is(err, ErrInvalidKey), errors.Is(err, ErrInvalidDevice),
+		errors.Is(err, ErrEncrypted), errors.Is(err, ErrNotEncrypted), errors.Is(err, ErrEncryptedGroup),
+		errors.Is(err, ErrInvalidQuery), errors.Is(err, ErrInvalidSendAt):
 		return web.Errorf(http.StatusBadRequest, err.Error())
 	}
+	return err
+}
 
-	return web.WriteJSON(w, http.StatusCreated, chat)
+func (s *APIServer) getMyDevices(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	devices, err := s.Service.GetDevices(ctx, uuid.MustParse(account.Id))
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusOK, devices)
 }
 
-func (s *APIServer) wsHandler(w http.ResponseWriter, r *http.Request) {
-	s.Logger.Info("Message")
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// publishKeys puts the device's public keys in the key directory and
+// responds with how many one-time prekeys it has.
+func (s *APIServer) publishKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
 
-	tokenStr := r.URL.Query().Get("token")
-	if tokenStr == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid token"))
-		return
+	defer r.Body.Close()
+	keys := &KeysIn{}
+	if err := json.NewDecoder(r.Body).Decode(keys); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if err := keys.Validate(); err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	count, err := s.Service.PublishKeys(ctx, uuid.MustParse(account.Id), mux.Vars(r)["device_id"], keys)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, &PreKeyCount{Count: count})
+}
+
+func (s *APIServer) countPreKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	count, err := s.Service.CountPreKeys(ctx, uuid.MustParse(account.Id), mux.Vars(r)["device_id"])
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, &PreKeyCount{Count: count})
+}
+
+func (s *APIServer) removeDeviceKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Service.RemoveDeviceKeys(ctx, uuid.MustParse(account.Id), mux.Vars(r)["device_id"]); err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, map[string]string{"message": "device keys removed"})
+}
+
+// getKeyBundles returns the key bundles of the account's devices, claiming
+// one of their one-time prekeys each.
+func (s *APIServer) getKeyBundles(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+	targetId, err := uuid.Parse(mux.Vars(r)["account_id"])
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid account id")
+	}
+
+	bundles, err := s.Service.GetKeyBundles(ctx, uuid.MustParse(account.Id), targetId)
+	if err != nil {
+		return chatError(err)
+	}
+	return web.WriteJSON(w, http.StatusOK, bundles)
+}
+
+// issueSocketTicket issues a single use ticket to open the socket with, for
+// clients which can't authenticate it otherwise.
+func (s *APIServer) issueSocketTicket(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := s.authenticate(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := s.Service.IssueSocketTicket(ctx, uuid.MustParse(account.Id), r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	return web.WriteJSON(w, http.StatusCreated, ticket)
+}
+
+// socketCredentials returns the token or ticket offered as subprotocol.
+// Tickets may be passed as the ticket query parameter as well, one which
+// ends up in a log was used up already.
+func socketCredentials(r *http.Request) (token, ticket string) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		switch {
+		case strings.HasPrefix(protocol, "bearer."):
+			return strings.TrimPrefix(protocol, "bearer."), ""
+		case strings.HasPrefix(protocol, "ticket."):
+			return "", strings.TrimPrefix(protocol, "ticket.")
+		}
+	}
+	return "", r.URL.Query().Get("ticket")
+}
+
+// authenticateSocket returns the account of the token or ticket and the
+// token the session is checked with while the socket is open.
+func (s *APIServer) authenticateSocket(ctx context.Context, token, ticket string) (*types.Account, string, error) {
+	if ticket != "" {
+		redeemed, err := s.Service.RedeemSocketTicket(ctx, ticket)
+		if errors.Is(err, ErrTicketNotFound) {
+			return nil, "", web.Errorf(http.StatusUnauthorized, "invalid ticket")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		token = redeemed.Token
+	}
+	if token == "" {
+		return nil, "", web.Errorf(http.StatusUnauthorized, "unauthorized user")
+	}
+
+	account, err := s.Auth.ObtainAccountRPC(ctx, &types.JWTToken{Token: token, Type: "bearer"})
+	if err != nil {
+		return nil, "", web.Errorf(http.StatusUnauthorized, "invalid token")
 	}
-	token := &types.JWTToken{
-		Token: r.URL.Query().Get("token"),
-		Type:  "bearer",
+	// Everything clients send over the socket changes something.
+	if !account.HasScope(types.ScopeWrite) {
+		return nil, "", web.Errorf(http.StatusForbidden, "token doesn't have the %q scope", types.ScopeWrite)
 	}
-	account, err := s.Auth.ObtainAccountRPC(ctx, token)
+	return account, token, nil
+}
+
+// authenticateFirstFrame authenticates a socket opened without credentials
+// with the auth envelope the client sends first, and acks it.
+func (s *APIServer) authenticateFirstFrame(ctx context.Context, conn *websocket.Conn) (*types.Account, string, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	env := &Envelope{}
+	if err := conn.ReadJSON(env); err != nil {
+		return nil, "", err
+	}
+
+	auth := &AuthIn{}
+	var err error
+	switch {
+	case env.Version != ProtocolVersion:
+		err = web.Errorf(http.StatusBadRequest, "unsupported protocol version %d", env.Version)
+	case env.Type != EnvelopeAuth:
+		err = web.Errorf(http.StatusUnauthorized, "the first envelope has to be auth")
+	case env.Decode(auth) != nil || auth.Validate() != nil:
+		err = web.Errorf(http.StatusBadRequest, "auth needs a token or a ticket")
+	}
+	var account *types.Account
+	var token string
+	if err == nil {
+		account, token, err = s.authenticateSocket(ctx, auth.Token, auth.Ticket)
+	}
+	if err != nil {
+		conn.WriteJSON(errorEnvelope(env.Id, err))
+		return nil, "", err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	ack, err := NewEnvelope(EnvelopeAck, env.Id, nil)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid token"))
+		return nil, "", err
+	}
+	return account, token, conn.WriteJSON(ack)
+}
+
+// watchSession closes the socket once the session of the token it was
+// opened with expired or was revoked, until ctx is done. The auth service
+// being unreachable doesn't end sessions.
+func (s *APIServer) watchSession(ctx context.Context, conn *websocket.Conn, token string) {
+	if s.SessionCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.SessionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		_, err := s.Auth.ObtainAccountRPC(ctx, &types.JWTToken{Token: token, Type: "bearer"})
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+			s.Logger.Error(err.Error())
+			continue
+		}
+
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired or revoked")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.Close()
 		return
 	}
+}
+
+// wsHandler opens the chat socket. Clients authenticate with a token or a
+// ticket offered as subprotocol, a ticket in the URL or, failing those, an
+// auth envelope sent first.
+func (s *APIServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var account *types.Account
+	token, ticket := socketCredentials(r)
+	if token != "" || ticket != "" {
+		var err error
+		account, token, err = s.authenticateSocket(ctx, token, ticket)
+		if err != nil {
+			code, message := http.StatusUnauthorized, "invalid token"
+			if httpErr, ok := err.(*web.HttpError); ok {
+				code, message = httpErr.StatusCode, httpErr.Message
+			}
+			w.WriteHeader(code)
+			w.Write([]byte(message))
+			return
+		}
+	}
 
-	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	// Browsers fail the handshake unless one of the offered subprotocols is
+	// chosen, never the one carrying the credentials.
+	var header http.Header
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == socketProtocol {
+			header = http.Header{"Sec-WebSocket-Protocol": {socketProtocol}}
+		}
+	}
+	conn, err := s.Upgrader.Upgrade(w, r, header)
 	if err != nil {
 		w.Write([]byte(err.Error()))
 		return
 	}
 	s.Logger.Info("connection received")
 
+	s.connections.add(conn)
+
+	if account == nil {
+		account, token, err = s.authenticateFirstFrame(ctx, conn)
+		if err != nil {
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			conn.Close()
+			s.connections.remove(conn)
+			return
+		}
+	}
+
+	// Clients should send a stable device id so a reconnect replaces the
+	// previous connection of the same device instead of adding one.
+	deviceId := r.URL.Query().Get("device")
+	if deviceId == "" {
+		deviceId = uuid.NewString()
+	}
+
 	accountId := uuid.MustParse(account.Id)
-	onlineAccount := NewOnlineAccount(accountId)
-	s.Service.AddOnlineAccount(onlineAccount)
+	onlineAccount, err := s.Service.Connect(ctx, accountId, deviceId)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		conn.Close()
+		s.connections.remove(conn)
+		return
+	}
 	defer func() {
-		s.Service.DelOnlineAccount(onlineAccount)
+		// The request context may already be canceled here.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Service.Disconnect(ctx, onlineAccount); err != nil {
+			s.Logger.Error(err.Error())
+		}
 		conn.Close()
+		s.connections.remove(conn)
 	}()
 
-	go func(ctx context.Context) {
-		for msg := range onlineAccount.msgCh {
-			conn.WriteJSON(msg)
+	// gorilla/websocket allows only one concurrent writer.
+	var writeMu sync.Mutex
+	writeJSON := func(v any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	go s.watchSession(ctx, conn, token)
+
+	// Live events queue up in the meantime, some may be resent as well
+	// which clients tell apart by message id.
+	if err := s.resync(ctx, accountId, deviceId, writeJSON); err != nil {
+		s.Logger.Error(err.Error())
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case event := <-onlineAccount.Events():
+				env, err := event.Envelope()
+				if err != nil {
+					s.Logger.Error(err.Error())
+					continue
+				}
+				if err := writeJSON(env); err != nil {
+					conn.Close()
+					return
+				}
+			case <-onlineAccount.Done():
+				// Unblocks the reader below.
+				conn.Close()
+				return
+			}
 		}
-	}(ctx)
+	}()
 
 	for {
-		s.Logger.Info("inside loop")
-		var msgIn MessageIn
-		if err := conn.ReadJSON(&msgIn); err != nil {
-			if err := conn.WriteJSON(web.Errorf(http.StatusBadRequest, "invalid message received")); err != nil {
+		env := &Envelope{}
+		if err := conn.ReadJSON(env); err != nil {
+			// The socket is gone when the error isn't about the JSON.
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
 				return
 			}
-			continue
-		}
-		if err := msgIn.Validate(); err != nil {
-			if err := conn.WriteJSON(web.Errorf(http.StatusBadRequest, "invalid message received")); err != nil {
+			if err := writeJSON(errorEnvelope("", web.Errorf(http.StatusBadRequest, "invalid envelope received"))); err != nil {
 				return
 			}
 			continue
 		}
 
-		if err := s.Service.Deliver(accountId, msgIn); err != nil {
-			conn.WriteJSON(web.Errorf(http.StatusBadRequest, err.Error()))
-			continue
+		reply, err := s.handleEnvelope(ctx, accountId, deviceId, env)
+		if err != nil {
+			if _, ok := err.(*web.HttpError); !ok {
+				s.Logger.Error(err.Error())
+			}
+			reply = errorEnvelope(env.Id, err)
+		}
+		if err := writeJSON(reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleEnvelope runs what a client sent over the socket and returns the
+// ack to send back.
+func (s *APIServer) handleEnvelope(ctx context.Context, accountId uuid.UUID, deviceId string, env *Envelope) (*Envelope, error) {
+	if env.Version != ProtocolVersion {
+		return nil, web.Errorf(http.StatusBadRequest, "unsupported protocol version %d", env.Version)
+	}
+	newPayload, found := envelopePayloads[env.Type]
+	if !found {
+		return nil, web.Errorf(http.StatusBadRequest, "unknown envelope type %q", env.Type)
+	}
+	payload := newPayload()
+	if err := env.Decode(payload); err != nil {
+		return nil, web.Errorf(http.StatusBadRequest, "invalid payload: %s", err)
+	}
+
+	var acked *Message
+	var err error
+	switch payload := payload.(type) {
+	case *MessageIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		payload.ClientId = env.Id
+		acked, err = s.Service.Deliver(ctx, accountId, deviceId, *payload)
+	case *EditIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		acked, err = s.Service.EditMessage(ctx, accountId, deviceId, payload.ChatId, payload.MessageId, payload.Text, payload.Entities)
+	case *DeleteIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.DeleteMessage(ctx, accountId, deviceId, payload.ChatId, payload.MessageId, payload.ForEveryone)
+	case *ReactIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.React(ctx, accountId, deviceId, payload.ChatId, payload.MessageId, payload.Emoji, payload.Remove)
+	case *ReceivedIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.AckDelivery(ctx, accountId, deviceId, payload.ChatId, payload.Seq)
+	case *ReadIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.MarkRead(ctx, accountId, deviceId, payload.ChatId, payload.Seq)
+	case *StatusIn:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.SetStatus(ctx, accountId, deviceId, payload.Status)
+	case *TypingPayload:
+		if err := payload.Validate(); err != nil {
+			return nil, web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		err = s.Service.Typing(ctx, accountId, deviceId, payload.ChatId, payload.Typing)
+	case *AuthIn:
+		return nil, web.Errorf(http.StatusBadRequest, "the socket is authenticated already")
+	default:
+		return nil, web.Errorf(http.StatusBadRequest, "%q can't be sent by clients", env.Type)
+	}
+	if err != nil {
+		return nil, chatError(err)
+	}
+
+	// Only sends and edits are acked with a payload.
+	var ack any
+	if acked != nil {
+		ack = acked
+	}
+	return NewEnvelope(EnvelopeAck, env.Id, ack)
+}
+
+// resync sends the device the messages it missed while it was offline,
+// followed by a synced envelope.
+func (s *APIServer) resync(ctx context.Context, accountId uuid.UUID, deviceId string, writeJSON func(any) error) error {
+	resync, err := s.Service.Resync(ctx, accountId, deviceId)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range resync.Messages {
+		env, err := Event{Type: EventMessage, Message: msg}.Envelope()
+		if err != nil {
+			return err
 		}
-		conn.WriteJSON(&map[string]string{"message": "sended"})
+		if err := writeJSON(env); err != nil {
+			return err
+		}
+	}
+
+	env, err := NewEnvelope(EnvelopeSynced, "", &SyncedPayload{Truncated: resync.Truncated})
+	if err != nil {
+		return err
+	}
+	return writeJSON(env)
+}
+
+func errorEnvelope(id string, err error) *Envelope {
+	payload := &ErrorPayload{Code: http.StatusInternalServerError, Message: "internal server error"}
+	if httpErr, ok := err.(*web.HttpError); ok {
+		payload.Code = httpErr.StatusCode
+		payload.Message = httpErr.Message
 	}
+	env, _ := NewEnvelope(EnvelopeError, id, payload)
+	return env
 }
 
 func (s *APIServer) Run() error {
 	router := mux.NewRouter()
 	router.HandleFunc("/chat", s.MakeHTTPHandler(s.createChat)).Methods("POST")
+	router.HandleFunc("/chat/me/devices", s.MakeHTTPHandler(s.getMyDevices)).Methods("GET")
+	router.HandleFunc("/chat/me/devices/{device_id}/keys", s.MakeHTTPHandler(s.publishKeys)).Methods("PUT")
+	router.HandleFunc("/chat/me/devices/{device_id}/keys", s.MakeHTTPHandler(s.removeDeviceKeys)).Methods("DELETE")
+	router.HandleFunc("/chat/me/devices/{device_id}/keys/count", s.MakeHTTPHandler(s.countPreKeys)).Methods("GET")
+	router.HandleFunc("/chat/me/privacy", s.MakeHTTPHandler(s.getPrivacySettings)).Methods("GET")
+	router.HandleFunc("/chat/me/privacy", s.MakeHTTPHandler(s.updatePrivacySettings)).Methods("PUT")
+	router.HandleFunc("/chat/inbox", s.MakeHTTPHandler(s.getInbox)).Methods("GET")
+	router.HandleFunc("/chat/search", s.MakeHTTPHandler(s.search)).Methods("GET")
+	router.HandleFunc("/chat/drafts", s.MakeHTTPHandler(s.getDrafts)).Methods("GET")
+	router.HandleFunc("/chat/scheduled", s.MakeHTTPHandler(s.getScheduledMessages)).Methods("GET")
+	router.HandleFunc("/chat/scheduled/{scheduled_id}", s.MakeHTTPHandler(s.updateScheduledMessage)).Methods("PUT")
+	router.HandleFunc("/chat/scheduled/{scheduled_id}", s.MakeHTTPHandler(s.cancelScheduledMessage)).Methods("DELETE")
+	router.HandleFunc("/chat/requests", s.MakeHTTPHandler(s.getMessageRequests)).Methods("GET")
+	router.HandleFunc("/chat/requests/{id}/accept", s.MakeHTTPHandler(s.acceptRequest)).Methods("POST")
+	router.HandleFunc("/chat/requests/{id}/decline", s.MakeHTTPHandler(s.declineRequest)).Methods("POST")
+	router.HandleFunc("/chat/presence", s.MakeHTTPHandler(s.getPresence)).Methods("GET")
+	router.HandleFunc("/chat/keys/{account_id}", s.MakeHTTPHandler(s.getKeyBundles)).Methods("GET")
+	router.HandleFunc("/chat/direct/{account_id}", s.MakeHTTPHandler(s.getDirectChat)).Methods("POST")
+	router.HandleFunc("/chat/join/{code}", s.MakeHTTPHandler(s.joinChat)).Methods("POST")
+	router.HandleFunc("/chat/{id}", s.MakeHTTPHandler(s.updateChatInfo)).Methods("PATCH")
+	router.HandleFunc("/chat/{id}/retention", s.MakeHTTPHandler(s.updateRetention)).Methods("PUT")
+	router.HandleFunc("/chat/{id}/draft", s.MakeHTTPHandler(s.saveDraft)).Methods("PUT", "DELETE")
+	router.HandleFunc("/chat/{id}/scheduled", s.MakeHTTPHandler(s.scheduleMessage)).Methods("POST")
+	router.HandleFunc("/chat/{id}/scheduled", s.MakeHTTPHandler(s.getScheduledMessages)).Methods("GET")
+	router.HandleFunc("/chat/{id}/members", s.MakeHTTPHandler(s.addMembers)).Methods("POST")
+	router.HandleFunc("/chat/{id}/members/{account_id}", s.MakeHTTPHandler(s.removeMember)).Methods("DELETE")
+	router.HandleFunc("/chat/{id}/members/{account_id}/role", s.MakeHTTPHandler(s.setRole)).Methods("PUT")
+	router.HandleFunc("/chat/{id}/owner", s.MakeHTTPHandler(s.transferOwnership)).Methods("POST")
+	router.HandleFunc("/chat/{id}/leave", s.MakeHTTPHandler(s.leaveChat)).Methods("POST")
+	router.HandleFunc("/chat/{id}/invites", s.MakeHTTPHandler(s.createInvite)).Methods("POST")
+	router.HandleFunc("/chat/{id}/invites", s.MakeHTTPHandler(s.getInvites)).Methods("GET")
+	router.HandleFunc("/chat/{id}/invites/{code}", s.MakeHTTPHandler(s.revokeInvite)).Methods("DELETE")
+	router.HandleFunc("/chat/{id}/messages", s.MakeHTTPHandler(s.getMessages)).Methods("GET")
+	router.HandleFunc("/chat/{id}/messages/{message_id}", s.MakeHTTPHandler(s.editMessage)).Methods("PATCH")
+	router.HandleFunc("/chat/{id}/messages/{message_id}", s.MakeHTTPHandler(s.deleteMessage)).Methods("DELETE")
+	router.HandleFunc("/chat/{id}/messages/{message_id}/reactions/{emoji}", s.MakeHTTPHandler(s.react)).Methods("PUT", "DELETE")
+	router.HandleFunc("/chat/{id}/receipts", s.MakeHTTPHandler(s.getReceipts)).Methods("GET")
+	router.HandleFunc("/chat/{id}/read", s.MakeHTTPHandler(s.markRead)).Methods("POST")
+	router.HandleFunc("/ws/ticket", s.MakeHTTPHandler(s.issueSocketTicket)).Methods("POST")
 	router.HandleFunc("/ws", s.wsHandler)
+
+	if s.Lifecycle == nil {
+		s.Lifecycle = web.NewLifecycle(s.Logger, 0)
+	}
+	s.Lifecycle.OnShutdown("websockets", s.connections.closeAll)
 	return s.APIServer.Run(router)
 }
@@ -3,21 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	web "github.com/sina-am/social-media/common"
 	"github.com/sina-am/social-media/internal/auth/client"
 	"github.com/sina-am/social-media/internal/auth/types"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/box"
 )
 
 func TestCreatChat(t *testing.T) {
@@ -35,10 +42,16 @@ func TestCreatChat(t *testing.T) {
 			Name:     "test2",
 			Email:    "test2@gmail.com",
 		},
+		{
+			Id:       uuid.NewString(),
+			Username: "test3",
+			Name:     "test3",
+			Email:    "test3@gmail.com",
+		},
 	}
 	auth := client.NewFakeGRPCClient(accounts)
 	storage := NewMemoryStorage()
-	service := NewChatService(storage, auth)
+	service := NewChatService(storage, auth, NewHub(4, 16, DisconnectSlowConsumer), NewLocalBroker())
 	logger, _ := zap.NewProduction()
 
 	server := APIServer{
@@ -69,29 +82,260 @@ func TestCreatChat(t *testing.T) {
 		assert.Equal(t, "method is not allowed", err.Error())
 	})
 
+	create := func(account string, chatIn *ChatIn) (*Chat, error) {
+		body, err := json.Marshal(chatIn)
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/chat", bytes.NewReader(body))
+		r.Header.Set("Authorization", account)
+		if err := server.createChat(ctx, w, r); err != nil {
+			return nil, err
+		}
+		chat := &Chat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
+		return chat, nil
+	}
+	id := func(i int) uuid.UUID {
+		return uuid.MustParse(accounts[i].Id)
+	}
+
 	t.Run("/chat create", func(t *testing.T) {
-		chatIn := &ChatIn{
-			Members:   []uuid.UUID{uuid.New(), uuid.New()},
-			IsPrivate: true,
+		chat, err := create(accounts[0].Id, &ChatIn{Members: []uuid.UUID{id(1)}, IsPrivate: true})
+		assert.Nil(t, err)
+		assert.True(t, chat.IsPrivate)
+		assert.Equal(t, sortMembers([]uuid.UUID{id(0), id(1)}), chat.Members)
+	})
+	t.Run("/chat members are a sorted set", func(t *testing.T) {
+		chat, err := create(accounts[0].Id, &ChatIn{Members: []uuid.UUID{id(2), id(0), id(1), id(2)}})
+		assert.Nil(t, err)
+		assert.Len(t, chat.Members, 3)
+		assert.Equal(t, sortMembers([]uuid.UUID{id(0), id(1), id(2)}), chat.Members)
+	})
+	t.Run("/chat unknown members", func(t *testing.T) {
+		unknown := uuid.New()
+		_, err := create(accounts[0].Id, &ChatIn{Members: []uuid.UUID{id(1), unknown}})
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+		assert.Contains(t, err.Error(), unknown.String())
+	})
+	t.Run("/chat private chat with more members", func(t *testing.T) {
+		_, err := create(accounts[0].Id, &ChatIn{Members: []uuid.UUID{id(1), id(2)}, IsPrivate: true})
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+		_, err = create(accounts[0].Id, &ChatIn{Members: []uuid.UUID{id(0)}, IsPrivate: true})
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("/chat duplicate private chat", func(t *testing.T) {
+		// Whoever creates it, there's one chat for the pair.
+		_, err := create(accounts[1].Id, &ChatIn{Members: []uuid.UUID{id(0)}, IsPrivate: true})
+		assert.Equal(t, http.StatusConflict, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("/chat/direct get or create", func(t *testing.T) {
+		direct := func(account string, otherId uuid.UUID) (*httptest.ResponseRecorder, *Chat) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/chat/direct/"+otherId.String(), nil)
+			r.Header.Set("Authorization", account)
+			r = mux.SetURLVars(r, map[string]string{"account_id": otherId.String()})
+			assert.Nil(t, server.getDirectChat(ctx, w, r))
+			chat := &Chat{}
+			assert.Nil(t, json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(chat))
+			return w, chat
 		}
 
-		body, err := json.Marshal(chatIn)
+		w, created := direct(accounts[0].Id, id(2))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		w, existing := direct(accounts[2].Id, id(0))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, created.Id, existing.Id)
+
+		existing, err := storage.GetDirectChat(ctx, id(1), id(0), false)
 		assert.Nil(t, err)
+		_, chat := direct(accounts[0].Id, id(1))
+		assert.Equal(t, existing.Id, chat.Id)
+	})
+}
+
+func TestChatHistory(t *testing.T) {
+	member, friend, outsider := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: member, Username: "member"},
+		&types.Account{Id: friend, Username: "friend"},
+		&types.Account{Id: outsider, Username: "outsider"},
+	)
+	ctx := context.Background()
+
+	chat, err := service.CreateChat(ctx, uuid.MustParse(member), &ChatIn{Members: []uuid.UUID{uuid.MustParse(friend)}, IsPrivate: true})
+	assert.Nil(t, err)
+	for i := 1; i <= 5; i++ {
+		_, err := service.Deliver(ctx, uuid.MustParse(member), "", MessageIn{ChatId: chat.Id, Text: fmt.Sprint(i)})
+		assert.Nil(t, err)
+	}
+
+	get := func(account, chatId, query string) (*MessagePage, error) {
 		w := httptest.NewRecorder()
-		r := httptest.NewRequest(http.MethodPost, "/chat", bytes.NewReader(body))
-		r.Header.Set("Authorization", accounts[0].Id)
+		r := httptest.NewRequest(http.MethodGet, "/chat/"+chatId+"/messages?"+query, nil)
+		r.Header.Set("Authorization", account)
+		r = mux.SetURLVars(r, map[string]string{"id": chatId})
+		if err := server.getMessages(ctx, w, r); err != nil {
+			return nil, err
+		}
+		page := &MessagePage{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(page))
+		return page, nil
+	}
 
-		err = server.createChat(ctx, w, r)
+	t.Run("pages through history", func(t *testing.T) {
+		texts := []string{}
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			page, err := get(member, chat.Id.String(), "limit=2&before="+cursor)
+			assert.Nil(t, err)
+			for _, msg := range page.Messages {
+				texts = append(texts, msg.Text)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"5", "4", "3", "2", "1"}, texts)
+	})
+	t.Run("cursor is stable when new messages arrive", func(t *testing.T) {
+		page, err := get(member, chat.Id.String(), "limit=2")
+		assert.Nil(t, err)
+		_, err = service.Deliver(ctx, uuid.MustParse(member), "", MessageIn{ChatId: chat.Id, Text: "6"})
 		assert.Nil(t, err)
 
-		chat := &Chat{}
-		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
-		assert.Equal(t, chatIn.IsPrivate, chat.IsPrivate)
-		chatIn.Members = append(chatIn.Members, uuid.MustParse(accounts[0].Id))
-		assert.Equal(t, chatIn.Members, chat.Members)
+		page, err = get(member, chat.Id.String(), "limit=2&before="+page.NextCursor)
+		assert.Nil(t, err)
+		assert.Equal(t, "3", page.Messages[0].Text)
+	})
+	t.Run("not a member", func(t *testing.T) {
+		_, err := get(outsider, chat.Id.String(), "")
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("unknown chat", func(t *testing.T) {
+		_, err := get(member, uuid.NewString(), "")
+		assert.Equal(t, http.StatusNotFound, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("invalid cursor", func(t *testing.T) {
+		_, err := get(member, chat.Id.String(), "before=abc")
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+	})
+}
+
+func TestMessageChanges(t *testing.T) {
+	author, member := uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: author.String(), Username: "author"},
+		&types.Account{Id: member.String(), Username: "member"},
+	)
+	ctx := context.Background()
+
+	chat, err := service.CreateChat(ctx, author, &ChatIn{Members: []uuid.UUID{member}, IsPrivate: true})
+	assert.Nil(t, err)
+	_, err = service.Deliver(ctx, author, "", MessageIn{ChatId: chat.Id, Text: "hello"})
+	assert.Nil(t, err)
+	page, err := service.GetMessages(ctx, author, "", chat.Id, "", 1)
+	assert.Nil(t, err)
+	msg := page.Messages[0]
+
+	memberConn, err := service.Connect(ctx, member, "phone")
+	assert.Nil(t, err)
+	nextEvent := func() Event {
+		select {
+		case event := <-memberConn.Events():
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+		return Event{}
+	}
+
+	request := func(method, account, messageId, query string, body any) (*httptest.ResponseRecorder, error) {
+		payload, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/chat/"+chat.Id.String()+"/messages/"+messageId+"?"+query, bytes.NewReader(payload))
+		r.Header.Set("Authorization", account)
+		r = mux.SetURLVars(r, map[string]string{"id": chat.Id.String(), "message_id": messageId})
+		if method == http.MethodPatch {
+			return w, server.editMessage(ctx, w, r)
+		}
+		return w, server.deleteMessage(ctx, w, r)
+	}
+
+	t.Run("reply to a message of the chat", func(t *testing.T) {
+		_, err := service.Deliver(ctx, member, "", MessageIn{ChatId: chat.Id, Text: "hi", ReplyMessageId: msg.Id})
+		assert.Nil(t, err)
+		event := nextEvent()
+		assert.Equal(t, EventMessage, event.Type)
+		assert.Equal(t, msg.Id, event.Message.ReplyMessageId)
+	})
+	t.Run("reply to an unknown message", func(t *testing.T) {
+		_, err := service.Deliver(ctx, member, "", MessageIn{ChatId: chat.Id, Text: "hi", ReplyMessageId: uuid.New()})
+		assert.ErrorIs(t, err, ErrInvalidReply)
+	})
+	t.Run("edit someone else's message", func(t *testing.T) {
+		_, err := request(http.MethodPatch, member.String(), msg.Id.String(), "", MessageEditIn{Text: "mine"})
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("edit keeps history", func(t *testing.T) {
+		w, err := request(http.MethodPatch, author.String(), msg.Id.String(), "", MessageEditIn{Text: "hello again"})
+		assert.Nil(t, err)
+		edited := &Message{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(edited))
+		assert.Equal(t, "hello again", edited.Text)
+		assert.Len(t, edited.Edits, 1)
+		assert.Equal(t, "hello", edited.Edits[0].Text)
+		assert.NotNil(t, edited.EditedAt)
+
+		event := nextEvent()
+		assert.Equal(t, EventMessageEdited, event.Type)
+		assert.Equal(t, "hello again", event.Message.Text)
+	})
+	t.Run("delete for me", func(t *testing.T) {
+		_, err := request(http.MethodDelete, member.String(), msg.Id.String(), "", nil)
+		assert.Nil(t, err)
+
+		// The member's devices are told, the message stays for the others.
+		event := nextEvent()
+		assert.Equal(t, EventMessageDeleted, event.Type)
+		assert.False(t, event.Message.Deleted)
+
+		page, err := service.GetMessages(ctx, member, "", chat.Id, "", 10)
+		assert.Nil(t, err)
+		for _, m := range page.Messages {
+			assert.NotEqual(t, msg.Id, m.Id)
+		}
+		page, err = service.GetMessages(ctx, author, "", chat.Id, "", 10)
+		assert.Nil(t, err)
+		assert.Len(t, page.Messages, 2)
 	})
+	t.Run("delete for everyone by another member", func(t *testing.T) {
+		_, err := request(http.MethodDelete, member.String(), msg.Id.String(), "for_everyone=true", nil)
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("delete for everyone", func(t *testing.T) {
+		_, err := request(http.MethodDelete, author.String(), msg.Id.String(), "for_everyone=true", nil)
+		assert.Nil(t, err)
 
+		event := nextEvent()
+		assert.Equal(t, EventMessageDeleted, event.Type)
+		assert.True(t, event.Message.Deleted)
+		assert.Empty(t, event.Message.Text)
+		assert.Empty(t, event.Message.Edits)
+
+		_, err = request(http.MethodPatch, author.String(), msg.Id.String(), "", MessageEditIn{Text: "back"})
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("reply to a message deleted for everyone", func(t *testing.T) {
+		_, err := service.Deliver(ctx, member, "", MessageIn{ChatId: chat.Id, Text: "what was it?", ReplyMessageId: msg.Id})
+		assert.ErrorIs(t, err, ErrInvalidReply)
+	})
+	t.Run("unknown message", func(t *testing.T) {
+		_, err := request(http.MethodDelete, author.String(), uuid.NewString(), "", nil)
+		assert.Equal(t, http.StatusNotFound, err.(*web.HttpError).StatusCode)
+	})
 }
+
 func TestServer(t *testing.T) {
 	validate = validator.New()
 	accounts := []*types.Account{
@@ -108,9 +352,13 @@ func TestServer(t *testing.T) {
 			Email:    "test2@gmail.com",
 		},
 	}
+	// Members of the groups who never connect.
+	for i := 3; i <= 5; i++ {
+		accounts = append(accounts, &types.Account{Id: uuid.NewString(), Username: fmt.Sprint("test", i)})
+	}
 	auth := client.NewFakeGRPCClient(accounts)
 	storage := NewMemoryStorage()
-	service := NewChatService(storage, auth)
+	service := NewChatService(storage, auth, NewHub(4, 16, DisconnectSlowConsumer), NewLocalBroker())
 	logger, _ := zap.NewProduction()
 
 	server := APIServer{
@@ -127,99 +375,139 @@ func TestServer(t *testing.T) {
 	defer s.Close()
 	ctx := context.Background()
 
-	t.Run("UPGRADE /ws with no token", func(t *testing.T) {
+	t.Run("UPGRADE /ws with invalid token", func(t *testing.T) {
 		u := "ws" + strings.TrimPrefix(s.URL, "http")
-		_, res, err := websocket.DefaultDialer.Dial(u, nil)
+		_, res, err := socketDialer(uuid.NewString()).Dial(u, nil)
 		assert.NotNil(t, err)
 		assert.Equal(t, res.StatusCode, http.StatusUnauthorized)
 	})
-	t.Run("UPGRADE /ws with invalid token", func(t *testing.T) {
-		u := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + uuid.NewString()
-		_, res, err := websocket.DefaultDialer.Dial(u, nil)
-		assert.NotNil(t, err)
-		assert.Equal(t, res.StatusCode, http.StatusUnauthorized)
+	t.Run("UPGRADE /ws chooses the chat subprotocol", func(t *testing.T) {
+		u := "ws" + strings.TrimPrefix(s.URL, "http")
+		ws, res, err := socketDialer(accounts[0].Id).Dial(u, nil)
+		assert.Nil(t, err)
+		defer ws.Close()
+		assert.Equal(t, socketProtocol, res.Header.Get("Sec-WebSocket-Protocol"))
+		assert.Equal(t, socketProtocol, ws.Subprotocol())
 	})
-
-	t.Run("/ws ", func(t *testing.T) {
-		u := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[0].Id
+	t.Run("/ws authenticates with the first envelope", func(t *testing.T) {
+		u := "ws" + strings.TrimPrefix(s.URL, "http")
 		ws, _, err := websocket.DefaultDialer.Dial(u, nil)
 		assert.Nil(t, err)
 		defer ws.Close()
 
-		msg := MessageIn{
-			Text: "",
-		}
-		err = ws.WriteJSON(&msg)
-		assert.Nil(t, err)
+		sendEnvelope(t, ws, EnvelopeAuth, "a", &AuthIn{Token: accounts[0].Id})
+		env := readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		assert.Equal(t, "a", env.Id)
+		env = readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeSynced, env.Type)
 
-		response := map[string]string{}
-		err = ws.ReadJSON(&response)
-		assert.Nil(t, err)
-		assert.Equal(t, response["message"], "invalid message received")
+		// Authenticating twice isn't.
+		sendEnvelope(t, ws, EnvelopeAuth, "b", &AuthIn{Token: accounts[0].Id})
+		payload := &ErrorPayload{}
+		env = readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusBadRequest, payload.Code)
 	})
-	t.Run("/ws invalid uuid", func(t *testing.T) {
-		u := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[0].Id
+	t.Run("/ws without credentials ignores the token query", func(t *testing.T) {
+		u := "ws" + strings.TrimPrefix(s.URL, "http") + "?token=" + accounts[0].Id
 		ws, _, err := websocket.DefaultDialer.Dial(u, nil)
 		assert.Nil(t, err)
 		defer ws.Close()
 
-		msg := map[string]string{
-			"to":   "invalid uuid",
-			"text": "test message",
-		}
-		err = ws.WriteJSON(&msg)
-		assert.Nil(t, err)
+		sendEnvelope(t, ws, EnvelopeSend, "1", &MessageIn{ChatId: uuid.New(), Text: "hi"})
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, "1", env.Id)
+		assert.Equal(t, http.StatusUnauthorized, payload.Code)
 
-		response := map[string]string{}
-		err = ws.ReadJSON(&response)
-		assert.Nil(t, err)
-		assert.Equal(t, response["message"], "invalid message received")
+		_, _, err = ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
 	})
-	t.Run("/ws send to none existent account", func(t *testing.T) {
-		u := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[0].Id
+	t.Run("/ws rejects an invalid first envelope", func(t *testing.T) {
+		u := "ws" + strings.TrimPrefix(s.URL, "http")
 		ws, _, err := websocket.DefaultDialer.Dial(u, nil)
 		assert.Nil(t, err)
 		defer ws.Close()
 
-		msg := map[string]string{
-			"chat_id": uuid.NewString(),
+		sendEnvelope(t, ws, EnvelopeAuth, "a", &AuthIn{Token: uuid.NewString()})
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusUnauthorized, payload.Code)
+
+		_, _, err = ws.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	})
+
+	t.Run("/ws invalid envelope", func(t *testing.T) {
+		ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
+		defer ws.Close()
+
+		assert.Nil(t, ws.WriteMessage(websocket.TextMessage, []byte("not json")))
+
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusBadRequest, payload.Code)
+		assert.Equal(t, "invalid envelope received", payload.Message)
+	})
+	t.Run("/ws unsupported version", func(t *testing.T) {
+		ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
+		defer ws.Close()
+
+		assert.Nil(t, ws.WriteJSON(&Envelope{Version: 2, Type: EnvelopeSend, Id: "1"}))
+
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, "1", env.Id)
+		assert.Equal(t, "unsupported protocol version 2", payload.Message)
+	})
+	t.Run("/ws invalid payload", func(t *testing.T) {
+		ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
+		defer ws.Close()
+
+		sendEnvelope(t, ws, EnvelopeSend, "1", map[string]string{
+			"chat_id": "invalid uuid",
 			"text":    "test message",
-		}
-		err = ws.WriteJSON(&msg)
-		assert.Nil(t, err)
+		})
 
-		response := map[string]string{}
-		err = ws.ReadJSON(&response)
-		assert.Nil(t, err)
-		assert.Equal(t, "chat not found", response["message"])
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusBadRequest, payload.Code)
+	})
+	t.Run("/ws server only type", func(t *testing.T) {
+		ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
+		defer ws.Close()
+
+		sendEnvelope(t, ws, EnvelopeAck, "1", &Message{})
+
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, `"ack" can't be sent by clients`, payload.Message)
 	})
 	t.Run("/ws send to none existent chat", func(t *testing.T) {
-		u := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[0].Id
-		ws, _, err := websocket.DefaultDialer.Dial(u, nil)
-		assert.Nil(t, err)
+		ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
 		defer ws.Close()
 
-		msg := map[string]string{
-			"chat_id": uuid.NewString(),
-			"text":    "test message",
-		}
-		err = ws.WriteJSON(&msg)
-		assert.Nil(t, err)
+		sendEnvelope(t, ws, EnvelopeSend, "1", &MessageIn{ChatId: uuid.New(), Text: "test message"})
 
-		response := map[string]string{}
-		err = ws.ReadJSON(&response)
-		assert.Nil(t, err)
-		assert.Equal(t, "chat not found", response["message"])
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, "1", env.Id)
+		assert.Equal(t, http.StatusNotFound, payload.Code)
+		assert.Equal(t, "chat not found", payload.Message)
 	})
 	t.Run("/ws send to online account", func(t *testing.T) {
-		u1 := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[0].Id
-		ws1, _, err := websocket.DefaultDialer.Dial(u1, nil)
-		assert.Nil(t, err)
+		ws1 := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[0].Id)
 		defer ws1.Close()
 
-		u2 := ("ws" + strings.TrimPrefix(s.URL, "http")) + "?token=" + accounts[1].Id
-		ws2, _, err := websocket.DefaultDialer.Dial(u2, nil)
-		assert.Nil(t, err)
+		ws2 := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), accounts[1].Id)
 		defer ws2.Close()
 
 		// Create chat room first
@@ -239,36 +527,2278 @@ func TestServer(t *testing.T) {
 		chat := &Chat{}
 		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
 
-		msg := map[string]string{
-			"chat_id": chat.Id.String(),
-			"text":    "test message",
-		}
-		err = ws1.WriteJSON(&msg)
+		sendEnvelope(t, ws1, EnvelopeSend, "msg-1", &MessageIn{ChatId: chat.Id, Text: "test message"})
+
+		recvMsg := &Message{}
+		env := readEnvelope(t, ws2, recvMsg)
+		assert.Equal(t, EnvelopeType(EventMessage), env.Type)
+		assert.Equal(t, "test message", recvMsg.Text)
+
+		acked := &Message{}
+		env = readEnvelope(t, ws1, acked)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		assert.Equal(t, "msg-1", env.Id)
+		assert.Equal(t, recvMsg.Id, acked.Id)
+
+		sendEnvelope(t, ws2, EnvelopeSend, "msg-1", &MessageIn{ChatId: chat.Id, Text: "test message2"})
+
+		recvMsg2 := &Message{}
+		readEnvelope(t, ws1, recvMsg2)
+		assert.Equal(t, "test message2", recvMsg2.Text)
+		assert.Equal(t, "msg-1", recvMsg2.ClientId)
+	})
+	t.Run("/ws resending is idempotent", func(t *testing.T) {
+		base := "ws" + strings.TrimPrefix(s.URL, "http")
+		ws1 := dialWS(t, base, accounts[0].Id)
+		defer ws1.Close()
+		ws2 := dialWS(t, base, accounts[1].Id)
+		defer ws2.Close()
+
+		chat, err := service.CreateChat(ctx, uuid.MustParse(accounts[0].Id), &ChatIn{
+			Members:   []uuid.UUID{uuid.MustParse(accounts[1].Id), uuid.MustParse(accounts[2].Id), uuid.MustParse(accounts[3].Id), uuid.MustParse(accounts[4].Id)},
+			IsPrivate: false,
+		})
 		assert.Nil(t, err)
 
-		var recvMsg Message
-		err = ws2.ReadJSON(&recvMsg)
+		first, second := &Message{}, &Message{}
+		sendEnvelope(t, ws1, EnvelopeSend, "retry", &MessageIn{ChatId: chat.Id, Text: "once"})
+		readEnvelope(t, ws1, first)
+		// The client didn't see the ack and sends it again.
+		sendEnvelope(t, ws1, EnvelopeSend, "retry", &MessageIn{ChatId: chat.Id, Text: "once"})
+		env := readEnvelope(t, ws1, second)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		assert.Equal(t, first.Id, second.Id)
+
+		// The recipient gets it once, the next message comes right after.
+		sendEnvelope(t, ws1, EnvelopeSend, "next", &MessageIn{ChatId: chat.Id, Text: "next"})
+		readEnvelope(t, ws1, nil)
+
+		msg := &Message{}
+		readEnvelope(t, ws2, msg)
+		assert.Equal(t, "once", msg.Text)
+		readEnvelope(t, ws2, msg)
+		assert.Equal(t, "next", msg.Text)
+	})
+	t.Run("/ws multiple devices", func(t *testing.T) {
+		base := "ws" + strings.TrimPrefix(s.URL, "http")
+		phone := dialWS(t, base+"?device=phone", accounts[0].Id)
+		defer phone.Close()
+
+		laptop := dialWS(t, base+"?device=laptop", accounts[0].Id)
+		defer laptop.Close()
+
+		ws2 := dialWS(t, base, accounts[1].Id)
+		defer ws2.Close()
+
+		chat, err := service.CreateChat(ctx, uuid.MustParse(accounts[0].Id), &ChatIn{
+			Members:   []uuid.UUID{uuid.MustParse(accounts[1].Id), uuid.MustParse(accounts[2].Id)},
+			IsPrivate: false,
+		})
 		assert.Nil(t, err)
 
-		assert.Equal(t, recvMsg.Text, "test message")
+		sendEnvelope(t, phone, EnvelopeSend, "1", &MessageIn{ChatId: chat.Id, Text: "from phone"})
+
+		// The recipient and the sender's other device get the message.
+		recvMsg := &Message{}
+		readEnvelope(t, ws2, recvMsg)
+		assert.Equal(t, "from phone", recvMsg.Text)
+
+		syncMsg := &Message{}
+		readEnvelope(t, laptop, syncMsg)
+		assert.Equal(t, "from phone", syncMsg.Text)
+
+		// The sending device only gets the acknowledgement.
+		env := readEnvelope(t, phone, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+	})
+	t.Run("/ws edit and delete", func(t *testing.T) {
+		base := "ws" + strings.TrimPrefix(s.URL, "http")
+		ws1 := dialWS(t, base, accounts[0].Id)
+		defer ws1.Close()
+		ws2 := dialWS(t, base, accounts[1].Id)
+		defer ws2.Close()
 
-		response := map[string]string{}
-		err = ws1.ReadJSON(&response)
+		chat, err := service.CreateChat(ctx, uuid.MustParse(accounts[0].Id), &ChatIn{
+			Members:   []uuid.UUID{uuid.MustParse(accounts[1].Id), uuid.MustParse(accounts[2].Id), uuid.MustParse(accounts[3].Id)},
+			IsPrivate: false,
+		})
 		assert.Nil(t, err)
-		assert.Equal(t, "sended", response["message"])
 
-		msg = map[string]string{
-			"chat_id": chat.Id.String(),
-			"text":    "test message2",
+		sendEnvelope(t, ws1, EnvelopeSend, "1", &MessageIn{ChatId: chat.Id, Text: "typo"})
+		msg := &Message{}
+		readEnvelope(t, ws2, msg)
+		readEnvelope(t, ws1, nil)
+
+		sendEnvelope(t, ws1, EnvelopeEdit, "2", &EditIn{ChatId: chat.Id, MessageId: msg.Id, Text: "fixed"})
+		edited := &Message{}
+		env := readEnvelope(t, ws2, edited)
+		assert.Equal(t, EnvelopeType(EventMessageEdited), env.Type)
+		assert.Equal(t, "fixed", edited.Text)
+		env = readEnvelope(t, ws1, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		assert.Equal(t, "2", env.Id)
+
+		sendEnvelope(t, ws1, EnvelopeDelete, "3", &DeleteIn{ChatId: chat.Id, MessageId: msg.Id, ForEveryone: true})
+		deleted := &Message{}
+		env = readEnvelope(t, ws2, deleted)
+		assert.Equal(t, EnvelopeType(EventMessageDeleted), env.Type)
+		assert.Equal(t, msg.Id, deleted.Id)
+		env = readEnvelope(t, ws1, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		assert.Empty(t, env.Payload)
+	})
+}
+
+// socketDialer opens the chat socket with the token offered as subprotocol,
+// the way clients authenticate.
+func socketDialer(token string) *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{socketProtocol, "bearer." + token}
+	return &dialer
+}
+
+// dialWS connects to the chat socket and waits for the resync to finish.
+func dialWS(t *testing.T, u, token string) *websocket.Conn {
+	ws, _, err := socketDialer(token).Dial(u, nil)
+	assert.Nil(t, err)
+	env := readEnvelope(t, ws, nil)
+	assert.Equal(t, EnvelopeSynced, env.Type)
+	return ws
+}
+
+// sendEnvelope writes an envelope of the current protocol version.
+func sendEnvelope(t *testing.T, ws *websocket.Conn, envelopeType EnvelopeType, id string, payload any) {
+	env, err := NewEnvelope(envelopeType, id, payload)
+	assert.Nil(t, err)
+	assert.Nil(t, ws.WriteJSON(env))
+}
+
+// readEnvelope reads the next envelope and decodes its payload into v,
+// unless v is nil. Presence events, which arrive whenever contacts connect,
+// are skipped.
+func readEnvelope(t *testing.T, ws *websocket.Conn, v any) *Envelope {
+	for {
+		env := &Envelope{}
+		if !assert.Nil(t, ws.ReadJSON(env)) {
+			return env
+		}
+		if env.Type == EnvelopeType(EventPresence) {
+			continue
+		}
+		assert.Equal(t, ProtocolVersion, env.Version)
+		if v != nil {
+			assert.Nil(t, env.Decode(v))
+		}
+		return env
+	}
+}
+
+// readPresence reads up to the next presence event.
+func readPresence(t *testing.T, ws *websocket.Conn) *PresencePayload {
+	for {
+		env := &Envelope{}
+		if !assert.Nil(t, ws.ReadJSON(env)) {
+			return nil
+		}
+		if env.Type == EnvelopeType(EventPresence) {
+			presence := &PresencePayload{}
+			assert.Nil(t, env.Decode(presence))
+			return presence
+		}
+	}
+}
+
+func TestOfflineDelivery(t *testing.T) {
+	sender, recipient, friend := uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: sender.String(), Username: "sender"},
+		&types.Account{Id: recipient.String(), Username: "recipient"},
+		&types.Account{Id: friend.String(), Username: "friend"},
+	)
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+	ctx := context.Background()
+	phoneURL := "ws" + strings.TrimPrefix(s.URL, "http") + "?device=phone"
+
+	chat, err := service.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{recipient}, IsPrivate: true})
+	assert.Nil(t, err)
+	send := func(text string) *Message {
+		msg, err := service.Deliver(ctx, sender, "", MessageIn{ChatId: chat.Id, Text: text})
+		assert.Nil(t, err)
+		return msg
+	}
+	// reconnect dials the phone again and collects what was resent.
+	reconnect := func() (*websocket.Conn, []string) {
+		ws, _, err := socketDialer(recipient.String()).Dial(phoneURL, nil)
+		assert.Nil(t, err)
+		texts := []string{}
+		for {
+			msg := &Message{}
+			env := readEnvelope(t, ws, msg)
+			if env.Type == EnvelopeSynced {
+				return ws, texts
+			}
+			texts = append(texts, msg.Text)
 		}
-		err = ws2.WriteJSON(&msg)
+	}
+	// disconnect waits until the server let go of the connection.
+	disconnect := func(ws *websocket.Conn) {
+		ws.Close()
+		assert.Eventually(t, func() bool {
+			devices, err := service.GetDevices(ctx, recipient)
+			return err == nil && len(devices) == 0
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	send("before the phone was seen")
+
+	t.Run("new device isn't sent old messages", func(t *testing.T) {
+		ws, texts := reconnect()
+		assert.Empty(t, texts)
+
+		msg := send("live")
+		received := &Message{}
+		readEnvelope(t, ws, received)
+		assert.Equal(t, "live", received.Text)
+
+		sendEnvelope(t, ws, EnvelopeReceived, "r1", &ReceivedIn{ChatId: chat.Id, Seq: msg.Seq})
+		env := readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		disconnect(ws)
+	})
+	t.Run("missed messages are resent", func(t *testing.T) {
+		send("offline 1")
+		send("offline 2")
+
+		ws, texts := reconnect()
+		assert.Equal(t, []string{"offline 1", "offline 2"}, texts)
+		// Nothing is confirmed before the connection drops.
+		disconnect(ws)
+	})
+	t.Run("unconfirmed messages are resent again", func(t *testing.T) {
+		ws, texts := reconnect()
+		assert.Equal(t, []string{"offline 1", "offline 2"}, texts)
+
+		page, err := service.GetMessages(ctx, recipient, "", chat.Id, "", 2)
 		assert.Nil(t, err)
+		// Only the first one is confirmed.
+		sendEnvelope(t, ws, EnvelopeReceived, "r2", &ReceivedIn{ChatId: chat.Id, Seq: page.Messages[1].Seq})
+		readEnvelope(t, ws, nil)
+		disconnect(ws)
+
+		ws, texts = reconnect()
+		assert.Equal(t, []string{"offline 2"}, texts)
+
+		sendEnvelope(t, ws, EnvelopeReceived, "r3", &ReceivedIn{ChatId: chat.Id, Seq: page.Messages[0].Seq})
+		readEnvelope(t, ws, nil)
+		disconnect(ws)
 
-		recvMsg2 := Message{}
-		err = ws1.ReadJSON(&recvMsg2)
+		ws, texts = reconnect()
+		assert.Empty(t, texts)
+		disconnect(ws)
+	})
+	t.Run("new chats are resent from the start", func(t *testing.T) {
+		other, err := service.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{recipient, friend}})
+		assert.Nil(t, err)
+		_, err = service.Deliver(ctx, sender, "", MessageIn{ChatId: other.Id, Text: "new chat"})
 		assert.Nil(t, err)
 
-		assert.Equal(t, recvMsg2.Text, "test message2")
+		ws, texts := reconnect()
+		assert.Equal(t, []string{"new chat"}, texts)
+		disconnect(ws)
+	})
+	t.Run("confirming a message that doesn't exist", func(t *testing.T) {
+		ws, _ := reconnect()
+		defer disconnect(ws)
+
+		sendEnvelope(t, ws, EnvelopeReceived, "r4", &ReceivedIn{ChatId: chat.Id, Seq: 1000})
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, ws, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusBadRequest, payload.Code)
+	})
+}
+
+func TestReceipts(t *testing.T) {
+	sender, reader, friend := uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: sender.String(), Username: "sender"},
+		&types.Account{Id: reader.String(), Username: "reader"},
+		&types.Account{Id: friend.String(), Username: "friend"},
+	)
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+	ctx := context.Background()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	direct, err := service.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{reader}, IsPrivate: true})
+	assert.Nil(t, err)
+	group, err := service.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{reader, friend}})
+	assert.Nil(t, err)
+	empty, err := service.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{reader, friend}})
+	assert.Nil(t, err)
+
+	// Inserted directly to control which chat was active last.
+	sentAt := time.Now().UTC().Round(time.Second).Add(-time.Minute)
+	for i, chatId := range []uuid.UUID{direct.Id, direct.Id, direct.Id, group.Id} {
+		msg := &Message{FromAccountId: sender, Text: fmt.Sprint(i), CreatedAt: sentAt.Add(time.Duration(i) * time.Second)}
+		assert.Nil(t, storage.InsertMessage(ctx, chatId, msg))
+	}
+	_, err = service.Deliver(ctx, reader, "", MessageIn{ChatId: direct.Id, Text: "reply"})
+	assert.Nil(t, err)
+
+	getInbox := func() []*InboxChat {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/chat/inbox", nil)
+		r.Header.Set("Authorization", reader.String())
+		assert.Nil(t, server.getInbox(ctx, w, r))
+		inbox := []*InboxChat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&inbox))
+		return inbox
+	}
+
+	t.Run("inbox", func(t *testing.T) {
+		inbox := getInbox()
+		assert.Len(t, inbox, 3)
+		assert.Equal(t, direct.Id, inbox[0].Id)
+		assert.Equal(t, "reply", inbox[0].LastMessage.Text)
+		// The reader's own reply doesn't count.
+		assert.Equal(t, int64(3), inbox[0].UnreadCount)
+		assert.Equal(t, group.Id, inbox[1].Id)
+		assert.Equal(t, "3", inbox[1].LastMessage.Text)
+		assert.Equal(t, int64(1), inbox[1].UnreadCount)
+		assert.Equal(t, empty.Id, inbox[2].Id)
+		assert.Nil(t, inbox[2].LastMessage)
+		assert.Equal(t, int64(0), inbox[2].UnreadCount)
+	})
+
+	senderWS := dialWS(t, wsURL+"?device=phone", sender.String())
+	defer senderWS.Close()
+	readerWS := dialWS(t, wsURL+"?device=phone", reader.String())
+	defer readerWS.Close()
+	readerLaptop := dialWS(t, wsURL+"?device=laptop", reader.String())
+	defer readerLaptop.Close()
+
+	t.Run("receipts are sent to the other members", func(t *testing.T) {
+		sendEnvelope(t, readerWS, EnvelopeReceived, "r1", &ReceivedIn{ChatId: direct.Id, Seq: 3})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, readerWS, nil).Type)
+		receipt := &ReceiptPayload{}
+		env := readEnvelope(t, senderWS, receipt)
+		assert.Equal(t, EnvelopeType(EventDeliveryReceipt), env.Type)
+		assert.Equal(t, ReceiptPayload{ChatId: direct.Id, AccountId: reader, Seq: 3}, *receipt)
+
+		sendEnvelope(t, readerWS, EnvelopeRead, "r2", &ReadIn{ChatId: direct.Id, Seq: 2})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, readerWS, nil).Type)
+		env = readEnvelope(t, senderWS, receipt)
+		assert.Equal(t, EnvelopeType(EventReadReceipt), env.Type)
+		assert.Equal(t, ReceiptPayload{ChatId: direct.Id, AccountId: reader, Seq: 2}, *receipt)
+
+		// The reader's other devices learn about it too.
+		env = readEnvelope(t, readerLaptop, nil)
+		assert.Equal(t, EnvelopeType(EventDeliveryReceipt), env.Type)
+		env = readEnvelope(t, readerLaptop, receipt)
+		assert.Equal(t, EnvelopeType(EventReadReceipt), env.Type)
+		assert.Equal(t, int64(2), receipt.Seq)
+	})
+	t.Run("receipts are only sent when they move", func(t *testing.T) {
+		// Already delivered to the phone.
+		sendEnvelope(t, readerLaptop, EnvelopeReceived, "r3", &ReceivedIn{ChatId: direct.Id, Seq: 2})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, readerLaptop, nil).Type)
+		sendEnvelope(t, readerLaptop, EnvelopeRead, "r4", &ReadIn{ChatId: direct.Id, Seq: 1})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, readerLaptop, nil).Type)
+
+		// Reading delivers as well, the next receipt is the only one.
+		sendEnvelope(t, readerLaptop, EnvelopeRead, "r5", &ReadIn{ChatId: group.Id, Seq: 1})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, readerLaptop, nil).Type)
+		receipt := &ReceiptPayload{}
+		env := readEnvelope(t, senderWS, receipt)
+		assert.Equal(t, EnvelopeType(EventReadReceipt), env.Type)
+		assert.Equal(t, group.Id, receipt.ChatId)
+		readEnvelope(t, readerWS, nil)
+	})
+	t.Run("invalid read", func(t *testing.T) {
+		sendEnvelope(t, readerWS, EnvelopeRead, "r6", &ReadIn{ChatId: empty.Id, Seq: 1})
+		payload := &ErrorPayload{}
+		env := readEnvelope(t, readerWS, payload)
+		assert.Equal(t, EnvelopeError, env.Type)
+		assert.Equal(t, http.StatusBadRequest, payload.Code)
+	})
+	t.Run("read over REST", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/chat/"+direct.Id.String()+"/read", strings.NewReader(`{"seq": 4}`))
+		r.Header.Set("Authorization", reader.String())
+		r = mux.SetURLVars(r, map[string]string{"id": direct.Id.String()})
+		assert.Nil(t, server.markRead(ctx, w, r))
+
+		receipt := &ReceiptPayload{}
+		readEnvelope(t, senderWS, receipt)
+		assert.Equal(t, int64(4), receipt.Seq)
+		readEnvelope(t, readerWS, nil)
+		readEnvelope(t, readerLaptop, nil)
+	})
+	t.Run("chat receipts", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/chat/"+direct.Id.String()+"/receipts", nil)
+		r.Header.Set("Authorization", sender.String())
+		r = mux.SetURLVars(r, map[string]string{"id": direct.Id.String()})
+		assert.Nil(t, server.getReceipts(ctx, w, r))
+
+		receipts := []*Receipt{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&receipts))
+		assert.ElementsMatch(t, []*Receipt{
+			{ChatId: direct.Id, AccountId: reader, LastReadSeq: 4, LastDeliveredSeq: 4},
+			{ChatId: direct.Id, AccountId: sender},
+		}, receipts)
+
+		r = httptest.NewRequest(http.MethodGet, "/chat/"+direct.Id.String()+"/receipts", nil)
+		r.Header.Set("Authorization", uuid.NewString())
+		r = mux.SetURLVars(r, map[string]string{"id": direct.Id.String()})
+		err := server.getReceipts(ctx, httptest.NewRecorder(), r)
+		assert.NotNil(t, err)
+	})
+	t.Run("inbox after reading", func(t *testing.T) {
+		inbox := getInbox()
+		assert.Equal(t, int64(4), inbox[0].LastReadSeq)
+		assert.Equal(t, int64(0), inbox[0].UnreadCount)
+		assert.Equal(t, int64(0), inbox[1].UnreadCount)
+	})
+}
 
+func TestPresence(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+	ctx := context.Background()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	_, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob}, IsPrivate: true})
+	assert.Nil(t, err)
+
+	getPresence := func(viewer uuid.UUID, accountId uuid.UUID) *PresencePayload {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/chat/presence?ids="+accountId.String(), nil)
+		r.Header.Set("Authorization", viewer.String())
+		assert.Nil(t, server.getPresence(ctx, w, r))
+		presences := []*PresencePayload{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&presences))
+		assert.Len(t, presences, 1)
+		return presences[0]
+	}
+	setPrivacy := func(accountId uuid.UUID, visibility PresenceVisibility) {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(fmt.Sprintf(`{"presence": %q}`, visibility))
+		r := httptest.NewRequest(http.MethodPut, "/chat/me/privacy", body)
+		r.Header.Set("Authorization", accountId.String())
+		assert.Nil(t, server.updatePrivacySettings(ctx, w, r))
+	}
+
+	bobWS := dialWS(t, wsURL+"?device=phone", bob.String())
+	defer bobWS.Close()
+	var alicePhone, aliceLaptop *websocket.Conn
+
+	t.Run("contacts see the account come online", func(t *testing.T) {
+		alicePhone = dialWS(t, wsURL+"?device=phone", alice.String())
+		presence := readPresence(t, bobWS)
+		assert.Equal(t, PresencePayload{AccountId: alice, Status: StatusOnline}, *presence)
+	})
+	t.Run("away when every device is", func(t *testing.T) {
+		aliceLaptop = dialWS(t, wsURL+"?device=laptop", alice.String())
+
+		sendEnvelope(t, alicePhone, EnvelopeStatus, "s1", &StatusIn{Status: StatusAway})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, alicePhone, nil).Type)
+		sendEnvelope(t, aliceLaptop, EnvelopeStatus, "s2", &StatusIn{Status: StatusAway})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, aliceLaptop, nil).Type)
+		// Only the second one changed alice's status.
+		assert.Equal(t, StatusAway, readPresence(t, bobWS).Status)
+		assert.Equal(t, StatusAway, getPresence(bob, alice).Status)
+
+		sendEnvelope(t, aliceLaptop, EnvelopeStatus, "s3", &StatusIn{Status: StatusOnline})
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, aliceLaptop, nil).Type)
+		assert.Equal(t, StatusOnline, readPresence(t, bobWS).Status)
+	})
+	t.Run("offline with last seen", func(t *testing.T) {
+		alicePhone.Close()
+		aliceLaptop.Close()
+		// Alice is away in between if the laptop is handled first.
+		presence := readPresence(t, bobWS)
+		if presence.Status == StatusAway {
+			presence = readPresence(t, bobWS)
+		}
+		assert.Equal(t, StatusOffline, presence.Status)
+		assert.NotNil(t, presence.LastSeen)
+
+		presence = getPresence(bob, alice)
+		assert.Equal(t, StatusOffline, presence.Status)
+		assert.NotNil(t, presence.LastSeen)
+	})
+	t.Run("visible to contacts only", func(t *testing.T) {
+		setPrivacy(alice, VisibleToContacts)
+		assert.NotNil(t, getPresence(bob, alice).LastSeen)
+		assert.Equal(t, &PresencePayload{AccountId: alice, Status: StatusOffline}, getPresence(carol, alice))
+		// The account always sees its own presence.
+		assert.NotNil(t, getPresence(alice, alice).LastSeen)
+	})
+	t.Run("visible to nobody", func(t *testing.T) {
+		setPrivacy(alice, VisibleToNobody)
+		// Contacts stop seeing when alice was last seen.
+		assert.Equal(t, PresencePayload{AccountId: alice, Status: StatusOffline}, *readPresence(t, bobWS))
+		assert.Equal(t, &PresencePayload{AccountId: alice, Status: StatusOffline}, getPresence(bob, alice))
+
+		alicePhone = dialWS(t, wsURL+"?device=phone", alice.String())
+		defer alicePhone.Close()
+		assert.Equal(t, StatusOffline, getPresence(bob, alice).Status)
+
+		// Bob only hears about alice again once she shows her presence.
+		setPrivacy(alice, VisibleToEveryone)
+		assert.Equal(t, PresencePayload{AccountId: alice, Status: StatusOnline}, *readPresence(t, bobWS))
+
+		setPrivacy(alice, VisibleToNobody)
+		assert.Equal(t, PresencePayload{AccountId: alice, Status: StatusOffline}, *readPresence(t, bobWS))
 	})
+	t.Run("invalid privacy settings", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/chat/me/privacy", strings.NewReader(`{"presence": "friends"}`))
+		r.Header.Set("Authorization", alice.String())
+		err := server.updatePrivacySettings(ctx, httptest.NewRecorder(), r)
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+	})
+}
+
+func TestTyping(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	service.typing = newTypingTracker(time.Hour, 100*time.Millisecond)
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+	ctx := context.Background()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	chat, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob}, IsPrivate: true})
+	assert.Nil(t, err)
+	aliceWS := dialWS(t, wsURL, alice.String())
+	defer aliceWS.Close()
+	bobWS := dialWS(t, wsURL, bob.String())
+	defer bobWS.Close()
+
+	typing := func(id string, chatId uuid.UUID, typing bool) {
+		sendEnvelope(t, aliceWS, EnvelopeType(EventTyping), id, &TypingPayload{ChatId: chatId, Typing: typing})
+	}
+
+	t.Run("refreshes are rate limited and expire", func(t *testing.T) {
+		typing("t1", chat.Id, true)
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, aliceWS, nil).Type)
+		payload := &TypingPayload{}
+		env := readEnvelope(t, bobWS, payload)
+		assert.Equal(t, EnvelopeType(EventTyping), env.Type)
+		assert.Equal(t, TypingPayload{ChatId: chat.Id, AccountId: alice, Typing: true}, *payload)
+
+		typing("t2", chat.Id, true)
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, aliceWS, nil).Type)
+
+		// The refresh wasn't sent, the next event is the expiry.
+		readEnvelope(t, bobWS, payload)
+		assert.False(t, payload.Typing)
+	})
+	t.Run("stop", func(t *testing.T) {
+		typing("t3", chat.Id, true)
+		readEnvelope(t, aliceWS, nil)
+		readEnvelope(t, bobWS, nil)
+
+		typing("t4", chat.Id, false)
+		assert.Equal(t, EnvelopeAck, readEnvelope(t, aliceWS, nil).Type)
+		payload := &TypingPayload{}
+		readEnvelope(t, bobWS, payload)
+		assert.False(t, payload.Typing)
+
+		// Stopping again isn't sent.
+		typing("t5", chat.Id, false)
+		readEnvelope(t, aliceWS, nil)
+		typing("t6", chat.Id, true)
+		readEnvelope(t, aliceWS, nil)
+		readEnvelope(t, bobWS, payload)
+		assert.True(t, payload.Typing)
+	})
+	t.Run("not a member", func(t *testing.T) {
+		other, err := service.CreateChat(ctx, bob, &ChatIn{Members: []uuid.UUID{carol}, IsPrivate: true})
+		assert.Nil(t, err)
+		typing("t7", other.Id, true)
+		payload := &ErrorPayload{}
+		assert.Equal(t, EnvelopeError, readEnvelope(t, aliceWS, payload).Type)
+		assert.Equal(t, http.StatusForbidden, payload.Code)
+	})
+}
+
+func TestGroupAdministration(t *testing.T) {
+	owner, admin, member, outsider, newcomer := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: newcomer.String(), Username: "newcomer"},
+		&types.Account{Id: owner.String(), Username: "owner"},
+		&types.Account{Id: admin.String(), Username: "admin"},
+		&types.Account{Id: member.String(), Username: "member"},
+		&types.Account{Id: outsider.String(), Username: "outsider"},
+	)
+	server.MediaURL = "http://media/media"
+	ctx := context.Background()
+
+	group, err := service.CreateChat(ctx, owner, &ChatIn{Members: []uuid.UUID{admin, member}, Title: "group"})
+	assert.Nil(t, err)
+	assert.Equal(t, RoleOwner, group.RoleOf(owner))
+
+	memberConn, err := service.Connect(ctx, member, "phone")
+	assert.Nil(t, err)
+	nextSystem := func() *SystemMessage {
+		for {
+			select {
+			case event := <-memberConn.Events():
+				if event.Type == EventPresence {
+					continue
+				}
+				assert.Equal(t, EventMessage, event.Type)
+				return event.Message.System
+			case <-time.After(time.Second):
+				t.Fatal("no event received")
+			}
+			return nil
+		}
+	}
+
+	type handler func(context.Context, http.ResponseWriter, *http.Request) error
+	request := func(h handler, account uuid.UUID, vars map[string]string, body any) (*httptest.ResponseRecorder, error) {
+		payload, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		r.Header.Set("Authorization", account.String())
+		if vars == nil {
+			vars = map[string]string{}
+		}
+		if vars["id"] == "" {
+			vars["id"] = group.Id.String()
+		}
+		return w, h(ctx, w, mux.SetURLVars(r, vars))
+	}
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+
+	t.Run("only the owner sets roles", func(t *testing.T) {
+		vars := map[string]string{"account_id": admin.String()}
+		_, err := request(server.setRole, admin, vars, RoleIn{Role: RoleAdmin})
+		assert.Equal(t, http.StatusForbidden, statusOf(err))
+
+		_, err = request(server.setRole, owner, vars, RoleIn{Role: RoleAdmin})
+		assert.Nil(t, err)
+		assert.Equal(t, &SystemMessage{Type: SystemRoleChanged, Members: []uuid.UUID{admin}, Role: RoleAdmin}, nextSystem())
+
+		_, err = request(server.setRole, owner, map[string]string{"account_id": owner.String()}, RoleIn{Role: RoleMember})
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+	})
+	t.Run("admins rename", func(t *testing.T) {
+		title := "renamed"
+		_, err := request(server.updateChatInfo, member, nil, ChatInfoIn{Title: &title})
+		assert.Equal(t, http.StatusForbidden, statusOf(err))
+
+		avatar := "http://elsewhere/avatar.png"
+		_, err = request(server.updateChatInfo, admin, nil, ChatInfoIn{Avatar: &avatar})
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+
+		avatar = "http://media/media/avatar.png"
+		w, err := request(server.updateChatInfo, admin, nil, ChatInfoIn{Title: &title, Avatar: &avatar})
+		assert.Nil(t, err)
+		chat := &Chat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
+		assert.Equal(t, "renamed", chat.Title)
+		assert.Equal(t, avatar, chat.Avatar)
+		assert.Equal(t, &SystemMessage{Type: SystemInfoChanged, Title: "renamed"}, nextSystem())
+	})
+	t.Run("add and remove members", func(t *testing.T) {
+		_, err := request(server.addMembers, admin, nil, MembersIn{Members: []uuid.UUID{uuid.New()}})
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+
+		_, err = request(server.addMembers, admin, nil, MembersIn{Members: []uuid.UUID{newcomer, member, newcomer}})
+		assert.Nil(t, err)
+		assert.Equal(t, &SystemMessage{Type: SystemMembersAdded, Members: []uuid.UUID{newcomer}}, nextSystem())
+
+		// Admins can't remove other admins.
+		_, err = request(server.removeMember, admin, map[string]string{"account_id": owner.String()}, nil)
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+		_, err = request(server.removeMember, member, map[string]string{"account_id": newcomer.String()}, nil)
+		assert.Equal(t, http.StatusForbidden, statusOf(err))
+		_, err = request(server.removeMember, admin, map[string]string{"account_id": outsider.String()}, nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+
+		_, err = request(server.removeMember, admin, map[string]string{"account_id": newcomer.String()}, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, &SystemMessage{Type: SystemMemberRemoved, Members: []uuid.UUID{newcomer}}, nextSystem())
+	})
+	t.Run("system messages can't be changed", func(t *testing.T) {
+		page, err := service.GetMessages(ctx, admin, "", group.Id, "", 1)
+		assert.Nil(t, err)
+		msg := page.Messages[0]
+		assert.NotNil(t, msg.System)
+
+		_, err = service.EditMessage(ctx, admin, "", group.Id, msg.Id, "edited", nil)
+		assert.ErrorIs(t, err, ErrSystemMessage)
+		assert.ErrorIs(t, service.DeleteMessage(ctx, admin, "", group.Id, msg.Id, true), ErrSystemMessage)
+	})
+	t.Run("invites", func(t *testing.T) {
+		_, err := request(server.createInvite, member, nil, InviteIn{})
+		assert.Equal(t, http.StatusForbidden, statusOf(err))
+
+		w, err := request(server.createInvite, admin, nil, InviteIn{ExpiresIn: 60})
+		assert.Nil(t, err)
+		invite := &Invite{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(invite))
+		assert.Equal(t, time.Minute, invite.ExpiresAt.Sub(invite.CreatedAt))
+
+		w, err = request(server.getInvites, owner, nil, nil)
+		assert.Nil(t, err)
+		invites := []*Invite{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&invites))
+		assert.Len(t, invites, 1)
+
+		w, err = request(server.joinChat, outsider, map[string]string{"code": invite.Code}, nil)
+		assert.Nil(t, err)
+		chat := &Chat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
+		assert.Contains(t, chat.Members, outsider)
+		assert.Equal(t, &SystemMessage{Type: SystemMemberJoined, Members: []uuid.UUID{outsider}}, nextSystem())
+
+		_, err = request(server.revokeInvite, admin, map[string]string{"code": invite.Code}, nil)
+		assert.Nil(t, err)
+		_, err = request(server.joinChat, member, map[string]string{"code": invite.Code}, nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+
+		expired := &Invite{Code: "expired", ChatId: group.Id, ExpiresAt: time.Now().Add(-time.Minute)}
+		assert.Nil(t, storage.InsertInvite(ctx, expired))
+		_, err = request(server.joinChat, member, map[string]string{"code": expired.Code}, nil)
+		assert.Equal(t, http.StatusGone, statusOf(err))
+	})
+	t.Run("transfer ownership and leave", func(t *testing.T) {
+		_, err := request(server.leaveChat, owner, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+
+		_, err = request(server.transferOwnership, owner, nil, OwnerIn{AccountId: admin})
+		assert.Nil(t, err)
+		assert.Equal(t, &SystemMessage{Type: SystemOwnerChanged, Members: []uuid.UUID{admin}}, nextSystem())
+
+		_, err = request(server.leaveChat, owner, nil, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, &SystemMessage{Type: SystemMemberLeft, Members: []uuid.UUID{owner}}, nextSystem())
+
+		chat, err := storage.GetChat(ctx, group.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, RoleOwner, chat.RoleOf(admin))
+		assert.NotContains(t, chat.Members, owner)
+		assert.NotContains(t, chat.Admins, owner)
+	})
+	t.Run("private chats have no administration", func(t *testing.T) {
+		direct, err := service.CreateChat(ctx, owner, &ChatIn{Members: []uuid.UUID{member}, IsPrivate: true})
+		assert.Nil(t, err)
+		_, err = request(server.leaveChat, owner, map[string]string{"id": direct.Id.String()}, nil)
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+	})
+}
+
+func TestMessageRequests(t *testing.T) {
+	alice, bob, carol, dave := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+		&types.Account{Id: dave.String(), Username: "dave"},
+	)
+	auth := server.Auth.(fakeAuth)
+	auth.Follow(bob.String(), alice.String())
+	auth.Follow(alice.String(), dave.String())
+	ctx := context.Background()
+
+	type handler func(context.Context, http.ResponseWriter, *http.Request) error
+	request := func(h handler, account uuid.UUID, vars map[string]string, body any) (*httptest.ResponseRecorder, error) {
+		payload, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		r.Header.Set("Authorization", account.String())
+		return w, h(ctx, w, mux.SetURLVars(r, vars))
+	}
+	direct := func(account, other uuid.UUID) *Chat {
+		w, err := request(server.getDirectChat, account, map[string]string{"account_id": other.String()}, nil)
+		assert.Nil(t, err)
+		chat := &Chat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(chat))
+		return chat
+	}
+	chats := func(h handler, account uuid.UUID) []*InboxChat {
+		w, err := request(h, account, nil, nil)
+		assert.Nil(t, err)
+		inbox := []*InboxChat{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&inbox))
+		return inbox
+	}
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+
+	_, err := request(server.updatePrivacySettings, alice, nil, PrivacySettings{Presence: VisibleToEveryone, DirectMessages: DMFromFollowers})
+	assert.Nil(t, err)
+	_, err = request(server.updatePrivacySettings, dave, nil, PrivacySettings{Presence: VisibleToEveryone, DirectMessages: DMFromMutuals})
+	assert.Nil(t, err)
+
+	t.Run("followers message directly", func(t *testing.T) {
+		assert.Nil(t, direct(bob, alice).Request)
+	})
+	t.Run("others send a request", func(t *testing.T) {
+		chat := direct(carol, alice)
+		assert.Equal(t, RequestPending, chat.Request.Status)
+		_, err := service.Deliver(ctx, carol, "", MessageIn{ChatId: chat.Id, Text: "hi"})
+		assert.Nil(t, err)
+
+		requests := chats(server.getMessageRequests, alice)
+		assert.Len(t, requests, 1)
+		assert.Equal(t, chat.Id, requests[0].Id)
+		assert.Equal(t, "hi", requests[0].LastMessage.Text)
+		assert.Equal(t, int64(1), requests[0].UnreadCount)
+		for _, inboxChat := range chats(server.getInbox, alice) {
+			assert.NotEqual(t, chat.Id, inboxChat.Id)
+		}
+		// The sender sees it as usual.
+		assert.Len(t, chats(server.getInbox, carol), 1)
+
+		_, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "hello"})
+		assert.ErrorIs(t, err, ErrRequestPending)
+	})
+	t.Run("reading a request sends no receipt", func(t *testing.T) {
+		chat := direct(carol, alice)
+		carolConn, err := service.Connect(ctx, carol, "phone")
+		assert.Nil(t, err)
+		defer service.Disconnect(ctx, carolConn)
+
+		assert.Nil(t, service.MarkRead(ctx, alice, "", chat.Id, 1))
+		select {
+		case event := <-carolConn.Events():
+			t.Fatalf("unexpected %s event", event.Type)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	t.Run("accept", func(t *testing.T) {
+		chat := direct(carol, alice)
+		_, err := request(server.acceptRequest, bob, map[string]string{"id": chat.Id.String()}, nil)
+		assert.Equal(t, http.StatusForbidden, statusOf(err))
+
+		_, err = request(server.acceptRequest, alice, map[string]string{"id": chat.Id.String()}, nil)
+		assert.Nil(t, err)
+		assert.Empty(t, chats(server.getMessageRequests, alice))
+		_, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "hello"})
+		assert.Nil(t, err)
+
+		_, err = request(server.acceptRequest, alice, map[string]string{"id": chat.Id.String()}, nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+	})
+	t.Run("only mutual follows", func(t *testing.T) {
+		chat := direct(alice, dave)
+		assert.Equal(t, RequestPending, chat.Request.Status)
+		sent, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "hi"})
+		assert.Nil(t, err)
+
+		_, err = request(server.declineRequest, dave, map[string]string{"id": chat.Id.String()}, nil)
+		assert.Nil(t, err)
+		assert.Empty(t, chats(server.getMessageRequests, dave))
+		_, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "hi again"})
+		assert.ErrorIs(t, err, ErrRequestDeclined)
+		_, err = service.EditMessage(ctx, alice, "", chat.Id, sent.Id, "hi again", nil)
+		assert.ErrorIs(t, err, ErrRequestDeclined)
+		assert.ErrorIs(t, service.Typing(ctx, alice, "", chat.Id, true), ErrRequestDeclined)
+
+		// Opening the chat doesn't accept it, only accepting does.
+		assert.Equal(t, RequestDeclined, direct(dave, alice).Request.Status)
+		_, err = request(server.acceptRequest, dave, map[string]string{"id": chat.Id.String()}, nil)
+		assert.Nil(t, err)
+		_, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "hi again"})
+		assert.Nil(t, err)
+	})
+	t.Run("groups keep the policy", func(t *testing.T) {
+		_, err := service.CreateChat(ctx, carol, &ChatIn{Members: []uuid.UUID{alice}})
+		assert.ErrorIs(t, err, ErrAddForbidden)
+		assert.Equal(t, http.StatusForbidden, statusOf(chatError(err)))
+		_, err = service.CreateChat(ctx, bob, &ChatIn{Members: []uuid.UUID{alice}})
+		assert.Nil(t, err)
+
+		group, err := service.CreateChat(ctx, carol, &ChatIn{Members: []uuid.UUID{bob}, Title: "group"})
+		assert.Nil(t, err)
+		_, err = service.AddMembers(ctx, carol, group.Id, []uuid.UUID{alice})
+		assert.ErrorIs(t, err, ErrAddForbidden)
+		group, err = storage.GetChat(ctx, group.Id)
+		assert.Nil(t, err)
+		assert.NotContains(t, group.Members, alice)
+	})
+	t.Run("policy is kept when left out", func(t *testing.T) {
+		_, err := request(server.updatePrivacySettings, alice, nil, PrivacySettings{Presence: VisibleToContacts})
+		assert.Nil(t, err)
+		settings, err := service.GetPrivacySettings(ctx, alice)
+		assert.Nil(t, err)
+		assert.Equal(t, DMFromFollowers, settings.DirectMessages)
+
+		_, err = request(server.updatePrivacySettings, alice, nil, map[string]string{"presence": "everyone", "direct_messages": "friends"})
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+	})
+}
+
+func TestRichMessages(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	image, voice, bobs := uuid.New(), uuid.New(), uuid.New()
+	service.media = fakeMediaClient{
+		image: {Id: image, OwnerId: alice.String(), ContentType: "image/png", URL: "http://media.test/media/image/original.png", Width: 64, Height: 64},
+		voice: {Id: voice, OwnerId: alice.String(), ContentType: "audio/mpeg", URL: "http://media.test/media/voice/file", Name: "note.mp3", Size: 2048},
+		bobs:  {Id: bobs, OwnerId: bob.String(), ContentType: "image/png", URL: "http://media.test/media/bobs/original.png"},
+	}
+	previews := &stubPreviewFetcher{previews: map[string]*LinkPreview{
+		"https://example.com/a": {URL: "https://example.com/a", Title: "A"},
+		"https://example.com/b": {URL: "https://example.com/b", Title: "B"},
+	}}
+	service.previews = previews
+	ctx := context.Background()
+
+	chat, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob}, Title: "friends"})
+	assert.Nil(t, err)
+	statusOf := func(err error) int {
+		if httpErr, ok := chatError(err).(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+
+	t.Run("attachments", func(t *testing.T) {
+		bobConn, err := service.Connect(ctx, bob, "phone")
+		assert.Nil(t, err)
+		defer service.Disconnect(ctx, bobConn)
+
+		msg, err := service.Deliver(ctx, alice, "", MessageIn{
+			ChatId:      chat.Id,
+			Attachments: []*Attachment{{Type: AttachmentImage, MediaId: image}, {Type: AttachmentVoice, MediaId: voice}},
+		})
+		assert.Nil(t, err)
+		assert.Len(t, msg.Attachments, 2)
+		assert.Equal(t, "http://media.test/media/image/original.png", msg.Attachments[0].URL)
+		assert.Equal(t, 64, msg.Attachments[0].Width)
+		assert.Equal(t, "note.mp3", msg.Attachments[1].Name)
+
+		event := <-bobConn.Events()
+		assert.Equal(t, EventMessage, event.Type)
+		assert.Equal(t, msg.Attachments, event.Message.Attachments)
+	})
+	t.Run("invalid attachments", func(t *testing.T) {
+		invalid := map[string]*Attachment{
+			"not uploaded":      {Type: AttachmentImage, MediaId: uuid.New()},
+			"someone else's":    {Type: AttachmentImage, MediaId: bobs},
+			"voice isn't image": {Type: AttachmentImage, MediaId: voice},
+			"image isn't voice": {Type: AttachmentVoice, MediaId: image},
+		}
+		for name, attachment := range invalid {
+			t.Run(name, func(t *testing.T) {
+				_, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Attachments: []*Attachment{attachment}})
+				assert.Equal(t, http.StatusBadRequest, statusOf(err))
+			})
+		}
+		_, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id})
+		assert.ErrorIs(t, err, ErrEmptyMessage)
+
+		env, _ := NewEnvelope(EnvelopeSend, "c1", &MessageIn{ChatId: chat.Id, Attachments: []*Attachment{{Type: "video", MediaId: image}}})
+		_, err = server.handleEnvelope(ctx, alice, "", env)
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+	})
+	t.Run("entities", func(t *testing.T) {
+		msg, err := service.Deliver(ctx, alice, "", MessageIn{
+			ChatId: chat.Id,
+			Text:   "@bob run `make`",
+			Entities: []*Entity{
+				{Type: EntityCode, Offset: 9, Length: 6},
+				{Type: EntityMention, Offset: 0, Length: 4, AccountId: &bob},
+			},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, EntityMention, msg.Entities[0].Type)
+		assert.Equal(t, EntityCode, msg.Entities[1].Type)
+
+		_, err = service.Deliver(ctx, alice, "", MessageIn{
+			ChatId:   chat.Id,
+			Text:     "@carol",
+			Entities: []*Entity{{Type: EntityMention, Offset: 0, Length: 6, AccountId: &carol}},
+		})
+		assert.ErrorIs(t, err, ErrInvalidEntity)
+	})
+	t.Run("link previews", func(t *testing.T) {
+		msg, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "look https://example.com/a."})
+		assert.Nil(t, err)
+		assert.Equal(t, "A", msg.Preview.Title)
+
+		// A preview which can't be generated doesn't stop the message.
+		unknown, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: chat.Id, Text: "https://example.com/unknown"})
+		assert.Nil(t, err)
+		assert.Nil(t, unknown.Preview)
+
+		payload, _ := json.Marshal(MessageEditIn{Text: "**look** https://example.com/a", Entities: []*Entity{{Type: EntityBold, Offset: 0, Length: 8}}})
+		r := httptest.NewRequest(http.MethodPatch, "/", bytes.NewReader(payload))
+		r.Header.Set("Authorization", alice.String())
+		vars := map[string]string{"id": chat.Id.String(), "message_id": msg.Id.String()}
+		w := httptest.NewRecorder()
+		assert.Nil(t, server.editMessage(ctx, w, mux.SetURLVars(r, vars)))
+		edited := &Message{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(edited))
+		assert.Len(t, edited.Entities, 1)
+		// Same link, it isn't fetched again.
+		assert.Equal(t, "A", edited.Preview.Title)
+		assert.Equal(t, []string{"https://example.com/a", "https://example.com/unknown"}, previews.fetched)
+
+		edited, err = service.EditMessage(ctx, alice, "", chat.Id, msg.Id, "actually https://example.com/b", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "B", edited.Preview.Title)
+		assert.Empty(t, edited.Entities)
+
+		assert.Nil(t, service.DeleteMessage(ctx, alice, "", chat.Id, msg.Id, true))
+		deleted, err := storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Nil(t, deleted.Preview)
+	})
+}
+
+func TestReactions(t *testing.T) {
+	alice, bob, carol, dave := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+		&types.Account{Id: dave.String(), Username: "dave"},
+	)
+	ctx := context.Background()
+
+	chat, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob, carol}, Title: "friends"})
+	assert.Nil(t, err)
+	msg, err := service.Deliver(ctx, bob, "", MessageIn{ChatId: chat.Id, Text: "party tonight"})
+	assert.Nil(t, err)
+
+	react := func(method string, account uuid.UUID, emoji string) error {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Authorization", account.String())
+		vars := map[string]string{"id": chat.Id.String(), "message_id": msg.Id.String(), "emoji": emoji}
+		return server.react(ctx, httptest.NewRecorder(), mux.SetURLVars(r, vars))
+	}
+	reactions := func(account uuid.UUID) []*ReactionCount {
+		page, err := service.GetMessages(ctx, account, "", chat.Id, "", 1)
+		assert.Nil(t, err)
+		return page.Messages[0].Reactions
+	}
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+	bobConn, err := service.Connect(ctx, bob, "phone")
+	assert.Nil(t, err)
+	defer service.Disconnect(ctx, bobConn)
+	nextEvent := func() *Event {
+		select {
+		case event := <-bobConn.Events():
+			return &event
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	t.Run("add", func(t *testing.T) {
+		assert.Nil(t, react(http.MethodPut, alice, "🎉"))
+		event := nextEvent()
+		assert.Equal(t, EventReactionAdded, event.Type)
+		assert.Equal(t, &ReactionPayload{ChatId: chat.Id, MessageId: msg.Id, AccountId: alice, Emoji: "🎉"}, event.Reaction)
+
+		// Adding it again changes nothing and tells nobody.
+		assert.Nil(t, react(http.MethodPut, alice, "🎉"))
+		assert.Nil(t, nextEvent())
+
+		assert.Nil(t, react(http.MethodPut, carol, "🎉"))
+		assert.Nil(t, react(http.MethodPut, carol, "👍"))
+		nextEvent()
+		nextEvent()
+	})
+	t.Run("counts in history", func(t *testing.T) {
+		assert.Equal(t, []*ReactionCount{{Emoji: "🎉", Count: 2, Reacted: true}, {Emoji: "👍", Count: 1}}, reactions(alice))
+		assert.Equal(t, []*ReactionCount{{Emoji: "🎉", Count: 2}, {Emoji: "👍", Count: 1}}, reactions(bob))
+	})
+	t.Run("remove", func(t *testing.T) {
+		assert.Nil(t, react(http.MethodDelete, carol, "👍"))
+		assert.Equal(t, EventReactionRemoved, nextEvent().Type)
+		assert.Nil(t, react(http.MethodDelete, carol, "👍"))
+		assert.Nil(t, nextEvent())
+		assert.Equal(t, []*ReactionCount{{Emoji: "🎉", Count: 2, Reacted: true}}, reactions(carol))
+	})
+	t.Run("over the socket", func(t *testing.T) {
+		env, _ := NewEnvelope(EnvelopeReact, "r1", &ReactIn{ChatId: chat.Id, MessageId: msg.Id, Emoji: "❤️"})
+		ack, err := server.handleEnvelope(ctx, alice, "laptop", env)
+		assert.Nil(t, err)
+		assert.Equal(t, EnvelopeAck, ack.Type)
+		assert.Equal(t, EventReactionAdded, nextEvent().Type)
+
+		env, _ = NewEnvelope(EnvelopeReact, "r2", &ReactIn{ChatId: chat.Id, MessageId: msg.Id, Emoji: "❤️", Remove: true})
+		_, err = server.handleEnvelope(ctx, alice, "laptop", env)
+		assert.Nil(t, err)
+		assert.Equal(t, EventReactionRemoved, nextEvent().Type)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, statusOf(react(http.MethodPut, alice, "lol")))
+		assert.Equal(t, http.StatusForbidden, statusOf(react(http.MethodPut, dave, "🎉")))
+
+		for r := rune(0x1F600); len(reactions(alice)) < maxReactionEmoji; r++ {
+			assert.Nil(t, react(http.MethodPut, alice, string(r)))
+		}
+		assert.Equal(t, http.StatusBadRequest, statusOf(react(http.MethodPut, alice, "🚀")))
+		// Existing ones can still be added.
+		assert.Nil(t, react(http.MethodPut, bob, "🎉"))
+	})
+	t.Run("deleting drops them", func(t *testing.T) {
+		assert.Nil(t, service.DeleteMessage(ctx, bob, "", chat.Id, msg.Id, true))
+		assert.Empty(t, reactions(alice))
+		assert.Equal(t, http.StatusBadRequest, statusOf(react(http.MethodPut, alice, "🎉")))
+	})
+}
+
+// testDevice is a client device holding its private keys, which the server
+// never sees.
+type testDevice struct {
+	accountId uuid.UUID
+	id        string
+	public    *[32]byte
+	private   *[32]byte
+}
+
+func newTestDevice(t *testing.T, accountId uuid.UUID, id string) *testDevice {
+	public, private, err := box.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return &testDevice{accountId: accountId, id: id, public: public, private: private}
+}
+
+// keys are the device's identity key, a signed prekey and one-time prekeys.
+func (d *testDevice) keys(t *testing.T, prekeys int) *KeysIn {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signed, _, err := box.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	keys := &KeysIn{
+		IdentityKey: base64.StdEncoding.EncodeToString(d.public[:]),
+		SignedPreKey: &SignedPreKey{
+			KeyId:     1,
+			PublicKey: base64.StdEncoding.EncodeToString(signed[:]),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, signed[:])),
+		},
+	}
+	for i := 0; i < prekeys; i++ {
+		prekey, _, err := box.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		keys.OneTimePreKeys = append(keys.OneTimePreKeys, &PreKey{
+			KeyId:     uint32(i + 1),
+			PublicKey: base64.StdEncoding.EncodeToString(prekey[:]),
+		})
+	}
+	return keys
+}
+
+// encryptFor seals text to the identity key of the bundle's device.
+func encryptFor(t *testing.T, accountId uuid.UUID, bundle *KeyBundle, text string) *Ciphertext {
+	key, err := base64.StdEncoding.DecodeString(bundle.IdentityKey)
+	assert.Nil(t, err)
+	sealed, err := box.SealAnonymous(nil, []byte(text), (*[32]byte)(key), rand.Reader)
+	assert.Nil(t, err)
+	return &Ciphertext{
+		AccountId: accountId,
+		DeviceId:  bundle.DeviceId,
+		Type:      CiphertextPreKey,
+		Body:      base64.StdEncoding.EncodeToString(sealed),
+	}
+}
+
+func (d *testDevice) decrypt(ciphertext *Ciphertext) (string, bool) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext.Body)
+	if err != nil {
+		return "", false
+	}
+	text, ok := box.OpenAnonymous(nil, sealed, d.public, d.private)
+	return string(text), ok
+}
+
+func TestEncryptedChats(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	ctx := context.Background()
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+
+	alicePhone := newTestDevice(t, alice, "phone")
+	aliceLaptop := newTestDevice(t, alice, "laptop")
+	bobPhone := newTestDevice(t, bob, "phone")
+
+	publish := func(device *testDevice, keys *KeysIn) (*PreKeyCount, error) {
+		body, _ := json.Marshal(keys)
+		r := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(body))
+		r.Header.Set("Authorization", device.accountId.String())
+		w := httptest.NewRecorder()
+		err := server.publishKeys(ctx, w, mux.SetURLVars(r, map[string]string{"device_id": device.id}))
+		count := &PreKeyCount{}
+		json.NewDecoder(w.Body).Decode(count)
+		return count, err
+	}
+	bundles := func(accountId uuid.UUID) ([]*KeyBundle, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", carol.String())
+		w := httptest.NewRecorder()
+		err := server.getKeyBundles(ctx, w, mux.SetURLVars(r, map[string]string{"account_id": accountId.String()}))
+		bundles := []*KeyBundle{}
+		json.NewDecoder(w.Body).Decode(&bundles)
+		return bundles, err
+	}
+	connect := func(device *testDevice) func() *Event {
+		conn, err := service.Connect(ctx, device.accountId, device.id)
+		assert.Nil(t, err)
+		t.Cleanup(func() { service.Disconnect(ctx, conn) })
+		// Devices coming online are announced too, those are skipped.
+		return func() *Event {
+			for {
+				select {
+				case event := <-conn.Events():
+					if event.Type != EventPresence {
+						return &event
+					}
+				case <-time.After(50 * time.Millisecond):
+					return nil
+				}
+			}
+		}
+	}
+
+	t.Run("key directory", func(t *testing.T) {
+		_, err := bundles(bob)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+
+		invalid := bobPhone.keys(t, 0)
+		invalid.IdentityKey = "bm90IGEga2V5"
+		_, err = publish(bobPhone, invalid)
+		assert.Equal(t, http.StatusBadRequest, statusOf(err))
+
+		count, err := publish(bobPhone, bobPhone.keys(t, 2))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, count.Count)
+		for _, device := range []*testDevice{alicePhone, aliceLaptop} {
+			_, err := publish(device, device.keys(t, 1))
+			assert.Nil(t, err)
+		}
+
+		// Every fetch gets a different one-time prekey until they run out.
+		first, err := bundles(bob)
+		assert.Nil(t, err)
+		assert.Len(t, first, 1)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(bobPhone.public[:]), first[0].IdentityKey)
+		second, err := bundles(bob)
+		assert.Nil(t, err)
+		assert.NotEqual(t, first[0].OneTimePreKey, second[0].OneTimePreKey)
+		third, err := bundles(bob)
+		assert.Nil(t, err)
+		assert.Nil(t, third[0].OneTimePreKey)
+		assert.NotNil(t, third[0].SignedPreKey)
+
+		left, err := service.CountPreKeys(ctx, bob, "phone")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, left)
+	})
+
+	chat, created, err := service.GetDirectChat(ctx, alice, bob, true)
+	assert.Nil(t, err)
+	assert.True(t, created)
+	assert.True(t, chat.Encrypted)
+	bobEvents := connect(bobPhone)
+	laptopEvents := connect(aliceLaptop)
+	var sent *Message
+
+	t.Run("only ciphertexts", func(t *testing.T) {
+		_, err := service.Deliver(ctx, alice, "phone", MessageIn{ChatId: chat.Id, Text: "in the clear"})
+		assert.ErrorIs(t, err, ErrEncrypted)
+
+		bobBundles, _ := bundles(bob)
+		// The laptop is missing.
+		_, err = service.Deliver(ctx, alice, "phone", MessageIn{ChatId: chat.Id, Ciphertexts: []*Ciphertext{
+			encryptFor(t, bob, bobBundles[0], "meet at noon"),
+		}})
+		assert.ErrorIs(t, err, ErrMismatchedDevices)
+		assert.Equal(t, http.StatusConflict, statusOf(chatError(err)))
+
+		_, err = service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob, carol}, Encrypted: true})
+		assert.ErrorIs(t, err, ErrEncryptedGroup)
+		plain, _, err := service.GetDirectChat(ctx, alice, bob, false)
+		assert.Nil(t, err)
+		assert.NotEqual(t, chat.Id, plain.Id)
+		_, err = service.Deliver(ctx, alice, "phone", MessageIn{ChatId: plain.Id, Ciphertexts: []*Ciphertext{
+			encryptFor(t, bob, bobBundles[0], "meet at noon"),
+		}})
+		assert.ErrorIs(t, err, ErrNotEncrypted)
+	})
+	t.Run("each device gets its own", func(t *testing.T) {
+		bobBundles, _ := bundles(bob)
+		aliceBundles, _ := bundles(alice)
+		ciphertexts := []*Ciphertext{encryptFor(t, bob, bobBundles[0], "meet at noon")}
+		for _, bundle := range aliceBundles {
+			if bundle.DeviceId != "phone" {
+				ciphertexts = append(ciphertexts, encryptFor(t, alice, bundle, "meet at noon"))
+			}
+		}
+
+		sent, err = service.Deliver(ctx, alice, "phone", MessageIn{ChatId: chat.Id, Ciphertexts: ciphertexts})
+		assert.Nil(t, err)
+		assert.Empty(t, sent.Ciphertexts)
+
+		for _, received := range []struct {
+			device *testDevice
+			event  *Event
+		}{{bobPhone, bobEvents()}, {aliceLaptop, laptopEvents()}} {
+			assert.Equal(t, EventMessage, received.event.Type)
+			assert.Len(t, received.event.Message.Ciphertexts, 1)
+			text, ok := received.device.decrypt(received.event.Message.Ciphertexts[0])
+			assert.True(t, ok)
+			assert.Equal(t, "meet at noon", text)
+		}
+
+		page, err := service.GetMessages(ctx, bob, "phone", chat.Id, "", 10)
+		assert.Nil(t, err)
+		assert.Len(t, page.Messages[0].Ciphertexts, 1)
+		assert.Equal(t, "phone", page.Messages[0].Ciphertexts[0].DeviceId)
+		page, err = service.GetMessages(ctx, bob, "", chat.Id, "", 10)
+		assert.Nil(t, err)
+		assert.Empty(t, page.Messages[0].Ciphertexts)
+	})
+	t.Run("the server can't read them", func(t *testing.T) {
+		stored, err := storage.GetMessage(ctx, chat.Id, sent.Id)
+		assert.Nil(t, err)
+		assert.Empty(t, stored.Text)
+		assert.Len(t, stored.Ciphertexts, 2)
+
+		raw, _ := json.Marshal(stored)
+		assert.NotContains(t, string(raw), "meet at noon")
+		for _, ciphertext := range stored.Ciphertexts {
+			body, err := base64.StdEncoding.DecodeString(ciphertext.Body)
+			assert.Nil(t, err)
+			assert.NotContains(t, string(body), "meet at noon")
+		}
+
+		// All the server has are public keys, no other key opens them.
+		eavesdropper := newTestDevice(t, carol, "phone")
+		for _, ciphertext := range stored.Ciphertexts {
+			_, ok := eavesdropper.decrypt(ciphertext)
+			assert.False(t, ok)
+		}
+		_, ok := bobPhone.decrypt(stored.Ciphertexts[1])
+		assert.False(t, ok)
+	})
+	t.Run("no plaintext changes", func(t *testing.T) {
+		_, err := service.EditMessage(ctx, alice, "phone", chat.Id, sent.Id, "changed my mind", nil)
+		assert.ErrorIs(t, err, ErrEncrypted)
+		assert.ErrorIs(t, service.React(ctx, bob, "phone", chat.Id, sent.Id, "👍", false), ErrEncrypted)
+
+		assert.Nil(t, service.DeleteMessage(ctx, alice, "phone", chat.Id, sent.Id, true))
+		stored, err := storage.GetMessage(ctx, chat.Id, sent.Id)
+		assert.Nil(t, err)
+		assert.Empty(t, stored.Ciphertexts)
+	})
+	t.Run("removed devices", func(t *testing.T) {
+		assert.Nil(t, service.RemoveDeviceKeys(ctx, bob, "phone"))
+		_, err := service.Deliver(ctx, alice, "phone", MessageIn{ChatId: chat.Id, Ciphertexts: []*Ciphertext{
+			{AccountId: alice, DeviceId: "laptop", Type: CiphertextMessage, Body: "3q2+7w=="},
+		}})
+		assert.ErrorIs(t, err, ErrNoDeviceKeys)
+	})
+}
+
+func TestKeyClaims(t *testing.T) {
+	alice, bob, carol, dave := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+		&types.Account{Id: dave.String(), Username: "dave"},
+	)
+	server.Auth.(fakeAuth).Follow(bob.String(), alice.String())
+	clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)}
+	service.clock = clock.Now
+	ctx := context.Background()
+
+	alicePhone := newTestDevice(t, alice, "phone")
+	_, err := service.PublishKeys(ctx, alice, alicePhone.id, alicePhone.keys(t, 20))
+	assert.Nil(t, err)
+	assert.Nil(t, service.UpdatePrivacySettings(ctx, alice, &PrivacySettings{Presence: VisibleToEveryone, DirectMessages: DMFromFollowers}))
+
+	bundles := func(accountId, targetId uuid.UUID) error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", accountId.String())
+		w := httptest.NewRecorder()
+		return server.getKeyBundles(ctx, w, mux.SetURLVars(r, map[string]string{"account_id": targetId.String()}))
+	}
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+	left := func() int {
+		count, err := service.CountPreKeys(ctx, alice, alicePhone.id)
+		assert.Nil(t, err)
+		return count
+	}
+
+	t.Run("only who can message", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, statusOf(bundles(carol, alice)))
+		assert.Equal(t, 20, left())
+
+		// Followers can, and so can the account itself.
+		assert.Nil(t, bundles(bob, alice))
+		assert.Nil(t, bundles(alice, alice))
+		assert.Equal(t, 18, left())
+	})
+	t.Run("message requests", func(t *testing.T) {
+		chat, _, err := service.GetDirectChat(ctx, carol, alice, true)
+		assert.Nil(t, err)
+		assert.Equal(t, RequestPending, chat.Request.Status)
+		assert.Nil(t, bundles(carol, alice))
+		// A request in a plain chat doesn't do.
+		_, _, err = service.GetDirectChat(ctx, dave, alice, false)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, statusOf(bundles(dave, alice)))
+
+		assert.Nil(t, service.DeclineRequest(ctx, alice, chat.Id))
+		assert.Equal(t, http.StatusForbidden, statusOf(bundles(carol, alice)))
+		assert.Equal(t, 17, left())
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		for i := 1; i < keyClaimLimit; i++ {
+			assert.Nil(t, bundles(bob, alice))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, statusOf(bundles(bob, alice)))
+		assert.Equal(t, 17-keyClaimLimit+1, left())
+
+		// Others have their own limit.
+		assert.Nil(t, bundles(alice, alice))
+
+		clock.Advance(keyClaimWindow)
+		assert.Nil(t, bundles(bob, alice))
+	})
+}
+
+func TestSearch(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	ctx := context.Background()
+
+	group, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob, carol}, Title: "friends"})
+	assert.Nil(t, err)
+	direct, _, err := service.GetDirectChat(ctx, alice, bob, false)
+	assert.Nil(t, err)
+	private, _, err := service.GetDirectChat(ctx, bob, carol, false)
+	assert.Nil(t, err)
+	for _, msg := range []struct {
+		from uuid.UUID
+		chat *Chat
+		text string
+	}{
+		{alice, group, "Who's up for lunch on Friday?"},
+		{bob, group, "friday works"},
+		{bob, direct, "Lunch at the usual place, Friday noon"},
+		{carol, private, "don't tell alice about friday"},
+	} {
+		_, err := service.Deliver(ctx, msg.from, "", MessageIn{ChatId: msg.chat.Id, Text: msg.text})
+		assert.Nil(t, err)
+	}
+
+	search := func(account uuid.UUID, query string) (*SearchPage, error) {
+		r := httptest.NewRequest(http.MethodGet, "/chat/search?"+query, nil)
+		r.Header.Set("Authorization", account.String())
+		w := httptest.NewRecorder()
+		if err := server.search(ctx, w, r); err != nil {
+			return nil, err
+		}
+		page := &SearchPage{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(page))
+		return page, nil
+	}
+	texts := func(page *SearchPage) []string {
+		texts := []string{}
+		for _, result := range page.Results {
+			texts = append(texts, result.Message.Text)
+		}
+		return texts
+	}
+
+	t.Run("across chats", func(t *testing.T) {
+		page, err := search(alice, "q=FRIDAY")
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"Lunch at the usual place, Friday noon", "friday works", "Who's up for lunch on Friday?"}, texts(page))
+		assert.Empty(t, page.NextCursor)
+
+		page, err = search(alice, "q=lunch+friday")
+		assert.Nil(t, err)
+		assert.Len(t, page.Results, 2)
+		result := page.Results[0]
+		if result.Message.ChatId != group.Id {
+			result = page.Results[1]
+		}
+		assert.Equal(t, "Who's up for lunch on Friday?", result.Snippet)
+		assert.Equal(t, []*Highlight{{Offset: 13, Length: 5}, {Offset: 22, Length: 6}}, result.Highlights)
+	})
+	t.Run("one chat", func(t *testing.T) {
+		page, err := search(alice, "q=friday&chat_id="+group.Id.String())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"friday works", "Who's up for lunch on Friday?"}, texts(page))
+
+		_, err = search(alice, "q=friday&chat_id="+private.Id.String())
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("pages", func(t *testing.T) {
+		first, err := search(alice, "q=friday&limit=2")
+		assert.Nil(t, err)
+		assert.Len(t, first.Results, 2)
+		assert.Equal(t, "2", first.NextCursor)
+
+		second, err := search(alice, "q=friday&limit=2&cursor="+first.NextCursor)
+		assert.Nil(t, err)
+		assert.Len(t, second.Results, 1)
+		assert.Empty(t, second.NextCursor)
+		assert.ElementsMatch(t, []string{"Lunch at the usual place, Friday noon", "friday works", "Who's up for lunch on Friday?"},
+			append(texts(first), texts(second)...))
+	})
+	t.Run("deleted messages", func(t *testing.T) {
+		page, err := search(bob, "q=works")
+		assert.Nil(t, err)
+		assert.Len(t, page.Results, 1)
+		assert.Nil(t, service.DeleteMessage(ctx, bob, "", group.Id, page.Results[0].Message.Id, true))
+
+		page, err = search(bob, "q=works")
+		assert.Nil(t, err)
+		assert.Empty(t, page.Results)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := search(alice, "q=+%3F%21")
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+		_, err = search(alice, "q=friday&cursor=nope")
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+	})
+}
+
+// testClock is a clock tests move forward by hand.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRetention(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)}
+	service.clock = clock.Now
+	ctx := context.Background()
+
+	updateRetention := func(account uuid.UUID, chatId uuid.UUID, body string) (*Chat, error) {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", account.String())
+		w := httptest.NewRecorder()
+		err := server.updateRetention(ctx, w, mux.SetURLVars(r, map[string]string{"id": chatId.String()}))
+		chat := &Chat{}
+		json.NewDecoder(w.Body).Decode(chat)
+		return chat, err
+	}
+	texts := func(account, chatId uuid.UUID) []string {
+		page, err := service.GetMessages(ctx, account, "", chatId, "", 50)
+		assert.Nil(t, err)
+		texts := []string{}
+		for _, msg := range page.Messages {
+			if msg.System == nil {
+				texts = append(texts, msg.Text)
+			}
+		}
+		return texts
+	}
+	bobConn, err := service.Connect(ctx, bob, "phone")
+	assert.Nil(t, err)
+	defer service.Disconnect(ctx, bobConn)
+	nextEvent := func() *Event {
+		for {
+			select {
+			case event := <-bobConn.Events():
+				if event.Type != EventPresence {
+					return &event
+				}
+			case <-time.After(50 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+
+	direct, _, err := service.GetDirectChat(ctx, alice, bob, false)
+	assert.Nil(t, err)
+
+	t.Run("disappearing messages", func(t *testing.T) {
+		chat, err := updateRetention(alice, direct.Id, `{"disappear_after": 3600}`)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3600), chat.DisappearAfter)
+		event := nextEvent()
+		assert.Equal(t, SystemRetentionChanged, event.Message.System.Type)
+		assert.Equal(t, int64(3600), *event.Message.System.DisappearAfter)
+		assert.Nil(t, event.Message.System.Retention)
+
+		// Setting it again changes nothing and tells nobody.
+		_, err = updateRetention(alice, direct.Id, `{"disappear_after": 3600}`)
+		assert.Nil(t, err)
+		assert.Nil(t, nextEvent())
+
+		msg, err := service.Deliver(ctx, alice, "", MessageIn{ChatId: direct.Id, Text: "this won't last"})
+		assert.Nil(t, err)
+		assert.Equal(t, clock.Now().Add(time.Hour), *msg.ExpiresAt)
+		assert.Equal(t, msg.ExpiresAt, nextEvent().Message.ExpiresAt)
+
+		clock.Advance(30 * time.Minute)
+		assert.Equal(t, []string{"this won't last"}, texts(bob, direct.Id))
+
+		// Gone before the sweeper gets to it.
+		clock.Advance(30 * time.Minute)
+		assert.Empty(t, texts(bob, direct.Id))
+		_, err = service.EditMessage(ctx, alice, "", direct.Id, msg.Id, "changed", nil)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+		_, err = service.Deliver(ctx, bob, "", MessageIn{ChatId: direct.Id, Text: "what?", ReplyMessageId: msg.Id})
+		assert.ErrorIs(t, err, ErrInvalidReply)
+
+		deleted, err := service.SweepMessages(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, deleted)
+		_, err = storage.GetMessage(ctx, direct.Id, msg.Id)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+
+		// Turning it off only affects new messages.
+		_, err = updateRetention(bob, direct.Id, `{"disappear_after": 0}`)
+		assert.Nil(t, err)
+		msg, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: direct.Id, Text: "here to stay"})
+		assert.Nil(t, err)
+		assert.Nil(t, msg.ExpiresAt)
+	})
+
+	group, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob, carol}, Title: "friends"})
+	assert.Nil(t, err)
+	_, err = service.Deliver(ctx, carol, "", MessageIn{ChatId: group.Id, Text: "from before"})
+	assert.Nil(t, err)
+
+	t.Run("retention", func(t *testing.T) {
+		_, err := updateRetention(carol, group.Id, `{"retention": 86400}`)
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+
+		clock.Advance(12 * time.Hour)
+		chat, err := updateRetention(alice, group.Id, `{"retention": 86400}`)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(86400), chat.Retention)
+		_, err = service.Deliver(ctx, carol, "", MessageIn{ChatId: group.Id, Text: "from after"})
+		assert.Nil(t, err)
+
+		// Older messages go too.
+		clock.Advance(13 * time.Hour)
+		assert.Equal(t, []string{"from after"}, texts(alice, group.Id))
+		deleted, err := service.SweepMessages(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, deleted)
+
+		clock.Advance(12 * time.Hour)
+		deleted, err = service.SweepMessages(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, deleted)
+		assert.Empty(t, texts(alice, group.Id))
+		// The direct chat keeps its messages.
+		assert.Equal(t, []string{"here to stay"}, texts(alice, direct.Id))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`{"retention": 30}`, `{"disappear_after": -1}`, `{"retention": 40000000}`} {
+			_, err := updateRetention(alice, group.Id, body)
+			assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode, body)
+		}
+	})
+	t.Run("sweeper", func(t *testing.T) {
+		_, err := service.Deliver(ctx, carol, "", MessageIn{ChatId: group.Id, Text: "swept in the background"})
+		assert.Nil(t, err)
+		clock.Advance(25 * time.Hour)
+
+		stop := service.StartSweeper(5*time.Millisecond, func(err error) { t.Error(err) })
+		assert.Eventually(t, func() bool {
+			messages, err := storage.GetMessages(ctx, group.Id, alice, 0, 10)
+			return err == nil && len(messages) == 0
+		}, time.Second, 5*time.Millisecond)
+		assert.Nil(t, stop(ctx))
+	})
+}
+
+func TestScheduledMessages(t *testing.T) {
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	server, service, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+		&types.Account{Id: carol.String(), Username: "carol"},
+	)
+	clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)}
+	service.clock = clock.Now
+	// A second replica sharing the storage.
+	replica := NewChatService(storage, server.Auth, NewHub(4, 16, DisconnectSlowConsumer), NewLocalBroker())
+	replica.clock = clock.Now
+	ctx := context.Background()
+
+	request := func(handler func(context.Context, http.ResponseWriter, *http.Request) error, method string, account uuid.UUID, vars map[string]string, body string, v any) error {
+		r := httptest.NewRequest(method, "/?device=laptop", strings.NewReader(body))
+		r.Header.Set("Authorization", account.String())
+		w := httptest.NewRecorder()
+		err := handler(ctx, w, mux.SetURLVars(r, vars))
+		if v != nil {
+			json.NewDecoder(w.Body).Decode(v)
+		}
+		return err
+	}
+	statusOf := func(err error) int {
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+	texts := func(chatId uuid.UUID) []string {
+		page, err := service.GetMessages(ctx, bob, "", chatId, "", 50)
+		assert.Nil(t, err)
+		texts := []string{}
+		for _, msg := range page.Messages {
+			texts = append(texts, msg.Text)
+		}
+		return texts
+	}
+	phone, err := service.Connect(ctx, alice, "phone")
+	assert.Nil(t, err)
+	defer service.Disconnect(ctx, phone)
+	nextEvent := func() *Event {
+		for {
+			select {
+			case event := <-phone.Events():
+				if event.Type != EventPresence {
+					return &event
+				}
+			case <-time.After(50 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+
+	direct, _, err := service.GetDirectChat(ctx, alice, bob, false)
+	assert.Nil(t, err)
+	chatVars := map[string]string{"id": direct.Id.String()}
+	inAnHour := clock.Now().Add(time.Hour).Format(time.RFC3339)
+
+	t.Run("schedule", func(t *testing.T) {
+		scheduled := &ScheduledMessage{}
+		err := request(server.scheduleMessage, http.MethodPost, alice, chatVars, `{"text": "good morning", "send_at": "`+inAnHour+`"}`, scheduled)
+		assert.Nil(t, err)
+		assert.Equal(t, ScheduledPending, scheduled.Status)
+		assert.Equal(t, clock.Now().Add(time.Hour), scheduled.SendAt)
+
+		// The author's other devices are told.
+		event := nextEvent()
+		if assert.NotNil(t, event) {
+			assert.Equal(t, EventScheduled, event.Type)
+			assert.Equal(t, scheduled.Id, event.Scheduled.Id)
+		}
+
+		listed := []*ScheduledMessage{}
+		assert.Nil(t, request(server.getScheduledMessages, http.MethodGet, alice, chatVars, "", &listed))
+		assert.Len(t, listed, 1)
+		// Others don't see them.
+		assert.Nil(t, request(server.getScheduledMessages, http.MethodGet, bob, map[string]string{}, "", &listed))
+		assert.Empty(t, listed)
+
+		// Nothing is sent before it's due.
+		sent, err := service.DispatchScheduledMessages(ctx, "a")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, sent)
+		assert.Empty(t, texts(direct.Id))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		past := clock.Now().Add(-time.Minute).Format(time.RFC3339)
+		tooLate := clock.Now().Add(2 * maxScheduleAhead).Format(time.RFC3339)
+		for _, body := range []string{`{"text": "hi"}`, `{"send_at": "` + inAnHour + `"}`, `{"text": "hi", "send_at": "` + past + `"}`, `{"text": "hi", "send_at": "` + tooLate + `"}`} {
+			err := request(server.scheduleMessage, http.MethodPost, alice, chatVars, body, nil)
+			assert.Equal(t, http.StatusBadRequest, statusOf(err), body)
+		}
+
+		group, err := service.CreateChat(ctx, bob, &ChatIn{Members: []uuid.UUID{carol}, Title: "without alice"})
+		if assert.Nil(t, err) {
+			err = request(server.scheduleMessage, http.MethodPost, alice, map[string]string{"id": group.Id.String()}, `{"text": "hi", "send_at": "`+inAnHour+`"}`, nil)
+			assert.Equal(t, http.StatusForbidden, statusOf(err))
+		}
+	})
+	t.Run("edit and cancel", func(t *testing.T) {
+		scheduled, err := service.ScheduleMessage(ctx, alice, "laptop", direct.Id, &ScheduledMessageIn{Text: "typo", SendAt: clock.Now().Add(time.Hour)})
+		assert.Nil(t, err)
+		assert.Equal(t, "typo", nextEvent().Scheduled.Text)
+		ids := map[string]string{"scheduled_id": scheduled.Id.String()}
+
+		edited := &ScheduledMessage{}
+		err = request(server.updateScheduledMessage, http.MethodPut, alice, ids, `{"text": "fixed", "send_at": "`+inAnHour+`"}`, edited)
+		assert.Nil(t, err)
+		assert.Equal(t, "fixed", edited.Text)
+		assert.Equal(t, "fixed", nextEvent().Scheduled.Text)
+
+		// Only the author can change it.
+		err = request(server.updateScheduledMessage, http.MethodPut, bob, ids, `{"text": "mine", "send_at": "`+inAnHour+`"}`, nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+		err = request(server.cancelScheduledMessage, http.MethodDelete, bob, ids, "", nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+
+		assert.Nil(t, request(server.cancelScheduledMessage, http.MethodDelete, alice, ids, "", nil))
+		assert.Equal(t, ScheduledCanceled, nextEvent().Scheduled.Status)
+		err = request(server.cancelScheduledMessage, http.MethodDelete, alice, ids, "", nil)
+		assert.Equal(t, http.StatusNotFound, statusOf(err))
+	})
+	t.Run("sent once", func(t *testing.T) {
+		clock.Advance(time.Hour)
+		sent, err := service.DispatchScheduledMessages(ctx, "a")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, sent)
+		sent, err = replica.DispatchScheduledMessages(ctx, "b")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, sent)
+		assert.Equal(t, []string{"good morning"}, texts(direct.Id))
+
+		// Every device of the author gets the message, then the update.
+		event := nextEvent()
+		if assert.NotNil(t, event) {
+			assert.Equal(t, EventMessage, event.Type)
+		}
+		event = nextEvent()
+		if assert.NotNil(t, event) {
+			assert.Equal(t, ScheduledSent, event.Scheduled.Status)
+			assert.NotEqual(t, uuid.Nil, event.Scheduled.MessageId)
+		}
+
+		listed, err := service.GetScheduledMessages(ctx, alice, uuid.Nil)
+		assert.Nil(t, err)
+		assert.Empty(t, listed)
+	})
+	t.Run("replica stops halfway", func(t *testing.T) {
+		scheduled, err := service.ScheduleMessage(ctx, alice, "laptop", direct.Id, &ScheduledMessageIn{Text: "see you", SendAt: clock.Now().Add(time.Minute)})
+		assert.Nil(t, err)
+		clock.Advance(time.Minute)
+
+		// The first replica claimed and sent it, but never released it.
+		claimed, err := storage.ClaimScheduledMessages(ctx, "gone", clock.Now(), clock.Now().Add(scheduledClaim), 10)
+		assert.Nil(t, err)
+		assert.Len(t, claimed, 1)
+		_, err = service.Deliver(ctx, alice, "", MessageIn{ChatId: direct.Id, Text: "see you", ClientId: scheduledClientId(scheduled.Id)})
+		assert.Nil(t, err)
+
+		// It can't be canceled while it's being sent.
+		err = request(server.cancelScheduledMessage, http.MethodDelete, alice, map[string]string{"scheduled_id": scheduled.Id.String()}, "", nil)
+		assert.Equal(t, http.StatusConflict, statusOf(err))
+		sent, err := replica.DispatchScheduledMessages(ctx, "b")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, sent)
+
+		// Another replica takes over once the claim runs out, without
+		// sending it again.
+		clock.Advance(scheduledClaim)
+		sent, err = replica.DispatchScheduledMessages(ctx, "b")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, sent)
+		assert.Equal(t, []string{"see you", "good morning"}, texts(direct.Id))
+	})
+	t.Run("failing", func(t *testing.T) {
+		group, err := service.CreateChat(ctx, alice, &ChatIn{Members: []uuid.UUID{bob}, Title: "gone soon"})
+		assert.Nil(t, err)
+		scheduled, err := service.ScheduleMessage(ctx, alice, "laptop", group.Id, &ScheduledMessageIn{Text: "anyone?", SendAt: clock.Now().Add(time.Minute)})
+		assert.Nil(t, err)
+		assert.Nil(t, service.RemoveMember(ctx, alice, group.Id, bob))
+		assert.Nil(t, storage.RemoveMember(ctx, group.Id, alice))
+
+		for i := 0; i < maxScheduledAttempts; i++ {
+			clock.Advance(time.Minute)
+			sent, err := service.DispatchScheduledMessages(ctx, "a")
+			assert.Nil(t, err)
+			assert.Equal(t, 0, sent)
+		}
+		stored, err := storage.GetScheduledMessage(ctx, scheduled.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, ScheduledFailed, stored.Status)
+		assert.Equal(t, ErrNotMember.Error(), stored.Error)
+
+		// It's left alone until the author changes it.
+		clock.Advance(time.Minute)
+		claimed, err := storage.ClaimScheduledMessages(ctx, "a", clock.Now(), clock.Now().Add(time.Minute), 10)
+		assert.Nil(t, err)
+		assert.Empty(t, claimed)
+	})
+}
+
+func TestDrafts(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	server, service, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+		&types.Account{Id: bob.String(), Username: "bob"},
+	)
+	ctx := context.Background()
+
+	saveDraft := func(method string, account, chatId uuid.UUID, body string) (*Draft, error) {
+		r := httptest.NewRequest(method, "/?device=laptop", strings.NewReader(body))
+		r.Header.Set("Authorization", account.String())
+		w := httptest.NewRecorder()
+		err := server.saveDraft(ctx, w, mux.SetURLVars(r, map[string]string{"id": chatId.String()}))
+		draft := &Draft{}
+		json.NewDecoder(w.Body).Decode(draft)
+		return draft, err
+	}
+	devices := map[string]*OnlineAccount{}
+	for _, device := range []string{"laptop", "phone"} {
+		conn, err := service.Connect(ctx, alice, device)
+		assert.Nil(t, err)
+		defer service.Disconnect(ctx, conn)
+		devices[device] = conn
+	}
+	nextEvent := func(device string) *Event {
+		for {
+			select {
+			case event := <-devices[device].Events():
+				if event.Type != EventPresence {
+					return &event
+				}
+			case <-time.After(50 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+
+	direct, _, err := service.GetDirectChat(ctx, alice, bob, false)
+	assert.Nil(t, err)
+
+	t.Run("synced", func(t *testing.T) {
+		draft, err := saveDraft(http.MethodPut, alice, direct.Id, `{"text": "I was thinking"}`)
+		assert.Nil(t, err)
+		assert.Equal(t, "I was thinking", draft.Text)
+
+		// The other device gets it, the one saving it doesn't.
+		event := nextEvent("phone")
+		if assert.NotNil(t, event) {
+			assert.Equal(t, EventDraft, event.Type)
+			assert.Equal(t, "I was thinking", event.Draft.Text)
+		}
+		assert.Nil(t, nextEvent("laptop"))
+
+		inbox, err := service.GetInbox(ctx, alice)
+		assert.Nil(t, err)
+		if assert.Len(t, inbox, 1) && assert.NotNil(t, inbox[0].Draft) {
+			assert.Equal(t, "I was thinking", inbox[0].Draft.Text)
+		}
+		// Drafts are private.
+		inbox, err = service.GetInbox(ctx, bob)
+		assert.Nil(t, err)
+		assert.Nil(t, inbox[0].Draft)
+	})
+	t.Run("cleared", func(t *testing.T) {
+		_, err := saveDraft(http.MethodDelete, alice, direct.Id, "")
+		assert.Nil(t, err)
+		event := nextEvent("phone")
+		if assert.NotNil(t, event) {
+			assert.Equal(t, "", event.Draft.Text)
+		}
+		drafts, err := service.GetDrafts(ctx, alice)
+		assert.Nil(t, err)
+		assert.Empty(t, drafts)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := saveDraft(http.MethodPut, alice, direct.Id, `{"text": "hi", "entities": [{"type": "bold", "offset": 1, "length": 5}]}`)
+		assert.Equal(t, http.StatusBadRequest, err.(*web.HttpError).StatusCode)
+		_, err = saveDraft(http.MethodPut, alice, uuid.New(), `{"text": "hi"}`)
+		assert.Equal(t, http.StatusNotFound, err.(*web.HttpError).StatusCode)
+	})
+}
+
+func TestShutdownClosesWebSockets(t *testing.T) {
+	validate = validator.New()
+	accounts := []*types.Account{
+		{
+			Id:       uuid.NewString(),
+			Username: "test1",
+			Name:     "test1",
+			Email:    "test1@gmail.com",
+		},
+	}
+	auth := client.NewFakeGRPCClient(accounts)
+	storage := NewMemoryStorage()
+	logger, _ := zap.NewProduction()
+
+	server := APIServer{
+		APIServer: web.APIServer{
+			Addr:   ":8080",
+			Logger: logger,
+		},
+		Auth:     auth,
+		Storage:  storage,
+		Service:  NewChatService(storage, auth, NewHub(4, 16, DisconnectSlowConsumer), NewLocalBroker()),
+		Upgrader: websocket.Upgrader{HandshakeTimeout: 3 * time.Second},
+	}
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	ws, _, err := socketDialer(accounts[0].Id).Dial(u, nil)
+	assert.Nil(t, err)
+	defer ws.Close()
+
+	// Keep reading so the close handshake gets answered.
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.Eventually(t, func() bool {
+		server.connections.mu.Lock()
+		defer server.connections.mu.Unlock()
+		return len(server.connections.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, server.connections.closeAll(ctx))
+
+	err = <-closed
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestSocketTickets(t *testing.T) {
+	alice := uuid.New()
+	server, _, storage := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+	)
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	ctx := context.Background()
+
+	issue := func() string {
+		r := httptest.NewRequest(http.MethodPost, "/ws/ticket", nil)
+		r.Header.Set("Authorization", alice.String())
+		w := httptest.NewRecorder()
+		assert.Nil(t, server.issueSocketTicket(ctx, w, r))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		ticket := &SocketTicket{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(ticket))
+		assert.NotEmpty(t, ticket.Ticket)
+		assert.True(t, ticket.ExpiresAt.After(time.Now()))
+		return ticket.Ticket
+	}
+
+	t.Run("issuing needs a token", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/ws/ticket", nil)
+		err := server.issueSocketTicket(ctx, httptest.NewRecorder(), r)
+		assert.Equal(t, http.StatusUnauthorized, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("query parameter", func(t *testing.T) {
+		ticket := issue()
+		ws, _, err := websocket.DefaultDialer.Dial(u+"?ticket="+ticket, nil)
+		assert.Nil(t, err)
+		defer ws.Close()
+		env := readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeSynced, env.Type)
+
+		// Someone who read it in a log is too late.
+		_, res, err := websocket.DefaultDialer.Dial(u+"?ticket="+ticket, nil)
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+	t.Run("subprotocol", func(t *testing.T) {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = []string{socketProtocol, "ticket." + issue()}
+		ws, _, err := dialer.Dial(u, nil)
+		assert.Nil(t, err)
+		defer ws.Close()
+		assert.Equal(t, socketProtocol, ws.Subprotocol())
+		env := readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeSynced, env.Type)
+	})
+	t.Run("first envelope", func(t *testing.T) {
+		ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+		assert.Nil(t, err)
+		defer ws.Close()
+		sendEnvelope(t, ws, EnvelopeAuth, "a", &AuthIn{Ticket: issue()})
+		env := readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeAck, env.Type)
+		env = readEnvelope(t, ws, nil)
+		assert.Equal(t, EnvelopeSynced, env.Type)
+	})
+	t.Run("token isn't stored", func(t *testing.T) {
+		ticket := issue()
+		stored := storage.tickets[socketTicketId(ticket)]
+		assert.Empty(t, stored.Token)
+		assert.NotContains(t, string(stored.SealedToken), alice.String())
+
+		// Only the ticket opens it.
+		_, err := openToken(issue(), stored.SealedToken)
+		assert.NotNil(t, err)
+		token, err := openToken(ticket, stored.SealedToken)
+		assert.Nil(t, err)
+		assert.Equal(t, alice.String(), token)
+	})
+	t.Run("unknown ticket", func(t *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial(u+"?ticket=unknown", nil)
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func TestSocketClosedWhenSessionEnds(t *testing.T) {
+	alice := uuid.New()
+	server, _, _ := newTestServer(t,
+		&types.Account{Id: alice.String(), Username: "alice"},
+	)
+	server.SessionCheckInterval = 10 * time.Millisecond
+	s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+	defer s.Close()
+
+	ws := dialWS(t, "ws"+strings.TrimPrefix(s.URL, "http"), alice.String())
+	defer ws.Close()
+
+	// The socket stays open while the session is valid.
+	time.Sleep(50 * time.Millisecond)
+	sendEnvelope(t, ws, EnvelopeStatus, "1", &StatusIn{Status: StatusAway})
+	env := readEnvelope(t, ws, nil)
+	assert.Equal(t, EnvelopeAck, env.Type)
+
+	server.Auth.(fakeAuth).Revoke(alice.String())
+
+	var err error
+	for err == nil {
+		_, _, err = ws.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	assert.Equal(t, "session expired or revoked", err.(*websocket.CloseError).Text)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin([]string{"https://app.example.com"})
+	for origin, allowed := range map[string]bool{
+		"":                          true,
+		"http://chat.example.com":   true,
+		"https://app.example.com":   true,
+		"https://evil.example.com":  false,
+		"https://app.example.com.x": false,
+		"::":                        false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://chat.example.com/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		assert.Equal(t, allowed, check(r), origin)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	reader := uuid.New()
+	server, _, _ := newTestServer(t,
+		&types.Account{Id: reader.String(), Username: "reader"},
+	)
+	server.Auth.(fakeAuth).Grant(reader.String(), types.ScopeRead)
+	ctx := context.Background()
+
+	t.Run("reads", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/chat/inbox", nil)
+		r.Header.Set("Authorization", reader.String())
+		w := httptest.NewRecorder()
+		assert.Nil(t, server.getInbox(ctx, w, r))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+	t.Run("writes", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader(`{"members": [], "is_private": false}`))
+		r.Header.Set("Authorization", reader.String())
+		err := server.createChat(ctx, httptest.NewRecorder(), r)
+		assert.Equal(t, http.StatusForbidden, err.(*web.HttpError).StatusCode)
+	})
+	t.Run("socket", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(server.wsHandler))
+		defer s.Close()
+		_, res, err := socketDialer(reader.String()).Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	})
+}
+
+// fakeAuth is what tests drive on the fake auth client besides looking up
+// accounts.
+type fakeAuth interface {
+	Follow(followerId, accountId string)
+	Revoke(token string)
+	Grant(token string, scopes ...string)
+}
+
+// newTestServer wires a server to a memory storage and a fake auth client
+// that knows the accounts, whose ids are their tokens.
+func newTestServer(t *testing.T, accounts ...*types.Account) (*APIServer, *chatService, *memoryStorage) {
+	validate = validator.New()
+	auth := client.NewFakeGRPCClient(accounts)
+	storage := NewMemoryStorage()
+	service := NewChatService(storage, auth, NewHub(4, 16, DisconnectSlowConsumer), NewLocalBroker())
+	logger, _ := zap.NewProduction()
+	server := &APIServer{
+		APIServer: web.APIServer{Logger: logger},
+		Auth:      auth,
+		Storage:   storage,
+		Service:   service,
+		Upgrader:  websocket.Upgrader{HandshakeTimeout: 3 * time.Second},
+	}
+	return server, service, storage
 }
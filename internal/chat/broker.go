@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Delivery is an event routed to every device of one account, except the
+// device it came from.
+type Delivery struct {
+	AccountID    uuid.UUID `json:"account_id"`
+	ExceptDevice string    `json:"except_device,omitempty"`
+	// Device limits the delivery to one device of the account.
+	Device string `json:"device,omitempty"`
+	Event  Event  `json:"event"`
+}
+
+// reaches reports whether the delivery is meant for the device.
+func (d *Delivery) reaches(deviceId string) bool {
+	if d.Device != "" {
+		return deviceId == d.Device
+	}
+	return deviceId != d.ExceptDevice
+}
+
+// Broker routes deliveries to whichever chat nodes hold the recipient's
+// connections and keeps track of which devices are online across nodes.
+type Broker interface {
+	Publish(ctx context.Context, delivery *Delivery) error
+	// Subscribe sets the handler for deliveries routed to this node.
+	Subscribe(handler func(*Delivery))
+
+	// Register adds the device, or replaces it when it's registered already.
+	Register(ctx context.Context, accountId uuid.UUID, device *Device) error
+	Unregister(ctx context.Context, accountId uuid.UUID, deviceId string) error
+	Devices(ctx context.Context, accountId uuid.UUID) ([]*Device, error)
+
+	Close(ctx context.Context) error
+}
+
+// localBroker is used when a single chat node is running.
+type localBroker struct {
+	mu      sync.RWMutex
+	handler func(*Delivery)
+	devices map[uuid.UUID]map[string]*Device
+}
+
+func NewLocalBroker() *localBroker {
+	return &localBroker{
+		devices: map[uuid.UUID]map[string]*Device{},
+	}
+}
+
+func (b *localBroker) Publish(ctx context.Context, delivery *Delivery) error {
+	b.mu.RLock()
+	handler := b.handler
+	b.mu.RUnlock()
+
+	if handler != nil {
+		handler(delivery)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(handler func(*Delivery)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+}
+
+func (b *localBroker) Register(ctx context.Context, accountId uuid.UUID, device *Device) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.devices[accountId] == nil {
+		b.devices[accountId] = map[string]*Device{}
+	}
+	clone := *device
+	b.devices[accountId][device.DeviceID] = &clone
+	return nil
+}
+
+func (b *localBroker) Unregister(ctx context.Context, accountId uuid.UUID, deviceId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.devices[accountId], deviceId)
+	if len(b.devices[accountId]) == 0 {
+		delete(b.devices, accountId)
+	}
+	return nil
+}
+
+func (b *localBroker) Devices(ctx context.Context, accountId uuid.UUID) ([]*Device, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	devices := []*Device{}
+	for _, device := range b.devices[accountId] {
+		clone := *device
+		devices = append(devices, &clone)
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+func (b *localBroker) Close(ctx context.Context) error {
+	return nil
+}
+
+func sortDevices(devices []*Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ConnectedAt.Before(devices[j].ConnectedAt)
+	})
+}
+
+const (
+	redisNodeTTL       = 30 * time.Second
+	redisNodeHeartbeat = 10 * time.Second
+)
+
+// unregisterScript removes a device only if it's still registered by the
+// calling node, a newer connection may have moved it to another node.
+var unregisterScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if current and cjson.decode(current)["node_id"] == ARGV[2] then
+	return redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+type redisDevice struct {
+	DeviceID    string    `json:"device_id"`
+	NodeID      string    `json:"node_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Away        bool      `json:"away,omitempty"`
+}
+
+// redisBroker lets several chat nodes share presence and route deliveries
+// through Redis. Every node keeps a key alive while it's running, which is
+// the node registry, and subscribes to its own delivery channel. Presence
+// entries of a node whose key expired are ignored and cleaned up lazily.
+type redisBroker struct {
+	client *redis.Client
+	nodeId string
+	pubsub *redis.PubSub
+
+	mu      sync.RWMutex
+	handler func(*Delivery)
+	local   map[uuid.UUID]map[string]struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewRedisBroker(ctx context.Context, client *redis.Client, nodeId string) (*redisBroker, error) {
+	b := &redisBroker{
+		client: client,
+		nodeId: nodeId,
+		local:  map[uuid.UUID]map[string]struct{}{},
+		stop:   make(chan struct{}),
+	}
+	if err := b.heartbeat(ctx); err != nil {
+		return nil, err
+	}
+
+	b.pubsub = client.Subscribe(ctx, b.channel(nodeId))
+	// Wait for the subscription so nothing published afterwards is missed.
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		b.pubsub.Close()
+		return nil, err
+	}
+
+	b.wg.Add(2)
+	go b.receive()
+	go b.keepAlive()
+	return b, nil
+}
+
+func (b *redisBroker) channel(nodeId string) string {
+	return "chat:deliver:" + nodeId
+}
+
+func (b *redisBroker) nodeKey(nodeId string) string {
+	return "chat:node:" + nodeId
+}
+
+func (b *redisBroker) presenceKey(accountId uuid.UUID) string {
+	return "chat:presence:" + accountId.String()
+}
+
+func (b *redisBroker) heartbeat(ctx context.Context) error {
+	return b.client.Set(ctx, b.nodeKey(b.nodeId), time.Now().UTC().Format(time.RFC3339), redisNodeTTL).Err()
+}
+
+func (b *redisBroker) keepAlive() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(redisNodeHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), redisNodeHeartbeat)
+			b.heartbeat(ctx)
+			cancel()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *redisBroker) receive() {
+	defer b.wg.Done()
+
+	for msg := range b.pubsub.Channel() {
+		delivery := &Delivery{}
+		if err := json.Unmarshal([]byte(msg.Payload), delivery); err != nil {
+			continue
+		}
+
+		b.mu.RLock()
+		handler := b.handler
+		b.mu.RUnlock()
+		if handler != nil {
+			handler(delivery)
+		}
+	}
+}
+
+func (b *redisBroker) Subscribe(handler func(*Delivery)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+}
+
+// Publish sends the delivery once to every live node that has a device of
+// the account, nothing is sent when the account is offline.
+func (b *redisBroker) Publish(ctx context.Context, delivery *Delivery) error {
+	devices, err := b.Devices(ctx, delivery.AccountID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	published := map[string]bool{}
+	for _, device := range devices {
+		if published[device.NodeID] || !delivery.reaches(device.DeviceID) {
+			continue
+		}
+		published[device.NodeID] = true
+		if err := b.client.Publish(ctx, b.channel(device.NodeID), payload).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisBroker) Register(ctx context.Context, accountId uuid.UUID, device *Device) error {
+	value, err := json.Marshal(&redisDevice{
+		DeviceID:    device.DeviceID,
+		NodeID:      b.nodeId,
+		ConnectedAt: device.ConnectedAt,
+		Away:        device.Away,
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.client.HSet(ctx, b.presenceKey(accountId), device.DeviceID, value).Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.local[accountId] == nil {
+		b.local[accountId] = map[string]struct{}{}
+	}
+	b.local[accountId][device.DeviceID] = struct{}{}
+	return nil
+}
+
+func (b *redisBroker) Unregister(ctx context.Context, accountId uuid.UUID, deviceId string) error {
+	b.mu.Lock()
+	delete(b.local[accountId], deviceId)
+	if len(b.local[accountId]) == 0 {
+		delete(b.local, accountId)
+	}
+	b.mu.Unlock()
+
+	return unregisterScript.Run(ctx, b.client, []string{b.presenceKey(accountId)}, deviceId, b.nodeId).Err()
+}
+
+// Devices lists the account's devices on nodes that are still alive.
+func (b *redisBroker) Devices(ctx context.Context, accountId uuid.UUID) ([]*Device, error) {
+	entries, err := b.client.HGetAll(ctx, b.presenceKey(accountId)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	alive := map[string]bool{}
+	devices := []*Device{}
+	for field, value := range entries {
+		entry := &redisDevice{}
+		if err := json.Unmarshal([]byte(value), entry); err != nil {
+			continue
+		}
+
+		isAlive, checked := alive[entry.NodeID]
+		if !checked {
+			n, err := b.client.Exists(ctx, b.nodeKey(entry.NodeID)).Result()
+			if err != nil {
+				return nil, err
+			}
+			isAlive = n == 1
+			alive[entry.NodeID] = isAlive
+		}
+		if !isAlive {
+			// The node died without cleaning up after itself.
+			unregisterScript.Run(ctx, b.client, []string{b.presenceKey(accountId)}, field, entry.NodeID)
+			continue
+		}
+
+		devices = append(devices, &Device{
+			DeviceID:    entry.DeviceID,
+			ConnectedAt: entry.ConnectedAt,
+			Away:        entry.Away,
+			NodeID:      entry.NodeID,
+		})
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+// Close unregisters the node and the devices connected to it.
+func (b *redisBroker) Close(ctx context.Context) error {
+	close(b.stop)
+	b.pubsub.Close()
+	b.wg.Wait()
+
+	b.mu.Lock()
+	local := b.local
+	b.local = map[uuid.UUID]map[string]struct{}{}
+	b.mu.Unlock()
+
+	for accountId, devices := range local {
+		for deviceId := range devices {
+			if err := unregisterScript.Run(ctx, b.client, []string{b.presenceKey(accountId)}, deviceId, b.nodeId).Err(); err != nil {
+				return fmt.Errorf("failed to unregister device: %w", err)
+			}
+		}
+	}
+	return b.client.Del(ctx, b.nodeKey(b.nodeId)).Err()
+}
+
+func (b *redisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
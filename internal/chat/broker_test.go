@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sina-am/social-media/internal/auth/client"
+	"github.com/sina-am/social-media/internal/auth/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisBroker(t *testing.T, mr *miniredis.Miniredis, nodeId string) *redisBroker {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	broker, err := NewRedisBroker(context.Background(), client, nodeId)
+	assert.Nil(t, err)
+	return broker
+}
+
+func TestBrokerPresence(t *testing.T) {
+	mr := miniredis.RunT(t)
+	brokers := map[string]Broker{
+		"local": NewLocalBroker(),
+		"redis": newTestRedisBroker(t, mr, "node-1"),
+	}
+
+	for name, broker := range brokers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			accountId := uuid.New()
+			now := time.Now().UTC()
+
+			assert.Nil(t, broker.Register(ctx, accountId, &Device{DeviceID: "phone", ConnectedAt: now}))
+			assert.Nil(t, broker.Register(ctx, accountId, &Device{DeviceID: "laptop", ConnectedAt: now.Add(time.Second)}))
+
+			devices, err := broker.Devices(ctx, accountId)
+			assert.Nil(t, err)
+			assert.Len(t, devices, 2)
+			assert.Equal(t, "phone", devices[0].DeviceID)
+
+			assert.Nil(t, broker.Unregister(ctx, accountId, "phone"))
+			devices, err = broker.Devices(ctx, accountId)
+			assert.Nil(t, err)
+			assert.Len(t, devices, 1)
+			assert.Equal(t, "laptop", devices[0].DeviceID)
+
+			received := make(chan *Delivery, 1)
+			broker.Subscribe(func(delivery *Delivery) { received <- delivery })
+			assert.Nil(t, broker.Publish(ctx, &Delivery{AccountID: accountId, Event: Event{Type: EventMessage, Message: &Message{Text: "hi"}}}))
+			select {
+			case delivery := <-received:
+				assert.Equal(t, "hi", delivery.Event.Message.Text)
+			case <-time.After(time.Second):
+				t.Fatal("delivery wasn't received")
+			}
+
+			assert.Nil(t, broker.Close(ctx))
+		})
+	}
+}
+
+func TestRedisBrokerAcrossNodes(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	node1 := newTestRedisBroker(t, mr, "node-1")
+	node2 := newTestRedisBroker(t, mr, "node-2")
+	defer node2.Close(ctx)
+
+	received1 := make(chan *Delivery, 4)
+	node1.Subscribe(func(delivery *Delivery) { received1 <- delivery })
+	received2 := make(chan *Delivery, 4)
+	node2.Subscribe(func(delivery *Delivery) { received2 <- delivery })
+
+	accountId := uuid.New()
+	assert.Nil(t, node1.Register(ctx, accountId, &Device{DeviceID: "phone", ConnectedAt: time.Now()}))
+
+	t.Run("presence is shared", func(t *testing.T) {
+		devices, err := node2.Devices(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Len(t, devices, 1)
+		assert.Equal(t, "node-1", devices[0].NodeID)
+	})
+	t.Run("delivery is routed to the node holding the device", func(t *testing.T) {
+		assert.Nil(t, node2.Publish(ctx, &Delivery{AccountID: accountId, Event: Event{Type: EventMessage, Message: &Message{Text: "hi"}}}))
+		select {
+		case delivery := <-received1:
+			assert.Equal(t, accountId, delivery.AccountID)
+			assert.Equal(t, "hi", delivery.Event.Message.Text)
+		case <-time.After(time.Second):
+			t.Fatal("delivery wasn't routed")
+		}
+		select {
+		case <-received2:
+			t.Fatal("node without devices shouldn't receive the delivery")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	t.Run("stale unregister keeps the newer registration", func(t *testing.T) {
+		// The device reconnected to node 2 before node 1 noticed it was gone.
+		assert.Nil(t, node2.Register(ctx, accountId, &Device{DeviceID: "phone", ConnectedAt: time.Now()}))
+		assert.Nil(t, node1.Unregister(ctx, accountId, "phone"))
+
+		devices, err := node1.Devices(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Len(t, devices, 1)
+		assert.Equal(t, "node-2", devices[0].NodeID)
+	})
+	t.Run("devices of a dead node are ignored", func(t *testing.T) {
+		otherId := uuid.New()
+		assert.Nil(t, node1.Register(ctx, otherId, &Device{DeviceID: "phone", ConnectedAt: time.Now()}))
+
+		// node 1 stops sending heartbeats without cleaning up.
+		close(node1.stop)
+		node1.pubsub.Close()
+		node1.wg.Wait()
+		mr.FastForward(redisNodeTTL + time.Second)
+
+		devices, err := node2.Devices(ctx, otherId)
+		assert.Nil(t, err)
+		assert.Len(t, devices, 0)
+		assert.False(t, mr.Exists("chat:presence:"+otherId.String()))
+	})
+}
+
+// nextMessageEvent skips the presence events queued for the connection.
+func nextMessageEvent(conn *OnlineAccount) <-chan Event {
+	next := make(chan Event, 1)
+	go func() {
+		for event := range conn.Events() {
+			if event.Type != EventPresence {
+				next <- event
+				return
+			}
+		}
+	}()
+	return next
+}
+
+func TestDeliverAcrossNodes(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	storage := NewMemoryStorage()
+	broker1, broker2 := newTestRedisBroker(t, mr, "node-1"), newTestRedisBroker(t, mr, "node-2")
+	defer broker1.Close(ctx)
+	defer broker2.Close(ctx)
+	sender, recipient := uuid.New(), uuid.New()
+	auth := client.NewFakeGRPCClient([]*types.Account{{Id: sender.String()}, {Id: recipient.String()}})
+	service1 := NewChatService(storage, auth, NewHub(4, 16, DropMessage), broker1)
+	service2 := NewChatService(storage, auth, NewHub(4, 16, DropMessage), broker2)
+
+	chat, err := service1.CreateChat(ctx, sender, &ChatIn{Members: []uuid.UUID{recipient}, IsPrivate: true})
+	assert.Nil(t, err)
+
+	recipientConn, err := service1.Connect(ctx, recipient, "phone")
+	assert.Nil(t, err)
+	senderLaptop, err := service1.Connect(ctx, sender, "laptop")
+	assert.Nil(t, err)
+	senderPhone, err := service2.Connect(ctx, sender, "phone")
+	assert.Nil(t, err)
+
+	_, err = service2.Deliver(ctx, sender, "phone", MessageIn{ChatId: chat.Id, Text: "hi"})
+	assert.Nil(t, err)
+
+	for _, conn := range []*OnlineAccount{recipientConn, senderLaptop} {
+		select {
+		case event := <-nextMessageEvent(conn):
+			assert.Equal(t, "hi", event.Message.Text)
+		case <-time.After(time.Second):
+			t.Fatal("message wasn't delivered across nodes")
+		}
+	}
+	select {
+	case <-senderPhone.Events():
+		t.Fatal("message shouldn't be echoed to the sending device")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	devices, err := service2.GetDevices(ctx, sender)
+	assert.Nil(t, err)
+	assert.Len(t, devices, 2)
+
+	assert.Nil(t, service1.Disconnect(ctx, senderLaptop))
+	devices, err = service2.GetDevices(ctx, sender)
+	assert.Nil(t, err)
+	assert.Len(t, devices, 1)
+}
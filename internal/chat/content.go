@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// previewTimeout bounds how long delivering a message waits for the
+// preview of its link.
+const previewTimeout = 3 * time.Second
+
+var (
+	ErrEmptyMessage      = errors.New("a message needs text or attachments")
+	ErrUnknownMedia      = errors.New("attachment wasn't uploaded")
+	ErrInvalidAttachment = errors.New("attachment doesn't match the uploaded media")
+	ErrInvalidEntity     = errors.New("invalid entity")
+)
+
+// Media is what the media service knows about an upload.
+type Media struct {
+	Id          uuid.UUID         `json:"id"`
+	OwnerId     string            `json:"owner_id"`
+	ContentType string            `json:"content_type"`
+	Name        string            `json:"name"`
+	Size        int               `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	URL         string            `json:"url"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+}
+
+// MediaClient looks up uploads on the media service.
+type MediaClient interface {
+	GetMedia(ctx context.Context, mediaId uuid.UUID) (*Media, error)
+}
+
+type httpMediaClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewMediaClient returns a client of the media service serving uploads
+// under baseURL.
+func NewMediaClient(baseURL string) *httpMediaClient {
+	return &httpMediaClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *httpMediaClient) GetMedia(ctx context.Context, mediaId uuid.UUID) (*Media, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/"+mediaId.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUnknownMedia
+	default:
+		return nil, fmt.Errorf("media service responded %s", res.Status)
+	}
+
+	media := &Media{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// accepts reports whether an upload of the content type can be sent as an
+// attachment of the type.
+func (t AttachmentType) accepts(contentType string) bool {
+	switch t {
+	case AttachmentImage:
+		return strings.HasPrefix(contentType, "image/")
+	case AttachmentVoice:
+		return strings.HasPrefix(contentType, "audio/") ||
+			contentType == "application/ogg" || contentType == "video/webm"
+	}
+	return true
+}
+
+// attachments looks up the uploads the attachments refer to, which have to
+// be accountId's own and of the attachment's type.
+func (s *chatService) attachments(ctx context.Context, accountId uuid.UUID, in []*Attachment) ([]*Attachment, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	if s.media == nil {
+		return nil, ErrUnknownMedia
+	}
+
+	attachments := make([]*Attachment, 0, len(in))
+	for _, attachment := range in {
+		media, err := s.media.GetMedia(ctx, attachment.MediaId)
+		if err != nil {
+			return nil, err
+		}
+		if media.OwnerId != accountId.String() || !attachment.Type.accepts(media.ContentType) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidAttachment, attachment.MediaId)
+		}
+		attachments = append(attachments, &Attachment{
+			Type:        attachment.Type,
+			MediaId:     media.Id,
+			URL:         media.URL,
+			ContentType: media.ContentType,
+			Name:        media.Name,
+			Size:        media.Size,
+			Width:       media.Width,
+			Height:      media.Height,
+			Thumbnails:  media.Thumbnails,
+		})
+	}
+	return attachments, nil
+}
+
+// checkEntities checks the entities fit in the text and mentions name
+// members of the chat. It returns them ordered by offset.
+func checkEntities(chat *Chat, text string, entities []*Entity) ([]*Entity, error) {
+	if len(entities) == 0 {
+		return nil, nil
+	}
+
+	length := utf8.RuneCountInString(text)
+	checked := make([]*Entity, 0, len(entities))
+	for _, entity := range entities {
+		if entity.Offset < 0 || entity.Length < 1 ||
+			entity.Offset > length || entity.Length > length-entity.Offset {
+			return nil, fmt.Errorf("%w: %s at %d is outside the text", ErrInvalidEntity, entity.Type, entity.Offset)
+		}
+		switch entity.Type {
+		case EntityMention:
+			if entity.AccountId == nil || !contains(chat.Members, *entity.AccountId) {
+				return nil, fmt.Errorf("%w: mentioned account isn't a member", ErrInvalidEntity)
+			}
+		case EntityBold, EntityItalic, EntityCode:
+			if entity.AccountId != nil {
+				return nil, fmt.Errorf("%w: only mentions name an account", ErrInvalidEntity)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidEntity, entity.Type)
+		}
+		copied := *entity
+		checked = append(checked, &copied)
+	}
+	sort.SliceStable(checked, func(i, j int) bool {
+		return checked[i].Offset < checked[j].Offset
+	})
+	return checked, nil
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// firstLink returns the first http link in the text, leaving out the
+// punctuation that usually follows a link in a sentence.
+func firstLink(text string) string {
+	link := linkPattern.FindString(text)
+	return strings.TrimRight(link, ".,;:!?'\")]}")
+}
+
+// preview returns the preview of the first link in the text, nil when
+// there's none or it couldn't be generated in time.
+func (s *chatService) preview(ctx context.Context, text string) *LinkPreview {
+	link := firstLink(text)
+	if s.previews == nil || link == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+	preview, err := s.previews.FetchPreview(ctx, link)
+	if err != nil {
+		return nil
+	}
+	return preview
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMediaClient serves uploads from memory.
+type fakeMediaClient map[uuid.UUID]*Media
+
+func (c fakeMediaClient) GetMedia(ctx context.Context, mediaId uuid.UUID) (*Media, error) {
+	media, ok := c[mediaId]
+	if !ok {
+		return nil, ErrUnknownMedia
+	}
+	return media, nil
+}
+
+// stubPreviewFetcher returns the previews it was given by link, and records
+// which links were fetched.
+type stubPreviewFetcher struct {
+	previews map[string]*LinkPreview
+	fetched  []string
+}
+
+func (f *stubPreviewFetcher) FetchPreview(ctx context.Context, link string) (*LinkPreview, error) {
+	f.fetched = append(f.fetched, link)
+	preview, ok := f.previews[link]
+	if !ok {
+		return nil, ErrNoPreview
+	}
+	copied := *preview
+	return &copied, nil
+}
+
+func TestCheckEntities(t *testing.T) {
+	member, stranger := uuid.New(), uuid.New()
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{uuid.New(), member}}
+	text := "héllo @bob"
+
+	entities, err := checkEntities(chat, text, []*Entity{
+		{Type: EntityMention, Offset: 6, Length: 4, AccountId: &member},
+		{Type: EntityBold, Offset: 0, Length: 5},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, EntityBold, entities[0].Type)
+	assert.Equal(t, EntityMention, entities[1].Type)
+
+	invalid := map[string][]*Entity{
+		"past the end":        {{Type: EntityCode, Offset: 6, Length: 5}},
+		"negative offset":     {{Type: EntityCode, Offset: -1, Length: 2}},
+		"overflowing end":     {{Type: EntityCode, Offset: math.MaxInt64, Length: 1}},
+		"empty":               {{Type: EntityItalic, Offset: 1, Length: 0}},
+		"mentions a stranger": {{Type: EntityMention, Offset: 6, Length: 4, AccountId: &stranger}},
+		"mentions nobody":     {{Type: EntityMention, Offset: 6, Length: 4}},
+		"bold with account":   {{Type: EntityBold, Offset: 0, Length: 2, AccountId: &member}},
+		"unknown type":        {{Type: "underline", Offset: 0, Length: 2}},
+	}
+	for name, entities := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := checkEntities(chat, text, entities)
+			assert.ErrorIs(t, err, ErrInvalidEntity)
+		})
+	}
+}
+
+func TestFirstLink(t *testing.T) {
+	assert.Equal(t, "https://example.com/a?b=c", firstLink("see https://example.com/a?b=c."))
+	assert.Equal(t, "http://example.com", firstLink("(http://example.com) and https://other.com"))
+	assert.Equal(t, "", firstLink("no links, ftp://example.com neither"))
+}
+
+func TestParseOpenGraph(t *testing.T) {
+	pageURL, _ := url.Parse("https://example.com/posts/1")
+
+	page := `<!doctype html><html><head>
+		<title>Fallback</title>
+		<meta property="og:title" content="A post">
+		<meta property="og:site_name" content="Example">
+		<meta name="description" content="Plain description">
+		<meta property="og:image" content="/cover.png">
+		</head><body><meta property="og:title" content="Not in the head"></body></html>`
+	preview := parseOpenGraph(pageURL, strings.NewReader(page))
+	assert.Equal(t, &LinkPreview{
+		SiteName:    "Example",
+		Title:       "A post",
+		Description: "Plain description",
+		Image:       "https://example.com/cover.png",
+	}, preview)
+
+	page = `<html><head><title> Only a title </title><meta property="og:image" content="javascript:alert(1)"></head></html>`
+	preview = parseOpenGraph(pageURL, strings.NewReader(page))
+	assert.Equal(t, "Only a title", preview.Title)
+	assert.Empty(t, preview.Image)
+
+	assert.Nil(t, parseOpenGraph(pageURL, strings.NewReader(`<html><body>nothing</body></html>`)))
+}
+
+func TestOpenGraphFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<html><head><meta property="og:title" content="Page"><meta property="og:image" content="img.png"></head></html>`))
+		case "/moved":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/file":
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write([]byte("PK"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	t.Run("fetch", func(t *testing.T) {
+		fetcher := &openGraphFetcher{client: server.Client()}
+		preview, err := fetcher.FetchPreview(ctx, server.URL+"/moved")
+		assert.Nil(t, err)
+		assert.Equal(t, server.URL+"/moved", preview.URL)
+		assert.Equal(t, "Page", preview.Title)
+		assert.Equal(t, server.URL+"/img.png", preview.Image)
+
+		_, err = fetcher.FetchPreview(ctx, server.URL+"/file")
+		assert.ErrorIs(t, err, ErrNoPreview)
+		_, err = fetcher.FetchPreview(ctx, server.URL+"/missing")
+		assert.ErrorIs(t, err, ErrNoPreview)
+	})
+	t.Run("private addresses", func(t *testing.T) {
+		_, err := NewOpenGraphFetcher(time.Second).FetchPreview(ctx, server.URL+"/page")
+		assert.True(t, errors.Is(err, ErrPrivateAddress), err)
+	})
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"198.18.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			assert.Equal(t, test.public, isPublicIP(netip.MustParseAddr(test.ip)))
+		})
+	}
+}
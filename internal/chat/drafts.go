@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// SaveDraft replaces the account's draft of the chat and tells its other
+// devices, an empty draft removes it. Drafts would be in the clear, there
+// are none in encrypted chats.
+func (s *chatService) SaveDraft(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, in *DraftIn) (*Draft, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+	if chat.Encrypted {
+		return nil, ErrEncrypted
+	}
+	entities, err := checkEntities(chat, in.Text, in.Entities)
+	if err != nil {
+		return nil, err
+	}
+
+	draft := &Draft{
+		ChatId:         chatId,
+		AccountId:      accountId,
+		ReplyMessageId: in.ReplyMessageId,
+		Text:           in.Text,
+		Entities:       entities,
+		UpdatedAt:      s.now(),
+	}
+	if draft.isEmpty() {
+		err = s.store.DeleteDraft(ctx, accountId, chatId)
+	} else {
+		err = s.store.SaveDraft(ctx, draft)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := Event{Type: EventDraft, Draft: draft}
+	return draft, s.publish(ctx, []uuid.UUID{accountId}, accountId, deviceId, event)
+}
+
+// GetDrafts returns the account's drafts, the most recently changed first.
+func (s *chatService) GetDrafts(ctx context.Context, accountId uuid.UUID) ([]*Draft, error) {
+	return s.store.GetDrafts(ctx, accountId)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNotGroup       = errors.New("only group chats can be administered")
+	ErrNotAdmin       = errors.New("only admins can do this")
+	ErrNotOwner       = errors.New("only the owner can do this")
+	ErrNoSuchMember   = errors.New("account isn't a member of this chat")
+	ErrOwner          = errors.New("the owner can't be removed or demoted")
+	ErrOwnerCantLeave = errors.New("the owner has to transfer the ownership before leaving")
+	ErrInviteExpired  = errors.New("invite has expired")
+)
+
+// getGroup returns the group, checking accountId is a member with at least
+// the given role.
+func (s *chatService) getGroup(ctx context.Context, accountId, chatId uuid.UUID, role Role) (*Chat, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+	if chat.IsPrivate {
+		return nil, ErrNotGroup
+	}
+
+	switch role {
+	case RoleOwner:
+		if chat.RoleOf(accountId) != RoleOwner {
+			return nil, ErrNotOwner
+		}
+	case RoleAdmin:
+		if chat.RoleOf(accountId) == RoleMember {
+			return nil, ErrNotAdmin
+		}
+	}
+	return chat, nil
+}
+
+// postSystemMessage posts a message about a change accountId made to the
+// group and pushes it to recipients, which include accounts that just
+// left so they learn about it too.
+func (s *chatService) postSystemMessage(ctx context.Context, chatId, accountId uuid.UUID, system *SystemMessage, recipients []uuid.UUID) error {
+	msg := &Message{
+		FromAccountId: accountId,
+		System:        system,
+		CreatedAt:     s.now(),
+	}
+	if err := s.store.InsertMessage(ctx, chatId, msg); err != nil {
+		return err
+	}
+	return s.publish(ctx, recipients, accountId, "", Event{Type: EventMessage, Message: msg})
+}
+
+// UpdateChatInfo changes the title, description or avatar of the group.
+func (s *chatService) UpdateChatInfo(ctx context.Context, accountId, chatId uuid.UUID, info *ChatInfoIn) (*Chat, error) {
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *chat
+	if info.Title != nil {
+		updated.Title = *info.Title
+	}
+	if info.Description != nil {
+		updated.Description = *info.Description
+	}
+	if info.Avatar != nil {
+		updated.Avatar = *info.Avatar
+	}
+	if updated.Title == chat.Title && updated.Description == chat.Description && updated.Avatar == chat.Avatar {
+		return chat, nil
+	}
+	if err := s.store.UpdateChatInfo(ctx, &updated); err != nil {
+		return nil, err
+	}
+
+	system := &SystemMessage{Type: SystemInfoChanged, Title: updated.Title}
+	if err := s.postSystemMessage(ctx, chatId, accountId, system, chat.Members); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chatId)
+}
+
+// AddMembers adds the accounts which aren't members yet to the group.
+func (s *chatService) AddMembers(ctx context.Context, accountId, chatId uuid.UUID, members []uuid.UUID) (*Chat, error) {
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	added := []uuid.UUID{}
+	for _, memberId := range members {
+		if !contains(chat.Members, memberId) && !contains(added, memberId) {
+			added = append(added, memberId)
+		}
+	}
+	if len(added) == 0 {
+		return chat, nil
+	}
+	if err := s.checkAccounts(ctx, added); err != nil {
+		return nil, err
+	}
+	if err := s.checkDMPolicies(ctx, accountId, added); err != nil {
+		return nil, err
+	}
+	if err := s.store.AddMembers(ctx, chatId, added); err != nil {
+		return nil, err
+	}
+
+	system := &SystemMessage{Type: SystemMembersAdded, Members: added}
+	if err := s.postSystemMessage(ctx, chatId, accountId, system, append(chat.Members, added...)); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chatId)
+}
+
+// RemoveMember removes a member from the group. Only the owner removes
+// admins, nobody removes the owner. Removing yourself is leaving.
+func (s *chatService) RemoveMember(ctx context.Context, accountId, chatId, memberId uuid.UUID) error {
+	if memberId == accountId {
+		return s.LeaveChat(ctx, accountId, chatId)
+	}
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if !s.IsMemberOf(memberId, chat) {
+		return ErrNoSuchMember
+	}
+	switch chat.RoleOf(memberId) {
+	case RoleOwner:
+		return ErrOwner
+	case RoleAdmin:
+		if chat.RoleOf(accountId) != RoleOwner {
+			return ErrNotOwner
+		}
+	}
+
+	if err := s.store.RemoveMember(ctx, chatId, memberId); err != nil {
+		return err
+	}
+	system := &SystemMessage{Type: SystemMemberRemoved, Members: []uuid.UUID{memberId}}
+	return s.postSystemMessage(ctx, chatId, accountId, system, chat.Members)
+}
+
+// LeaveChat removes the account from the group. The owner can only leave
+// once nobody else is left.
+func (s *chatService) LeaveChat(ctx context.Context, accountId, chatId uuid.UUID) error {
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleMember)
+	if err != nil {
+		return err
+	}
+	if chat.RoleOf(accountId) == RoleOwner && len(chat.Members) > 1 {
+		return ErrOwnerCantLeave
+	}
+
+	if err := s.store.RemoveMember(ctx, chatId, accountId); err != nil {
+		return err
+	}
+	system := &SystemMessage{Type: SystemMemberLeft, Members: []uuid.UUID{accountId}}
+	return s.postSystemMessage(ctx, chatId, accountId, system, chat.Members)
+}
+
+// SetRole makes a member an admin or takes the admin role away, which only
+// the owner may do.
+func (s *chatService) SetRole(ctx context.Context, accountId, chatId, memberId uuid.UUID, role Role) (*Chat, error) {
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(memberId, chat) {
+		return nil, ErrNoSuchMember
+	}
+	current := chat.RoleOf(memberId)
+	if current == RoleOwner {
+		return nil, ErrOwner
+	}
+	if current == role {
+		return chat, nil
+	}
+
+	if err := s.store.SetAdmin(ctx, chatId, memberId, role == RoleAdmin); err != nil {
+		return nil, err
+	}
+	system := &SystemMessage{Type: SystemRoleChanged, Members: []uuid.UUID{memberId}, Role: role}
+	if err := s.postSystemMessage(ctx, chatId, accountId, system, chat.Members); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chatId)
+}
+
+// TransferOwnership makes another member the owner, the previous owner
+// stays an admin.
+func (s *chatService) TransferOwnership(ctx context.Context, accountId, chatId, ownerId uuid.UUID) (*Chat, error) {
+	chat, err := s.getGroup(ctx, accountId, chatId, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(ownerId, chat) {
+		return nil, ErrNoSuchMember
+	}
+	if ownerId == accountId {
+		return chat, nil
+	}
+
+	if err := s.store.SetOwner(ctx, chatId, ownerId); err != nil {
+		return nil, err
+	}
+	if err := s.store.SetAdmin(ctx, chatId, accountId, true); err != nil {
+		return nil, err
+	}
+	system := &SystemMessage{Type: SystemOwnerChanged, Members: []uuid.UUID{ownerId}}
+	if err := s.postSystemMessage(ctx, chatId, accountId, system, chat.Members); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chatId)
+}
+
+// CreateInvite creates an invite link to the group which expires after
+// ttl, a week when it's zero and at most a month.
+func (s *chatService) CreateInvite(ctx context.Context, accountId, chatId uuid.UUID, ttl time.Duration) (*Invite, error) {
+	if _, err := s.getGroup(ctx, accountId, chatId, RoleAdmin); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = defaultInviteTTL
+	}
+	if ttl > maxInviteTTL {
+		ttl = maxInviteTTL
+	}
+
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	invite := &Invite{
+		Code:      base64.RawURLEncoding.EncodeToString(code),
+		ChatId:    chatId,
+		CreatedBy: accountId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.store.InsertInvite(ctx, invite); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// GetInvites returns the group's invites which haven't expired.
+func (s *chatService) GetInvites(ctx context.Context, accountId, chatId uuid.UUID) ([]*Invite, error) {
+	if _, err := s.getGroup(ctx, accountId, chatId, RoleAdmin); err != nil {
+		return nil, err
+	}
+	invites, err := s.store.GetChatInvites(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock()
+	valid := []*Invite{}
+	for _, invite := range invites {
+		if invite.ExpiresAt.After(now) {
+			valid = append(valid, invite)
+		}
+	}
+	return valid, nil
+}
+
+func (s *chatService) RevokeInvite(ctx context.Context, accountId, chatId uuid.UUID, code string) error {
+	if _, err := s.getGroup(ctx, accountId, chatId, RoleAdmin); err != nil {
+		return err
+	}
+	return s.store.DeleteInvite(ctx, chatId, code)
+}
+
+// JoinChat adds the account to the group the invite is for.
+func (s *chatService) JoinChat(ctx context.Context, accountId uuid.UUID, code string) (*Chat, error) {
+	invite, err := s.store.GetInvite(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !invite.ExpiresAt.After(s.clock()) {
+		return nil, ErrInviteExpired
+	}
+
+	chat, err := s.store.GetChat(ctx, invite.ChatId)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsMemberOf(accountId, chat) {
+		return chat, nil
+	}
+	if err := s.store.AddMembers(ctx, chat.Id, []uuid.UUID{accountId}); err != nil {
+		return nil, err
+	}
+
+	system := &SystemMessage{Type: SystemMemberJoined, Members: []uuid.UUID{accountId}}
+	if err := s.postSystemMessage(ctx, chat.Id, accountId, system, append(chat.Members, accountId)); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chat.Id)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BackpressurePolicy decides what happens to an event when the recipient's
+// outbound queue is full, which means its socket isn't keeping up.
+type BackpressurePolicy int
+
+const (
+	// DropMessage discards the event, the client can fetch it later.
+	DropMessage BackpressurePolicy = iota
+	// DisconnectSlowConsumer closes the connection so the client reconnects.
+	DisconnectSlowConsumer
+)
+
+// OnlineAccount is one connected device of an account.
+type OnlineAccount struct {
+	accountID   uuid.UUID
+	deviceID    string
+	connectedAt time.Time
+	events      chan Event
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewOnlineAccount(accountID uuid.UUID, deviceID string, queueSize int) *OnlineAccount {
+	return &OnlineAccount{
+		accountID:   accountID,
+		deviceID:    deviceID,
+		connectedAt: time.Now().UTC(),
+		events:      make(chan Event, queueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func (ws *OnlineAccount) GetAccountID() uuid.UUID {
+	return ws.accountID
+}
+
+func (ws *OnlineAccount) GetDeviceID() string {
+	return ws.deviceID
+}
+
+// Events is the outbound queue the socket writer consumes.
+func (ws *OnlineAccount) Events() <-chan Event {
+	return ws.events
+}
+
+// Done is closed once the connection must stop, either because it was
+// disconnected or because it fell too far behind.
+func (ws *OnlineAccount) Done() <-chan struct{} {
+	return ws.done
+}
+
+func (ws *OnlineAccount) Close() {
+	ws.closeOnce.Do(func() { close(ws.done) })
+}
+
+// enqueue never blocks. The queue channel is never closed, so a send can't
+// race with the connection going away.
+func (ws *OnlineAccount) enqueue(event Event, policy BackpressurePolicy) bool {
+	select {
+	case <-ws.done:
+		return false
+	default:
+	}
+
+	select {
+	case ws.events <- event:
+		return true
+	default:
+		if policy == DisconnectSlowConsumer {
+			ws.Close()
+		}
+		return false
+	}
+}
+
+// Device describes a connected device for presence.
+type Device struct {
+	DeviceID    string    `json:"device_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Away is set by the client while the user is idle.
+	Away bool `json:"away"`
+	// NodeID is the chat node holding the connection.
+	NodeID string `json:"-"`
+}
+
+type hubShard struct {
+	mu       sync.RWMutex
+	accounts map[uuid.UUID]map[string]*OnlineAccount
+}
+
+// devices returns a snapshot of the account's connections so events can
+// be queued without holding the lock.
+func (s *hubShard) devices(accountId uuid.UUID) []*OnlineAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	devices := make([]*OnlineAccount, 0, len(s.accounts[accountId]))
+	for _, device := range s.accounts[accountId] {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// Hub tracks online accounts and each of their connected devices. Accounts
+// are spread over shards, each with its own lock, so connects and
+// deliveries for different accounts rarely contend.
+type Hub struct {
+	shards    []*hubShard
+	queueSize int
+	policy    BackpressurePolicy
+}
+
+func NewHub(shardCount, queueSize int, policy BackpressurePolicy) *Hub {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shards := make([]*hubShard, shardCount)
+	for i := range shards {
+		shards[i] = &hubShard{accounts: map[uuid.UUID]map[string]*OnlineAccount{}}
+	}
+	return &Hub{
+		shards:    shards,
+		queueSize: queueSize,
+		policy:    policy,
+	}
+}
+
+func (h *Hub) shard(accountId uuid.UUID) *hubShard {
+	f := fnv.New32a()
+	f.Write(accountId[:])
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// Connect registers a new connection for the account's device. An older
+// connection from the same device is closed, other devices are kept.
+func (h *Hub) Connect(accountId uuid.UUID, deviceId string) *OnlineAccount {
+	account := NewOnlineAccount(accountId, deviceId, h.queueSize)
+
+	shard := h.shard(accountId)
+	shard.mu.Lock()
+	devices, found := shard.accounts[accountId]
+	if !found {
+		devices = map[string]*OnlineAccount{}
+		shard.accounts[accountId] = devices
+	}
+	old := devices[deviceId]
+	devices[deviceId] = account
+	shard.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return account
+}
+
+// Disconnect closes the connection and unregisters it, unless it has
+// already been replaced by a newer one from the same device. It reports
+// whether the device went offline.
+func (h *Hub) Disconnect(account *OnlineAccount) bool {
+	account.Close()
+
+	shard := h.shard(account.accountID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	removed := false
+	devices := shard.accounts[account.accountID]
+	if devices[account.deviceID] == account {
+		delete(devices, account.deviceID)
+		removed = true
+	}
+	if len(devices) == 0 {
+		delete(shard.accounts, account.accountID)
+	}
+	return removed
+}
+
+// Send queues event on every device of the account and returns on how many
+// devices it was queued.
+func (h *Hub) Send(accountId uuid.UUID, event Event) int {
+	return h.SendExcept(accountId, "", event)
+}
+
+// SendExcept is like Send but skips exceptDevice, usually the device the
+// event came from.
+func (h *Hub) SendExcept(accountId uuid.UUID, exceptDevice string, event Event) int {
+	sent := 0
+	for _, device := range h.shard(accountId).devices(accountId) {
+		if device.deviceID == exceptDevice {
+			continue
+		}
+		if device.enqueue(event, h.policy) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// SendTo queues event on one device of the account and reports whether it
+// was queued.
+func (h *Hub) SendTo(accountId uuid.UUID, deviceId string, event Event) bool {
+	for _, device := range h.shard(accountId).devices(accountId) {
+		if device.deviceID == deviceId {
+			return device.enqueue(event, h.policy)
+		}
+	}
+	return false
+}
+
+func (h *Hub) IsOnline(accountId uuid.UUID) bool {
+	shard := h.shard(accountId)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return len(shard.accounts[accountId]) > 0
+}
+
+// Devices lists the connected devices of the account, oldest first.
+func (h *Hub) Devices(accountId uuid.UUID) []*Device {
+	devices := []*Device{}
+	for _, device := range h.shard(accountId).devices(accountId) {
+		devices = append(devices, &Device{
+			DeviceID:    device.deviceID,
+			ConnectedAt: device.connectedAt,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ConnectedAt.Before(devices[j].ConnectedAt)
+	})
+	return devices
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sina-am/social-media/internal/auth/client"
+	"github.com/sina-am/social-media/internal/auth/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	t.Run("send to offline account", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		assert.Equal(t, 0, hub.Send(uuid.New(), Event{Type: EventMessage, Message: &Message{Text: "hi"}}))
+	})
+	t.Run("send to online account", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		account := hub.Connect(uuid.New(), "phone")
+		assert.Equal(t, 1, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "hi"}}))
+		assert.Equal(t, "hi", (<-account.Events()).Message.Text)
+	})
+	t.Run("drop message when queue is full", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		account := hub.Connect(uuid.New(), "phone")
+		assert.Equal(t, 1, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "first"}}))
+		assert.Equal(t, 0, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "second"}}))
+
+		assert.Equal(t, "first", (<-account.Events()).Message.Text)
+		select {
+		case <-account.Done():
+			t.Fatal("connection shouldn't be closed")
+		default:
+		}
+	})
+	t.Run("disconnect slow consumer", func(t *testing.T) {
+		hub := NewHub(4, 1, DisconnectSlowConsumer)
+		account := hub.Connect(uuid.New(), "phone")
+		assert.Equal(t, 1, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "first"}}))
+		assert.Equal(t, 0, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "second"}}))
+
+		select {
+		case <-account.Done():
+		case <-time.After(time.Second):
+			t.Fatal("slow consumer wasn't disconnected")
+		}
+		assert.Equal(t, 0, hub.Send(account.GetAccountID(), Event{Type: EventMessage, Message: &Message{Text: "third"}}))
+	})
+	t.Run("stale disconnect keeps newer connection", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		accountId := uuid.New()
+		old := hub.Connect(accountId, "phone")
+		current := hub.Connect(accountId, "phone")
+
+		select {
+		case <-old.Done():
+		default:
+			t.Fatal("replaced connection should be closed")
+		}
+
+		hub.Disconnect(old)
+		assert.True(t, hub.IsOnline(accountId))
+		assert.Equal(t, 1, hub.Send(accountId, Event{Type: EventMessage, Message: &Message{Text: "hi"}}))
+		assert.Equal(t, "hi", (<-current.Events()).Message.Text)
+	})
+	t.Run("fan out to every device", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		accountId := uuid.New()
+		phone := hub.Connect(accountId, "phone")
+		laptop := hub.Connect(accountId, "laptop")
+
+		assert.Equal(t, 2, hub.Send(accountId, Event{Type: EventMessage, Message: &Message{Text: "hi"}}))
+		assert.Equal(t, "hi", (<-phone.Events()).Message.Text)
+		assert.Equal(t, "hi", (<-laptop.Events()).Message.Text)
+
+		assert.Equal(t, 1, hub.SendExcept(accountId, "phone", Event{Type: EventMessage, Message: &Message{Text: "sync"}}))
+		assert.Equal(t, "sync", (<-laptop.Events()).Message.Text)
+		assert.Len(t, phone.Events(), 0)
+	})
+	t.Run("per device presence", func(t *testing.T) {
+		hub := NewHub(4, 1, DropMessage)
+		accountId := uuid.New()
+		phone := hub.Connect(accountId, "phone")
+		laptop := hub.Connect(accountId, "laptop")
+
+		devices := hub.Devices(accountId)
+		assert.Len(t, devices, 2)
+		assert.Equal(t, "phone", devices[0].DeviceID)
+		assert.Equal(t, "laptop", devices[1].DeviceID)
+
+		hub.Disconnect(phone)
+		devices = hub.Devices(accountId)
+		assert.Len(t, devices, 1)
+		assert.Equal(t, "laptop", devices[0].DeviceID)
+
+		hub.Disconnect(laptop)
+		assert.False(t, hub.IsOnline(accountId))
+		assert.Empty(t, hub.Devices(accountId))
+	})
+}
+
+// TestHubConcurrency is meant to be run with the race detector.
+func TestHubConcurrency(t *testing.T) {
+	hub := NewHub(8, 4, DisconnectSlowConsumer)
+	accountIds := make([]uuid.UUID, 16)
+	for i := range accountIds {
+		accountIds[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				account := hub.Connect(accountIds[(i+j)%len(accountIds)], fmt.Sprint(j%3))
+
+				// Half of the connections drain their queue, the others are
+				// slow consumers.
+				if i%2 == 0 {
+					go func() {
+						for {
+							select {
+							case <-account.Events():
+							case <-account.Done():
+								return
+							}
+						}
+					}()
+				}
+				hub.Disconnect(account)
+			}
+		}(i)
+	}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				hub.Send(accountIds[(i*j)%len(accountIds)], Event{Type: EventMessage, Message: &Message{Text: "hi"}})
+				hub.IsOnline(accountIds[j%len(accountIds)])
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock between connects, disconnects and deliveries")
+	}
+
+	for _, accountId := range accountIds {
+		assert.False(t, hub.IsOnline(accountId))
+	}
+}
+
+func TestDeliverToStalledRecipient(t *testing.T) {
+	storage := NewMemoryStorage()
+	sender, recipient := uuid.New(), uuid.New()
+	auth := client.NewFakeGRPCClient([]*types.Account{{Id: sender.String()}, {Id: recipient.String()}})
+	service := NewChatService(storage, auth, NewHub(4, 1, DisconnectSlowConsumer), NewLocalBroker())
+	chat, err := service.CreateChat(context.Background(), sender, &ChatIn{Members: []uuid.UUID{recipient}, IsPrivate: true})
+	assert.Nil(t, err)
+
+	// Nobody reads from the recipient's queue.
+	stalled, err := service.Connect(context.Background(), recipient, "phone")
+	assert.Nil(t, err)
+
+	delivered := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			_, err := service.Deliver(context.Background(), sender, "", MessageIn{ChatId: chat.Id, Text: "hi"})
+			assert.Nil(t, err)
+		}
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked on a stalled recipient")
+	}
+	select {
+	case <-stalled.Done():
+	default:
+		t.Fatal("stalled recipient should be disconnected")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// publicKeyLength is a Curve25519 key, optionally prefixed with a byte
+	// naming its type.
+	publicKeyLength = 32
+	signatureLength = 64
+	maxDeviceId     = 64
+	// keyClaimLimit is how many times an account can fetch the key bundles
+	// of another within keyClaimWindow. Starting a session takes one, more
+	// than a few only drains the other's one-time prekeys.
+	keyClaimLimit  = 10
+	keyClaimWindow = time.Hour
+)
+
+var (
+	ErrInvalidKey        = errors.New("keys have to be base64 encoded Curve25519 keys")
+	ErrInvalidDevice     = errors.New("invalid device id")
+	ErrNoDeviceKeys      = errors.New("account has no devices with published keys")
+	ErrEncrypted         = errors.New("encrypted chats only take ciphertexts")
+	ErrNotEncrypted      = errors.New("chat isn't encrypted")
+	ErrEncryptedGroup    = errors.New("only private chats can be encrypted")
+	ErrMismatchedDevices = errors.New("ciphertexts don't match the devices of the members")
+	ErrKeysForbidden     = errors.New("the account's DM policy doesn't let you fetch its keys")
+	ErrTooManyClaims     = errors.New("fetched the account's keys too many times, try again later")
+)
+
+func isPublicKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && (len(decoded) == publicKeyLength || len(decoded) == publicKeyLength+1)
+}
+
+func isSignature(signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && len(decoded) == signatureLength
+}
+
+func checkDeviceId(deviceId string) error {
+	if deviceId == "" || len(deviceId) > maxDeviceId || strings.Contains(deviceId, "/") {
+		return ErrInvalidDevice
+	}
+	return nil
+}
+
+// PublishKeys stores the device's public keys in the key directory and adds
+// its one-time prekeys. It returns how many prekeys the device has, so it
+// knows when to publish more.
+func (s *chatService) PublishKeys(ctx context.Context, accountId uuid.UUID, deviceId string, keys *KeysIn) (int, error) {
+	if err := checkDeviceId(deviceId); err != nil {
+		return 0, err
+	}
+	published, err := s.store.GetDeviceKeys(ctx, accountId)
+	if err != nil {
+		return 0, err
+	}
+	for _, device := range published {
+		// Prekeys of the old identity are no use to anyone.
+		if device.DeviceId == deviceId && device.IdentityKey != keys.IdentityKey {
+			if err := s.store.DeleteDeviceKeys(ctx, accountId, deviceId); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err = s.store.UpsertDeviceKeys(ctx, &DeviceKeys{
+		AccountId:    accountId,
+		DeviceId:     deviceId,
+		IdentityKey:  keys.IdentityKey,
+		SignedPreKey: keys.SignedPreKey,
+		UpdatedAt:    s.now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.store.AddPreKeys(ctx, accountId, deviceId, keys.OneTimePreKeys); err != nil {
+		return 0, err
+	}
+	return s.store.CountPreKeys(ctx, accountId, deviceId)
+}
+
+// CountPreKeys returns how many one-time prekeys the device has left.
+func (s *chatService) CountPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string) (int, error) {
+	if err := checkDeviceId(deviceId); err != nil {
+		return 0, err
+	}
+	return s.store.CountPreKeys(ctx, accountId, deviceId)
+}
+
+// RemoveDeviceKeys takes the device out of the key directory, messages
+// aren't encrypted for it anymore.
+func (s *chatService) RemoveDeviceKeys(ctx context.Context, accountId uuid.UUID, deviceId string) error {
+	if err := checkDeviceId(deviceId); err != nil {
+		return err
+	}
+	return s.store.DeleteDeviceKeys(ctx, accountId, deviceId)
+}
+
+// GetKeyBundles returns a key bundle for every device of the target with
+// published keys, each with one of the device's one-time prekeys, which
+// nobody else gets. Only accounts which can message the target get them,
+// and only a few times in a while.
+func (s *chatService) GetKeyBundles(ctx context.Context, accountId, targetId uuid.UUID) ([]*KeyBundle, error) {
+	if err := s.checkKeyClaim(ctx, accountId, targetId); err != nil {
+		return nil, err
+	}
+	if !s.claims.Allow(accountId, targetId, s.clock()) {
+		return nil, ErrTooManyClaims
+	}
+
+	devices, err := s.store.GetDeviceKeys(ctx, targetId)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoDeviceKeys
+	}
+
+	bundles := make([]*KeyBundle, len(devices))
+	for i, device := range devices {
+		bundles[i] = &KeyBundle{
+			DeviceId:     device.DeviceId,
+			IdentityKey:  device.IdentityKey,
+			SignedPreKey: device.SignedPreKey,
+		}
+		prekey, err := s.store.ClaimPreKey(ctx, targetId, device.DeviceId)
+		if err != nil && !errors.Is(err, ErrNoPreKeys) {
+			return nil, err
+		}
+		bundles[i].OneTimePreKey = prekey
+	}
+	return bundles, nil
+}
+
+// checkKeyClaim fails unless accountId can message targetId: there's
+// already an encrypted chat between them the target didn't decline, or the
+// target's DM policy lets accountId start one. A message request needs the
+// chat created first.
+func (s *chatService) checkKeyClaim(ctx context.Context, accountId, targetId uuid.UUID) error {
+	if accountId == targetId {
+		return nil
+	}
+	chat, err := s.store.GetDirectChat(ctx, accountId, targetId, true)
+	if err == nil {
+		if chat.IsRequestTo(targetId) && chat.Request.Status == RequestDeclined {
+			return ErrRequestDeclined
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrChatNotFound) {
+		return err
+	}
+
+	request, err := s.messageRequest(ctx, accountId, targetId)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		return ErrKeysForbidden
+	}
+	return nil
+}
+
+type claimKey struct {
+	accountId uuid.UUID
+	targetId  uuid.UUID
+}
+
+type claimWindow struct {
+	start time.Time
+	count int
+}
+
+// claimLimiter counts how many times this node handed out the key bundles
+// of an account to another.
+type claimLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	claims map[claimKey]*claimWindow
+	swept  time.Time
+}
+
+func newClaimLimiter(limit int, window time.Duration) *claimLimiter {
+	return &claimLimiter{
+		limit:  limit,
+		window: window,
+		claims: map[claimKey]*claimWindow{},
+	}
+}
+
+// Allow reports whether accountId can fetch the key bundles of targetId
+// now, and counts it if so.
+func (l *claimLimiter) Allow(accountId, targetId uuid.UUID, now time.Time) bool {
+	key := claimKey{accountId: accountId, targetId: targetId}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Windows that are over are dropped once in a window, so the map only
+	// holds the recent ones.
+	if now.Sub(l.swept) >= l.window {
+		for key, claims := range l.claims {
+			if now.Sub(claims.start) >= l.window {
+				delete(l.claims, key)
+			}
+		}
+		l.swept = now
+	}
+
+	claims, found := l.claims[key]
+	if !found || now.Sub(claims.start) >= l.window {
+		l.claims[key] = &claimWindow{start: now, count: 1}
+		return true
+	}
+	if claims.count >= l.limit {
+		return false
+	}
+	claims.count++
+	return true
+}
+
+// checkCiphertexts makes sure a message in an encrypted chat has exactly
+// one ciphertext for every device of the members in the key directory,
+// except the device sending it. Clients which are missing a device, or
+// still encrypt for a removed one, fetch the key bundles again.
+func (s *chatService) checkCiphertexts(ctx context.Context, chat *Chat, accountId uuid.UUID, deviceId string, ciphertexts []*Ciphertext) error {
+	expected := map[string]bool{}
+	for _, memberId := range chat.Members {
+		devices, err := s.store.GetDeviceKeys(ctx, memberId)
+		if err != nil {
+			return err
+		}
+		if len(devices) == 0 && memberId != accountId {
+			return ErrNoDeviceKeys
+		}
+		for _, device := range devices {
+			if memberId != accountId || device.DeviceId != deviceId {
+				expected[deliveryCursorsId(memberId, device.DeviceId)] = true
+			}
+		}
+	}
+
+	unexpected := []string{}
+	for _, ciphertext := range ciphertexts {
+		id := deliveryCursorsId(ciphertext.AccountId, ciphertext.DeviceId)
+		if !expected[id] {
+			unexpected = append(unexpected, id)
+			continue
+		}
+		// Seen, a second one for the device is unexpected.
+		delete(expected, id)
+	}
+	missing := []string{}
+	for id := range expected {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+
+	if len(missing) > 0 || len(unexpected) > 0 {
+		return fmt.Errorf("%w: missing [%s], unexpected [%s]", ErrMismatchedDevices,
+			strings.Join(missing, ", "), strings.Join(unexpected, ", "))
+	}
+	return nil
+}
+
+// publishCiphertexts pushes the message to each device it was encrypted
+// for, with only that device's ciphertext.
+func (s *chatService) publishCiphertexts(ctx context.Context, msg *Message) error {
+	for _, ciphertext := range msg.Ciphertexts {
+		err := s.broker.Publish(ctx, &Delivery{
+			AccountID: ciphertext.AccountId,
+			Device:    ciphertext.DeviceId,
+			Event:     Event{Type: EventMessage, Message: msg.forDevice(ciphertext.AccountId, ciphertext.DeviceId)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeysInValidate(t *testing.T) {
+	validate = validator.New()
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	// Keys may name their type in a leading byte.
+	typed := base64.StdEncoding.EncodeToString(append([]byte{5}, make([]byte, 32)...))
+	signature := base64.StdEncoding.EncodeToString(make([]byte, 64))
+	valid := func() *KeysIn {
+		return &KeysIn{
+			IdentityKey:    typed,
+			SignedPreKey:   &SignedPreKey{KeyId: 1, PublicKey: key, Signature: signature},
+			OneTimePreKeys: []*PreKey{{KeyId: 1, PublicKey: key}},
+		}
+	}
+	assert.Nil(t, valid().Validate())
+
+	for name, change := range map[string]func(in *KeysIn){
+		"short identity key":   func(in *KeysIn) { in.IdentityKey = base64.StdEncoding.EncodeToString(make([]byte, 16)) },
+		"not base64":           func(in *KeysIn) { in.IdentityKey = strings.Repeat("!", 44) },
+		"no signed prekey":     func(in *KeysIn) { in.SignedPreKey = nil },
+		"short signature":      func(in *KeysIn) { in.SignedPreKey.Signature = key },
+		"invalid prekey":       func(in *KeysIn) { in.OneTimePreKeys[0].PublicKey = "a2V5" },
+		"too many prekeys":     func(in *KeysIn) { in.OneTimePreKeys = make([]*PreKey, 101) },
+		"missing identity key": func(in *KeysIn) { in.IdentityKey = "" },
+	} {
+		in := valid()
+		change(in)
+		assert.NotNil(t, in.Validate(), name)
+	}
+}
+
+func TestMessageForDevice(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	msg := &Message{Ciphertexts: []*Ciphertext{
+		{AccountId: alice, DeviceId: "laptop", Body: "YQ=="},
+		{AccountId: bob, DeviceId: "phone", Body: "Yg=="},
+		{AccountId: bob, DeviceId: "laptop", Body: "Yw=="},
+	}}
+
+	forBob := msg.forDevice(bob, "laptop")
+	assert.Equal(t, []*Ciphertext{msg.Ciphertexts[2]}, forBob.Ciphertexts)
+	assert.Len(t, msg.Ciphertexts, 3)
+	assert.Empty(t, msg.forDevice(bob, "tablet").Ciphertexts)
+	assert.Empty(t, msg.forDevice(bob, "").Ciphertexts)
+
+	plain := &Message{Text: "hi"}
+	assert.Same(t, plain, plain.forDevice(bob, "phone"))
+}
+
+func TestClaimLimiter(t *testing.T) {
+	limiter := newClaimLimiter(2, time.Minute)
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.True(t, limiter.Allow(alice, bob, now))
+	assert.True(t, limiter.Allow(alice, bob, now.Add(time.Second)))
+	assert.False(t, limiter.Allow(alice, bob, now.Add(2*time.Second)))
+	assert.True(t, limiter.Allow(alice, carol, now.Add(2*time.Second)))
+	assert.True(t, limiter.Allow(bob, alice, now.Add(2*time.Second)))
+
+	// The window starts with the first claim.
+	assert.False(t, limiter.Allow(alice, bob, now.Add(time.Minute-time.Second)))
+	assert.True(t, limiter.Allow(alice, bob, now.Add(time.Minute)))
+
+	// Windows that are over are dropped.
+	limiter.Allow(carol, alice, now.Add(3*time.Minute))
+	assert.Len(t, limiter.claims, 1)
+}
@@ -1,21 +1,55 @@
 package main
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"github.com/Netflix/go-env"
 	"github.com/go-playground/validator"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 	web "github.com/sina-am/social-media/common"
 	"github.com/sina-am/social-media/internal/auth/client"
 	"go.uber.org/zap"
 )
 
 type Settings struct {
-	HTTPAddress string `env:"HTTP_ADDRESS,default=localhost:8080"`
-	AuthAddress string `env:"AUTH_ADDRESS,default=localhost:5000"`
-	MongoURI    string `env:"MONGO_URI,default=mongodb://localhost"`
-	MongoDBName string `env:"MONGO_DBNAME,default=chat"`
+	HTTPAddress    string        `env:"HTTP_ADDRESS,default=localhost:8080"`
+	AuthAddress    string        `env:"AUTH_ADDRESS,default=localhost:5000"`
+	MongoURI       string        `env:"MONGO_URI,default=mongodb://localhost"`
+	MongoDBName    string        `env:"MONGO_DBNAME,default=chat"`
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT,default=10s"`
+	DrainTimeout   time.Duration `env:"DRAIN_TIMEOUT,default=15s"`
+	MediaURL       string        `env:"MEDIA_URL,default=http://localhost:8090/media"`
+	// MediaServiceURL is where this service looks up uploads, MEDIA_URL when
+	// empty. It differs when the public URL isn't reachable from inside.
+	MediaServiceURL string `env:"MEDIA_SERVICE_URL"`
+	// PreviewTimeout is how long fetching a link preview may take, zero
+	// disables link previews.
+	PreviewTimeout time.Duration `env:"PREVIEW_TIMEOUT,default=3s"`
+	HubShards      int           `env:"HUB_SHARDS,default=32"`
+	OutboundQueue  int           `env:"OUTBOUND_QUEUE,default=64"`
+	// SlowConsumer is either "drop" or "disconnect".
+	SlowConsumer string `env:"SLOW_CONSUMER,default=disconnect"`
+	// Broker is either "local" for a single node or "redis" to run several
+	// chat nodes behind a load balancer.
+	Broker    string `env:"BROKER,default=local"`
+	RedisAddr string `env:"REDIS_ADDR,default=localhost:6379"`
+	// NodeID identifies this node to the others, a random one is used when empty.
+	NodeID string `env:"NODE_ID"`
+	// SweepInterval is how often expired messages are deleted.
+	SweepInterval time.Duration `env:"SWEEP_INTERVAL,default=1m"`
+	// ScheduleInterval is how often scheduled messages which are due are
+	// sent, they go out up to that late.
+	ScheduleInterval time.Duration `env:"SCHEDULE_INTERVAL,default=10s"`
+	// AllowedOrigins are the comma separated origins of web clients which
+	// may open the socket besides this service's own.
+	AllowedOrigins string `env:"ALLOWED_ORIGINS"`
+	// SessionCheckInterval is how often open sockets check their session
+	// wasn't revoked and didn't expire.
+	SessionCheckInterval time.Duration `env:"SESSION_CHECK_INTERVAL,default=1m"`
 }
 
 func main() {
@@ -32,18 +66,81 @@ func main() {
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	if err := storage.Migrate(context.Background()); err != nil {
+		logger.Fatal(err.Error())
+	}
 	auth := client.NewGRPCClient(settings.AuthAddress)
-	service := NewChatService(storage, auth)
+	policy := DisconnectSlowConsumer
+	if settings.SlowConsumer == "drop" {
+		policy = DropMessage
+	}
+	hub := NewHub(settings.HubShards, settings.OutboundQueue, policy)
+
+	lifecycle := web.NewLifecycle(logger, settings.DrainTimeout)
+	lifecycle.AddReadinessCheck("mongo", storage.Ping)
+	lifecycle.AddReadinessCheck("auth", auth.CheckHealthRPC)
+	lifecycle.OnShutdown("mongo", storage.Close)
+
+	var broker Broker = NewLocalBroker()
+	if settings.Broker == "redis" {
+		if settings.NodeID == "" {
+			settings.NodeID = uuid.NewString()
+		}
+		redisBroker, err := NewRedisBroker(
+			context.Background(),
+			redis.NewClient(&redis.Options{Addr: settings.RedisAddr}),
+			settings.NodeID,
+		)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		lifecycle.AddReadinessCheck("redis", redisBroker.Ping)
+		broker = redisBroker
+	}
+	lifecycle.OnShutdown("broker", broker.Close)
+	service := NewChatService(storage, auth, hub, broker)
+	if settings.MediaServiceURL == "" {
+		settings.MediaServiceURL = settings.MediaURL
+	}
+	service.media = NewMediaClient(settings.MediaServiceURL)
+	if settings.PreviewTimeout > 0 {
+		service.previews = NewOpenGraphFetcher(settings.PreviewTimeout)
+	}
+	stopSweeper := service.StartSweeper(settings.SweepInterval, func(err error) {
+		logger.Error(err.Error())
+	})
+	lifecycle.OnShutdown("sweeper", stopSweeper)
+	stopScheduler := service.StartScheduler(settings.ScheduleInterval, func(err error) {
+		logger.Error(err.Error())
+	})
+	lifecycle.OnShutdown("scheduler", stopScheduler)
+
+	var origins []string
+	for _, origin := range strings.Split(settings.AllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
 	apiServer := APIServer{
 		APIServer: web.APIServer{
-			Addr:   settings.HTTPAddress,
-			Logger: logger,
+			Addr:           settings.HTTPAddress,
+			Logger:         logger,
+			RequestTimeout: settings.RequestTimeout,
+			Lifecycle:      lifecycle,
 		},
 		Auth:     auth,
 		Storage:  storage,
 		Service:  service,
-		Upgrader: websocket.Upgrader{HandshakeTimeout: 3 * time.Second},
+		MediaURL: settings.MediaURL,
+		Upgrader: websocket.Upgrader{
+			HandshakeTimeout: 3 * time.Second,
+			CheckOrigin:      checkOrigin(origins),
+		},
+		SessionCheckInterval: settings.SessionCheckInterval,
 	}
 
-	logger.Fatal(apiServer.Run().Error())
+	if err := apiServer.Run(); err != nil {
+		logger.Fatal(err.Error())
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"sort"
 	"time"
 
 	"github.com/go-playground/validator"
@@ -12,32 +14,708 @@ var validate *validator.Validate
 type Chat struct {
 	Id        uuid.UUID   `json:"id" bson:"_id"`
 	Members   []uuid.UUID `json:"members" bson:"members"`
-	Messages  []*Message  `json:"messages" bson:"messages"`
 	IsPrivate bool        `json:"is_private" bson:"is_private"`
+	// LastSeq is the sequence number of the newest message.
+	LastSeq int64 `json:"-" bson:"last_seq"`
+	// DirectKey is set by the storage on private chats between two
+	// accounts, there's at most one of them for each pair.
+	DirectKey string `json:"-" bson:"direct_key,omitempty"`
+	// Encrypted private chats only take messages encrypted end-to-end for
+	// each device of the members, the server never sees their content.
+	Encrypted bool `json:"encrypted,omitempty" bson:"encrypted,omitempty"`
+	// Retention is in seconds, messages older than it are deleted. Zero
+	// keeps them.
+	Retention int64 `json:"retention,omitempty" bson:"retention,omitempty"`
+	// DisappearAfter is in seconds, messages sent while it's set are
+	// deleted that long after they were sent.
+	DisappearAfter int64 `json:"disappear_after,omitempty" bson:"disappear_after,omitempty"`
+
+	// Only groups, chats which aren't private, have metadata and roles.
+	Title       string      `json:"title,omitempty" bson:"title,omitempty"`
+	Description string      `json:"description,omitempty" bson:"description,omitempty"`
+	Avatar      string      `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	OwnerId     uuid.UUID   `json:"owner_id" bson:"owner_id"`
+	Admins      []uuid.UUID `json:"admins,omitempty" bson:"admins,omitempty"`
+
+	// Request is set on a private chat until its recipient accepts it.
+	Request *MessageRequest `json:"request,omitempty" bson:"request,omitempty"`
+}
+
+type RequestStatus string
+
+const (
+	RequestPending  RequestStatus = "pending"
+	RequestDeclined RequestStatus = "declined"
+)
+
+// MessageRequest is a private chat the recipient's DM policy didn't let the
+// sender start directly. It's kept out of the recipient's inbox, and a
+// declined one takes no more messages.
+type MessageRequest struct {
+	From      uuid.UUID     `json:"from" bson:"from"`
+	To        uuid.UUID     `json:"to" bson:"to"`
+	Status    RequestStatus `json:"status" bson:"status"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// IsRequestTo reports whether the chat is a message request accountId
+// hasn't accepted.
+func (c *Chat) IsRequestTo(accountId uuid.UUID) bool {
+	return c.Request != nil && c.Request.To == accountId
+}
+
+// sortMembers returns the distinct members in a canonical order, so the same
+// set of accounts is always stored the same way.
+func sortMembers(members []uuid.UUID) []uuid.UUID {
+	sorted := []uuid.UUID{}
+	for _, memberId := range members {
+		if !contains(sorted, memberId) {
+			sorted = append(sorted, memberId)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	return sorted
+}
+
+// directKey identifies the private chat between two accounts regardless of
+// the order of its members, it's empty for any other chat. Two accounts may
+// have an encrypted private chat besides the plain one.
+func directKey(chat *Chat) string {
+	if !chat.IsPrivate || len(chat.Members) != 2 || chat.Members[0] == chat.Members[1] {
+		return ""
+	}
+	members := sortMembers(chat.Members)
+	key := members[0].String() + ":" + members[1].String()
+	if chat.Encrypted {
+		key = "e2ee:" + key
+	}
+	return key
+}
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+// RoleOf returns the member's role in a group, the owner is an admin too.
+func (c *Chat) RoleOf(accountId uuid.UUID) Role {
+	if c.OwnerId == accountId {
+		return RoleOwner
+	}
+	for _, adminId := range c.Admins {
+		if adminId == accountId {
+			return RoleAdmin
+		}
+	}
+	return RoleMember
 }
 
 type ChatIn struct {
-	Members   []uuid.UUID `json:"members" validate:"required"`
-	IsPrivate bool        `json:"is_private" validate:"required"`
+	Members   []uuid.UUID `json:"members" validate:"required,max=256"`
+	IsPrivate bool        `json:"is_private"`
+	// Encrypted is only allowed on private chats.
+	Encrypted   bool   `json:"encrypted"`
+	Title       string `json:"title" validate:"max=128"`
+	Description string `json:"description" validate:"max=1024"`
+	Avatar      string `json:"avatar"`
 }
 
 func (in *ChatIn) Validate() error {
 	return validate.Struct(in)
 }
 
+// ChatInfoIn changes the metadata of a group, fields left out are kept.
+type ChatInfoIn struct {
+	Title       *string `json:"title" validate:"omitempty,min=1,max=128"`
+	Description *string `json:"description" validate:"omitempty,max=1024"`
+	Avatar      *string `json:"avatar"`
+}
+
+func (in *ChatInfoIn) Validate() error {
+	return validate.Struct(in)
+}
+
+type MembersIn struct {
+	Members []uuid.UUID `json:"members" validate:"required,min=1,max=256"`
+}
+
+func (in *MembersIn) Validate() error {
+	return validate.Struct(in)
+}
+
+type RoleIn struct {
+	Role Role `json:"role" validate:"required,oneof=admin member"`
+}
+
+func (in *RoleIn) Validate() error {
+	return validate.Struct(in)
+}
+
+type OwnerIn struct {
+	AccountId uuid.UUID `json:"account_id" validate:"required"`
+}
+
+func (in *OwnerIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// Invite lets whoever has the code join a group until it expires.
+type Invite struct {
+	Code      string    `json:"code" bson:"_id"`
+	ChatId    uuid.UUID `json:"chat_id" bson:"chat_id"`
+	CreatedBy uuid.UUID `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// RetentionIn changes how long the chat keeps its messages, fields left out
+// are kept and zero turns them off. Both are in seconds.
+type RetentionIn struct {
+	Retention      *int64 `json:"retention" validate:"omitempty,min=0,max=31536000"`
+	DisappearAfter *int64 `json:"disappear_after" validate:"omitempty,min=0,max=31536000"`
+}
+
+func (in *RetentionIn) Validate() error {
+	if err := validate.Struct(in); err != nil {
+		return err
+	}
+	for _, seconds := range []*int64{in.Retention, in.DisappearAfter} {
+		if seconds != nil && *seconds != 0 && *seconds < minRetention {
+			return ErrInvalidRetention
+		}
+	}
+	return nil
+}
+
+type InviteIn struct {
+	// ExpiresIn is in seconds, a week when left out.
+	ExpiresIn int64 `json:"expires_in" validate:"min=0"`
+}
+
+func (in *InviteIn) Validate() error {
+	return validate.Struct(in)
+}
+
+type SystemMessageType string
+
+const (
+	SystemInfoChanged   SystemMessageType = "info_changed"
+	SystemMembersAdded  SystemMessageType = "members_added"
+	SystemMemberRemoved SystemMessageType = "member_removed"
+	SystemMemberLeft    SystemMessageType = "member_left"
+	SystemMemberJoined  SystemMessageType = "member_joined"
+	SystemRoleChanged   SystemMessageType = "role_changed"
+	SystemOwnerChanged  SystemMessageType = "owner_changed"
+	// SystemRetentionChanged is posted in private chats too.
+	SystemRetentionChanged SystemMessageType = "retention_changed"
+)
+
+// SystemMessage describes a change of a group. It's posted into the chat
+// as a message from the member who made the change, Members are the ones
+// it's about. Retention and DisappearAfter are the new values of the ones
+// which changed.
+type SystemMessage struct {
+	Type           SystemMessageType `json:"type" bson:"type"`
+	Members        []uuid.UUID       `json:"members,omitempty" bson:"members,omitempty"`
+	Title          string            `json:"title,omitempty" bson:"title,omitempty"`
+	Role           Role              `json:"role,omitempty" bson:"role,omitempty"`
+	Retention      *int64            `json:"retention,omitempty" bson:"retention,omitempty"`
+	DisappearAfter *int64            `json:"disappear_after,omitempty" bson:"disappear_after,omitempty"`
+}
+
 type Message struct {
+	Id     uuid.UUID `json:"id" bson:"_id"`
+	ChatId uuid.UUID `json:"chat_id" bson:"chat_id"`
+	// Seq orders the messages of a chat, it starts at 1 and never changes.
+	Seq            int64     `json:"seq" bson:"seq"`
 	FromAccountId  uuid.UUID `json:"from" bson:"from_account_id" validate:"required"`
 	ReplyMessageId uuid.UUID `json:"reply_to" bson:"replay_message_id,omitempty"`
 	Text           string    `json:"text" bson:"text" validate:"required"`
 	CreatedAt      time.Time `json:"created_at" bson:"created_at" validate:"required"`
+	// ClientId is the id the sending client gave the message.
+	ClientId string `json:"client_id,omitempty" bson:"client_id,omitempty"`
+	// Edits holds the previous versions of the text, oldest first.
+	Edits    []*MessageEdit `json:"edits,omitempty" bson:"edits,omitempty"`
+	EditedAt *time.Time     `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	// ExpiresAt is set on disappearing messages, they're deleted then.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	// Deleted messages were deleted for everyone, only a tombstone is kept.
+	Deleted bool `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	// HiddenFor lists the members who deleted the message for themselves.
+	HiddenFor []uuid.UUID `json:"-" bson:"hidden_for,omitempty"`
+	// System is set on messages the server posts about group changes.
+	System      *SystemMessage `json:"system,omitempty" bson:"system,omitempty"`
+	Attachments []*Attachment  `json:"attachments,omitempty" bson:"attachments,omitempty"`
+	Entities    []*Entity      `json:"entities,omitempty" bson:"entities,omitempty"`
+	// Preview is generated by the server for the first link in the text.
+	Preview *LinkPreview `json:"preview,omitempty" bson:"preview,omitempty"`
+	// ReactedBy holds every member's reactions, members are only shown the
+	// counts in Reactions.
+	ReactedBy []*Reaction      `json:"-" bson:"reactions,omitempty"`
+	Reactions []*ReactionCount `json:"reactions,omitempty" bson:"-"`
+	// Ciphertexts hold the content of a message in an encrypted chat, one
+	// for each device. Devices are only given their own.
+	Ciphertexts []*Ciphertext `json:"ciphertexts,omitempty" bson:"ciphertexts,omitempty"`
+}
+
+type CiphertextType string
+
+const (
+	// CiphertextPreKey starts a session with the device, it carries the
+	// sender's keys and which of the device's prekeys were used.
+	CiphertextPreKey  CiphertextType = "prekey"
+	CiphertextMessage CiphertextType = "message"
+)
+
+// Ciphertext is a message encrypted for one device of a member. Body is
+// opaque to the server.
+type Ciphertext struct {
+	AccountId uuid.UUID      `json:"account_id" bson:"account_id" validate:"required"`
+	DeviceId  string         `json:"device_id" bson:"device_id" validate:"required,max=64"`
+	Type      CiphertextType `json:"type" bson:"type" validate:"required,oneof=prekey message"`
+	Body      string         `json:"body" bson:"body" validate:"required,base64,max=65536"`
+}
+
+// forDevice returns the message as the device gets it, with only the
+// ciphertext encrypted for it. Without a device there's none.
+func (m *Message) forDevice(accountId uuid.UUID, deviceId string) *Message {
+	if len(m.Ciphertexts) == 0 {
+		return m
+	}
+	clone := m.Clone()
+	clone.Ciphertexts = nil
+	for _, ciphertext := range m.Ciphertexts {
+		if deviceId != "" && ciphertext.AccountId == accountId && ciphertext.DeviceId == deviceId {
+			clone.Ciphertexts = append(clone.Ciphertexts, ciphertext)
+		}
+	}
+	return clone
+}
+
+// PreKey is a public key other devices use to start an encrypted session
+// with the device. One-time prekeys are handed out once each.
+type PreKey struct {
+	KeyId     uint32 `json:"key_id" bson:"key_id"`
+	PublicKey string `json:"public_key" bson:"public_key" validate:"required"`
+}
+
+// SignedPreKey is a prekey signed with the device's identity key, used when
+// the device has run out of one-time prekeys. Clients check the signature,
+// the server only stores it.
+type SignedPreKey struct {
+	KeyId     uint32 `json:"key_id" bson:"key_id"`
+	PublicKey string `json:"public_key" bson:"public_key" validate:"required"`
+	Signature string `json:"signature" bson:"signature" validate:"required"`
+}
+
+// DeviceKeys are the public keys a device published to the key directory.
+type DeviceKeys struct {
+	AccountId    uuid.UUID     `json:"account_id" bson:"account_id"`
+	DeviceId     string        `json:"device_id" bson:"device_id"`
+	IdentityKey  string        `json:"identity_key" bson:"identity_key"`
+	SignedPreKey *SignedPreKey `json:"signed_prekey" bson:"signed_prekey"`
+	UpdatedAt    time.Time     `json:"updated_at" bson:"updated_at"`
+}
+
+// KeysIn publishes the device's keys. Publishing a new identity key drops
+// the one-time prekeys which went with the old one.
+type KeysIn struct {
+	IdentityKey    string        `json:"identity_key" validate:"required"`
+	SignedPreKey   *SignedPreKey `json:"signed_prekey" validate:"required"`
+	OneTimePreKeys []*PreKey     `json:"one_time_prekeys" validate:"max=100,dive"`
+}
+
+func (in *KeysIn) Validate() error {
+	if err := validate.Struct(in); err != nil {
+		return err
+	}
+	if !isPublicKey(in.IdentityKey) || !isPublicKey(in.SignedPreKey.PublicKey) ||
+		!isSignature(in.SignedPreKey.Signature) {
+		return ErrInvalidKey
+	}
+	for _, prekey := range in.OneTimePreKeys {
+		if !isPublicKey(prekey.PublicKey) {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// KeyBundle is what a device needs to start a session with another device.
+// OneTimePreKey is left out once the device has run out of them.
+type KeyBundle struct {
+	DeviceId      string        `json:"device_id"`
+	IdentityKey   string        `json:"identity_key"`
+	SignedPreKey  *SignedPreKey `json:"signed_prekey"`
+	OneTimePreKey *PreKey       `json:"one_time_prekey,omitempty"`
+}
+
+// PreKeyCount is how many one-time prekeys the device has left.
+type PreKeyCount struct {
+	Count int `json:"count"`
+}
+
+// Reaction is an emoji a member reacted to a message with. Members may
+// react with several different emoji.
+type Reaction struct {
+	Emoji     string    `json:"emoji" bson:"emoji"`
+	AccountId uuid.UUID `json:"account_id" bson:"account_id"`
+}
+
+// ReactionCount is how many members reacted with the emoji, Reacted tells
+// whether the member viewing the message is one of them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted,omitempty"`
+}
+
+type AttachmentType string
+
+const (
+	AttachmentImage AttachmentType = "image"
+	AttachmentFile  AttachmentType = "file"
+	AttachmentVoice AttachmentType = "voice"
+)
+
+// Attachment is an uploaded media file sent with a message. Clients only
+// give the type and the media id, the rest is copied from the media service.
+type Attachment struct {
+	Type        AttachmentType    `json:"type" bson:"type" validate:"required,oneof=image file voice"`
+	MediaId     uuid.UUID         `json:"media_id" bson:"media_id" validate:"required"`
+	URL         string            `json:"url,omitempty" bson:"url"`
+	ContentType string            `json:"content_type,omitempty" bson:"content_type"`
+	Name        string            `json:"name,omitempty" bson:"name,omitempty"`
+	Size        int               `json:"size,omitempty" bson:"size"`
+	Width       int               `json:"width,omitempty" bson:"width,omitempty"`
+	Height      int               `json:"height,omitempty" bson:"height,omitempty"`
+	Thumbnails  map[string]string `json:"thumbnails,omitempty" bson:"thumbnails,omitempty"`
+}
+
+type EntityType string
+
+const (
+	EntityMention EntityType = "mention"
+	EntityBold    EntityType = "bold"
+	EntityItalic  EntityType = "italic"
+	EntityCode    EntityType = "code"
+)
+
+// Entity formats part of a message's text. Offset and Length count
+// characters (unicode code points), not bytes. Mentions name the member
+// through AccountId.
+type Entity struct {
+	Type      EntityType `json:"type" bson:"type" validate:"required,oneof=mention bold italic code"`
+	Offset    int        `json:"offset" bson:"offset" validate:"min=0"`
+	Length    int        `json:"length" bson:"length" validate:"min=1"`
+	AccountId *uuid.UUID `json:"account_id,omitempty" bson:"account_id,omitempty"`
+}
+
+// LinkPreview is the Open Graph metadata of a page linked in a message.
+type LinkPreview struct {
+	URL         string `json:"url" bson:"url"`
+	SiteName    string `json:"site_name,omitempty" bson:"site_name,omitempty"`
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	Image       string `json:"image,omitempty" bson:"image,omitempty"`
+}
+
+type MessageEdit struct {
+	Text     string    `json:"text" bson:"text"`
+	EditedAt time.Time `json:"edited_at" bson:"edited_at"`
+}
+
+// Clone returns a copy of the message which doesn't share slices with it.
+func (m *Message) Clone() *Message {
+	clone := *m
+	clone.Edits = append([]*MessageEdit(nil), m.Edits...)
+	clone.HiddenFor = append([]uuid.UUID(nil), m.HiddenFor...)
+	clone.Attachments = append([]*Attachment(nil), m.Attachments...)
+	clone.Entities = append([]*Entity(nil), m.Entities...)
+	clone.ReactedBy = append([]*Reaction(nil), m.ReactedBy...)
+	clone.Reactions = append([]*ReactionCount(nil), m.Reactions...)
+	clone.Ciphertexts = append([]*Ciphertext(nil), m.Ciphertexts...)
+	return &clone
 }
 
+func (m *Message) IsHiddenFor(accountId uuid.UUID) bool {
+	for _, id := range m.HiddenFor {
+		if id == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageIn is the payload of a send envelope.
 type MessageIn struct {
-	ChatId         uuid.UUID `json:"chat_id" validate:"required"`
-	ReplyMessageId uuid.UUID `json:"reply_to" `
-	Text           string    `json:"text"`
+	ChatId         uuid.UUID     `json:"chat_id" validate:"required"`
+	ReplyMessageId uuid.UUID     `json:"reply_to" `
+	Text           string        `json:"text"`
+	Attachments    []*Attachment `json:"attachments,omitempty" validate:"max=10,dive"`
+	Entities       []*Entity     `json:"entities,omitempty" validate:"max=100,dive"`
+	// Ciphertexts replace everything else in encrypted chats.
+	Ciphertexts []*Ciphertext `json:"ciphertexts,omitempty" validate:"max=256,dive"`
+	// ClientId is the id of the envelope, sending it again is a no-op.
+	ClientId string `json:"-"`
 }
 
 func (in *MessageIn) Validate() error {
+	if err := validate.Struct(in); err != nil {
+		return err
+	}
+	if in.Text == "" && len(in.Attachments) == 0 && len(in.Ciphertexts) == 0 {
+		return ErrEmptyMessage
+	}
+	return nil
+}
+
+// ScheduledStatus is where a scheduled message is at. Only pending and
+// failed ones are kept, the others are only told to the author's devices.
+type ScheduledStatus string
+
+const (
+	ScheduledPending ScheduledStatus = "pending"
+	// ScheduledFailed messages couldn't be sent, they're kept until the
+	// author changes or cancels them.
+	ScheduledFailed   ScheduledStatus = "failed"
+	ScheduledSent     ScheduledStatus = "sent"
+	ScheduledCanceled ScheduledStatus = "canceled"
+)
+
+// ScheduledMessage is a message the scheduler sends on behalf of its author
+// at SendAt. MessageId is the message it was sent as.
+type ScheduledMessage struct {
+	Id             uuid.UUID       `json:"id" bson:"_id"`
+	ChatId         uuid.UUID       `json:"chat_id" bson:"chat_id"`
+	AccountId      uuid.UUID       `json:"-" bson:"account_id"`
+	ReplyMessageId uuid.UUID       `json:"reply_to" bson:"reply_message_id,omitempty"`
+	Text           string          `json:"text" bson:"text"`
+	Attachments    []*Attachment   `json:"attachments,omitempty" bson:"attachments,omitempty"`
+	Entities       []*Entity       `json:"entities,omitempty" bson:"entities,omitempty"`
+	SendAt         time.Time       `json:"send_at" bson:"send_at"`
+	Status         ScheduledStatus `json:"status" bson:"status"`
+	Error          string          `json:"error,omitempty" bson:"error,omitempty"`
+	MessageId      uuid.UUID       `json:"message_id" bson:"message_id,omitempty"`
+	CreatedAt      time.Time       `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at" bson:"updated_at"`
+	// A replica sending the message claims it until ClaimedUntil, nobody
+	// else sends or changes it meanwhile. Attempts counts the claims.
+	ClaimedBy    string     `json:"-" bson:"claimed_by,omitempty"`
+	ClaimedUntil *time.Time `json:"-" bson:"claimed_until,omitempty"`
+	Attempts     int        `json:"-" bson:"attempts"`
+}
+
+// claimedAt reports whether a replica holds a claim on the message at now.
+func (m *ScheduledMessage) claimedAt(now time.Time) bool {
+	return m.ClaimedUntil != nil && m.ClaimedUntil.After(now)
+}
+
+// ScheduledMessageIn schedules a message, or replaces a scheduled one.
+type ScheduledMessageIn struct {
+	ReplyMessageId uuid.UUID     `json:"reply_to"`
+	Text           string        `json:"text"`
+	Attachments    []*Attachment `json:"attachments,omitempty" validate:"max=10,dive"`
+	Entities       []*Entity     `json:"entities,omitempty" validate:"max=100,dive"`
+	SendAt         time.Time     `json:"send_at" validate:"required"`
+}
+
+func (in *ScheduledMessageIn) Validate() error {
+	if err := validate.Struct(in); err != nil {
+		return err
+	}
+	if in.Text == "" && len(in.Attachments) == 0 {
+		return ErrEmptyMessage
+	}
+	return nil
+}
+
+// Draft is what a member started writing in a chat, it's kept in sync
+// across their devices. A draft without text or a reply is removed.
+type Draft struct {
+	ChatId         uuid.UUID `json:"chat_id" bson:"chat_id"`
+	AccountId      uuid.UUID `json:"-" bson:"account_id"`
+	ReplyMessageId uuid.UUID `json:"reply_to" bson:"reply_message_id,omitempty"`
+	Text           string    `json:"text" bson:"text"`
+	Entities       []*Entity `json:"entities,omitempty" bson:"entities,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+func (d *Draft) isEmpty() bool {
+	return d.Text == "" && d.ReplyMessageId == uuid.Nil
+}
+
+// SocketTicket lets a client open the chat socket without its token in the
+// URL, where proxies log it. It's redeemed once, shortly after it was
+// issued. Only the hash of the ticket is stored, as Id, with the token it
+// was issued for so the connection can check the session is still valid.
+// The token is sealed with a key only the ticket gives, the stored tickets
+// don't give it away.
+type SocketTicket struct {
+	Id          string    `json:"-" bson:"_id"`
+	Ticket      string    `json:"ticket" bson:"-"`
+	AccountId   uuid.UUID `json:"-" bson:"account_id"`
+	SealedToken []byte    `json:"-" bson:"sealed_token"`
+	// Token is opened from SealedToken once the ticket is redeemed.
+	Token     string    `json:"-" bson:"-"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type DraftIn struct {
+	ReplyMessageId uuid.UUID `json:"reply_to"`
+	Text           string    `json:"text"`
+	Entities       []*Entity `json:"entities,omitempty" validate:"max=100,dive"`
+}
+
+func (in *DraftIn) Validate() error {
 	return validate.Struct(in)
 }
+
+// SearchResult is a message matching a search with a snippet of its text
+// around the first match. Highlights are the matched words in the snippet,
+// counted in characters like entities.
+type SearchResult struct {
+	Message    *Message     `json:"message"`
+	Snippet    string       `json:"snippet"`
+	Highlights []*Highlight `json:"highlights"`
+}
+
+type Highlight struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// SearchPage is a page of search results, newest first. NextCursor is
+// passed as cursor to get the next page, it's empty on the last page.
+type SearchPage struct {
+	Results    []*SearchResult `json:"results"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// MessagePage is a page of a chat's history, newest first. NextCursor is
+// passed as before to get the next page, it's empty on the last page.
+type MessagePage struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Resync is what a device missed while it was offline. Truncated lists the
+// chats with more missed messages than were resent.
+type Resync struct {
+	Messages  []*Message
+	Truncated []uuid.UUID
+}
+
+// Receipt is how far a member got in a chat. Both are sequence numbers and
+// never move backwards, a read message counts as delivered too.
+type Receipt struct {
+	ChatId           uuid.UUID `json:"chat_id" bson:"chat_id"`
+	AccountId        uuid.UUID `json:"account_id" bson:"account_id"`
+	LastReadSeq      int64     `json:"last_read_seq" bson:"last_read_seq"`
+	LastDeliveredSeq int64     `json:"last_delivered_seq" bson:"last_delivered_seq"`
+}
+
+// InboxChat is a chat of the account's inbox. UnreadCount leaves out the
+// account's own messages.
+type InboxChat struct {
+	*Chat
+	LastMessage *Message `json:"last_message,omitempty"`
+	LastReadSeq int64    `json:"last_read_seq"`
+	UnreadCount int64    `json:"unread_count"`
+	// Draft is what the account started writing in the chat.
+	Draft *Draft `json:"draft,omitempty"`
+}
+
+// ChatSummary is what the inbox shows of a chat for one account.
+type ChatSummary struct {
+	ChatId      uuid.UUID `bson:"_id"`
+	LastMessage *Message  `bson:"last_message"`
+	LastReadSeq int64     `bson:"last_read_seq"`
+	UnreadCount int64     `bson:"unread_count"`
+}
+
+type PresenceStatus string
+
+const (
+	StatusOnline  PresenceStatus = "online"
+	StatusAway    PresenceStatus = "away"
+	StatusOffline PresenceStatus = "offline"
+)
+
+// PresenceVisibility decides who sees an account's presence, contacts are
+// the accounts it shares a chat with.
+type PresenceVisibility string
+
+const (
+	VisibleToEveryone PresenceVisibility = "everyone"
+	VisibleToContacts PresenceVisibility = "contacts"
+	VisibleToNobody   PresenceVisibility = "nobody"
+)
+
+// DMPolicy says who can start a private chat with the account, anyone else
+// sends a message request.
+type DMPolicy string
+
+const (
+	DMFromEveryone DMPolicy = "everyone"
+	// DMFromFollowers lets accounts following the recipient in.
+	DMFromFollowers DMPolicy = "followers"
+	// DMFromMutuals lets accounts in which follow and are followed back.
+	DMFromMutuals DMPolicy = "mutual"
+)
+
+type PrivacySettings struct {
+	AccountId uuid.UUID          `json:"-" bson:"_id"`
+	Presence  PresenceVisibility `json:"presence" bson:"presence" validate:"required,oneof=everyone contacts nobody"`
+	// DirectMessages is kept as it is when left out.
+	DirectMessages DMPolicy `json:"direct_messages" bson:"direct_messages" validate:"omitempty,oneof=everyone followers mutual"`
+}
+
+func (in *PrivacySettings) Validate() error {
+	return validate.Struct(in)
+}
+
+type MessageEditIn struct {
+	Text string `json:"text" validate:"required"`
+	// Entities replace the ones of the previous text.
+	Entities []*Entity `json:"entities,omitempty" validate:"max=100,dive"`
+}
+
+func (in *MessageEditIn) Validate() error {
+	return validate.Struct(in)
+}
+
+type EventType string
+
+const (
+	EventMessage         EventType = "message"
+	EventMessageEdited   EventType = "message_edited"
+	EventMessageDeleted  EventType = "message_deleted"
+	EventTyping          EventType = "typing"
+	EventReadReceipt     EventType = "read_receipt"
+	EventDeliveryReceipt EventType = "delivery_receipt"
+	EventPresence        EventType = "presence"
+	EventReactionAdded   EventType = "reaction_added"
+	EventReactionRemoved EventType = "reaction_removed"
+	// EventDraft and EventScheduled only go to the author's other devices.
+	EventDraft     EventType = "draft"
+	EventScheduled EventType = "scheduled_message"
+)
+
+// Event is pushed to the connected devices of chat members, only the field
+// matching Type is set.
+type Event struct {
+	Type      EventType         `json:"type"`
+	Message   *Message          `json:"message,omitempty"`
+	Typing    *TypingPayload    `json:"typing,omitempty"`
+	Receipt   *ReceiptPayload   `json:"receipt,omitempty"`
+	Presence  *PresencePayload  `json:"presence,omitempty"`
+	Reaction  *ReactionPayload  `json:"reaction,omitempty"`
+	Draft     *Draft            `json:"draft,omitempty"`
+	Scheduled *ScheduledMessage `json:"scheduled,omitempty"`
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// maxPreviewBody is how much of a page is read looking for its metadata,
+	// which is in the head.
+	maxPreviewBody      = 512 << 10
+	maxPreviewRedirects = 3
+	maxPreviewTitle     = 256
+	maxPreviewText      = 1024
+)
+
+var (
+	ErrNoPreview      = errors.New("page has no preview")
+	ErrPrivateAddress = errors.New("link points to a private address")
+)
+
+// PreviewFetcher generates the preview of a linked page. Clients never
+// fetch links themselves, so the sender's address isn't leaked to the site.
+type PreviewFetcher interface {
+	FetchPreview(ctx context.Context, link string) (*LinkPreview, error)
+}
+
+// openGraphFetcher builds previews from the Open Graph tags of pages,
+// falling back to their title and description.
+type openGraphFetcher struct {
+	client *http.Client
+}
+
+// NewOpenGraphFetcher returns a fetcher which only connects to public
+// addresses, so links can't be used to reach the internal network.
+func NewOpenGraphFetcher(timeout time.Duration) *openGraphFetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !isPublicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	return &openGraphFetcher{
+		client: &http.Client{
+			Timeout: timeout,
+			// No proxy from the environment, it would get around the check.
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxPreviewRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxPreviewRedirects)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// nonPublicPrefixes are the ranges that aren't reachable on the internet
+// but the netip checks don't cover.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// Carrier-grade NAT, the provider's internal network.
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+func isPublicIP(ip netip.Addr) bool {
+	// IPv4-mapped IPv6 addresses are dialed as IPv4.
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *openGraphFetcher) FetchPreview(ctx context.Context, link string) (*LinkPreview, error) {
+	pageURL, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if pageURL.Scheme != "http" && pageURL.Scheme != "https" {
+		return nil, ErrNoPreview
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded %s", ErrNoPreview, link, res.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNoPreview
+	}
+
+	// Redirects may have moved the page, relative image links resolve
+	// against where it ended up.
+	preview := parseOpenGraph(res.Request.URL, io.LimitReader(res.Body, maxPreviewBody))
+	if preview == nil {
+		return nil, ErrNoPreview
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// parseOpenGraph reads the metadata in the head of the page, nil when
+// there's no title.
+func parseOpenGraph(pageURL *url.URL, r io.Reader) *LinkPreview {
+	var preview LinkPreview
+	var title, description string
+	z := html.NewTokenizer(r)
+	for done := false; !done; {
+		switch z.Next() {
+		case html.ErrorToken:
+			done = true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.DataAtom {
+			case atom.Body:
+				done = true
+			case atom.Title:
+				if z.Next() == html.TextToken && title == "" {
+					title = strings.TrimSpace(string(z.Text()))
+				}
+			case atom.Meta:
+				key, content := metaTag(token)
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if preview.Image == "" {
+						preview.Image = imageURL(pageURL, content)
+					}
+				case "description":
+					description = content
+				}
+			}
+		case html.EndTagToken:
+			if z.Token().DataAtom == atom.Head {
+				done = true
+			}
+		}
+	}
+
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	if preview.Title == "" {
+		return nil
+	}
+	preview.Title = truncate(preview.Title, maxPreviewTitle)
+	preview.SiteName = truncate(preview.SiteName, maxPreviewTitle)
+	preview.Description = truncate(preview.Description, maxPreviewText)
+	return &preview
+}
+
+// metaTag returns the property, or name, of a meta tag and its content.
+func metaTag(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(attr.Val)
+			}
+		case "content":
+			content = strings.TrimSpace(attr.Val)
+		}
+	}
+	return key, content
+}
+
+// imageURL resolves the image against the page, only keeping http links.
+func imageURL(pageURL *url.URL, image string) string {
+	u, err := pageURL.Parse(image)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// truncate cuts s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the version of the socket protocol described in
+// protocol.schema.json. Envelopes of other versions are rejected.
+const ProtocolVersion = 1
+
+type EnvelopeType string
+
+// Envelopes clients send. Auth is only sent first, by clients which didn't
+// authenticate when opening the socket.
+const (
+	EnvelopeAuth     EnvelopeType = "auth"
+	EnvelopeSend     EnvelopeType = "send"
+	EnvelopeEdit     EnvelopeType = "edit"
+	EnvelopeDelete   EnvelopeType = "delete"
+	EnvelopeReceived EnvelopeType = "received"
+	EnvelopeRead     EnvelopeType = "read"
+	EnvelopeStatus   EnvelopeType = "status"
+	EnvelopeReact    EnvelopeType = "react"
+)
+
+// Envelopes the server sends. Events pushed to members have the same type
+// as the Event they carry. Clients send typing envelopes too.
+const (
+	EnvelopeAck    EnvelopeType = "ack"
+	EnvelopeError  EnvelopeType = "error"
+	EnvelopeSynced EnvelopeType = "synced"
+)
+
+// Envelope wraps everything sent over the chat socket. Id is chosen by the
+// client for the envelopes it sends and is echoed back in their ack or
+// error, so responses can be matched to requests.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    EnvelopeType    `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func NewEnvelope(envelopeType EnvelopeType, id string, payload any) (*Envelope, error) {
+	env := &Envelope{
+		Version: ProtocolVersion,
+		Type:    envelopeType,
+		Id:      id,
+	}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = raw
+	}
+	return env, nil
+}
+
+// Decode unmarshals the payload into v.
+func (env *Envelope) Decode(v any) error {
+	if len(env.Payload) == 0 {
+		return fmt.Errorf("payload is required")
+	}
+	return json.Unmarshal(env.Payload, v)
+}
+
+// AuthIn is the payload of an auth envelope, either a token or a ticket
+// issued by POST /ws/ticket.
+type AuthIn struct {
+	Token  string `json:"token,omitempty" validate:"required_without=Ticket"`
+	Ticket string `json:"ticket,omitempty" validate:"required_without=Token"`
+}
+
+func (in *AuthIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// EditIn is the payload of an edit envelope.
+type EditIn struct {
+	ChatId    uuid.UUID `json:"chat_id" validate:"required"`
+	MessageId uuid.UUID `json:"message_id" validate:"required"`
+	Text      string    `json:"text" validate:"required"`
+	Entities  []*Entity `json:"entities,omitempty" validate:"max=100,dive"`
+}
+
+func (in *EditIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// DeleteIn is the payload of a delete envelope.
+type DeleteIn struct {
+	ChatId      uuid.UUID `json:"chat_id" validate:"required"`
+	MessageId   uuid.UUID `json:"message_id" validate:"required"`
+	ForEveryone bool      `json:"for_everyone"`
+}
+
+func (in *DeleteIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// ReactIn is the payload of a react envelope, it adds the account's
+// reaction to the message or removes it.
+type ReactIn struct {
+	ChatId    uuid.UUID `json:"chat_id" validate:"required"`
+	MessageId uuid.UUID `json:"message_id" validate:"required"`
+	Emoji     string    `json:"emoji" validate:"required"`
+	Remove    bool      `json:"remove"`
+}
+
+func (in *ReactIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// ReceivedIn is the payload of a received envelope. It confirms the device
+// got every message of the chat up to Seq, so they aren't resent when it
+// reconnects.
+type ReceivedIn struct {
+	ChatId uuid.UUID `json:"chat_id" validate:"required"`
+	Seq    int64     `json:"seq" validate:"required,min=1"`
+}
+
+func (in *ReceivedIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// ReadIn is the payload of a read envelope. It marks every message of the
+// chat up to Seq as read by the account.
+type ReadIn struct {
+	ChatId uuid.UUID `json:"chat_id" validate:"required"`
+	Seq    int64     `json:"seq" validate:"required,min=1"`
+}
+
+func (in *ReadIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// SyncedPayload is the payload of the synced envelope, which follows the
+// missed messages resent after connecting.
+type SyncedPayload struct {
+	Truncated []uuid.UUID `json:"truncated,omitempty"`
+}
+
+// ErrorPayload is the payload of an error envelope, Code follows HTTP
+// status codes.
+type ErrorPayload struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// StatusIn is the payload of a status envelope, clients set themselves away
+// when the user is idle and back online when they return.
+type StatusIn struct {
+	Status PresenceStatus `json:"status" validate:"required,oneof=online away"`
+}
+
+func (in *StatusIn) Validate() error {
+	return validate.Struct(in)
+}
+
+// TypingPayload is the payload of typing envelopes and events. Clients
+// may leave out AccountId and send a start every few seconds while the user
+// is typing.
+type TypingPayload struct {
+	ChatId    uuid.UUID `json:"chat_id" validate:"required"`
+	AccountId uuid.UUID `json:"account_id"`
+	Typing    bool      `json:"typing"`
+}
+
+func (in *TypingPayload) Validate() error {
+	return validate.Struct(in)
+}
+
+// ReceiptPayload is the payload of read and delivery receipt events, every
+// message up to Seq was read or delivered to one of the account's devices.
+type ReceiptPayload struct {
+	ChatId    uuid.UUID `json:"chat_id"`
+	AccountId uuid.UUID `json:"account_id"`
+	Seq       int64     `json:"seq"`
+}
+
+// PresencePayload is the payload of presence events. LastSeen is only set
+// when the account is offline, if it's visible.
+type PresencePayload struct {
+	AccountId uuid.UUID      `json:"account_id"`
+	Status    PresenceStatus `json:"status"`
+	LastSeen  *time.Time     `json:"last_seen,omitempty"`
+}
+
+// ReactionPayload is the payload of reaction added and removed events.
+type ReactionPayload struct {
+	ChatId    uuid.UUID `json:"chat_id"`
+	MessageId uuid.UUID `json:"message_id"`
+	AccountId uuid.UUID `json:"account_id"`
+	Emoji     string    `json:"emoji"`
+}
+
+// envelopePayloads returns a value to decode the payload of each envelope
+// type into. Acks carry the message they acknowledge, if any.
+var envelopePayloads = map[EnvelopeType]func() any{
+	EnvelopeAuth:     func() any { return &AuthIn{} },
+	EnvelopeSend:     func() any { return &MessageIn{} },
+	EnvelopeEdit:     func() any { return &EditIn{} },
+	EnvelopeDelete:   func() any { return &DeleteIn{} },
+	EnvelopeReceived: func() any { return &ReceivedIn{} },
+	EnvelopeRead:     func() any { return &ReadIn{} },
+	EnvelopeStatus:   func() any { return &StatusIn{} },
+	EnvelopeReact:    func() any { return &ReactIn{} },
+	EnvelopeAck:      func() any { return &Message{} },
+	EnvelopeError:    func() any { return &ErrorPayload{} },
+	EnvelopeSynced:   func() any { return &SyncedPayload{} },
+
+	EnvelopeType(EventMessage):         func() any { return &Message{} },
+	EnvelopeType(EventMessageEdited):   func() any { return &Message{} },
+	EnvelopeType(EventMessageDeleted):  func() any { return &Message{} },
+	EnvelopeType(EventTyping):          func() any { return &TypingPayload{} },
+	EnvelopeType(EventReadReceipt):     func() any { return &ReceiptPayload{} },
+	EnvelopeType(EventDeliveryReceipt): func() any { return &ReceiptPayload{} },
+	EnvelopeType(EventPresence):        func() any { return &PresencePayload{} },
+	EnvelopeType(EventReactionAdded):   func() any { return &ReactionPayload{} },
+	EnvelopeType(EventReactionRemoved): func() any { return &ReactionPayload{} },
+	EnvelopeType(EventDraft):           func() any { return &Draft{} },
+	EnvelopeType(EventScheduled):       func() any { return &ScheduledMessage{} },
+}
+
+// Envelope wraps the event to push it to a socket.
+func (e Event) Envelope() (*Envelope, error) {
+	return NewEnvelope(EnvelopeType(e.Type), "", e.payload())
+}
+
+func (e Event) payload() any {
+	switch {
+	case e.Message != nil:
+		return e.Message
+	case e.Typing != nil:
+		return e.Typing
+	case e.Receipt != nil:
+		return e.Receipt
+	case e.Presence != nil:
+		return e.Presence
+	case e.Reaction != nil:
+		return e.Reaction
+	case e.Draft != nil:
+		return e.Draft
+	case e.Scheduled != nil:
+		return e.Scheduled
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type protocolSchema struct {
+	Properties struct {
+		Version struct {
+			Const int `json:"const"`
+		} `json:"v"`
+		Type struct {
+			Enum []EnvelopeType `json:"enum"`
+		} `json:"type"`
+	} `json:"properties"`
+	Examples []json.RawMessage `json:"examples"`
+}
+
+func loadProtocolSchema(t *testing.T) *protocolSchema {
+	raw, err := os.ReadFile("protocol.schema.json")
+	assert.Nil(t, err)
+	schema := &protocolSchema{}
+	assert.Nil(t, json.Unmarshal(raw, schema))
+	return schema
+}
+
+func TestProtocolSchema(t *testing.T) {
+	schema := loadProtocolSchema(t)
+
+	t.Run("version", func(t *testing.T) {
+		assert.Equal(t, ProtocolVersion, schema.Properties.Version.Const)
+	})
+	t.Run("documents every type", func(t *testing.T) {
+		types := []EnvelopeType{}
+		for envelopeType := range envelopePayloads {
+			types = append(types, envelopeType)
+		}
+		assert.ElementsMatch(t, types, schema.Properties.Type.Enum)
+	})
+	t.Run("examples round trip", func(t *testing.T) {
+		examples := map[EnvelopeType]bool{}
+		for _, example := range schema.Examples {
+			env := &Envelope{}
+			assert.Nil(t, json.Unmarshal(example, env))
+			examples[env.Type] = true
+
+			newPayload, found := envelopePayloads[env.Type]
+			assert.True(t, found, env.Type)
+			var payload any
+			if len(env.Payload) > 0 {
+				payload = newPayload()
+				assert.Nil(t, env.Decode(payload))
+			}
+
+			encoded, err := NewEnvelope(env.Type, env.Id, payload)
+			assert.Nil(t, err)
+			raw, err := json.Marshal(encoded)
+			assert.Nil(t, err)
+			assert.JSONEq(t, string(example), string(raw))
+		}
+		// Every type has at least one example.
+		assert.Len(t, examples, len(envelopePayloads))
+	})
+}
+
+func TestEventEnvelope(t *testing.T) {
+	editedAt := time.Now().UTC().Round(time.Second)
+	events := []Event{
+		{Type: EventMessage, Message: &Message{Id: uuid.New(), ChatId: uuid.New(), Seq: 1, Text: "hi", CreatedAt: editedAt}},
+		{Type: EventMessageEdited, Message: &Message{Id: uuid.New(), Text: "hello", EditedAt: &editedAt, Edits: []*MessageEdit{{Text: "hi", EditedAt: editedAt}}}},
+		{Type: EventMessageDeleted, Message: &Message{Id: uuid.New(), Deleted: true}},
+		{Type: EventTyping, Typing: &TypingPayload{ChatId: uuid.New(), AccountId: uuid.New(), Typing: true}},
+		{Type: EventReadReceipt, Receipt: &ReceiptPayload{ChatId: uuid.New(), AccountId: uuid.New(), Seq: 3}},
+		{Type: EventDeliveryReceipt, Receipt: &ReceiptPayload{ChatId: uuid.New(), AccountId: uuid.New(), Seq: 4}},
+		{Type: EventPresence, Presence: &PresencePayload{AccountId: uuid.New(), Status: StatusOnline}},
+		{Type: EventPresence, Presence: &PresencePayload{AccountId: uuid.New(), Status: StatusOffline, LastSeen: &editedAt}},
+		{Type: EventReactionAdded, Reaction: &ReactionPayload{ChatId: uuid.New(), MessageId: uuid.New(), AccountId: uuid.New(), Emoji: "👍"}},
+		{Type: EventDraft, Draft: &Draft{ChatId: uuid.New(), Text: "I think", UpdatedAt: editedAt}},
+		{Type: EventScheduled, Scheduled: &ScheduledMessage{Id: uuid.New(), ChatId: uuid.New(), Text: "later", SendAt: editedAt, Status: ScheduledPending, CreatedAt: editedAt, UpdatedAt: editedAt}},
+	}
+
+	for _, event := range events {
+		t.Run(string(event.Type), func(t *testing.T) {
+			env, err := event.Envelope()
+			assert.Nil(t, err)
+
+			raw, err := json.Marshal(env)
+			assert.Nil(t, err)
+			decoded := &Envelope{}
+			assert.Nil(t, json.Unmarshal(raw, decoded))
+			assert.Equal(t, ProtocolVersion, decoded.Version)
+			assert.Equal(t, EnvelopeType(event.Type), decoded.Type)
+
+			payload := envelopePayloads[decoded.Type]()
+			assert.Nil(t, decoded.Decode(payload))
+			assert.Equal(t, event.payload(), payload)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxEmojiLength fits the longest emoji sequences, families joined by
+	// zero width joiners and flags of subdivisions.
+	maxEmojiLength = 16
+	// maxReactionEmoji is how many different emoji a message may get.
+	maxReactionEmoji = 20
+)
+
+var (
+	ErrInvalidEmoji     = errors.New("reactions have to be a single emoji")
+	ErrTooManyReactions = errors.New("message has too many different reactions")
+)
+
+// isEmoji reports whether s looks like one emoji: symbols, optionally
+// joined or modified, without any letters, digits or spaces.
+func isEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > maxEmojiLength {
+		return false
+	}
+	symbol := false
+	for _, r := range s {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case r == 0x200D, // zero width joiner
+			r == 0xFE0F,                  // emoji presentation
+			r >= 0x1F3FB && r <= 0x1F3FF, // skin tones
+			r >= 0xE0020 && r <= 0xE007F: // tags of subdivision flags
+		default:
+			return false
+		}
+	}
+	return symbol
+}
+
+// React adds the account's reaction to the message, or removes it, and
+// tells the members. Doing it twice changes nothing.
+func (s *chatService) React(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, emoji string, remove bool) error {
+	if !isEmoji(emoji) {
+		return ErrInvalidEmoji
+	}
+	chat, msg, err := s.getChatMessage(ctx, accountId, chatId, messageId)
+	if err != nil {
+		return err
+	}
+	if err := checkRequest(chat, accountId); err != nil {
+		return err
+	}
+	// Reactions would be in the clear.
+	if chat.Encrypted {
+		return ErrEncrypted
+	}
+
+	reaction := &Reaction{Emoji: emoji, AccountId: accountId}
+	var changed bool
+	eventType := EventReactionAdded
+	if remove {
+		eventType = EventReactionRemoved
+		changed, err = s.store.RemoveReaction(ctx, chatId, messageId, reaction)
+	} else {
+		if hasReaction(msg.ReactedBy, reaction) < 0 && !hasEmoji(msg.ReactedBy, emoji) &&
+			len(countReactions(msg.ReactedBy, accountId)) >= maxReactionEmoji {
+			return ErrTooManyReactions
+		}
+		changed, err = s.store.AddReaction(ctx, chatId, messageId, reaction)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	event := Event{Type: eventType, Reaction: &ReactionPayload{
+		ChatId:    chatId,
+		MessageId: messageId,
+		AccountId: accountId,
+		Emoji:     emoji,
+	}}
+	return s.publish(ctx, chat.Members, accountId, deviceId, event)
+}
+
+func hasEmoji(reactions []*Reaction, emoji string) bool {
+	for _, reaction := range reactions {
+		if reaction.Emoji == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// countReactions counts the reactions by emoji, in the order they were
+// first used, and marks the ones viewerId reacted with.
+func countReactions(reactions []*Reaction, viewerId uuid.UUID) []*ReactionCount {
+	counts := []*ReactionCount{}
+	byEmoji := map[string]*ReactionCount{}
+	for _, reaction := range reactions {
+		count, ok := byEmoji[reaction.Emoji]
+		if !ok {
+			count = &ReactionCount{Emoji: reaction.Emoji}
+			byEmoji[reaction.Emoji] = count
+			counts = append(counts, count)
+		}
+		count.Count++
+		if reaction.AccountId == viewerId {
+			count.Reacted = true
+		}
+	}
+	return counts
+}
+
+// withReactions fills in the reaction counts of the messages as viewerId
+// sees them.
+func withReactions(messages []*Message, viewerId uuid.UUID) []*Message {
+	for _, msg := range messages {
+		if len(msg.ReactedBy) > 0 {
+			msg.Reactions = countReactions(msg.ReactedBy, viewerId)
+		}
+	}
+	return messages
+}
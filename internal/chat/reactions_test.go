@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "👨‍👩‍👧", "🇮🇷", "🏴󠁧󠁢󠁳󠁣󠁴󠁿"} {
+		assert.True(t, isEmoji(emoji), emoji)
+	}
+	for _, text := range []string{"", "a", "ok", "1", "👍 ", "👍a", "<script>", "‍"} {
+		assert.False(t, isEmoji(text), text)
+	}
+}
+
+func TestCountReactions(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	reactions := []*Reaction{
+		{Emoji: "🎉", AccountId: bob},
+		{Emoji: "👍", AccountId: alice},
+		{Emoji: "🎉", AccountId: alice},
+	}
+	assert.Equal(t, []*ReactionCount{
+		{Emoji: "🎉", Count: 2, Reacted: true},
+		{Emoji: "👍", Count: 1},
+	}, countReactions(reactions, bob))
+	assert.Empty(t, countReactions(nil, bob))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNoRequest       = errors.New("there's no message request in this chat")
+	ErrRequestPending  = errors.New("accept the message request first")
+	ErrRequestDeclined = errors.New("the message request was declined")
+	ErrAddForbidden    = errors.New("the account's DM policy doesn't let you add it to chats")
+)
+
+// messageRequest returns the request a private chat accountId starts with
+// recipientId begins as, nil when the recipient's DM policy lets accountId
+// message them directly.
+func (s *chatService) messageRequest(ctx context.Context, accountId, recipientId uuid.UUID) (*MessageRequest, error) {
+	settings, err := s.store.GetPrivacySettings(ctx, recipientId)
+	if err != nil {
+		return nil, err
+	}
+	if settings.DirectMessages != DMFromFollowers && settings.DirectMessages != DMFromMutuals {
+		return nil, nil
+	}
+
+	relationship, err := s.auth.GetRelationshipRPC(ctx, accountId.String(), recipientId.String())
+	if err != nil {
+		return nil, err
+	}
+	allowed := relationship.Following
+	if settings.DirectMessages == DMFromMutuals {
+		allowed = allowed && relationship.FollowedBy
+	}
+	if allowed {
+		return nil, nil
+	}
+	return &MessageRequest{
+		From:      accountId,
+		To:        recipientId,
+		Status:    RequestPending,
+		CreatedAt: s.now(),
+	}, nil
+}
+
+// checkDMPolicies fails unless the DM policy of every one of the accounts
+// lets accountId message it. Groups have no message requests, they'd get
+// around the policy otherwise.
+func (s *chatService) checkDMPolicies(ctx context.Context, accountId uuid.UUID, accountIds []uuid.UUID) error {
+	for _, id := range accountIds {
+		request, err := s.messageRequest(ctx, accountId, id)
+		if err != nil {
+			return err
+		}
+		if request != nil {
+			return fmt.Errorf("%w: %s", ErrAddForbidden, id)
+		}
+	}
+	return nil
+}
+
+// checkRequest fails when accountId can't send into the chat because of its
+// message request: the recipient has to accept it first, and the sender
+// can't send anything more once it's declined.
+func checkRequest(chat *Chat, accountId uuid.UUID) error {
+	switch {
+	case chat.Request == nil:
+		return nil
+	case chat.IsRequestTo(accountId):
+		return ErrRequestPending
+	case chat.Request.Status == RequestDeclined:
+		return ErrRequestDeclined
+	}
+	return nil
+}
+
+// GetMessageRequests returns the pending requests sent to the account, the
+// newest first.
+func (s *chatService) GetMessageRequests(ctx context.Context, accountId uuid.UUID) ([]*InboxChat, error) {
+	return s.inbox(ctx, accountId, func(chat *Chat) bool {
+		return chat.IsRequestTo(accountId) && chat.Request.Status == RequestPending
+	})
+}
+
+// getRequest returns the chat with a message request to accountId.
+func (s *chatService) getRequest(ctx context.Context, accountId, chatId uuid.UUID) (*Chat, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+	if !chat.IsRequestTo(accountId) {
+		return nil, ErrNoRequest
+	}
+	return chat, nil
+}
+
+// AcceptRequest turns the request into an ordinary private chat, a
+// declined one too.
+func (s *chatService) AcceptRequest(ctx context.Context, accountId, chatId uuid.UUID) (*Chat, error) {
+	chat, err := s.getRequest(ctx, accountId, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.UpdateMessageRequest(ctx, chatId, nil); err != nil {
+		return nil, err
+	}
+	chat.Request = nil
+	return chat, nil
+}
+
+// DeclineRequest hides the request from the recipient and stops the sender
+// from sending more. The sender isn't told.
+func (s *chatService) DeclineRequest(ctx context.Context, accountId, chatId uuid.UUID) error {
+	chat, err := s.getRequest(ctx, accountId, chatId)
+	if err != nil {
+		return err
+	}
+	declined := *chat.Request
+	declined.Status = RequestDeclined
+	return s.store.UpdateMessageRequest(ctx, chatId, &declined)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// minRetention is the shortest retention or disappearing timer, in
+// seconds.
+const minRetention = 60
+
+var ErrInvalidRetention = errors.New("retention has to be at least a minute")
+
+// expired reports whether the message disappeared or is past the chat's
+// retention, the sweeper may not have deleted it yet.
+func expired(chat *Chat, msg *Message, now time.Time) bool {
+	if msg.ExpiresAt != nil && !msg.ExpiresAt.After(now) {
+		return true
+	}
+	return chat.Retention > 0 && msg.CreatedAt.Before(now.Add(-time.Duration(chat.Retention)*time.Second))
+}
+
+// unexpired leaves the expired messages of the chat out.
+func (s *chatService) unexpired(chat *Chat, messages []*Message) []*Message {
+	now := s.now()
+	kept := []*Message{}
+	for _, msg := range messages {
+		if !expired(chat, msg, now) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// UpdateRetention changes how long the chat keeps its messages and tells
+// the members with a system message. Any member of a private chat may
+// change it, only admins of a group.
+func (s *chatService) UpdateRetention(ctx context.Context, accountId, chatId uuid.UUID, in *RetentionIn) (*Chat, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+	if chat.IsPrivate {
+		if err := checkRequest(chat, accountId); err != nil {
+			return nil, err
+		}
+	} else if chat.RoleOf(accountId) == RoleMember {
+		return nil, ErrNotAdmin
+	}
+
+	updated := *chat
+	system := &SystemMessage{Type: SystemRetentionChanged}
+	if in.Retention != nil && *in.Retention != chat.Retention {
+		updated.Retention = *in.Retention
+		system.Retention = in.Retention
+	}
+	if in.DisappearAfter != nil && *in.DisappearAfter != chat.DisappearAfter {
+		updated.DisappearAfter = *in.DisappearAfter
+		system.DisappearAfter = in.DisappearAfter
+	}
+	if system.Retention == nil && system.DisappearAfter == nil {
+		return chat, nil
+	}
+	if err := s.store.UpdateRetention(ctx, &updated); err != nil {
+		return nil, err
+	}
+
+	if err := s.postSystemMessage(ctx, chatId, accountId, system, chat.Members); err != nil {
+		return nil, err
+	}
+	return s.store.GetChat(ctx, chatId)
+}
+
+// SweepMessages deletes the messages which disappeared or are past the
+// retention of their chat and returns how many there were. Clients drop
+// them by themselves, nobody is told.
+func (s *chatService) SweepMessages(ctx context.Context) (int, error) {
+	now := s.now()
+	deleted, err := s.store.DeleteExpiredMessages(ctx, now)
+	if err != nil {
+		return deleted, err
+	}
+
+	chats, err := s.store.GetRetentionChats(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	for _, chat := range chats {
+		n, err := s.store.DeleteMessagesBefore(ctx, chat.Id, now.Add(-time.Duration(chat.Retention)*time.Second))
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// StartSweeper sweeps the messages every interval, errors are passed to
+// onError. Every node may run one, sweeping twice does no harm. The
+// returned function stops it.
+func (s *chatService) StartSweeper(interval time.Duration, onError func(err error)) func(ctx context.Context) error {
+	return runEvery(interval, func(ctx context.Context) error {
+		_, err := s.SweepMessages(ctx)
+		return err
+	}, onError)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxScheduleAhead is how far ahead messages may be scheduled.
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// scheduledClaim is how long a replica has to send the messages it
+	// claimed before another may take them over.
+	scheduledClaim = time.Minute
+	// scheduledBatch is the most messages one run of the scheduler sends.
+	scheduledBatch = 100
+	// maxScheduledAttempts is how often sending a message is tried before
+	// it fails.
+	maxScheduledAttempts = 5
+)
+
+var ErrInvalidSendAt = errors.New("messages have to be scheduled in the future, up to a year ahead")
+
+// scheduledClientId is the client id a scheduled message is sent with, so
+// sending it twice stores it once.
+func scheduledClientId(id uuid.UUID) string {
+	return "scheduled/" + id.String()
+}
+
+// checkScheduled checks the account can send the scheduled message in the
+// chat and returns its attachments and entities. Scheduled messages are
+// kept in the clear, encrypted chats can't have any.
+func (s *chatService) checkScheduled(ctx context.Context, accountId uuid.UUID, chat *Chat, in *ScheduledMessageIn) ([]*Attachment, []*Entity, error) {
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, nil, ErrNotMember
+	}
+	if err := checkRequest(chat, accountId); err != nil {
+		return nil, nil, err
+	}
+	if chat.Encrypted {
+		return nil, nil, ErrEncrypted
+	}
+	now := s.now()
+	if !in.SendAt.After(now) || in.SendAt.After(now.Add(maxScheduleAhead)) {
+		return nil, nil, ErrInvalidSendAt
+	}
+	if in.ReplyMessageId != uuid.Nil {
+		if err := s.checkReply(ctx, chat, in.ReplyMessageId); err != nil {
+			return nil, nil, err
+		}
+	}
+	entities, err := checkEntities(chat, in.Text, in.Entities)
+	if err != nil {
+		return nil, nil, err
+	}
+	attachments, err := s.attachments(ctx, accountId, in.Attachments)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachments, entities, nil
+}
+
+// publishScheduled tells the author's devices, except deviceId, about a
+// change to one of their scheduled messages.
+func (s *chatService) publishScheduled(ctx context.Context, deviceId string, msg *ScheduledMessage) error {
+	event := Event{Type: EventScheduled, Scheduled: msg}
+	return s.publish(ctx, []uuid.UUID{msg.AccountId}, msg.AccountId, deviceId, event)
+}
+
+// ScheduleMessage stores a message the scheduler sends to the chat at
+// in.SendAt.
+func (s *chatService) ScheduleMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, in *ScheduledMessageIn) (*ScheduledMessage, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	attachments, entities, err := s.checkScheduled(ctx, accountId, chat, in)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	msg := &ScheduledMessage{
+		Id:             uuid.New(),
+		ChatId:         chat.Id,
+		AccountId:      accountId,
+		ReplyMessageId: in.ReplyMessageId,
+		Text:           in.Text,
+		Attachments:    attachments,
+		Entities:       entities,
+		SendAt:         in.SendAt.UTC(),
+		Status:         ScheduledPending,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := s.store.InsertScheduledMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	return msg, s.publishScheduled(ctx, deviceId, msg)
+}
+
+// GetScheduledMessages returns the account's scheduled messages of the
+// chat, or of all its chats when chatId is nil.
+func (s *chatService) GetScheduledMessages(ctx context.Context, accountId, chatId uuid.UUID) ([]*ScheduledMessage, error) {
+	return s.store.GetScheduledMessages(ctx, accountId, chatId)
+}
+
+// getScheduledMessage returns one of the account's scheduled messages,
+// those of others don't exist as far as it's concerned.
+func (s *chatService) getScheduledMessage(ctx context.Context, accountId, id uuid.UUID) (*ScheduledMessage, error) {
+	msg, err := s.store.GetScheduledMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.AccountId != accountId {
+		return nil, ErrScheduledNotFound
+	}
+	return msg, nil
+}
+
+// UpdateScheduledMessage replaces the content and send time of a scheduled
+// message which wasn't sent yet. A failed message is tried again.
+func (s *chatService) UpdateScheduledMessage(ctx context.Context, accountId uuid.UUID, deviceId string, id uuid.UUID, in *ScheduledMessageIn) (*ScheduledMessage, error) {
+	msg, err := s.getScheduledMessage(ctx, accountId, id)
+	if err != nil {
+		return nil, err
+	}
+	chat, err := s.store.GetChat(ctx, msg.ChatId)
+	if err != nil {
+		return nil, err
+	}
+	attachments, entities, err := s.checkScheduled(ctx, accountId, chat, in)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.ReplyMessageId = in.ReplyMessageId
+	msg.Text = in.Text
+	msg.Attachments = attachments
+	msg.Entities = entities
+	msg.SendAt = in.SendAt.UTC()
+	msg.Status = ScheduledPending
+	msg.Error = ""
+	msg.UpdatedAt = s.now()
+	if err := s.store.UpdateScheduledMessage(ctx, msg, s.now()); err != nil {
+		return nil, err
+	}
+	return msg, s.publishScheduled(ctx, deviceId, msg)
+}
+
+// CancelScheduledMessage deletes a scheduled message which wasn't sent yet.
+func (s *chatService) CancelScheduledMessage(ctx context.Context, accountId uuid.UUID, deviceId string, id uuid.UUID) error {
+	msg, err := s.getScheduledMessage(ctx, accountId, id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteScheduledMessage(ctx, id, s.now()); err != nil {
+		return err
+	}
+	msg.Status = ScheduledCanceled
+	msg.UpdatedAt = s.now()
+	return s.publishScheduled(ctx, deviceId, msg)
+}
+
+// DispatchScheduledMessages sends the scheduled messages which are due and
+// returns how many were sent. Replicas claim the messages as owner before
+// sending them, so only one sends each. A replica which stops before it's
+// done leaves its claims to run out, the messages are sent with a client
+// id so the replica taking over doesn't send them twice.
+func (s *chatService) DispatchScheduledMessages(ctx context.Context, owner string) (int, error) {
+	now := s.now()
+	claimed, err := s.store.ClaimScheduledMessages(ctx, owner, now, now.Add(scheduledClaim), scheduledBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, scheduled := range claimed {
+		// Sent from none of the author's devices, all of them get it.
+		msg, err := s.Deliver(ctx, scheduled.AccountId, "", MessageIn{
+			ChatId:         scheduled.ChatId,
+			ReplyMessageId: scheduled.ReplyMessageId,
+			Text:           scheduled.Text,
+			Attachments:    scheduled.Attachments,
+			Entities:       scheduled.Entities,
+			ClientId:       scheduledClientId(scheduled.Id),
+		})
+		switch {
+		case err == nil:
+			scheduled.Status = ScheduledSent
+			scheduled.MessageId = msg.Id
+			scheduled.Error = ""
+			sent++
+		case ctx.Err() != nil:
+			return sent, ctx.Err()
+		case scheduled.Attempts >= maxScheduledAttempts:
+			scheduled.Status = ScheduledFailed
+			scheduled.Error = err.Error()
+		default:
+			// Tried again on the next run.
+			scheduled.Error = err.Error()
+		}
+		if err := s.store.ReleaseScheduledMessage(ctx, scheduled); err != nil {
+			return sent, err
+		}
+		if scheduled.Status != ScheduledPending {
+			scheduled.UpdatedAt = s.now()
+			if err := s.publishScheduled(ctx, "", scheduled); err != nil {
+				return sent, err
+			}
+		}
+	}
+	return sent, nil
+}
+
+// StartScheduler sends the scheduled messages which are due every
+// interval, errors are passed to onError. Every replica may run one. The
+// returned function stops it.
+func (s *chatService) StartScheduler(interval time.Duration, onError func(err error)) func(ctx context.Context) error {
+	owner := uuid.NewString()
+	return runEvery(interval, func(ctx context.Context) error {
+		_, err := s.DispatchScheduledMessages(ctx, owner)
+		return err
+	}, onError)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	maxSearchQuery     = 256
+	maxSearchTerms     = 10
+	// snippetLength is how many characters of a message a snippet shows,
+	// starting snippetContext characters before the first match.
+	snippetLength  = 160
+	snippetContext = 40
+)
+
+var ErrInvalidQuery = errors.New("search for at least one word")
+
+// span is where a word starts and ends in a text, in characters.
+type span struct {
+	start, end int
+	word       string
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// words splits text into lower cased words, anything but letters and digits
+// separates them.
+func words(text string) []span {
+	spans := []span{}
+	start := -1
+	runes := []rune(text)
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) && isWordChar(runes[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			spans = append(spans, span{start: start, end: i, word: strings.ToLower(string(runes[start:i]))})
+			start = -1
+		}
+	}
+	return spans
+}
+
+// tokenize returns the distinct words of text, which is what messages are
+// indexed and searched by.
+func tokenize(text string) []string {
+	tokens := []string{}
+	seen := map[string]bool{}
+	for _, word := range words(text) {
+		if !seen[word.word] {
+			seen[word.word] = true
+			tokens = append(tokens, word.word)
+		}
+	}
+	return tokens
+}
+
+// snippet cuts the part of text around the first of the terms out and
+// highlights the terms in it.
+func snippet(text string, terms []string) (string, []*Highlight) {
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+	matches := []span{}
+	for _, word := range words(text) {
+		if wanted[word.word] {
+			matches = append(matches, word)
+		}
+	}
+
+	runes := []rune(text)
+	start := 0
+	if len(matches) > 0 && matches[0].start > snippetContext {
+		start = matches[0].start - snippetContext
+	}
+	end := start + snippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	prefix, suffix := "", ""
+	if start > 0 {
+		prefix = "…"
+	}
+	if end < len(runes) {
+		suffix = "…"
+	}
+	highlights := []*Highlight{}
+	for _, match := range matches {
+		if match.start >= start && match.end <= end {
+			highlights = append(highlights, &Highlight{
+				Offset: match.start - start + len([]rune(prefix)),
+				Length: match.end - match.start,
+			})
+		}
+	}
+	return prefix + string(runes[start:end]) + suffix, highlights
+}
+
+// Search finds the messages with every word of query in the chats of the
+// account, or only in chatId when it's set. Encrypted chats can't be
+// searched, the server doesn't have their text.
+func (s *chatService) Search(ctx context.Context, accountId uuid.UUID, query string, chatId uuid.UUID, cursor string, limit int) (*SearchPage, error) {
+	terms := tokenize(query)
+	if len(query) > maxSearchQuery || len(terms) == 0 || len(terms) > maxSearchTerms {
+		return nil, ErrInvalidQuery
+	}
+	skip := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidCursor
+		}
+		skip = n
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	var chats []*Chat
+	if chatId != uuid.Nil {
+		chat, err := s.store.GetChat(ctx, chatId)
+		if err != nil {
+			return nil, err
+		}
+		if !s.IsMemberOf(accountId, chat) {
+			return nil, ErrNotMember
+		}
+		chats = []*Chat{chat}
+	} else {
+		var err error
+		chats, err = s.store.GetAccountChats(ctx, accountId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	chatIds := []uuid.UUID{}
+	byId := map[uuid.UUID]*Chat{}
+	for _, chat := range chats {
+		if !chat.Encrypted {
+			chatIds = append(chatIds, chat.Id)
+			byId[chat.Id] = chat
+		}
+	}
+
+	page := &SearchPage{Results: []*SearchResult{}}
+	if len(chatIds) == 0 {
+		return page, nil
+	}
+	// One more tells whether there's another page.
+	messages, err := s.store.SearchMessages(ctx, chatIds, accountId, terms, skip, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.NextCursor = strconv.Itoa(skip + limit)
+	}
+	now := s.now()
+	for _, msg := range withReactions(messages, accountId) {
+		if expired(byId[msg.ChatId], msg, now) {
+			continue
+		}
+		text, highlights := snippet(msg.Text, terms)
+		page.Results = append(page.Results, &SearchResult{Message: msg, Snippet: text, Highlights: highlights})
+	}
+	return page, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"see", "you", "at", "5pm", "café"}, tokenize("See you at 5pm... you at Café!"))
+	assert.Equal(t, []string{"سلام", "دنیا"}, tokenize("سلام، دنیا"))
+	assert.Empty(t, tokenize(" ?! -- "))
+}
+
+func TestSnippet(t *testing.T) {
+	text, highlights := snippet("Lunch on Friday? friday works", []string{"friday"})
+	assert.Equal(t, "Lunch on Friday? friday works", text)
+	assert.Equal(t, []*Highlight{{Offset: 9, Length: 6}, {Offset: 17, Length: 6}}, highlights)
+
+	long := strings.Repeat("filler ", 20) + "the déjà vu part " + strings.Repeat("more ", 40)
+	text, highlights = snippet(long, []string{"déjà"})
+	assert.True(t, strings.HasPrefix(text, "…"))
+	assert.True(t, strings.HasSuffix(text, "…"))
+	assert.Equal(t, snippetLength+2, len([]rune(text)))
+	assert.Len(t, highlights, 1)
+	runes := []rune(text)
+	assert.Equal(t, "déjà", string(runes[highlights[0].Offset:highlights[0].Offset+highlights[0].Length]))
+
+	// Without a match the text starts the snippet.
+	text, highlights = snippet("nothing here", []string{"else"})
+	assert.Equal(t, "nothing here", text)
+	assert.Empty(t, highlights)
+}
@@ -2,58 +2,202 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sina-am/social-media/internal/auth/client"
 )
 
-type OnlineAccount struct {
-	accountID uuid.UUID
-	msgCh     chan Message
-}
-
-func NewOnlineAccount(accountID uuid.UUID) *OnlineAccount {
-	return &OnlineAccount{
-		accountID: accountID,
-		msgCh:     make(chan Message),
-	}
-}
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+	// resyncLimit is the most missed messages resent per chat on connect,
+	// clients fetch older ones from the history.
+	resyncLimit = 200
+)
 
-func (ws *OnlineAccount) GetAccountID() uuid.UUID {
-	return ws.accountID
-}
+var (
+	ErrNotMember     = errors.New("you're not a member of this chat room")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidReply  = errors.New("replied message doesn't exist in this chat")
+	ErrNotAuthor     = errors.New("only the author can change a message")
+	ErrDeleted       = errors.New("message is deleted")
+	ErrSystemMessage = errors.New("system messages can't be changed")
+	ErrUnknownMember = errors.New("unknown accounts")
+	ErrDirectChat    = errors.New("a private chat is between two different accounts")
+)
 
 type Service interface {
-	AddOnlineAccount(account *OnlineAccount)
-	DelOnlineAccount(account *OnlineAccount)
-	Deliver(accountId uuid.UUID, msg MessageIn) error
+	Connect(ctx context.Context, accountId uuid.UUID, deviceId string) (*OnlineAccount, error)
+	Disconnect(ctx context.Context, account *OnlineAccount) error
+	GetDevices(ctx context.Context, accountId uuid.UUID) ([]*Device, error)
+	Deliver(ctx context.Context, accountId uuid.UUID, deviceId string, msg MessageIn) (*Message, error)
+	EditMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, text string, entities []*Entity) (*Message, error)
+	DeleteMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, forEveryone bool) error
+	React(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, emoji string, remove bool) error
 	CreateChat(ctx context.Context, accountId uuid.UUID, chatIn *ChatIn) (*Chat, error)
+	// GetDirectChat returns the private chat between the two accounts,
+	// creating it if there's none yet, and reports whether it was created.
+	// Encrypted direct chats are separate from the plain ones.
+	GetDirectChat(ctx context.Context, accountId, otherId uuid.UUID, encrypted bool) (*Chat, bool, error)
+	// GetMessages gives deviceId only its own ciphertexts of encrypted
+	// messages.
+	GetMessages(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, before string, limit int) (*MessagePage, error)
+	Resync(ctx context.Context, accountId uuid.UUID, deviceId string) (*Resync, error)
+	AckDelivery(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error
+	MarkRead(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error
+	GetReceipts(ctx context.Context, accountId, chatId uuid.UUID) ([]*Receipt, error)
+	GetInbox(ctx context.Context, accountId uuid.UUID) ([]*InboxChat, error)
+	GetMessageRequests(ctx context.Context, accountId uuid.UUID) ([]*InboxChat, error)
+	AcceptRequest(ctx context.Context, accountId, chatId uuid.UUID) (*Chat, error)
+	DeclineRequest(ctx context.Context, accountId, chatId uuid.UUID) error
+	SetStatus(ctx context.Context, accountId uuid.UUID, deviceId string, status PresenceStatus) error
+	Typing(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, typing bool) error
+	GetPresence(ctx context.Context, viewerId uuid.UUID, accountIds []uuid.UUID) ([]*PresencePayload, error)
+	GetPrivacySettings(ctx context.Context, accountId uuid.UUID) (*PrivacySettings, error)
+	UpdatePrivacySettings(ctx context.Context, accountId uuid.UUID, settings *PrivacySettings) error
+	UpdateChatInfo(ctx context.Context, accountId, chatId uuid.UUID, info *ChatInfoIn) (*Chat, error)
+	AddMembers(ctx context.Context, accountId, chatId uuid.UUID, members []uuid.UUID) (*Chat, error)
+	RemoveMember(ctx context.Context, accountId, chatId, memberId uuid.UUID) error
+	LeaveChat(ctx context.Context, accountId, chatId uuid.UUID) error
+	SetRole(ctx context.Context, accountId, chatId, memberId uuid.UUID, role Role) (*Chat, error)
+	TransferOwnership(ctx context.Context, accountId, chatId, ownerId uuid.UUID) (*Chat, error)
+	CreateInvite(ctx context.Context, accountId, chatId uuid.UUID, ttl time.Duration) (*Invite, error)
+	GetInvites(ctx context.Context, accountId, chatId uuid.UUID) ([]*Invite, error)
+	RevokeInvite(ctx context.Context, accountId, chatId uuid.UUID, code string) error
+	JoinChat(ctx context.Context, accountId uuid.UUID, code string) (*Chat, error)
+	PublishKeys(ctx context.Context, accountId uuid.UUID, deviceId string, keys *KeysIn) (int, error)
+	CountPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string) (int, error)
+	RemoveDeviceKeys(ctx context.Context, accountId uuid.UUID, deviceId string) error
+	GetKeyBundles(ctx context.Context, accountId, targetId uuid.UUID) ([]*KeyBundle, error)
+	// Search looks through every chat of the account unless chatId is set.
+	Search(ctx context.Context, accountId uuid.UUID, query string, chatId uuid.UUID, cursor string, limit int) (*SearchPage, error)
+	UpdateRetention(ctx context.Context, accountId, chatId uuid.UUID, in *RetentionIn) (*Chat, error)
+	ScheduleMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, in *ScheduledMessageIn) (*ScheduledMessage, error)
+	// GetScheduledMessages returns those of every chat unless chatId is set.
+	GetScheduledMessages(ctx context.Context, accountId, chatId uuid.UUID) ([]*ScheduledMessage, error)
+	UpdateScheduledMessage(ctx context.Context, accountId uuid.UUID, deviceId string, id uuid.UUID, in *ScheduledMessageIn) (*ScheduledMessage, error)
+	CancelScheduledMessage(ctx context.Context, accountId uuid.UUID, deviceId string, id uuid.UUID) error
+	SaveDraft(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, in *DraftIn) (*Draft, error)
+	GetDrafts(ctx context.Context, accountId uuid.UUID) ([]*Draft, error)
+	// IssueSocketTicket issues a ticket to open the socket as the account
+	// with, token is what the account authenticated with.
+	IssueSocketTicket(ctx context.Context, accountId uuid.UUID, token string) (*SocketTicket, error)
+	RedeemSocketTicket(ctx context.Context, ticket string) (*SocketTicket, error)
 }
 
 type chatService struct {
-	store          Storage
-	auth           client.GRPCClient
-	onlineAccounts map[uuid.UUID]*OnlineAccount
+	store  Storage
+	auth   client.GRPCClient
+	hub    *Hub
+	broker Broker
+	typing *typingTracker
+	claims *claimLimiter
+	// media looks up attachments, without it messages can't have any.
+	media MediaClient
+	// previews generates link previews, there are none without it.
+	previews PreviewFetcher
+	// clock tells the time messages are sent and expire at.
+	clock func() time.Time
 }
 
-func NewChatService(store Storage, auth client.GRPCClient) *chatService {
+// NewChatService routes deliveries through the broker, which hands the ones
+// meant for this node's connections to the hub.
+func NewChatService(store Storage, auth client.GRPCClient, hub *Hub, broker Broker) *chatService {
+	broker.Subscribe(func(delivery *Delivery) {
+		if delivery.Device != "" {
+			hub.SendTo(delivery.AccountID, delivery.Device, delivery.Event)
+			return
+		}
+		hub.SendExcept(delivery.AccountID, delivery.ExceptDevice, delivery.Event)
+	})
 	return &chatService{
-		store:          store,
-		auth:           auth,
-		onlineAccounts: make(map[uuid.UUID]*OnlineAccount, 0),
+		store:  store,
+		auth:   auth,
+		hub:    hub,
+		broker: broker,
+		typing: newTypingTracker(typingInterval, typingTimeout),
+		claims: newClaimLimiter(keyClaimLimit, keyClaimWindow),
+		clock:  time.Now,
 	}
 }
 
+// now is the time of the clock as it's stored.
+func (s *chatService) now() time.Time {
+	return s.clock().UTC().Round(time.Second)
+}
+
+// runEvery runs run every interval in the background until the returned
+// function stops it, errors are passed to onError.
+func runEvery(interval time.Duration, run func(ctx context.Context) error, onError func(err error)) func(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := run(ctx); err != nil && ctx.Err() == nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	return func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+	}
+}
+
+// CreateChat creates a chat between accountId and the members, which have
+// to be existing accounts. A private chat the other member's DM policy
+// doesn't allow starts as a message request, a group can't have them.
 func (s *chatService) CreateChat(ctx context.Context, accountId uuid.UUID, chatIn *ChatIn) (*Chat, error) {
 	chat := &Chat{
 		Id:        uuid.New(),
-		Members:   chatIn.Members,
-		Messages:  []*Message{},
+		Members:   sortMembers(append(chatIn.Members, accountId)),
 		IsPrivate: chatIn.IsPrivate,
+		Encrypted: chatIn.Encrypted,
+	}
+	if chat.IsPrivate && len(chat.Members) != 2 {
+		return nil, ErrDirectChat
+	}
+	if chat.Encrypted && !chat.IsPrivate {
+		return nil, ErrEncryptedGroup
+	}
+	if !chat.IsPrivate {
+		chat.OwnerId = accountId
+		chat.Title = chatIn.Title
+		chat.Description = chatIn.Description
+		chat.Avatar = chatIn.Avatar
+	}
+	if err := s.checkAccounts(ctx, without(chat.Members, accountId)); err != nil {
+		return nil, err
+	}
+	if chat.IsPrivate {
+		request, err := s.messageRequest(ctx, accountId, without(chat.Members, accountId)[0])
+		if err != nil {
+			return nil, err
+		}
+		chat.Request = request
+	} else if err := s.checkDMPolicies(ctx, accountId, without(chat.Members, accountId)); err != nil {
+		return nil, err
 	}
-	chat.Members = append(chat.Members, accountId)
 
 	if err := s.store.InsertChat(ctx, chat); err != nil {
 		return nil, err
@@ -62,6 +206,64 @@ func (s *chatService) CreateChat(ctx context.Context, accountId uuid.UUID, chatI
 	return chat, nil
 }
 
+// The recipient of a message request gets the chat as it is, only
+// AcceptRequest accepts it.
+func (s *chatService) GetDirectChat(ctx context.Context, accountId, otherId uuid.UUID, encrypted bool) (*Chat, bool, error) {
+	if accountId == otherId {
+		return nil, false, ErrDirectChat
+	}
+	chat, err := s.store.GetDirectChat(ctx, accountId, otherId, encrypted)
+	if err == nil {
+		return chat, false, nil
+	}
+	if !errors.Is(err, ErrChatNotFound) {
+		return nil, false, err
+	}
+
+	chatIn := &ChatIn{Members: []uuid.UUID{otherId}, IsPrivate: true, Encrypted: encrypted}
+	chat, err = s.CreateChat(ctx, accountId, chatIn)
+	if errors.Is(err, ErrChatExists) {
+		// Created concurrently, by the other account perhaps.
+		chat, err = s.store.GetDirectChat(ctx, accountId, otherId, encrypted)
+		return chat, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return chat, true, nil
+}
+
+// checkAccounts asks the auth service, in one call, whether the accounts
+// exist and fails with ErrUnknownMember naming the ones which don't.
+func (s *chatService) checkAccounts(ctx context.Context, accountIds []uuid.UUID) error {
+	if len(accountIds) == 0 {
+		return nil
+	}
+	ids := make([]string, len(accountIds))
+	for i, accountId := range accountIds {
+		ids[i] = accountId.String()
+	}
+	accounts, err := s.auth.GetAccountsByIdsRPC(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]bool{}
+	for _, account := range accounts {
+		found[account.Id] = true
+	}
+	unknown := []string{}
+	for _, id := range ids {
+		if !found[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownMember, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
 func (s *chatService) IsMemberOf(accountId uuid.UUID, chat *Chat) bool {
 	for i := range chat.Members {
 		if chat.Members[i] == accountId {
@@ -70,42 +272,723 @@ func (s *chatService) IsMemberOf(accountId uuid.UUID, chat *Chat) bool {
 	}
 	return false
 }
-func (s *chatService) Deliver(accountId uuid.UUID, msgIn MessageIn) error {
-	chat, err := s.store.GetChat(context.Background(), msgIn.ChatId)
+
+// checkReply fails with ErrInvalidReply unless the replied message is in
+// the chat. Messages deleted for everyone or expired are gone as far as
+// members can tell, so replying to them fails the same way.
+func (s *chatService) checkReply(ctx context.Context, chat *Chat, messageId uuid.UUID) error {
+	msg, err := s.store.GetMessage(ctx, chat.Id, messageId)
+	if errors.Is(err, ErrMessageNotFound) {
+		return ErrInvalidReply
+	}
 	if err != nil {
 		return err
 	}
+	if msg.Deleted || expired(chat, msg, s.now()) {
+		return ErrInvalidReply
+	}
+	return nil
+}
+
+// Deliver stores the message and pushes it to every device of the other
+// members. It's also echoed to the sender's other devices, except deviceId
+// which sent it, so they stay in sync. Delivering a message with a client id
+// the sender already used in the chat returns the stored message again
+// without pushing it.
+//
+// Messages in encrypted chats have no content but a ciphertext for each
+// device of the members, which is pushed to that device only.
+func (s *chatService) Deliver(ctx context.Context, accountId uuid.UUID, deviceId string, msgIn MessageIn) (*Message, error) {
+	chat, err := s.store.GetChat(ctx, msgIn.ChatId)
+	if err != nil {
+		return nil, err
+	}
 
 	if !s.IsMemberOf(accountId, chat) {
-		return fmt.Errorf("you're not a member of this chat room")
+		return nil, ErrNotMember
+	}
+	if err := checkRequest(chat, accountId); err != nil {
+		return nil, err
+	}
+
+	if msgIn.ClientId != "" {
+		msg, err := s.store.GetMessageByClientId(ctx, chat.Id, accountId, msgIn.ClientId)
+		if err == nil {
+			return msg.forDevice(accountId, deviceId), nil
+		}
+		if !errors.Is(err, ErrMessageNotFound) {
+			return nil, err
+		}
+	}
+
+	if msgIn.ReplyMessageId != uuid.Nil {
+		if err := s.checkReply(ctx, chat, msgIn.ReplyMessageId); err != nil {
+			return nil, err
+		}
+	}
+
+	if chat.Encrypted {
+		if msgIn.Text != "" || len(msgIn.Attachments) > 0 || len(msgIn.Entities) > 0 {
+			return nil, ErrEncrypted
+		}
+		if err := s.checkCiphertexts(ctx, chat, accountId, deviceId, msgIn.Ciphertexts); err != nil {
+			return nil, err
+		}
+	} else if len(msgIn.Ciphertexts) > 0 {
+		return nil, ErrNotEncrypted
+	} else if msgIn.Text == "" && len(msgIn.Attachments) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	entities, err := checkEntities(chat, msgIn.Text, msgIn.Entities)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := s.attachments(ctx, accountId, msgIn.Attachments)
+	if err != nil {
+		return nil, err
 	}
 
 	msg := &Message{
 		FromAccountId:  accountId,
 		ReplyMessageId: msgIn.ReplyMessageId,
 		Text:           msgIn.Text,
-		CreatedAt:      time.Now().UTC().Round(time.Second),
+		Attachments:    attachments,
+		Entities:       entities,
+		Preview:        s.preview(ctx, msgIn.Text),
+		Ciphertexts:    msgIn.Ciphertexts,
+		ClientId:       msgIn.ClientId,
+		CreatedAt:      s.now(),
 	}
-	if err := s.store.InsertMessage(context.Background(), chat.Id, msg); err != nil {
-		return err
+	if chat.DisappearAfter > 0 {
+		expiresAt := msg.CreatedAt.Add(time.Duration(chat.DisappearAfter) * time.Second)
+		msg.ExpiresAt = &expiresAt
+	}
+	if err := s.store.InsertMessage(ctx, chat.Id, msg); err != nil {
+		// Lost a race with a retry of the same message.
+		if errors.Is(err, ErrDuplicateMessage) {
+			msg, err := s.store.GetMessageByClientId(ctx, chat.Id, accountId, msgIn.ClientId)
+			if err != nil {
+				return nil, err
+			}
+			return msg.forDevice(accountId, deviceId), nil
+		}
+		return nil, err
 	}
 
-	for _, memberId := range chat.Members {
-		// Don't send back the message
+	// Members stop showing the sender as typing when the message arrives.
+	s.typing.Stop(accountId, chat.Id)
+
+	if chat.Encrypted {
+		if err := s.publishCiphertexts(ctx, msg); err != nil {
+			return nil, err
+		}
+		return msg.forDevice(accountId, deviceId), nil
+	}
+	event := Event{Type: EventMessage, Message: msg}
+	if err := s.publish(ctx, chat.Members, accountId, deviceId, event); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// publish pushes event to every device of members except deviceId of
+// accountId, which caused it.
+func (s *chatService) publish(ctx context.Context, members []uuid.UUID, accountId uuid.UUID, deviceId string, event Event) error {
+	for _, memberId := range members {
+		delivery := &Delivery{AccountID: memberId, Event: event}
 		if memberId == accountId {
-			continue
+			delivery.ExceptDevice = deviceId
 		}
-		if member, found := s.onlineAccounts[memberId]; found {
-			member.msgCh <- *msg
+		if err := s.broker.Publish(ctx, delivery); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (s *chatService) AddOnlineAccount(account *OnlineAccount) {
-	s.onlineAccounts[account.GetAccountID()] = account
+// getChatMessage returns the chat and one of its messages which accountId,
+// a member, wants to change.
+func (s *chatService) getChatMessage(ctx context.Context, accountId, chatId, messageId uuid.UUID) (*Chat, *Message, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, nil, ErrNotMember
+	}
+
+	msg, err := s.store.GetMessage(ctx, chatId, messageId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expired(chat, msg, s.now()) {
+		return nil, nil, ErrMessageNotFound
+	}
+	if msg.Deleted {
+		return nil, nil, ErrDeleted
+	}
+	return chat, msg, nil
+}
+
+// EditMessage changes the text of the author's message and keeps the
+// previous text in its edit history. The entities and the link preview are
+// replaced along with the text, the attachments stay.
+func (s *chatService) EditMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, text string, entities []*Entity) (*Message, error) {
+	chat, msg, err := s.getChatMessage(ctx, accountId, chatId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if msg.System != nil {
+		return nil, ErrSystemMessage
+	}
+	if msg.FromAccountId != accountId {
+		return nil, ErrNotAuthor
+	}
+	if err := checkRequest(chat, accountId); err != nil {
+		return nil, err
+	}
+	// The server can't tell what the ciphertexts would be edited to.
+	if chat.Encrypted {
+		return nil, ErrEncrypted
+	}
+	entities, err = checkEntities(chat, text, entities)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	editedAt := msg.CreatedAt
+	if msg.EditedAt != nil {
+		editedAt = *msg.EditedAt
+	}
+	msg.Edits = append(msg.Edits, &MessageEdit{Text: msg.Text, EditedAt: editedAt})
+	msg.Text = text
+	msg.Entities = entities
+	if firstLink(text) != firstLink(msg.Edits[len(msg.Edits)-1].Text) {
+		msg.Preview = s.preview(ctx, text)
+	}
+	msg.EditedAt = &now
+	if err := s.store.UpdateMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	event := Event{Type: EventMessageEdited, Message: msg}
+	if err := s.publish(ctx, chat.Members, accountId, deviceId, event); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// DeleteMessage deletes the message for every member, which only the author
+// may do, or hides it from accountId's own history.
+func (s *chatService) DeleteMessage(ctx context.Context, accountId uuid.UUID, deviceId string, chatId, messageId uuid.UUID, forEveryone bool) error {
+	chat, msg, err := s.getChatMessage(ctx, accountId, chatId, messageId)
+	if err != nil {
+		return err
+	}
+
+	if !forEveryone {
+		if err := s.store.HideMessage(ctx, chatId, messageId, accountId); err != nil {
+			return err
+		}
+		// Only the account's other devices need to know.
+		event := Event{Type: EventMessageDeleted, Message: msg.forDevice(accountId, "")}
+		return s.publish(ctx, []uuid.UUID{accountId}, accountId, deviceId, event)
+	}
+
+	if msg.System != nil {
+		return ErrSystemMessage
+	}
+	if msg.FromAccountId != accountId {
+		return ErrNotAuthor
+	}
+	// Nothing of the content is kept, including earlier versions.
+	msg.Text = ""
+	msg.Edits = nil
+	msg.Attachments = nil
+	msg.Entities = nil
+	msg.Preview = nil
+	msg.Ciphertexts = nil
+	msg.Deleted = true
+	if err := s.store.UpdateMessage(ctx, msg); err != nil {
+		return err
+	}
+
+	return s.publish(ctx, chat.Members, accountId, deviceId, Event{Type: EventMessageDeleted, Message: msg})
+}
+
+// GetMessages returns a page of the chat's history, newest first. before is
+// the cursor of the previous page, empty for the newest messages.
+func (s *chatService) GetMessages(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, before string, limit int) (*MessagePage, error) {
+	var beforeSeq int64
+	if before != "" {
+		seq, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || seq <= 0 {
+			return nil, ErrInvalidCursor
+		}
+		beforeSeq = seq
+	}
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+
+	messages, err := s.store.GetMessages(ctx, chatId, accountId, beforeSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{Messages: []*Message{}}
+	if len(messages) == limit && messages[len(messages)-1].Seq > 1 {
+		page.NextCursor = strconv.FormatInt(messages[len(messages)-1].Seq, 10)
+	}
+	for _, msg := range withReactions(s.unexpired(chat, messages), accountId) {
+		page.Messages = append(page.Messages, msg.forDevice(accountId, deviceId))
+	}
+	return page, nil
+}
+
+// Resync returns the messages of every chat of the account the device
+// hasn't confirmed yet, oldest first per chat. A device seen for the first
+// time starts from the newest messages, it only gets what's sent afterwards.
+func (s *chatService) Resync(ctx context.Context, accountId uuid.UUID, deviceId string) (*Resync, error) {
+	chats, err := s.store.GetAccountChats(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	resync := &Resync{Messages: []*Message{}}
+	cursors, err := s.store.GetDeliveryCursors(ctx, accountId, deviceId)
+	if errors.Is(err, ErrCursorsNotFound) {
+		cursors = map[uuid.UUID]int64{}
+		for _, chat := range chats {
+			cursors[chat.Id] = chat.LastSeq
+		}
+		return resync, s.store.InsertDeliveryCursors(ctx, accountId, deviceId, cursors)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chat := range chats {
+		// Chats without a cursor were created after the device was seen.
+		after := cursors[chat.Id]
+		if after >= chat.LastSeq {
+			continue
+		}
+		messages, err := s.store.GetMessagesAfter(ctx, chat.Id, accountId, after, resyncLimit)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == resyncLimit && messages[len(messages)-1].Seq < chat.LastSeq {
+			resync.Truncated = append(resync.Truncated, chat.Id)
+		}
+		for _, msg := range withReactions(s.unexpired(chat, messages), accountId) {
+			resync.Messages = append(resync.Messages, msg.forDevice(accountId, deviceId))
+		}
+	}
+	return resync, nil
+}
+
+// getMemberChat returns the chat, checking accountId is a member and seq
+// belongs to one of its messages.
+func (s *chatService) getMemberChat(ctx context.Context, accountId, chatId uuid.UUID, seq int64) (*Chat, error) {
+	chat, err := s.store.GetChat(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsMemberOf(accountId, chat) {
+		return nil, ErrNotMember
+	}
+	if seq > chat.LastSeq {
+		return nil, ErrInvalidCursor
+	}
+	return chat, nil
+}
+
+// AckDelivery moves the device's cursor of the chat to seq, which the
+// client confirms it received along with every message before it. The
+// other members get a delivery receipt the first time any of the account's
+// devices gets a message.
+func (s *chatService) AckDelivery(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error {
+	chat, err := s.getMemberChat(ctx, accountId, chatId, seq)
+	if err != nil {
+		return err
+	}
+	if err := s.store.UpdateDeliveryCursor(ctx, accountId, deviceId, chatId, seq); err != nil {
+		return err
+	}
+
+	moved, err := s.store.MarkDelivered(ctx, chatId, accountId, seq)
+	// The sender of a request doesn't learn whether it was seen.
+	if err != nil || !moved || chat.IsRequestTo(accountId) {
+		return err
+	}
+	receipt := &ReceiptPayload{ChatId: chatId, AccountId: accountId, Seq: seq}
+	return s.publish(ctx, chat.Members, accountId, deviceId, Event{Type: EventDeliveryReceipt, Receipt: receipt})
+}
+
+// MarkRead marks every message of the chat up to seq as read by the account
+// and sends a read receipt to the other members, and the account's other
+// devices so they update their unread counts.
+func (s *chatService) MarkRead(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error {
+	chat, err := s.getMemberChat(ctx, accountId, chatId, seq)
+	if err != nil {
+		return err
+	}
+
+	moved, err := s.store.MarkRead(ctx, chatId, accountId, seq)
+	if err != nil || !moved || chat.IsRequestTo(accountId) {
+		return err
+	}
+	receipt := &ReceiptPayload{ChatId: chatId, AccountId: accountId, Seq: seq}
+	return s.publish(ctx, chat.Members, accountId, deviceId, Event{Type: EventReadReceipt, Receipt: receipt})
+}
+
+// GetReceipts returns the receipt of every member of the chat, members who
+// haven't received anything yet have zero markers.
+func (s *chatService) GetReceipts(ctx context.Context, accountId, chatId uuid.UUID) ([]*Receipt, error) {
+	chat, err := s.getMemberChat(ctx, accountId, chatId, 0)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.store.GetReceipts(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	byMember := map[uuid.UUID]*Receipt{}
+	for _, receipt := range stored {
+		byMember[receipt.AccountId] = receipt
+	}
+	receipts := make([]*Receipt, len(chat.Members))
+	for i, memberId := range chat.Members {
+		receipts[i] = byMember[memberId]
+		if receipts[i] == nil {
+			receipts[i] = &Receipt{ChatId: chatId, AccountId: memberId}
+		}
+	}
+	return receipts, nil
+}
+
+// GetInbox returns the account's chats with their last message and unread
+// count, the most recently active first. Message requests to the account
+// aren't in it.
+func (s *chatService) GetInbox(ctx context.Context, accountId uuid.UUID) ([]*InboxChat, error) {
+	return s.inbox(ctx, accountId, func(chat *Chat) bool {
+		return !chat.IsRequestTo(accountId)
+	})
+}
+
+// inbox lists the account's chats which include returns true for.
+func (s *chatService) inbox(ctx context.Context, accountId uuid.UUID, include func(chat *Chat) bool) ([]*InboxChat, error) {
+	all, err := s.store.GetAccountChats(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	chats := []*Chat{}
+	for _, chat := range all {
+		if include(chat) {
+			chats = append(chats, chat)
+		}
+	}
+	chatIds := make([]uuid.UUID, len(chats))
+	for i, chat := range chats {
+		chatIds[i] = chat.Id
+	}
+	summaries, err := s.store.GetChatSummaries(ctx, accountId, chatIds)
+	if err != nil {
+		return nil, err
+	}
+	drafts, err := s.store.GetDrafts(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	draftOf := map[uuid.UUID]*Draft{}
+	for _, draft := range drafts {
+		draftOf[draft.ChatId] = draft
+	}
+
+	inbox := make([]*InboxChat, len(chats))
+	for i, chat := range chats {
+		inbox[i] = &InboxChat{Chat: chat, Draft: draftOf[chat.Id]}
+		summary, found := summaries[chat.Id]
+		if !found {
+			continue
+		}
+		inbox[i].LastReadSeq = summary.LastReadSeq
+		inbox[i].UnreadCount = summary.UnreadCount
+		if summary.LastMessage == nil {
+			continue
+		}
+		last := s.unexpired(chat, []*Message{summary.LastMessage})
+		if len(last) > 0 {
+			// The inbox isn't for any device in particular.
+			inbox[i].LastMessage = withReactions(last, accountId)[0].forDevice(accountId, "")
+		}
+	}
+
+	// Chats without messages go last.
+	sort.SliceStable(inbox, func(i, j int) bool {
+		if inbox[j].LastMessage == nil {
+			return inbox[i].LastMessage != nil
+		}
+		return inbox[i].LastMessage != nil && inbox[i].LastMessage.CreatedAt.After(inbox[j].LastMessage.CreatedAt)
+	})
+	return inbox, nil
+}
+
+// Connect registers the device on this node and announces it to the broker
+// so other nodes route its deliveries here.
+func (s *chatService) Connect(ctx context.Context, accountId uuid.UUID, deviceId string) (*OnlineAccount, error) {
+	account := s.hub.Connect(accountId, deviceId)
+	device := &Device{DeviceID: deviceId, ConnectedAt: account.connectedAt}
+	err := s.updatePresence(ctx, accountId, func([]*Device) error {
+		return s.broker.Register(ctx, accountId, device)
+	})
+	if err != nil {
+		s.hub.Disconnect(account)
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *chatService) Disconnect(ctx context.Context, account *OnlineAccount) error {
+	// A newer connection of the same device took over, it's still online.
+	if !s.hub.Disconnect(account) {
+		return nil
+	}
+	return s.updatePresence(ctx, account.accountID, func([]*Device) error {
+		return s.broker.Unregister(ctx, account.accountID, account.deviceID)
+	})
+}
+
+// SetStatus marks the device away or back online. The account is away when
+// all of its devices are.
+func (s *chatService) SetStatus(ctx context.Context, accountId uuid.UUID, deviceId string, status PresenceStatus) error {
+	return s.updatePresence(ctx, accountId, func(devices []*Device) error {
+		for _, device := range devices {
+			if device.DeviceID == deviceId {
+				device.Away = status == StatusAway
+				return s.broker.Register(ctx, accountId, device)
+			}
+		}
+		return nil
+	})
+}
+
+func presenceStatus(devices []*Device) PresenceStatus {
+	if len(devices) == 0 {
+		return StatusOffline
+	}
+	for _, device := range devices {
+		if !device.Away {
+			return StatusOnline
+		}
+	}
+	return StatusAway
+}
+
+// updatePresence runs change, which registers or unregisters devices of the
+// account, and tells the account's contacts if that changed its status.
+func (s *chatService) updatePresence(ctx context.Context, accountId uuid.UUID, change func(devices []*Device) error) error {
+	devices, err := s.broker.Devices(ctx, accountId)
+	if err != nil {
+		return err
+	}
+	before := presenceStatus(devices)
+	if err := change(devices); err != nil {
+		return err
+	}
+	if devices, err = s.broker.Devices(ctx, accountId); err != nil {
+		return err
+	}
+	after := presenceStatus(devices)
+	if before == after {
+		return nil
+	}
+
+	if before == StatusOnline {
+		if err := s.store.UpdateLastSeen(ctx, accountId, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	settings, err := s.store.GetPrivacySettings(ctx, accountId)
+	if err != nil || settings.Presence == VisibleToNobody {
+		return err
+	}
+	presence, err := s.presence(ctx, accountId, devices, true)
+	if err != nil {
+		return err
+	}
+	return s.announcePresence(ctx, accountId, presence)
+}
+
+// presence builds the presence of the account from its devices. Accounts
+// whose presence isn't visible always look offline.
+func (s *chatService) presence(ctx context.Context, accountId uuid.UUID, devices []*Device, visible bool) (*PresencePayload, error) {
+	presence := &PresencePayload{AccountId: accountId, Status: StatusOffline}
+	if !visible {
+		return presence, nil
+	}
+	presence.Status = presenceStatus(devices)
+	if presence.Status == StatusOffline {
+		lastSeen, err := s.store.GetLastSeen(ctx, accountId)
+		if err != nil {
+			return nil, err
+		}
+		presence.LastSeen = lastSeen
+	}
+	return presence, nil
+}
+
+// announcePresence pushes the account's presence to its contacts.
+func (s *chatService) announcePresence(ctx context.Context, accountId uuid.UUID, presence *PresencePayload) error {
+	contacts, err := s.contacts(ctx, accountId)
+	if err != nil {
+		return err
+	}
+	members := make([]uuid.UUID, 0, len(contacts))
+	for contactId := range contacts {
+		members = append(members, contactId)
+	}
+	return s.publish(ctx, members, accountId, "", Event{Type: EventPresence, Presence: presence})
+}
+
+// contacts returns the accounts which share a chat, other than a message
+// request, with the account.
+func (s *chatService) contacts(ctx context.Context, accountId uuid.UUID) (map[uuid.UUID]bool, error) {
+	chats, err := s.store.GetAccountChats(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	contacts := map[uuid.UUID]bool{}
+	for _, chat := range chats {
+		// Message requests don't make contacts until they're accepted.
+		if chat.Request != nil {
+			continue
+		}
+		for _, memberId := range chat.Members {
+			if memberId != accountId {
+				contacts[memberId] = true
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// GetPresence returns the presence of the accounts as the viewer is allowed
+// to see it.
+func (s *chatService) GetPresence(ctx context.Context, viewerId uuid.UUID, accountIds []uuid.UUID) ([]*PresencePayload, error) {
+	contacts, err := s.contacts(ctx, viewerId)
+	if err != nil {
+		return nil, err
+	}
+
+	presences := make([]*PresencePayload, len(accountIds))
+	for i, accountId := range accountIds {
+		settings, err := s.store.GetPrivacySettings(ctx, accountId)
+		if err != nil {
+			return nil, err
+		}
+		visible := accountId == viewerId ||
+			settings.Presence == VisibleToEveryone ||
+			settings.Presence == VisibleToContacts && contacts[accountId]
+
+		devices, err := s.broker.Devices(ctx, accountId)
+		if err != nil {
+			return nil, err
+		}
+		if presences[i], err = s.presence(ctx, accountId, devices, visible); err != nil {
+			return nil, err
+		}
+	}
+	return presences, nil
+}
+
+func (s *chatService) GetPrivacySettings(ctx context.Context, accountId uuid.UUID) (*PrivacySettings, error) {
+	return s.store.GetPrivacySettings(ctx, accountId)
+}
+
+// UpdatePrivacySettings stores the settings. Contacts see the account go
+// offline when it hides its presence, and its actual presence when it
+// shows it again.
+func (s *chatService) UpdatePrivacySettings(ctx context.Context, accountId uuid.UUID, settings *PrivacySettings) error {
+	current, err := s.store.GetPrivacySettings(ctx, accountId)
+	if err != nil {
+		return err
+	}
+	settings.AccountId = accountId
+	if settings.DirectMessages == "" {
+		settings.DirectMessages = current.DirectMessages
+	}
+	if err := s.store.UpdatePrivacySettings(ctx, settings); err != nil {
+		return err
+	}
+
+	visible := settings.Presence != VisibleToNobody
+	if visible == (current.Presence != VisibleToNobody) {
+		return nil
+	}
+	devices, err := s.broker.Devices(ctx, accountId)
+	if err != nil {
+		return err
+	}
+	presence, err := s.presence(ctx, accountId, devices, visible)
+	if err != nil {
+		return err
+	}
+	return s.announcePresence(ctx, accountId, presence)
+}
+
+// Typing tells the other members of the chat the account started or
+// stopped typing. Starts are rate limited and stop by themselves unless
+// they're refreshed.
+func (s *chatService) Typing(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, typing bool) error {
+	chat, err := s.getMemberChat(ctx, accountId, chatId, 0)
+	if err != nil {
+		return err
+	}
+	if err := checkRequest(chat, accountId); err != nil {
+		return err
+	}
+	members := make([]uuid.UUID, 0, len(chat.Members))
+	for _, memberId := range chat.Members {
+		if memberId != accountId {
+			members = append(members, memberId)
+		}
+	}
+
+	if typing {
+		expire := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			s.publishTyping(ctx, members, accountId, chatId, false)
+		}
+		if !s.typing.Start(accountId, chatId, expire) {
+			return nil
+		}
+	} else if !s.typing.Stop(accountId, chatId) {
+		return nil
+	}
+	return s.publishTyping(ctx, members, accountId, chatId, typing)
+}
+
+func (s *chatService) publishTyping(ctx context.Context, members []uuid.UUID, accountId, chatId uuid.UUID, typing bool) error {
+	payload := &TypingPayload{ChatId: chatId, AccountId: accountId, Typing: typing}
+	return s.publish(ctx, members, accountId, "", Event{Type: EventTyping, Typing: payload})
 }
 
-func (s *chatService) DelOnlineAccount(account *OnlineAccount) {
-	delete(s.onlineAccounts, account.GetAccountID())
+func (s *chatService) GetDevices(ctx context.Context, accountId uuid.UUID) ([]*Device, error) {
+	return s.broker.Devices(ctx, accountId)
 }
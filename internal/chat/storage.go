@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
@@ -11,11 +15,172 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrChatNotFound    = errors.New("chat not found")
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrChatExists is returned when the private chat between two accounts
+	// already exists.
+	ErrChatExists = errors.New("chat with these members already exists")
+	// ErrDuplicateMessage is returned when the author already sent a
+	// message with the same client id in the chat.
+	ErrDuplicateMessage  = errors.New("message was already sent")
+	ErrCursorsNotFound   = errors.New("delivery cursors not found")
+	ErrInviteNotFound    = errors.New("invite not found")
+	ErrNoPreKeys         = errors.New("device has no one-time prekeys left")
+	ErrScheduledNotFound = errors.New("scheduled message not found")
+	// ErrScheduledClaimed is returned when a scheduled message is being
+	// sent and can't be changed anymore.
+	ErrScheduledClaimed = errors.New("scheduled message is being sent")
+	// ErrTicketNotFound is returned for socket tickets which were never
+	// issued, already redeemed or expired.
+	ErrTicketNotFound = errors.New("socket ticket not found")
+)
+
 type Storage interface {
+	// InsertMessage assigns msg the chat's next sequence number.
 	InsertMessage(ctx context.Context, chatId uuid.UUID, msg *Message) error
 	GetChat(ctx context.Context, chatId uuid.UUID) (*Chat, error)
+	// InsertChat fails with ErrChatExists for a second private chat between
+	// the same two accounts, whatever the order of the members.
 	InsertChat(ctx context.Context, chat *Chat) error
-	GetMessages(ctx context.Context, chatId uuid.UUID, count int) ([]*Message, error)
+	GetDirectChat(ctx context.Context, accountId, otherId uuid.UUID, encrypted bool) (*Chat, error)
+	// GetMessages returns up to limit messages older than the before
+	// sequence number, newest first. A zero before starts from the newest.
+	// Messages viewerId deleted for themselves are left out.
+	GetMessages(ctx context.Context, chatId, viewerId uuid.UUID, before int64, limit int) ([]*Message, error)
+	GetMessage(ctx context.Context, chatId, messageId uuid.UUID) (*Message, error)
+	GetMessageByClientId(ctx context.Context, chatId, accountId uuid.UUID, clientId string) (*Message, error)
+	// UpdateMessage replaces the stored text, edits and deletion state, and
+	// the content that goes with the text. Deleting a message drops its
+	// reactions too.
+	UpdateMessage(ctx context.Context, msg *Message) error
+	// AddReaction adds the reaction to the message and reports whether it
+	// wasn't there yet.
+	AddReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error)
+	// RemoveReaction removes the reaction from the message and reports
+	// whether it was there.
+	RemoveReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error)
+	HideMessage(ctx context.Context, chatId, messageId, accountId uuid.UUID) error
+	GetAccountChats(ctx context.Context, accountId uuid.UUID) ([]*Chat, error)
+	// GetMessagesAfter returns up to limit messages newer than the after
+	// sequence number, oldest first.
+	GetMessagesAfter(ctx context.Context, chatId, viewerId uuid.UUID, after int64, limit int) ([]*Message, error)
+
+	// Delivery cursors hold, per chat, the sequence number of the last
+	// message a device confirmed it received.
+	GetDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string) (map[uuid.UUID]int64, error)
+	// InsertDeliveryCursors keeps the existing cursors if the device has any.
+	InsertDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string, cursors map[uuid.UUID]int64) error
+	// UpdateDeliveryCursor never moves a cursor backwards.
+	UpdateDeliveryCursor(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error
+
+	// Members without a receipt in the chat yet are left out.
+	GetReceipts(ctx context.Context, chatId uuid.UUID) ([]*Receipt, error)
+	GetAccountReceipts(ctx context.Context, accountId uuid.UUID) ([]*Receipt, error)
+	// MarkRead moves both markers of the member's receipt up to seq, it
+	// reports whether the read marker moved.
+	MarkRead(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error)
+	// MarkDelivered reports whether the delivered marker moved.
+	MarkDelivered(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error)
+	// GetChatSummaries returns, for each of the chats, the account's read
+	// marker, the newest message it can see and how many messages after the
+	// marker it can see, leaving out its own and deleted ones.
+	GetChatSummaries(ctx context.Context, accountId uuid.UUID, chatIds []uuid.UUID) (map[uuid.UUID]*ChatSummary, error)
+
+	// GetPrivacySettings returns the defaults when the account has none, or
+	// for the settings left out.
+	GetPrivacySettings(ctx context.Context, accountId uuid.UUID) (*PrivacySettings, error)
+	UpdatePrivacySettings(ctx context.Context, settings *PrivacySettings) error
+	// GetLastSeen returns nil when the account was never seen.
+	GetLastSeen(ctx context.Context, accountId uuid.UUID) (*time.Time, error)
+	// UpdateLastSeen never moves the last seen time backwards.
+	UpdateLastSeen(ctx context.Context, accountId uuid.UUID, lastSeen time.Time) error
+
+	// UpdateChatInfo replaces the stored title, description and avatar.
+	UpdateChatInfo(ctx context.Context, chat *Chat) error
+	// UpdateRetention replaces the stored retention and disappearing timer.
+	UpdateRetention(ctx context.Context, chat *Chat) error
+	// GetRetentionChats returns the chats with a retention.
+	GetRetentionChats(ctx context.Context) ([]*Chat, error)
+	// DeleteMessagesBefore deletes the chat's messages sent before the time
+	// and returns how many there were.
+	DeleteMessagesBefore(ctx context.Context, chatId uuid.UUID, before time.Time) (int, error)
+	// DeleteExpiredMessages deletes the disappearing messages which expired
+	// by now and returns how many there were.
+	DeleteExpiredMessages(ctx context.Context, now time.Time) (int, error)
+	// AddMembers skips the ones who are members already.
+	AddMembers(ctx context.Context, chatId uuid.UUID, members []uuid.UUID) error
+	// RemoveMember removes the account's admin role along with it.
+	RemoveMember(ctx context.Context, chatId, accountId uuid.UUID) error
+	SetAdmin(ctx context.Context, chatId, accountId uuid.UUID, admin bool) error
+	// SetOwner removes the new owner from the admins, the previous owner
+	// stays a member.
+	SetOwner(ctx context.Context, chatId, ownerId uuid.UUID) error
+	// UpdateMessageRequest replaces the chat's request, nil accepts it.
+	UpdateMessageRequest(ctx context.Context, chatId uuid.UUID, request *MessageRequest) error
+
+	InsertInvite(ctx context.Context, invite *Invite) error
+	GetInvite(ctx context.Context, code string) (*Invite, error)
+	GetChatInvites(ctx context.Context, chatId uuid.UUID) ([]*Invite, error)
+	DeleteInvite(ctx context.Context, chatId uuid.UUID, code string) error
+
+	// UpsertDeviceKeys replaces the identity key and signed prekey of the
+	// device.
+	UpsertDeviceKeys(ctx context.Context, keys *DeviceKeys) error
+	// GetDeviceKeys returns the keys of every device of the account, ordered
+	// by device id.
+	GetDeviceKeys(ctx context.Context, accountId uuid.UUID) ([]*DeviceKeys, error)
+	// DeleteDeviceKeys removes the device's keys and prekeys.
+	DeleteDeviceKeys(ctx context.Context, accountId uuid.UUID, deviceId string) error
+	// AddPreKeys skips prekeys whose id the device already has.
+	AddPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string, prekeys []*PreKey) error
+	// ClaimPreKey removes one of the device's one-time prekeys and returns
+	// it, each is only ever handed out once. It fails with ErrNoPreKeys when
+	// there's none left.
+	ClaimPreKey(ctx context.Context, accountId uuid.UUID, deviceId string) (*PreKey, error)
+	CountPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string) (int, error)
+
+	// SearchMessages returns the messages of the chats with every one of the
+	// terms, lower cased words, in their text. They're newest first, skip
+	// leaves out the first ones. Messages viewerId deleted for themselves
+	// are left out.
+	SearchMessages(ctx context.Context, chatIds []uuid.UUID, viewerId uuid.UUID, terms []string, skip, limit int) ([]*Message, error)
+
+	InsertScheduledMessage(ctx context.Context, msg *ScheduledMessage) error
+	GetScheduledMessage(ctx context.Context, id uuid.UUID) (*ScheduledMessage, error)
+	// GetScheduledMessages returns the account's scheduled messages of the
+	// chat, or of every chat when chatId is nil, in the order they're sent.
+	GetScheduledMessages(ctx context.Context, accountId, chatId uuid.UUID) ([]*ScheduledMessage, error)
+	// UpdateScheduledMessage replaces the content, send time, status and
+	// error of the message and resets its attempts. It fails with
+	// ErrScheduledClaimed while the message is claimed at now.
+	UpdateScheduledMessage(ctx context.Context, msg *ScheduledMessage, now time.Time) error
+	// DeleteScheduledMessage fails with ErrScheduledClaimed while the
+	// message is claimed at now.
+	DeleteScheduledMessage(ctx context.Context, id uuid.UUID, now time.Time) error
+	// ClaimScheduledMessages claims up to limit pending messages due at now
+	// for owner until the given time, the ones due first first. A message
+	// is claimed by one owner at a time, claims which ran out may be taken
+	// over.
+	ClaimScheduledMessages(ctx context.Context, owner string, now, until time.Time, limit int) ([]*ScheduledMessage, error)
+	// ReleaseScheduledMessage drops the claim of msg.ClaimedBy on the
+	// message, keeping its status and error. Sent and canceled messages
+	// are deleted. Nothing changes when the claim was taken over.
+	ReleaseScheduledMessage(ctx context.Context, msg *ScheduledMessage) error
+
+	// SaveDraft replaces the account's draft of the chat.
+	SaveDraft(ctx context.Context, draft *Draft) error
+	DeleteDraft(ctx context.Context, accountId, chatId uuid.UUID) error
+	GetDrafts(ctx context.Context, accountId uuid.UUID) ([]*Draft, error)
+
+	InsertSocketTicket(ctx context.Context, ticket *SocketTicket) error
+	// ClaimSocketTicket deletes the ticket and returns it, unless it
+	// expired at now. A ticket is claimed once.
+	ClaimSocketTicket(ctx context.Context, id string, now time.Time) (*SocketTicket, error)
+}
+
+func defaultPrivacySettings(accountId uuid.UUID) *PrivacySettings {
+	return &PrivacySettings{AccountId: accountId, Presence: VisibleToEveryone, DirectMessages: DMFromEveryone}
 }
 
 type mongoStorage struct {
@@ -35,112 +200,2325 @@ func NewMongoStorage(uri, database string) (*mongoStorage, error) {
 	}, nil
 }
 
+func (s *mongoStorage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *mongoStorage) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
 func (s *mongoStorage) Drop() {
-	s.client.Database(s.database).Collection("chats").Drop(context.Background())
+	s.getChatCollection().Drop(context.Background())
+	s.getMessageCollection().Drop(context.Background())
+	s.getCursorCollection().Drop(context.Background())
+	s.getReceiptCollection().Drop(context.Background())
+	s.getAccountCollection().Drop(context.Background())
+	s.getInviteCollection().Drop(context.Background())
+	s.getDeviceKeyCollection().Drop(context.Background())
+	s.getPreKeyCollection().Drop(context.Background())
+	s.getScheduledCollection().Drop(context.Background())
+	s.getDraftCollection().Drop(context.Background())
+	s.getSocketTicketCollection().Drop(context.Background())
 }
 
 func (s *mongoStorage) getChatCollection() *mongo.Collection {
 	return s.client.Database(s.database).Collection("chats")
 }
 
-func (s *mongoStorage) GetChat(ctx context.Context, chatId uuid.UUID) (*Chat, error) {
-	res := s.getChatCollection().FindOne(ctx, bson.M{
-		"_id": chatId,
-	})
+func (s *mongoStorage) getMessageCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("messages")
+}
 
-	chat := &Chat{}
-	if err := res.Decode(chat); err != nil {
-		return nil, err
-	}
-	return chat, nil
+func (s *mongoStorage) getCursorCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("delivery_cursors")
+}
+
+func (s *mongoStorage) getReceiptCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("receipts")
+}
+
+// getAccountCollection holds what chat knows about accounts, their privacy
+// settings and when they were last seen.
+func (s *mongoStorage) getAccountCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("accounts")
 }
 
-func (s *mongoStorage) ExistChat(ctx context.Context, members []uuid.UUID) error {
-	coll := s.getChatCollection()
-	docs, err := coll.Find(ctx, bson.M{
-		"members": bson.M{"$eq": members},
+func (s *mongoStorage) getInviteCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("invites")
+}
+
+// getDeviceKeyCollection is the key directory, the public keys devices
+// publish for encrypted chats.
+func (s *mongoStorage) getDeviceKeyCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("device_keys")
+}
+
+func (s *mongoStorage) getPreKeyCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("prekeys")
+}
+
+func (s *mongoStorage) getScheduledCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("scheduled_messages")
+}
+
+func (s *mongoStorage) getDraftCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("drafts")
+}
+
+func (s *mongoStorage) getSocketTicketCollection() *mongo.Collection {
+	return s.client.Database(s.database).Collection("socket_tickets")
+}
+
+// Migrate creates the indexes and moves messages still embedded in chat
+// documents, from before messages had their own collection, out of them.
+// It also keys the private chats created before duplicates were prevented.
+// It's safe to run again if it's interrupted.
+func (s *mongoStorage) Migrate(ctx context.Context) error {
+	_, err := s.getMessageCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "chat_id", Value: 1}, {Key: "seq", Value: -1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			// Without a language words are matched as they are, chats
+			// aren't in any one language.
+			Keys:    bson.D{{Key: "text", Value: "text"}},
+			Options: options.Index().SetDefaultLanguage("none"),
+		},
+		{
+			// Mongo deletes disappearing messages by itself too, about
+			// a minute late.
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "chat_id", Value: 1}, {Key: "from_account_id", Value: 1}, {Key: "client_id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"client_id": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getChatCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "members", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "direct_key", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"direct_key": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "retention", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"retention": bson.M{"$gt": 0}}),
+		},
 	})
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil
-		}
 		return err
 	}
-	if docs.Next(ctx) {
-		return fmt.Errorf("chat with these members already exist")
+	_, err = s.getInviteCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}}},
+		// Expired invites are removed by Mongo eventually.
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = s.getReceiptCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chat_id", Value: 1}}},
+		{Keys: bson.D{{Key: "account_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getDeviceKeyCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "device_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getPreKeyCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "device_id", Value: 1}, {Key: "key_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getScheduledCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "send_at", Value: 1}}},
+		{Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "send_at", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getDraftCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Tickets which were never redeemed are removed by Mongo eventually.
+	_, err = s.getSocketTicketCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	cur, err := s.getChatCollection().Find(ctx, bson.M{
+		"messages": bson.M{"$exists": true},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		legacy := struct {
+			Id       uuid.UUID  `bson:"_id"`
+			Messages []*Message `bson:"messages"`
+		}{}
+		if err := cur.Decode(&legacy); err != nil {
+			return err
+		}
+		if err := s.migrateMessages(ctx, legacy.Id, legacy.Messages); err != nil {
+			return fmt.Errorf("failed to migrate chat %s: %w", legacy.Id, err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	return s.migrateDirectKeys(ctx)
 }
 
-func (s *mongoStorage) InsertChat(ctx context.Context, chat *Chat) error {
-	if err := s.ExistChat(ctx, chat.Members); err != nil {
+// migrateDirectKeys sets the key of private chats created before it
+// existed. Of the duplicates created back then only the first gets it, the
+// others are still readable but never returned as the pair's chat.
+func (s *mongoStorage) migrateDirectKeys(ctx context.Context) error {
+	cur, err := s.getChatCollection().Find(ctx, bson.M{
+		"is_private": true,
+		"members":    bson.M{"$size": 2},
+		"direct_key": bson.M{"$exists": false},
+	}, options.Find().SetSort(bson.M{"_id": 1}).SetProjection(bson.M{"messages": 0}))
+	if err != nil {
 		return err
 	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		chat := &Chat{}
+		if err := cur.Decode(chat); err != nil {
+			return err
+		}
+		key := directKey(chat)
+		if key == "" {
+			continue
+		}
+		_, err := s.getChatCollection().UpdateOne(ctx, bson.M{"_id": chat.Id}, bson.M{
+			"$set": bson.M{"direct_key": key},
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *mongoStorage) migrateMessages(ctx context.Context, chatId uuid.UUID, messages []*Message) error {
+	var lastSeq int64
+	docs := make([]any, len(messages))
+	for i, msg := range messages {
+		// Messages stored before sequence numbers existed are in order.
+		if msg.Seq == 0 {
+			msg.Seq = int64(i + 1)
+		}
+		if msg.Seq > lastSeq {
+			lastSeq = msg.Seq
+		}
+		// Derived from the position so a rerun inserts the same documents.
+		msg.Id = uuid.NewSHA1(chatId, []byte(fmt.Sprint(msg.Seq)))
+		msg.ChatId = chatId
+		docs[i] = msg
+	}
+
+	if len(docs) > 0 {
+		_, err := s.getMessageCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if err != nil && !isOnlyDuplicateKeyErrors(err) {
+			return err
+		}
+	}
+
+	_, err := s.getChatCollection().UpdateOne(ctx, bson.M{
+		"_id": chatId,
+	}, bson.M{
+		"$unset": bson.M{"messages": ""},
+		"$max":   bson.M{"last_seq": lastSeq},
+	})
+	return err
+}
+
+func isOnlyDuplicateKeyErrors(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *mongoStorage) GetChat(ctx context.Context, chatId uuid.UUID) (*Chat, error) {
+	res := s.getChatCollection().FindOne(ctx, bson.M{
+		"_id": chatId,
+	}, options.FindOne().SetProjection(bson.M{"messages": 0}))
+
+	chat := &Chat{}
+	if err := res.Decode(chat); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrChatNotFound
+		}
+		return nil, err
+	}
+	return chat, nil
+}
 
+func (s *mongoStorage) InsertChat(ctx context.Context, chat *Chat) error {
 	if chat.Id == uuid.Nil {
 		chat.Id = uuid.New()
 	}
+	chat.DirectKey = directKey(chat)
 
 	_, err := s.getChatCollection().InsertOne(ctx, chat)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrChatExists
+	}
 	return err
 }
 
+func (s *mongoStorage) GetDirectChat(ctx context.Context, accountId, otherId uuid.UUID, encrypted bool) (*Chat, error) {
+	key := directKey(&Chat{IsPrivate: true, Encrypted: encrypted, Members: []uuid.UUID{accountId, otherId}})
+	if key == "" {
+		return nil, ErrChatNotFound
+	}
+	res := s.getChatCollection().FindOne(ctx, bson.M{
+		"direct_key": key,
+	}, options.FindOne().SetProjection(bson.M{"messages": 0}))
+
+	chat := &Chat{}
+	if err := res.Decode(chat); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrChatNotFound
+		}
+		return nil, err
+	}
+	return chat, nil
+}
+
+// InsertMessage gives the message the seq after the chat's last one. The
+// seq is only taken by inserting the message, the unique (chat_id, seq)
+// index makes concurrent senders retry with the next one. So seqs have no
+// gaps and a message is never visible before the ones sent ahead of it,
+// which the delivery cursors rely on.
 func (s *mongoStorage) InsertMessage(ctx context.Context, chatId uuid.UUID, msg *Message) error {
-	_, err := s.getChatCollection().UpdateOne(context.TODO(), bson.M{
+	msg.ChatId = chatId
+	if msg.Id == uuid.Nil {
+		msg.Id = uuid.New()
+	}
+
+	for {
+		if msg.ClientId != "" {
+			_, err := s.GetMessageByClientId(ctx, chatId, msg.FromAccountId, msg.ClientId)
+			if err == nil {
+				return ErrDuplicateMessage
+			}
+			if !errors.Is(err, ErrMessageNotFound) {
+				return err
+			}
+		}
+
+		res := s.getChatCollection().FindOne(ctx, bson.M{
+			"_id": chatId,
+		}, options.FindOne().SetProjection(bson.M{"last_seq": 1}))
+		chat := &Chat{}
+		if err := res.Decode(chat); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return ErrChatNotFound
+			}
+			return err
+		}
+		msg.Seq = chat.LastSeq + 1
+
+		_, err := s.getMessageCollection().InsertOne(ctx, msg)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// Another sender took the seq, or a retry of this message got in
+		// first, which the client id check catches. The seq winner may
+		// not have raised last_seq yet, raise it for them.
+		if err := s.raiseLastSeq(ctx, chatId, msg.Seq); err != nil {
+			return err
+		}
+	}
+	return s.raiseLastSeq(ctx, chatId, msg.Seq)
+}
+
+// raiseLastSeq moves the chat's last_seq up to seq. It never goes down, so
+// seqs of deleted messages aren't given out again.
+func (s *mongoStorage) raiseLastSeq(ctx context.Context, chatId uuid.UUID, seq int64) error {
+	_, err := s.getChatCollection().UpdateOne(ctx, bson.M{
 		"_id": chatId,
 	}, bson.M{
-		"$push": bson.M{"messages": msg},
+		"$max": bson.M{"last_seq": seq},
 	})
 	return err
 }
 
-func (s *mongoStorage) GetMessages(ctx context.Context, chatId uuid.UUID, count int) ([]*Message, error) {
-	return nil, fmt.Errorf("not implemented yet")
-}
+func (s *mongoStorage) GetMessages(ctx context.Context, chatId, viewerId uuid.UUID, before int64, limit int) ([]*Message, error) {
+	if _, err := s.GetChat(ctx, chatId); err != nil {
+		return nil, err
+	}
 
-type memoryStorage struct {
-	chats []*Chat
+	filter := bson.M{
+		"chat_id":    chatId,
+		"hidden_for": bson.M{"$ne": viewerId},
+	}
+	if before > 0 {
+		filter["seq"] = bson.M{"$lt": before}
+	}
+	cur, err := s.getMessageCollection().Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "seq", Value: -1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	messages := []*Message{}
+	if err := cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
 }
 
-func NewMemoryStorage() *memoryStorage {
-	return &memoryStorage{
-		chats: []*Chat{},
+func (s *mongoStorage) GetMessage(ctx context.Context, chatId, messageId uuid.UUID) (*Message, error) {
+	res := s.getMessageCollection().FindOne(ctx, bson.M{
+		"_id":     messageId,
+		"chat_id": chatId,
+	})
+
+	msg := &Message{}
+	if err := res.Decode(msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
 	}
+	return msg, nil
 }
 
-func (s *memoryStorage) GetChat(ctx context.Context, chatId uuid.UUID) (*Chat, error) {
-	for i := range s.chats {
-		if s.chats[i].Id == chatId {
-			return s.chats[i], nil
+func (s *mongoStorage) GetMessageByClientId(ctx context.Context, chatId, accountId uuid.UUID, clientId string) (*Message, error) {
+	res := s.getMessageCollection().FindOne(ctx, bson.M{
+		"chat_id":         chatId,
+		"from_account_id": accountId,
+		"client_id":       clientId,
+	})
+
+	msg := &Message{}
+	if err := res.Decode(msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMessageNotFound
 		}
+		return nil, err
 	}
-	return nil, fmt.Errorf("chat not found")
+	return msg, nil
 }
 
-func (s *memoryStorage) InsertChat(ctx context.Context, chat *Chat) error {
-	if chat.Id == uuid.Nil {
-		chat.Id, _ = uuid.NewUUID()
+func (s *mongoStorage) UpdateMessage(ctx context.Context, msg *Message) error {
+	set := bson.M{
+		"text":        msg.Text,
+		"edits":       msg.Edits,
+		"edited_at":   msg.EditedAt,
+		"deleted":     msg.Deleted,
+		"attachments": msg.Attachments,
+		"entities":    msg.Entities,
+		"preview":     msg.Preview,
+		"ciphertexts": msg.Ciphertexts,
+	}
+	// Reactions change on their own, edits mustn't overwrite them.
+	if msg.Deleted {
+		set["reactions"] = nil
+	}
+	res, err := s.getMessageCollection().UpdateOne(ctx, bson.M{
+		"_id":     msg.Id,
+		"chat_id": msg.ChatId,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrMessageNotFound
 	}
-	s.chats = append(s.chats, chat)
 	return nil
 }
 
-func (s *memoryStorage) InsertMessage(ctx context.Context, chatId uuid.UUID, msg *Message) error {
-	chat, err := s.GetChat(ctx, chatId)
+func (s *mongoStorage) AddReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error) {
+	// $addToSet compares documents field by field in order, the struct
+	// always encodes them the same way.
+	res, err := s.getMessageCollection().UpdateOne(ctx, bson.M{
+		"_id":     messageId,
+		"chat_id": chatId,
+	}, bson.M{
+		"$addToSet": bson.M{"reactions": reaction},
+	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, ErrMessageNotFound
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (s *mongoStorage) RemoveReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error) {
+	res, err := s.getMessageCollection().UpdateOne(ctx, bson.M{
+		"_id":     messageId,
+		"chat_id": chatId,
+	}, bson.M{
+		"$pull": bson.M{"reactions": bson.M{"emoji": reaction.Emoji, "account_id": reaction.AccountId}},
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, ErrMessageNotFound
 	}
+	return res.ModifiedCount > 0, nil
+}
 
-	chat.Messages = append(chat.Messages, msg)
+func (s *mongoStorage) HideMessage(ctx context.Context, chatId, messageId, accountId uuid.UUID) error {
+	res, err := s.getMessageCollection().UpdateOne(ctx, bson.M{
+		"_id":     messageId,
+		"chat_id": chatId,
+	}, bson.M{
+		"$addToSet": bson.M{"hidden_for": accountId},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrMessageNotFound
+	}
 	return nil
 }
-func (s *memoryStorage) GetMessages(ctx context.Context, chatId uuid.UUID, count int) ([]*Message, error) {
-	chat, err := s.GetChat(ctx, chatId)
+
+func (s *mongoStorage) GetAccountChats(ctx context.Context, accountId uuid.UUID) ([]*Chat, error) {
+	cur, err := s.getChatCollection().Find(ctx, bson.M{
+		"members": accountId,
+	}, options.Find().SetProjection(bson.M{"messages": 0}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	chats := []*Chat{}
+	if err := cur.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func (s *mongoStorage) GetMessagesAfter(ctx context.Context, chatId, viewerId uuid.UUID, after int64, limit int) ([]*Message, error) {
+	cur, err := s.getMessageCollection().Find(ctx, bson.M{
+		"chat_id":    chatId,
+		"seq":        bson.M{"$gt": after},
+		"hidden_for": bson.M{"$ne": viewerId},
+	}, options.Find().
+		SetSort(bson.D{{Key: "seq", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	messages := []*Message{}
+	if err := cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *mongoStorage) SearchMessages(ctx context.Context, chatIds []uuid.UUID, viewerId uuid.UUID, terms []string, skip, limit int) ([]*Message, error) {
+	// Quoted terms are all required, unquoted ones any of them.
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + term + `"`
+	}
+	cur, err := s.getMessageCollection().Find(ctx, bson.M{
+		"$text":      bson.M{"$search": strings.Join(phrases, " ")},
+		"chat_id":    bson.M{"$in": chatIds},
+		"hidden_for": bson.M{"$ne": viewerId},
+	}, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "seq", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit)))
 	if err != nil {
 		return nil, err
 	}
-	if len(chat.Messages) < count {
-		return chat.Messages, nil
+	defer cur.Close(ctx)
+
+	messages := []*Message{}
+	if err := cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// deliveryCursors is how cursors are stored, bson keys have to be strings.
+type deliveryCursors struct {
+	Id        string           `bson:"_id"`
+	AccountId uuid.UUID        `bson:"account_id"`
+	DeviceId  string           `bson:"device_id"`
+	Chats     map[string]int64 `bson:"chats"`
+}
+
+func deliveryCursorsId(accountId uuid.UUID, deviceId string) string {
+	return accountId.String() + "/" + deviceId
+}
+
+func (s *mongoStorage) GetDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string) (map[uuid.UUID]int64, error) {
+	res := s.getCursorCollection().FindOne(ctx, bson.M{
+		"_id": deliveryCursorsId(accountId, deviceId),
+	})
+
+	doc := &deliveryCursors{}
+	if err := res.Decode(doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrCursorsNotFound
+		}
+		return nil, err
+	}
+
+	cursors := map[uuid.UUID]int64{}
+	for chatId, seq := range doc.Chats {
+		id, err := uuid.Parse(chatId)
+		if err != nil {
+			return nil, err
+		}
+		cursors[id] = seq
+	}
+	return cursors, nil
+}
+
+func (s *mongoStorage) InsertDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string, cursors map[uuid.UUID]int64) error {
+	chats := map[string]int64{}
+	for chatId, seq := range cursors {
+		chats[chatId.String()] = seq
+	}
+
+	_, err := s.getCursorCollection().UpdateOne(ctx, bson.M{
+		"_id": deliveryCursorsId(accountId, deviceId),
+	}, bson.M{
+		"$setOnInsert": bson.M{
+			"account_id": accountId,
+			"device_id":  deviceId,
+			"chats":      chats,
+		},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStorage) UpdateDeliveryCursor(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error {
+	_, err := s.getCursorCollection().UpdateOne(ctx, bson.M{
+		"_id": deliveryCursorsId(accountId, deviceId),
+	}, bson.M{
+		"$setOnInsert": bson.M{"account_id": accountId, "device_id": deviceId},
+		"$max":         bson.M{"chats." + chatId.String(): seq},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func receiptId(chatId, accountId uuid.UUID) string {
+	return chatId.String() + "/" + accountId.String()
+}
+
+func (s *mongoStorage) findReceipts(ctx context.Context, filter bson.M) ([]*Receipt, error) {
+	cur, err := s.getReceiptCollection().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	receipts := []*Receipt{}
+	if err := cur.All(ctx, &receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+func (s *mongoStorage) GetReceipts(ctx context.Context, chatId uuid.UUID) ([]*Receipt, error) {
+	return s.findReceipts(ctx, bson.M{"chat_id": chatId})
+}
+
+func (s *mongoStorage) GetAccountReceipts(ctx context.Context, accountId uuid.UUID) ([]*Receipt, error) {
+	return s.findReceipts(ctx, bson.M{"account_id": accountId})
+}
+
+// markReceipt raises the given markers to seq, creating the receipt if the
+// member has none.
+func (s *mongoStorage) markReceipt(ctx context.Context, chatId, accountId uuid.UUID, markers bson.M) (bool, error) {
+	res, err := s.getReceiptCollection().UpdateOne(ctx, bson.M{
+		"_id": receiptId(chatId, accountId),
+	}, bson.M{
+		"$setOnInsert": bson.M{"chat_id": chatId, "account_id": accountId},
+		"$max":         markers,
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// The delivered marker is never behind the read one, so the receipt is only
+// modified when the read marker moves.
+func (s *mongoStorage) MarkRead(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error) {
+	return s.markReceipt(ctx, chatId, accountId, bson.M{
+		"last_read_seq":      seq,
+		"last_delivered_seq": seq,
+	})
+}
+
+func (s *mongoStorage) MarkDelivered(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error) {
+	return s.markReceipt(ctx, chatId, accountId, bson.M{
+		"last_delivered_seq": seq,
+	})
+}
+
+// GetChatSummaries looks up the receipt, last message and unread count of
+// every chat in one aggregation. The lookups on messages go through the
+// (chat_id, seq) index.
+func (s *mongoStorage) GetChatSummaries(ctx context.Context, accountId uuid.UUID, chatIds []uuid.UUID) (map[uuid.UUID]*ChatSummary, error) {
+	messages := s.getMessageCollection().Name()
+	sameChat := bson.M{"$eq": bson.A{"$chat_id", "$$chat"}}
+	cur, err := s.getChatCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$in": chatIds}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": s.getReceiptCollection().Name(),
+			"let":  bson.M{"chat": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"account_id": accountId, "$expr": sameChat}},
+			},
+			"as": "receipt",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"last_read_seq": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$receipt.last_read_seq", 0}}, 0}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": messages,
+			"let":  bson.M{"chat": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"hidden_for": bson.M{"$ne": accountId}, "$expr": sameChat}},
+				bson.M{"$sort": bson.M{"seq": -1}},
+				bson.M{"$limit": 1},
+			},
+			"as": "last_message",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": messages,
+			"let":  bson.M{"chat": "$_id", "read": "$last_read_seq"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{
+					"from_account_id": bson.M{"$ne": accountId},
+					"hidden_for":      bson.M{"$ne": accountId},
+					"deleted":         bson.M{"$ne": true},
+					"$expr": bson.M{"$and": bson.A{
+						sameChat,
+						bson.M{"$gt": bson.A{"$seq", "$$read"}},
+					}},
+				}},
+				bson.M{"$count": "count"},
+			},
+			"as": "unread",
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"last_read_seq": 1,
+			"last_message":  bson.M{"$arrayElemAt": bson.A{"$last_message", 0}},
+			"unread_count":  bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$unread.count", 0}}, 0}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	found := []*ChatSummary{}
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	summaries := make(map[uuid.UUID]*ChatSummary, len(found))
+	for _, summary := range found {
+		summaries[summary.ChatId] = summary
+	}
+	return summaries, nil
+}
+
+func (s *mongoStorage) GetPrivacySettings(ctx context.Context, accountId uuid.UUID) (*PrivacySettings, error) {
+	res := s.getAccountCollection().FindOne(ctx, bson.M{
+		"_id":      accountId,
+		"presence": bson.M{"$exists": true},
+	})
+
+	settings := &PrivacySettings{}
+	if err := res.Decode(settings); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return defaultPrivacySettings(accountId), nil
+		}
+		return nil, err
+	}
+	if settings.DirectMessages == "" {
+		settings.DirectMessages = DMFromEveryone
+	}
+	return settings, nil
+}
+
+func (s *mongoStorage) UpdatePrivacySettings(ctx context.Context, settings *PrivacySettings) error {
+	_, err := s.getAccountCollection().UpdateOne(ctx, bson.M{
+		"_id": settings.AccountId,
+	}, bson.M{
+		"$set": bson.M{"presence": settings.Presence, "direct_messages": settings.DirectMessages},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStorage) GetLastSeen(ctx context.Context, accountId uuid.UUID) (*time.Time, error) {
+	res := s.getAccountCollection().FindOne(ctx, bson.M{
+		"_id": accountId,
+	}, options.FindOne().SetProjection(bson.M{"last_seen": 1}))
+
+	doc := struct {
+		LastSeen *time.Time `bson:"last_seen"`
+	}{}
+	if err := res.Decode(&doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return doc.LastSeen, nil
+}
+
+func (s *mongoStorage) UpdateLastSeen(ctx context.Context, accountId uuid.UUID, lastSeen time.Time) error {
+	_, err := s.getAccountCollection().UpdateOne(ctx, bson.M{
+		"_id": accountId,
+	}, bson.M{
+		"$max": bson.M{"last_seen": lastSeen},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// updateChat applies update to the chat, failing when it doesn't exist.
+func (s *mongoStorage) updateChat(ctx context.Context, chatId uuid.UUID, update bson.M) error {
+	res, err := s.getChatCollection().UpdateOne(ctx, bson.M{"_id": chatId}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrChatNotFound
+	}
+	return nil
+}
+
+func (s *mongoStorage) UpdateChatInfo(ctx context.Context, chat *Chat) error {
+	return s.updateChat(ctx, chat.Id, bson.M{
+		"$set": bson.M{
+			"title":       chat.Title,
+			"description": chat.Description,
+			"avatar":      chat.Avatar,
+		},
+	})
+}
+
+func (s *mongoStorage) UpdateRetention(ctx context.Context, chat *Chat) error {
+	return s.updateChat(ctx, chat.Id, bson.M{
+		"$set": bson.M{
+			"retention":       chat.Retention,
+			"disappear_after": chat.DisappearAfter,
+		},
+	})
+}
+
+func (s *mongoStorage) GetRetentionChats(ctx context.Context) ([]*Chat, error) {
+	cur, err := s.getChatCollection().Find(ctx, bson.M{
+		"retention": bson.M{"$gt": 0},
+	}, options.Find().SetProjection(bson.M{"messages": 0}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	chats := []*Chat{}
+	if err := cur.All(ctx, &chats); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func (s *mongoStorage) DeleteMessagesBefore(ctx context.Context, chatId uuid.UUID, before time.Time) (int, error) {
+	res, err := s.getMessageCollection().DeleteMany(ctx, bson.M{
+		"chat_id":    chatId,
+		"created_at": bson.M{"$lt": before},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (s *mongoStorage) DeleteExpiredMessages(ctx context.Context, now time.Time) (int, error) {
+	res, err := s.getMessageCollection().DeleteMany(ctx, bson.M{
+		"expires_at": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (s *mongoStorage) AddMembers(ctx context.Context, chatId uuid.UUID, members []uuid.UUID) error {
+	return s.updateChat(ctx, chatId, bson.M{
+		"$addToSet": bson.M{"members": bson.M{"$each": members}},
+	})
+}
+
+func (s *mongoStorage) RemoveMember(ctx context.Context, chatId, accountId uuid.UUID) error {
+	return s.updateChat(ctx, chatId, bson.M{
+		"$pull": bson.M{"members": accountId, "admins": accountId},
+	})
+}
+
+func (s *mongoStorage) SetAdmin(ctx context.Context, chatId, accountId uuid.UUID, admin bool) error {
+	op := "$pull"
+	if admin {
+		op = "$addToSet"
+	}
+	return s.updateChat(ctx, chatId, bson.M{
+		op: bson.M{"admins": accountId},
+	})
+}
+
+func (s *mongoStorage) SetOwner(ctx context.Context, chatId, ownerId uuid.UUID) error {
+	return s.updateChat(ctx, chatId, bson.M{
+		"$set":  bson.M{"owner_id": ownerId},
+		"$pull": bson.M{"admins": ownerId},
+	})
+}
+
+func (s *mongoStorage) UpdateMessageRequest(ctx context.Context, chatId uuid.UUID, request *MessageRequest) error {
+	if request == nil {
+		return s.updateChat(ctx, chatId, bson.M{"$unset": bson.M{"request": ""}})
+	}
+	return s.updateChat(ctx, chatId, bson.M{"$set": bson.M{"request": request}})
+}
+
+func (s *mongoStorage) InsertInvite(ctx context.Context, invite *Invite) error {
+	_, err := s.getInviteCollection().InsertOne(ctx, invite)
+	return err
+}
+
+func (s *mongoStorage) GetInvite(ctx context.Context, code string) (*Invite, error) {
+	res := s.getInviteCollection().FindOne(ctx, bson.M{"_id": code})
+
+	invite := &Invite{}
+	if err := res.Decode(invite); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (s *mongoStorage) GetChatInvites(ctx context.Context, chatId uuid.UUID) ([]*Invite, error) {
+	cur, err := s.getInviteCollection().Find(ctx, bson.M{
+		"chat_id": chatId,
+	}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	invites := []*Invite{}
+	if err := cur.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (s *mongoStorage) DeleteInvite(ctx context.Context, chatId uuid.UUID, code string) error {
+	res, err := s.getInviteCollection().DeleteOne(ctx, bson.M{
+		"_id":     code,
+		"chat_id": chatId,
+	})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// deviceKeysDoc keys the device's keys by account and device.
+type deviceKeysDoc struct {
+	Id         string `bson:"_id"`
+	DeviceKeys `bson:",inline"`
+}
+
+type preKeyDoc struct {
+	Id        string    `bson:"_id"`
+	AccountId uuid.UUID `bson:"account_id"`
+	DeviceId  string    `bson:"device_id"`
+	PreKey    `bson:",inline"`
+}
+
+func (s *mongoStorage) UpsertDeviceKeys(ctx context.Context, keys *DeviceKeys) error {
+	id := deliveryCursorsId(keys.AccountId, keys.DeviceId)
+	_, err := s.getDeviceKeyCollection().ReplaceOne(ctx, bson.M{
+		"_id": id,
+	}, &deviceKeysDoc{Id: id, DeviceKeys: *keys}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStorage) GetDeviceKeys(ctx context.Context, accountId uuid.UUID) ([]*DeviceKeys, error) {
+	cur, err := s.getDeviceKeyCollection().Find(ctx, bson.M{
+		"account_id": accountId,
+	}, options.Find().SetSort(bson.D{{Key: "device_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	keys := []*DeviceKeys{}
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *mongoStorage) DeleteDeviceKeys(ctx context.Context, accountId uuid.UUID, deviceId string) error {
+	_, err := s.getDeviceKeyCollection().DeleteOne(ctx, bson.M{
+		"_id": deliveryCursorsId(accountId, deviceId),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.getPreKeyCollection().DeleteMany(ctx, bson.M{
+		"account_id": accountId,
+		"device_id":  deviceId,
+	})
+	return err
+}
+
+func (s *mongoStorage) AddPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string, prekeys []*PreKey) error {
+	if len(prekeys) == 0 {
+		return nil
+	}
+	docs := make([]any, len(prekeys))
+	for i, prekey := range prekeys {
+		docs[i] = &preKeyDoc{
+			Id:        fmt.Sprintf("%s/%d", deliveryCursorsId(accountId, deviceId), prekey.KeyId),
+			AccountId: accountId,
+			DeviceId:  deviceId,
+			PreKey:    *prekey,
+		}
+	}
+	// Unordered so the prekeys after a duplicate are still inserted.
+	_, err := s.getPreKeyCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !isOnlyDuplicateKeys(err) {
+		return err
+	}
+	return nil
+}
+
+// isOnlyDuplicateKeys reports whether every write of a bulk insert failed
+// because the document was there already.
+func isOnlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *mongoStorage) ClaimPreKey(ctx context.Context, accountId uuid.UUID, deviceId string) (*PreKey, error) {
+	res := s.getPreKeyCollection().FindOneAndDelete(ctx, bson.M{
+		"account_id": accountId,
+		"device_id":  deviceId,
+	}, options.FindOneAndDelete().SetSort(bson.D{{Key: "key_id", Value: 1}}))
+
+	doc := &preKeyDoc{}
+	if err := res.Decode(doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNoPreKeys
+		}
+		return nil, err
+	}
+	return &doc.PreKey, nil
+}
+
+func (s *mongoStorage) CountPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string) (int, error) {
+	count, err := s.getPreKeyCollection().CountDocuments(ctx, bson.M{
+		"account_id": accountId,
+		"device_id":  deviceId,
+	})
+	return int(count), err
+}
+
+func (s *mongoStorage) InsertScheduledMessage(ctx context.Context, msg *ScheduledMessage) error {
+	_, err := s.getScheduledCollection().InsertOne(ctx, msg)
+	return err
+}
+
+func (s *mongoStorage) GetScheduledMessage(ctx context.Context, id uuid.UUID) (*ScheduledMessage, error) {
+	res := s.getScheduledCollection().FindOne(ctx, bson.M{"_id": id})
+
+	msg := &ScheduledMessage{}
+	if err := res.Decode(msg); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrScheduledNotFound
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *mongoStorage) GetScheduledMessages(ctx context.Context, accountId, chatId uuid.UUID) ([]*ScheduledMessage, error) {
+	filter := bson.M{"account_id": accountId}
+	if chatId != uuid.Nil {
+		filter["chat_id"] = chatId
+	}
+	cur, err := s.getScheduledCollection().Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "send_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	messages := []*ScheduledMessage{}
+	if err := cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// unclaimed matches the scheduled messages nobody holds a claim on at now.
+func unclaimed(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"claimed_until": bson.M{"$exists": false}},
+		bson.M{"claimed_until": bson.M{"$lte": now}},
+	}}
+}
+
+// scheduledMiss tells why a write to an unclaimed scheduled message
+// matched nothing.
+func (s *mongoStorage) scheduledMiss(ctx context.Context, id uuid.UUID) error {
+	count, err := s.getScheduledCollection().CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrScheduledNotFound
+	}
+	return ErrScheduledClaimed
+}
+
+func (s *mongoStorage) UpdateScheduledMessage(ctx context.Context, msg *ScheduledMessage, now time.Time) error {
+	filter := unclaimed(now)
+	filter["_id"] = msg.Id
+	res, err := s.getScheduledCollection().UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{
+			"reply_message_id": msg.ReplyMessageId,
+			"text":             msg.Text,
+			"attachments":      msg.Attachments,
+			"entities":         msg.Entities,
+			"send_at":          msg.SendAt,
+			"status":           msg.Status,
+			"error":            msg.Error,
+			"updated_at":       msg.UpdatedAt,
+			"attempts":         0,
+		},
+		"$unset": bson.M{"claimed_by": "", "claimed_until": ""},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return s.scheduledMiss(ctx, msg.Id)
+	}
+	return nil
+}
+
+func (s *mongoStorage) DeleteScheduledMessage(ctx context.Context, id uuid.UUID, now time.Time) error {
+	filter := unclaimed(now)
+	filter["_id"] = id
+	res, err := s.getScheduledCollection().DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return s.scheduledMiss(ctx, id)
+	}
+	return nil
+}
+
+// ClaimScheduledMessages claims the messages one at a time, so replicas
+// claiming at once never get the same one.
+func (s *mongoStorage) ClaimScheduledMessages(ctx context.Context, owner string, now, until time.Time, limit int) ([]*ScheduledMessage, error) {
+	filter := unclaimed(now)
+	filter["status"] = ScheduledPending
+	filter["send_at"] = bson.M{"$lte": now}
+
+	claimed := []*ScheduledMessage{}
+	for len(claimed) < limit {
+		res := s.getScheduledCollection().FindOneAndUpdate(ctx, filter, bson.M{
+			"$set": bson.M{"claimed_by": owner, "claimed_until": until},
+			"$inc": bson.M{"attempts": 1},
+		}, options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "send_at", Value: 1}}).
+			SetReturnDocument(options.After))
+
+		msg := &ScheduledMessage{}
+		if err := res.Decode(msg); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				break
+			}
+			return claimed, err
+		}
+		claimed = append(claimed, msg)
+	}
+	return claimed, nil
+}
+
+func (s *mongoStorage) ReleaseScheduledMessage(ctx context.Context, msg *ScheduledMessage) error {
+	filter := bson.M{"_id": msg.Id, "claimed_by": msg.ClaimedBy}
+	if msg.Status == ScheduledSent || msg.Status == ScheduledCanceled {
+		_, err := s.getScheduledCollection().DeleteOne(ctx, filter)
+		return err
+	}
+	_, err := s.getScheduledCollection().UpdateOne(ctx, filter, bson.M{
+		"$set":   bson.M{"status": msg.Status, "error": msg.Error},
+		"$unset": bson.M{"claimed_by": "", "claimed_until": ""},
+	})
+	return err
+}
+
+// draftDoc keys the draft by account and chat.
+type draftDoc struct {
+	Id    string `bson:"_id"`
+	Draft `bson:",inline"`
+}
+
+func draftId(accountId, chatId uuid.UUID) string {
+	return accountId.String() + "/" + chatId.String()
+}
+
+func (s *mongoStorage) SaveDraft(ctx context.Context, draft *Draft) error {
+	id := draftId(draft.AccountId, draft.ChatId)
+	_, err := s.getDraftCollection().ReplaceOne(ctx, bson.M{
+		"_id": id,
+	}, &draftDoc{Id: id, Draft: *draft}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStorage) DeleteDraft(ctx context.Context, accountId, chatId uuid.UUID) error {
+	_, err := s.getDraftCollection().DeleteOne(ctx, bson.M{"_id": draftId(accountId, chatId)})
+	return err
+}
+
+func (s *mongoStorage) GetDrafts(ctx context.Context, accountId uuid.UUID) ([]*Draft, error) {
+	cur, err := s.getDraftCollection().Find(ctx, bson.M{
+		"account_id": accountId,
+	}, options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	drafts := []*Draft{}
+	if err := cur.All(ctx, &drafts); err != nil {
+		return nil, err
+	}
+	return drafts, nil
+}
+
+func (s *mongoStorage) InsertSocketTicket(ctx context.Context, ticket *SocketTicket) error {
+	_, err := s.getSocketTicketCollection().InsertOne(ctx, ticket)
+	return err
+}
+
+// ClaimSocketTicket deletes the ticket in the same operation it's found in,
+// so two connections can't both redeem it.
+func (s *mongoStorage) ClaimSocketTicket(ctx context.Context, id string, now time.Time) (*SocketTicket, error) {
+	res := s.getSocketTicketCollection().FindOneAndDelete(ctx, bson.M{
+		"_id":        id,
+		"expires_at": bson.M{"$gt": now},
+	})
+
+	ticket := &SocketTicket{}
+	if err := res.Decode(ticket); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrTicketNotFound
+		}
+		return nil, err
+	}
+	return ticket, nil
+}
+
+type memoryStorage struct {
+	mu        sync.RWMutex
+	chats     []*Chat
+	messages  map[uuid.UUID][]*Message
+	cursors   map[string]map[uuid.UUID]int64
+	receipts  map[string]*Receipt
+	privacy   map[uuid.UUID]PrivacySettings
+	lastSeen  map[uuid.UUID]time.Time
+	invites   []*Invite
+	keys      map[string]*DeviceKeys
+	prekeys   map[string][]*PreKey
+	scheduled map[uuid.UUID]*ScheduledMessage
+	drafts    map[string]*Draft
+	tickets   map[string]*SocketTicket
+	// words indexes the messages by the words of their text.
+	words map[string]map[messageRef]bool
+}
+
+type messageRef struct {
+	chatId, messageId uuid.UUID
+}
+
+func (s *memoryStorage) indexMessage(msg *Message) {
+	for _, token := range tokenize(msg.Text) {
+		if s.words[token] == nil {
+			s.words[token] = map[messageRef]bool{}
+		}
+		s.words[token][messageRef{msg.ChatId, msg.Id}] = true
+	}
+}
+
+func (s *memoryStorage) unindexMessage(msg *Message) {
+	for _, token := range tokenize(msg.Text) {
+		delete(s.words[token], messageRef{msg.ChatId, msg.Id})
+		if len(s.words[token]) == 0 {
+			delete(s.words, token)
+		}
+	}
+}
+
+func NewMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		chats:     []*Chat{},
+		messages:  map[uuid.UUID][]*Message{},
+		cursors:   map[string]map[uuid.UUID]int64{},
+		receipts:  map[string]*Receipt{},
+		privacy:   map[uuid.UUID]PrivacySettings{},
+		lastSeen:  map[uuid.UUID]time.Time{},
+		invites:   []*Invite{},
+		keys:      map[string]*DeviceKeys{},
+		prekeys:   map[string][]*PreKey{},
+		scheduled: map[uuid.UUID]*ScheduledMessage{},
+		drafts:    map[string]*Draft{},
+		tickets:   map[string]*SocketTicket{},
+		words:     map[string]map[messageRef]bool{},
+	}
+}
+
+// Chats are returned as copies, their LastSeq changes under the lock.
+func (s *memoryStorage) GetChat(ctx context.Context, chatId uuid.UUID) (*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chat, err := s.getChat(chatId)
+	if err != nil {
+		return nil, err
+	}
+	clone := *chat
+	return &clone, nil
+}
+
+func (s *memoryStorage) getChat(chatId uuid.UUID) (*Chat, error) {
+	for i := range s.chats {
+		if s.chats[i].Id == chatId {
+			return s.chats[i], nil
+		}
+	}
+	return nil, ErrChatNotFound
+}
+
+func (s *memoryStorage) InsertChat(ctx context.Context, chat *Chat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if chat.Id == uuid.Nil {
+		chat.Id, _ = uuid.NewUUID()
+	}
+	chat.DirectKey = directKey(chat)
+	for _, other := range s.chats {
+		if other.Id == chat.Id || (chat.DirectKey != "" && other.DirectKey == chat.DirectKey) {
+			return ErrChatExists
+		}
+	}
+	clone := *chat
+	s.chats = append(s.chats, &clone)
+	return nil
+}
+
+func (s *memoryStorage) GetDirectChat(ctx context.Context, accountId, otherId uuid.UUID, encrypted bool) (*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := directKey(&Chat{IsPrivate: true, Encrypted: encrypted, Members: []uuid.UUID{accountId, otherId}})
+	for _, chat := range s.chats {
+		if key != "" && chat.DirectKey == key {
+			clone := *chat
+			return &clone, nil
+		}
+	}
+	return nil, ErrChatNotFound
+}
+
+func (s *memoryStorage) InsertMessage(ctx context.Context, chatId uuid.UUID, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.getChat(chatId)
+	if err != nil {
+		return err
+	}
+
+	if msg.ClientId != "" {
+		if _, err := s.getMessageByClientId(chatId, msg.FromAccountId, msg.ClientId); err == nil {
+			return ErrDuplicateMessage
+		}
+	}
+
+	chat.LastSeq++
+	msg.Seq = chat.LastSeq
+	msg.ChatId = chatId
+	if msg.Id == uuid.Nil {
+		msg.Id = uuid.New()
+	}
+	s.messages[chatId] = append(s.messages[chatId], msg.Clone())
+	s.indexMessage(msg)
+	return nil
+}
+
+// Messages are copied in and out so callers never share them.
+func (s *memoryStorage) GetMessages(ctx context.Context, chatId, viewerId uuid.UUID, before int64, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.getChat(chatId); err != nil {
+		return nil, err
+	}
+
+	// Messages are appended in sequence order.
+	chatMessages := s.messages[chatId]
+	messages := []*Message{}
+	for i := len(chatMessages) - 1; i >= 0 && len(messages) < limit; i-- {
+		if before > 0 && chatMessages[i].Seq >= before {
+			continue
+		}
+		if chatMessages[i].IsHiddenFor(viewerId) {
+			continue
+		}
+		messages = append(messages, chatMessages[i].Clone())
+	}
+	return messages, nil
+}
+
+func (s *memoryStorage) getMessage(chatId, messageId uuid.UUID) (int, error) {
+	for i, msg := range s.messages[chatId] {
+		if msg.Id == messageId {
+			return i, nil
+		}
+	}
+	return 0, ErrMessageNotFound
+}
+
+func (s *memoryStorage) GetMessage(ctx context.Context, chatId, messageId uuid.UUID) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, err := s.getMessage(chatId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	return s.messages[chatId][i].Clone(), nil
+}
+
+func (s *memoryStorage) getMessageByClientId(chatId, accountId uuid.UUID, clientId string) (*Message, error) {
+	for _, msg := range s.messages[chatId] {
+		if msg.FromAccountId == accountId && msg.ClientId == clientId {
+			return msg, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (s *memoryStorage) GetMessageByClientId(ctx context.Context, chatId, accountId uuid.UUID, clientId string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msg, err := s.getMessageByClientId(chatId, accountId, clientId)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Clone(), nil
+}
+
+func (s *memoryStorage) UpdateMessage(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.getMessage(msg.ChatId, msg.Id)
+	if err != nil {
+		return err
+	}
+	stored := s.messages[msg.ChatId][i].Clone()
+	s.unindexMessage(stored)
+	stored.Text = msg.Text
+	stored.Edits = append([]*MessageEdit(nil), msg.Edits...)
+	stored.EditedAt = msg.EditedAt
+	stored.Deleted = msg.Deleted
+	stored.Attachments = append([]*Attachment(nil), msg.Attachments...)
+	stored.Entities = append([]*Entity(nil), msg.Entities...)
+	stored.Preview = msg.Preview
+	stored.Ciphertexts = append([]*Ciphertext(nil), msg.Ciphertexts...)
+	if msg.Deleted {
+		stored.ReactedBy = nil
+	}
+	s.messages[msg.ChatId][i] = stored
+	s.indexMessage(stored)
+	return nil
+}
+
+func (s *memoryStorage) AddReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.getMessage(chatId, messageId)
+	if err != nil {
+		return false, err
+	}
+	stored := s.messages[chatId][i]
+	if hasReaction(stored.ReactedBy, reaction) >= 0 {
+		return false, nil
+	}
+	stored = stored.Clone()
+	copied := *reaction
+	stored.ReactedBy = append(stored.ReactedBy, &copied)
+	s.messages[chatId][i] = stored
+	return true, nil
+}
+
+func (s *memoryStorage) RemoveReaction(ctx context.Context, chatId, messageId uuid.UUID, reaction *Reaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.getMessage(chatId, messageId)
+	if err != nil {
+		return false, err
+	}
+	stored := s.messages[chatId][i]
+	j := hasReaction(stored.ReactedBy, reaction)
+	if j < 0 {
+		return false, nil
+	}
+	stored = stored.Clone()
+	stored.ReactedBy = append(stored.ReactedBy[:j], stored.ReactedBy[j+1:]...)
+	s.messages[chatId][i] = stored
+	return true, nil
+}
+
+// hasReaction returns the index of the reaction, -1 when it's not there.
+func hasReaction(reactions []*Reaction, reaction *Reaction) int {
+	for i, r := range reactions {
+		if r.Emoji == reaction.Emoji && r.AccountId == reaction.AccountId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStorage) HideMessage(ctx context.Context, chatId, messageId, accountId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.getMessage(chatId, messageId)
+	if err != nil {
+		return err
+	}
+	stored := s.messages[chatId][i]
+	if !stored.IsHiddenFor(accountId) {
+		stored = stored.Clone()
+		stored.HiddenFor = append(stored.HiddenFor, accountId)
+		s.messages[chatId][i] = stored
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetAccountChats(ctx context.Context, accountId uuid.UUID) ([]*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chats := []*Chat{}
+	for _, chat := range s.chats {
+		for _, memberId := range chat.Members {
+			if memberId == accountId {
+				clone := *chat
+				chats = append(chats, &clone)
+				break
+			}
+		}
+	}
+	return chats, nil
+}
+
+func (s *memoryStorage) GetMessagesAfter(ctx context.Context, chatId, viewerId uuid.UUID, after int64, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := []*Message{}
+	for _, msg := range s.messages[chatId] {
+		if len(messages) == limit {
+			break
+		}
+		if msg.Seq <= after || msg.IsHiddenFor(viewerId) {
+			continue
+		}
+		messages = append(messages, msg.Clone())
+	}
+	return messages, nil
+}
+
+func (s *memoryStorage) GetDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string) (map[uuid.UUID]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, found := s.cursors[deliveryCursorsId(accountId, deviceId)]
+	if !found {
+		return nil, ErrCursorsNotFound
+	}
+	cursors := map[uuid.UUID]int64{}
+	for chatId, seq := range stored {
+		cursors[chatId] = seq
+	}
+	return cursors, nil
+}
+
+func (s *memoryStorage) InsertDeliveryCursors(ctx context.Context, accountId uuid.UUID, deviceId string, cursors map[uuid.UUID]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := deliveryCursorsId(accountId, deviceId)
+	if _, found := s.cursors[id]; found {
+		return nil
+	}
+	stored := map[uuid.UUID]int64{}
+	for chatId, seq := range cursors {
+		stored[chatId] = seq
+	}
+	s.cursors[id] = stored
+	return nil
+}
+
+func (s *memoryStorage) UpdateDeliveryCursor(ctx context.Context, accountId uuid.UUID, deviceId string, chatId uuid.UUID, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := deliveryCursorsId(accountId, deviceId)
+	if s.cursors[id] == nil {
+		s.cursors[id] = map[uuid.UUID]int64{}
+	}
+	if seq > s.cursors[id][chatId] {
+		s.cursors[id][chatId] = seq
+	}
+	return nil
+}
+
+func (s *memoryStorage) findReceipts(match func(*Receipt) bool) []*Receipt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	receipts := []*Receipt{}
+	for _, receipt := range s.receipts {
+		if match(receipt) {
+			clone := *receipt
+			receipts = append(receipts, &clone)
+		}
+	}
+	return receipts
+}
+
+func (s *memoryStorage) GetReceipts(ctx context.Context, chatId uuid.UUID) ([]*Receipt, error) {
+	return s.findReceipts(func(receipt *Receipt) bool {
+		return receipt.ChatId == chatId
+	}), nil
+}
+
+func (s *memoryStorage) GetAccountReceipts(ctx context.Context, accountId uuid.UUID) ([]*Receipt, error) {
+	return s.findReceipts(func(receipt *Receipt) bool {
+		return receipt.AccountId == accountId
+	}), nil
+}
+
+func (s *memoryStorage) getReceipt(chatId, accountId uuid.UUID) *Receipt {
+	id := receiptId(chatId, accountId)
+	if s.receipts[id] == nil {
+		s.receipts[id] = &Receipt{ChatId: chatId, AccountId: accountId}
+	}
+	return s.receipts[id]
+}
+
+func (s *memoryStorage) MarkRead(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receipt := s.getReceipt(chatId, accountId)
+	if seq > receipt.LastDeliveredSeq {
+		receipt.LastDeliveredSeq = seq
+	}
+	if seq <= receipt.LastReadSeq {
+		return false, nil
+	}
+	receipt.LastReadSeq = seq
+	return true, nil
+}
+
+func (s *memoryStorage) MarkDelivered(ctx context.Context, chatId, accountId uuid.UUID, seq int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receipt := s.getReceipt(chatId, accountId)
+	if seq <= receipt.LastDeliveredSeq {
+		return false, nil
+	}
+	receipt.LastDeliveredSeq = seq
+	return true, nil
+}
+
+func (s *memoryStorage) GetChatSummaries(ctx context.Context, accountId uuid.UUID, chatIds []uuid.UUID) (map[uuid.UUID]*ChatSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	summaries := map[uuid.UUID]*ChatSummary{}
+	for _, chatId := range chatIds {
+		if _, err := s.getChat(chatId); err != nil {
+			continue
+		}
+		summary := &ChatSummary{ChatId: chatId}
+		if receipt, found := s.receipts[receiptId(chatId, accountId)]; found {
+			summary.LastReadSeq = receipt.LastReadSeq
+		}
+		for _, msg := range s.messages[chatId] {
+			if msg.IsHiddenFor(accountId) {
+				continue
+			}
+			if summary.LastMessage == nil || msg.Seq > summary.LastMessage.Seq {
+				summary.LastMessage = msg
+			}
+			if msg.Seq > summary.LastReadSeq && msg.FromAccountId != accountId && !msg.Deleted {
+				summary.UnreadCount++
+			}
+		}
+		if summary.LastMessage != nil {
+			summary.LastMessage = summary.LastMessage.Clone()
+		}
+		summaries[chatId] = summary
+	}
+	return summaries, nil
+}
+
+func (s *memoryStorage) GetPrivacySettings(ctx context.Context, accountId uuid.UUID) (*PrivacySettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	settings, found := s.privacy[accountId]
+	if !found {
+		return defaultPrivacySettings(accountId), nil
+	}
+	if settings.DirectMessages == "" {
+		settings.DirectMessages = DMFromEveryone
+	}
+	return &settings, nil
+}
+
+func (s *memoryStorage) UpdatePrivacySettings(ctx context.Context, settings *PrivacySettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.privacy[settings.AccountId] = *settings
+	return nil
+}
+
+func (s *memoryStorage) GetLastSeen(ctx context.Context, accountId uuid.UUID) (*time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lastSeen, found := s.lastSeen[accountId]
+	if !found {
+		return nil, nil
+	}
+	return &lastSeen, nil
+}
+
+func (s *memoryStorage) UpdateLastSeen(ctx context.Context, accountId uuid.UUID, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lastSeen.After(s.lastSeen[accountId]) {
+		s.lastSeen[accountId] = lastSeen
+	}
+	return nil
+}
+
+// updateChat replaces the stored chat with the one update makes out of a
+// copy of it, so chats handed out before never change.
+func (s *memoryStorage) updateChat(chatId uuid.UUID, update func(chat *Chat)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.chats {
+		if s.chats[i].Id == chatId {
+			clone := *s.chats[i]
+			update(&clone)
+			s.chats[i] = &clone
+			return nil
+		}
+	}
+	return ErrChatNotFound
+}
+
+// without returns a copy of ids without id.
+func without(ids []uuid.UUID, id uuid.UUID) []uuid.UUID {
+	kept := []uuid.UUID{}
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+func contains(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStorage) UpdateChatInfo(ctx context.Context, chat *Chat) error {
+	return s.updateChat(chat.Id, func(stored *Chat) {
+		stored.Title = chat.Title
+		stored.Description = chat.Description
+		stored.Avatar = chat.Avatar
+	})
+}
+
+func (s *memoryStorage) UpdateRetention(ctx context.Context, chat *Chat) error {
+	return s.updateChat(chat.Id, func(stored *Chat) {
+		stored.Retention = chat.Retention
+		stored.DisappearAfter = chat.DisappearAfter
+	})
+}
+
+func (s *memoryStorage) GetRetentionChats(ctx context.Context) ([]*Chat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chats := []*Chat{}
+	for _, chat := range s.chats {
+		if chat.Retention > 0 {
+			clone := *chat
+			chats = append(chats, &clone)
+		}
+	}
+	return chats, nil
+}
+
+// deleteMessages deletes the messages of the chat which expired returns
+// true for.
+func (s *memoryStorage) deleteMessages(chatId uuid.UUID, expired func(msg *Message) bool) int {
+	kept := []*Message{}
+	for _, msg := range s.messages[chatId] {
+		if expired(msg) {
+			s.unindexMessage(msg)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	deleted := len(s.messages[chatId]) - len(kept)
+	s.messages[chatId] = kept
+	return deleted
+}
+
+func (s *memoryStorage) DeleteMessagesBefore(ctx context.Context, chatId uuid.UUID, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteMessages(chatId, func(msg *Message) bool {
+		return msg.CreatedAt.Before(before)
+	}), nil
+}
+
+func (s *memoryStorage) DeleteExpiredMessages(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for chatId := range s.messages {
+		deleted += s.deleteMessages(chatId, func(msg *Message) bool {
+			return msg.ExpiresAt != nil && !msg.ExpiresAt.After(now)
+		})
+	}
+	return deleted, nil
+}
+
+func (s *memoryStorage) AddMembers(ctx context.Context, chatId uuid.UUID, members []uuid.UUID) error {
+	return s.updateChat(chatId, func(chat *Chat) {
+		chat.Members = append([]uuid.UUID(nil), chat.Members...)
+		for _, memberId := range members {
+			if !contains(chat.Members, memberId) {
+				chat.Members = append(chat.Members, memberId)
+			}
+		}
+	})
+}
+
+func (s *memoryStorage) RemoveMember(ctx context.Context, chatId, accountId uuid.UUID) error {
+	return s.updateChat(chatId, func(chat *Chat) {
+		chat.Members = without(chat.Members, accountId)
+		chat.Admins = without(chat.Admins, accountId)
+	})
+}
+
+func (s *memoryStorage) SetAdmin(ctx context.Context, chatId, accountId uuid.UUID, admin bool) error {
+	return s.updateChat(chatId, func(chat *Chat) {
+		chat.Admins = without(chat.Admins, accountId)
+		if admin {
+			chat.Admins = append(chat.Admins, accountId)
+		}
+	})
+}
+
+func (s *memoryStorage) SetOwner(ctx context.Context, chatId, ownerId uuid.UUID) error {
+	return s.updateChat(chatId, func(chat *Chat) {
+		chat.OwnerId = ownerId
+		chat.Admins = without(chat.Admins, ownerId)
+	})
+}
+
+func (s *memoryStorage) UpdateMessageRequest(ctx context.Context, chatId uuid.UUID, request *MessageRequest) error {
+	return s.updateChat(chatId, func(chat *Chat) {
+		chat.Request = request
+	})
+}
+
+func (s *memoryStorage) InsertInvite(ctx context.Context, invite *Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clone := *invite
+	s.invites = append(s.invites, &clone)
+	return nil
+}
+
+func (s *memoryStorage) GetInvite(ctx context.Context, code string) (*Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, invite := range s.invites {
+		if invite.Code == code {
+			clone := *invite
+			return &clone, nil
+		}
+	}
+	return nil, ErrInviteNotFound
+}
+
+func (s *memoryStorage) GetChatInvites(ctx context.Context, chatId uuid.UUID) ([]*Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	invites := []*Invite{}
+	for _, invite := range s.invites {
+		if invite.ChatId == chatId {
+			clone := *invite
+			invites = append(invites, &clone)
+		}
+	}
+	return invites, nil
+}
+
+func (s *memoryStorage) DeleteInvite(ctx context.Context, chatId uuid.UUID, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, invite := range s.invites {
+		if invite.Code == code && invite.ChatId == chatId {
+			s.invites = append(s.invites[:i:i], s.invites[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInviteNotFound
+}
+
+func (s *memoryStorage) UpsertDeviceKeys(ctx context.Context, keys *DeviceKeys) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *keys
+	s.keys[deliveryCursorsId(keys.AccountId, keys.DeviceId)] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetDeviceKeys(ctx context.Context, accountId uuid.UUID) ([]*DeviceKeys, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*DeviceKeys{}
+	for _, stored := range s.keys {
+		if stored.AccountId == accountId {
+			copied := *stored
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].DeviceId < keys[j].DeviceId
+	})
+	return keys, nil
+}
+
+func (s *memoryStorage) DeleteDeviceKeys(ctx context.Context, accountId uuid.UUID, deviceId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, deliveryCursorsId(accountId, deviceId))
+	delete(s.prekeys, deliveryCursorsId(accountId, deviceId))
+	return nil
+}
+
+func (s *memoryStorage) AddPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string, prekeys []*PreKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := deliveryCursorsId(accountId, deviceId)
+	stored := s.prekeys[id]
+	for _, prekey := range prekeys {
+		duplicate := false
+		for _, existing := range stored {
+			duplicate = duplicate || existing.KeyId == prekey.KeyId
+		}
+		if !duplicate {
+			copied := *prekey
+			stored = append(stored, &copied)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].KeyId < stored[j].KeyId
+	})
+	s.prekeys[id] = stored
+	return nil
+}
+
+func (s *memoryStorage) ClaimPreKey(ctx context.Context, accountId uuid.UUID, deviceId string) (*PreKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := deliveryCursorsId(accountId, deviceId)
+	stored := s.prekeys[id]
+	if len(stored) == 0 {
+		return nil, ErrNoPreKeys
+	}
+	s.prekeys[id] = stored[1:]
+	return stored[0], nil
+}
+
+func (s *memoryStorage) CountPreKeys(ctx context.Context, accountId uuid.UUID, deviceId string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.prekeys[deliveryCursorsId(accountId, deviceId)]), nil
+}
+
+func (s *memoryStorage) SearchMessages(ctx context.Context, chatIds []uuid.UUID, viewerId uuid.UUID, terms []string, skip, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(terms) == 0 {
+		return []*Message{}, nil
+	}
+	inChats := map[uuid.UUID]bool{}
+	for _, chatId := range chatIds {
+		inChats[chatId] = true
+	}
+
+	messages := []*Message{}
+	for ref := range s.words[terms[0]] {
+		matches := inChats[ref.chatId]
+		for _, term := range terms[1:] {
+			matches = matches && s.words[term][ref]
+		}
+		if !matches {
+			continue
+		}
+		i, err := s.getMessage(ref.chatId, ref.messageId)
+		if err != nil {
+			return nil, err
+		}
+		if msg := s.messages[ref.chatId][i]; !msg.IsHiddenFor(viewerId) {
+			messages = append(messages, msg.Clone())
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].CreatedAt.Equal(messages[j].CreatedAt) {
+			return messages[i].CreatedAt.After(messages[j].CreatedAt)
+		}
+		if messages[i].Seq != messages[j].Seq {
+			return messages[i].Seq > messages[j].Seq
+		}
+		return messages[i].Id.String() > messages[j].Id.String()
+	})
+
+	if skip >= len(messages) {
+		return []*Message{}, nil
+	}
+	messages = messages[skip:]
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *memoryStorage) InsertScheduledMessage(ctx context.Context, msg *ScheduledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *msg
+	s.scheduled[msg.Id] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetScheduledMessage(ctx context.Context, id uuid.UUID) (*ScheduledMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.scheduled[id]
+	if !ok {
+		return nil, ErrScheduledNotFound
+	}
+	copied := *stored
+	return &copied, nil
+}
+
+// sortScheduled orders the messages by when they're sent.
+func sortScheduled(messages []*ScheduledMessage) {
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].SendAt.Equal(messages[j].SendAt) {
+			return messages[i].SendAt.Before(messages[j].SendAt)
+		}
+		return messages[i].Id.String() < messages[j].Id.String()
+	})
+}
+
+func (s *memoryStorage) GetScheduledMessages(ctx context.Context, accountId, chatId uuid.UUID) ([]*ScheduledMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := []*ScheduledMessage{}
+	for _, stored := range s.scheduled {
+		if stored.AccountId == accountId && (chatId == uuid.Nil || stored.ChatId == chatId) {
+			copied := *stored
+			messages = append(messages, &copied)
+		}
+	}
+	sortScheduled(messages)
+	return messages, nil
+}
+
+// getUnclaimed returns the stored scheduled message if nobody holds a
+// claim on it at now.
+func (s *memoryStorage) getUnclaimed(id uuid.UUID, now time.Time) (*ScheduledMessage, error) {
+	stored, ok := s.scheduled[id]
+	if !ok {
+		return nil, ErrScheduledNotFound
+	}
+	if stored.claimedAt(now) {
+		return nil, ErrScheduledClaimed
+	}
+	return stored, nil
+}
+
+func (s *memoryStorage) UpdateScheduledMessage(ctx context.Context, msg *ScheduledMessage, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.getUnclaimed(msg.Id, now)
+	if err != nil {
+		return err
+	}
+	updated := *stored
+	updated.ReplyMessageId = msg.ReplyMessageId
+	updated.Text = msg.Text
+	updated.Attachments = msg.Attachments
+	updated.Entities = msg.Entities
+	updated.SendAt = msg.SendAt
+	updated.Status = msg.Status
+	updated.Error = msg.Error
+	updated.UpdatedAt = msg.UpdatedAt
+	updated.Attempts = 0
+	updated.ClaimedBy = ""
+	updated.ClaimedUntil = nil
+	s.scheduled[msg.Id] = &updated
+	return nil
+}
+
+func (s *memoryStorage) DeleteScheduledMessage(ctx context.Context, id uuid.UUID, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.getUnclaimed(id, now); err != nil {
+		return err
+	}
+	delete(s.scheduled, id)
+	return nil
+}
+
+func (s *memoryStorage) ClaimScheduledMessages(ctx context.Context, owner string, now, until time.Time, limit int) ([]*ScheduledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*ScheduledMessage{}
+	for _, stored := range s.scheduled {
+		if stored.Status == ScheduledPending && !stored.SendAt.After(now) && !stored.claimedAt(now) {
+			due = append(due, stored)
+		}
+	}
+	sortScheduled(due)
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*ScheduledMessage, len(due))
+	for i, stored := range due {
+		updated := *stored
+		updated.ClaimedBy = owner
+		updated.ClaimedUntil = &until
+		updated.Attempts++
+		s.scheduled[stored.Id] = &updated
+		copied := updated
+		claimed[i] = &copied
+	}
+	return claimed, nil
+}
+
+func (s *memoryStorage) ReleaseScheduledMessage(ctx context.Context, msg *ScheduledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.scheduled[msg.Id]
+	if !ok || stored.ClaimedBy != msg.ClaimedBy {
+		return nil
+	}
+	if msg.Status == ScheduledSent || msg.Status == ScheduledCanceled {
+		delete(s.scheduled, msg.Id)
+		return nil
+	}
+	updated := *stored
+	updated.Status = msg.Status
+	updated.Error = msg.Error
+	updated.ClaimedBy = ""
+	updated.ClaimedUntil = nil
+	s.scheduled[msg.Id] = &updated
+	return nil
+}
+
+func (s *memoryStorage) SaveDraft(ctx context.Context, draft *Draft) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *draft
+	s.drafts[draftId(draft.AccountId, draft.ChatId)] = &stored
+	return nil
+}
+
+func (s *memoryStorage) DeleteDraft(ctx context.Context, accountId, chatId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.drafts, draftId(accountId, chatId))
+	return nil
+}
+
+func (s *memoryStorage) GetDrafts(ctx context.Context, accountId uuid.UUID) ([]*Draft, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	drafts := []*Draft{}
+	for _, stored := range s.drafts {
+		if stored.AccountId == accountId {
+			copied := *stored
+			drafts = append(drafts, &copied)
+		}
+	}
+	sort.Slice(drafts, func(i, j int) bool {
+		return drafts[i].UpdatedAt.After(drafts[j].UpdatedAt)
+	})
+	return drafts, nil
+}
+
+func (s *memoryStorage) InsertSocketTicket(ctx context.Context, ticket *SocketTicket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *ticket
+	stored.Ticket = ""
+	stored.Token = ""
+	s.tickets[ticket.Id] = &stored
+	return nil
+}
+
+func (s *memoryStorage) ClaimSocketTicket(ctx context.Context, id string, now time.Time) (*SocketTicket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ticket, found := s.tickets[id]
+	if !found {
+		return nil, ErrTicketNotFound
+	}
+	delete(s.tickets, id)
+	if !ticket.ExpiresAt.After(now) {
+		return nil, ErrTicketNotFound
 	}
-	return chat.Messages[:count], nil
+	return ticket, nil
 }
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestMongoStorage(t *testing.T) {
@@ -15,11 +20,12 @@ func TestMongoStorage(t *testing.T) {
 	defer storage.Drop()
 
 	ctx := context.Background()
+	// Creates the indexes.
+	assert.Nil(t, storage.Migrate(ctx))
 	t.Run("test creating chat", func(t *testing.T) {
 		chat := &Chat{
 			Id:        uuid.New(),
 			Members:   []uuid.UUID{uuid.New(), uuid.New()},
-			Messages:  []*Message{},
 			IsPrivate: true,
 		}
 		assert.Nil(t, storage.InsertChat(ctx, chat))
@@ -30,7 +36,6 @@ func TestMongoStorage(t *testing.T) {
 		chat := &Chat{
 			Id:        uuid.New(),
 			Members:   []uuid.UUID{accountId1, accountId2},
-			Messages:  []*Message{},
 			IsPrivate: true,
 		}
 		assert.Nil(t, storage.InsertChat(ctx, chat))
@@ -43,7 +48,6 @@ func TestMongoStorage(t *testing.T) {
 		chat := &Chat{
 			Id:        uuid.New(),
 			Members:   []uuid.UUID{accountId1, accountId2, uuid.New()},
-			Messages:  []*Message{},
 			IsPrivate: true,
 		}
 		assert.Nil(t, storage.InsertChat(ctx, chat))
@@ -56,7 +60,6 @@ func TestMongoStorage(t *testing.T) {
 		chat := &Chat{
 			Id:        uuid.New(),
 			Members:   []uuid.UUID{uuid.New(), uuid.New()},
-			Messages:  []*Message{},
 			IsPrivate: true,
 		}
 		storage.InsertChat(ctx, chat)
@@ -68,7 +71,6 @@ func TestMongoStorage(t *testing.T) {
 		chat := &Chat{
 			Id:        uuid.New(),
 			Members:   []uuid.UUID{uuid.New(), uuid.New()},
-			Messages:  []*Message{},
 			IsPrivate: true,
 		}
 		storage.InsertChat(ctx, chat)
@@ -81,8 +83,1087 @@ func TestMongoStorage(t *testing.T) {
 		err := storage.InsertMessage(ctx, chat.Id, msg)
 		assert.Nil(t, err)
 
-		chatDb, err := storage.GetChat(ctx, chat.Id)
+		messages, err := storage.GetMessages(ctx, chat.Id, uuid.Nil, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []*Message{msg}, messages)
+	})
+	t.Run("test message history", func(t *testing.T) {
+		testMessageHistory(t, storage)
+	})
+	t.Run("test message changes", func(t *testing.T) {
+		testMessageChanges(t, storage)
+	})
+	t.Run("test concurrent messages", func(t *testing.T) {
+		testConcurrentMessages(t, storage)
+	})
+	t.Run("test delivery cursors", func(t *testing.T) {
+		testDeliveryCursors(t, storage)
+	})
+	t.Run("test receipts", func(t *testing.T) {
+		testReceipts(t, storage)
+	})
+	t.Run("test presence", func(t *testing.T) {
+		testPresenceStorage(t, storage)
+	})
+	t.Run("test group administration", func(t *testing.T) {
+		testGroupStorage(t, storage)
+	})
+	t.Run("test direct chats", func(t *testing.T) {
+		testDirectChats(t, storage)
+	})
+	t.Run("test device keys", func(t *testing.T) {
+		testDeviceKeys(t, storage)
+	})
+	t.Run("test search", func(t *testing.T) {
+		testSearch(t, storage)
+	})
+	t.Run("test retention", func(t *testing.T) {
+		testRetention(t, storage)
+	})
+	t.Run("test scheduled messages", func(t *testing.T) {
+		testScheduledMessages(t, storage)
+	})
+	t.Run("test drafts", func(t *testing.T) {
+		testDrafts(t, storage)
+	})
+	t.Run("test socket tickets", func(t *testing.T) {
+		testSocketTickets(t, storage)
+	})
+	t.Run("test migrate embedded messages", func(t *testing.T) {
+		chatId := uuid.New()
+		_, err := storage.getChatCollection().InsertOne(ctx, bson.M{
+			"_id":        chatId,
+			"members":    []uuid.UUID{uuid.New(), uuid.New()},
+			"is_private": true,
+			"messages": []bson.M{
+				{"from_account_id": uuid.New(), "text": "first", "created_at": time.Now().UTC()},
+				{"from_account_id": uuid.New(), "text": "second", "created_at": time.Now().UTC()},
+			},
+		})
+		assert.Nil(t, err)
+
+		// Running it twice mustn't duplicate anything.
+		assert.Nil(t, storage.Migrate(ctx))
+		assert.Nil(t, storage.Migrate(ctx))
+
+		messages, err := storage.GetMessages(ctx, chatId, uuid.Nil, 0, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "second", messages[0].Text)
+		assert.Equal(t, int64(2), messages[0].Seq)
+
+		chat, err := storage.GetChat(ctx, chatId)
 		assert.Nil(t, err)
-		assert.Equal(t, msg, chatDb.Messages[0])
+		assert.Equal(t, int64(2), chat.LastSeq)
+
+		msg := &Message{FromAccountId: uuid.New(), Text: "third"}
+		assert.Nil(t, storage.InsertMessage(ctx, chatId, msg))
+		assert.Equal(t, int64(3), msg.Seq)
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	t.Run("test message history", func(t *testing.T) {
+		testMessageHistory(t, NewMemoryStorage())
+	})
+	t.Run("test message changes", func(t *testing.T) {
+		testMessageChanges(t, NewMemoryStorage())
+	})
+	t.Run("test concurrent messages", func(t *testing.T) {
+		testConcurrentMessages(t, NewMemoryStorage())
+	})
+	t.Run("test delivery cursors", func(t *testing.T) {
+		testDeliveryCursors(t, NewMemoryStorage())
+	})
+	t.Run("test receipts", func(t *testing.T) {
+		testReceipts(t, NewMemoryStorage())
+	})
+	t.Run("test presence", func(t *testing.T) {
+		testPresenceStorage(t, NewMemoryStorage())
+	})
+	t.Run("test group administration", func(t *testing.T) {
+		testGroupStorage(t, NewMemoryStorage())
 	})
+	t.Run("test direct chats", func(t *testing.T) {
+		testDirectChats(t, NewMemoryStorage())
+	})
+	t.Run("test device keys", func(t *testing.T) {
+		testDeviceKeys(t, NewMemoryStorage())
+	})
+	t.Run("test search", func(t *testing.T) {
+		testSearch(t, NewMemoryStorage())
+	})
+	t.Run("test retention", func(t *testing.T) {
+		testRetention(t, NewMemoryStorage())
+	})
+	t.Run("test scheduled messages", func(t *testing.T) {
+		testScheduledMessages(t, NewMemoryStorage())
+	})
+	t.Run("test drafts", func(t *testing.T) {
+		testDrafts(t, NewMemoryStorage())
+	})
+	t.Run("test socket tickets", func(t *testing.T) {
+		testSocketTickets(t, NewMemoryStorage())
+	})
+}
+
+// testMessageHistory is run against every Storage implementation.
+func testMessageHistory(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	chat := &Chat{
+		Id:        uuid.New(),
+		Members:   []uuid.UUID{uuid.New(), uuid.New()},
+		IsPrivate: true,
+	}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+
+	for i := 1; i <= 5; i++ {
+		msg := &Message{
+			FromAccountId: chat.Members[i%2],
+			Text:          fmt.Sprintf("message %d", i),
+			CreatedAt:     time.Now().UTC().Round(time.Second),
+		}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+		assert.Equal(t, int64(i), msg.Seq)
+	}
+
+	t.Run("newest first", func(t *testing.T) {
+		messages, err := storage.GetMessages(ctx, chat.Id, uuid.Nil, 0, 2)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "message 5", messages[0].Text)
+		assert.Equal(t, "message 4", messages[1].Text)
+	})
+	t.Run("before cursor", func(t *testing.T) {
+		messages, err := storage.GetMessages(ctx, chat.Id, uuid.Nil, 4, 2)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, int64(3), messages[0].Seq)
+		assert.Equal(t, int64(2), messages[1].Seq)
+	})
+	t.Run("last page", func(t *testing.T) {
+		messages, err := storage.GetMessages(ctx, chat.Id, uuid.Nil, 2, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "message 1", messages[0].Text)
+	})
+	t.Run("empty chat", func(t *testing.T) {
+		empty := &Chat{Id: uuid.New(), Members: []uuid.UUID{uuid.New()}}
+		assert.Nil(t, storage.InsertChat(ctx, empty))
+		messages, err := storage.GetMessages(ctx, empty.Id, uuid.Nil, 0, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 0)
+	})
+	t.Run("unknown chat", func(t *testing.T) {
+		_, err := storage.GetMessages(ctx, uuid.New(), uuid.Nil, 0, 10)
+		assert.ErrorIs(t, err, ErrChatNotFound)
+	})
+}
+
+// testConcurrentMessages is run against every Storage implementation.
+func testConcurrentMessages(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	chat := &Chat{
+		Id:        uuid.New(),
+		Members:   []uuid.UUID{uuid.New(), uuid.New()},
+		IsPrivate: true,
+	}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+
+	// Every message is sent twice at once, like a client retrying.
+	const senders = 10
+	var wg sync.WaitGroup
+	var duplicates atomic.Int32
+	for i := 0; i < senders*2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := &Message{
+				FromAccountId: chat.Members[0],
+				Text:          fmt.Sprint(i / 2),
+				ClientId:      fmt.Sprint(i / 2),
+			}
+			err := storage.InsertMessage(ctx, chat.Id, msg)
+			if errors.Is(err, ErrDuplicateMessage) {
+				duplicates.Add(1)
+				return
+			}
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(senders), duplicates.Load())
+
+	messages, err := storage.GetMessages(ctx, chat.Id, uuid.Nil, 0, senders*2)
+	assert.Nil(t, err)
+	assert.Len(t, messages, senders)
+	// Newest first, without gaps.
+	for i, msg := range messages {
+		assert.Equal(t, int64(senders-i), msg.Seq)
+	}
+
+	stored, err := storage.GetChat(ctx, chat.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(senders), stored.LastSeq)
+
+	t.Run("unknown chat", func(t *testing.T) {
+		err := storage.InsertMessage(ctx, uuid.New(), &Message{FromAccountId: uuid.New(), Text: "hi"})
+		assert.ErrorIs(t, err, ErrChatNotFound)
+	})
+}
+
+// testMessageChanges is run against every Storage implementation.
+func testMessageChanges(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	chat := &Chat{
+		Id:        uuid.New(),
+		Members:   []uuid.UUID{uuid.New(), uuid.New()},
+		IsPrivate: true,
+	}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+
+	msg := &Message{
+		FromAccountId: chat.Members[0],
+		Text:          "original",
+		CreatedAt:     time.Now().UTC().Round(time.Second),
+	}
+	assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+	assert.NotEqual(t, uuid.Nil, msg.Id)
+
+	t.Run("get message", func(t *testing.T) {
+		stored, err := storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, stored)
+
+		_, err = storage.GetMessage(ctx, uuid.New(), msg.Id)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+	})
+	t.Run("update message", func(t *testing.T) {
+		editedAt := time.Now().UTC().Round(time.Second)
+		edited := msg.Clone()
+		edited.Edits = []*MessageEdit{{Text: msg.Text, EditedAt: msg.CreatedAt}}
+		edited.Text = "edited"
+		edited.EditedAt = &editedAt
+		assert.Nil(t, storage.UpdateMessage(ctx, edited))
+
+		stored, err := storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, edited, stored)
+
+		unknown := msg.Clone()
+		unknown.Id = uuid.New()
+		assert.ErrorIs(t, storage.UpdateMessage(ctx, unknown), ErrMessageNotFound)
+	})
+	t.Run("hide message", func(t *testing.T) {
+		assert.Nil(t, storage.HideMessage(ctx, chat.Id, msg.Id, chat.Members[1]))
+		// Hiding twice is fine.
+		assert.Nil(t, storage.HideMessage(ctx, chat.Id, msg.Id, chat.Members[1]))
+
+		messages, err := storage.GetMessages(ctx, chat.Id, chat.Members[1], 0, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 0)
+
+		messages, err = storage.GetMessages(ctx, chat.Id, chat.Members[0], 0, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 1)
+
+		assert.ErrorIs(t, storage.HideMessage(ctx, chat.Id, uuid.New(), chat.Members[1]), ErrMessageNotFound)
+	})
+	t.Run("rich content", func(t *testing.T) {
+		mentioned := chat.Members[1]
+		rich := &Message{
+			FromAccountId: chat.Members[0],
+			Text:          "hey look https://example.com",
+			CreatedAt:     time.Now().UTC().Round(time.Second),
+			Attachments: []*Attachment{{
+				Type:        AttachmentImage,
+				MediaId:     uuid.New(),
+				URL:         "http://media.test/media/1/original.png",
+				ContentType: "image/png",
+				Size:        1024,
+				Width:       64,
+				Height:      64,
+				Thumbnails:  map[string]string{"small": "http://media.test/media/1/small.png"},
+			}},
+			Entities: []*Entity{
+				{Type: EntityMention, Offset: 0, Length: 3, AccountId: &mentioned},
+				{Type: EntityBold, Offset: 4, Length: 4},
+			},
+			Preview: &LinkPreview{URL: "https://example.com", Title: "Example"},
+		}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, rich))
+
+		stored, err := storage.GetMessage(ctx, chat.Id, rich.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, rich, stored)
+
+		deleted := rich.Clone()
+		deleted.Text = ""
+		deleted.Attachments = nil
+		deleted.Entities = nil
+		deleted.Preview = nil
+		deleted.Deleted = true
+		assert.Nil(t, storage.UpdateMessage(ctx, deleted))
+
+		stored, err = storage.GetMessage(ctx, chat.Id, rich.Id)
+		assert.Nil(t, err)
+		assert.Empty(t, stored.Attachments)
+		assert.Empty(t, stored.Entities)
+		assert.Nil(t, stored.Preview)
+	})
+	t.Run("ciphertexts", func(t *testing.T) {
+		msg := &Message{
+			FromAccountId: chat.Members[0],
+			CreatedAt:     time.Now().UTC().Round(time.Second),
+			Ciphertexts: []*Ciphertext{
+				{AccountId: chat.Members[1], DeviceId: "phone", Type: CiphertextPreKey, Body: "q83vEjRWeJA="},
+				{AccountId: chat.Members[0], DeviceId: "laptop", Type: CiphertextMessage, Body: "3q2+7wAAAAE="},
+			},
+		}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+
+		stored, err := storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, msg.Ciphertexts, stored.Ciphertexts)
+
+		stored.Ciphertexts = nil
+		stored.Deleted = true
+		assert.Nil(t, storage.UpdateMessage(ctx, stored))
+		stored, err = storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Empty(t, stored.Ciphertexts)
+	})
+	t.Run("reactions", func(t *testing.T) {
+		msg := &Message{FromAccountId: chat.Members[0], Text: "react to me"}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+		like := &Reaction{Emoji: "👍", AccountId: chat.Members[1]}
+
+		added, err := storage.AddReaction(ctx, chat.Id, msg.Id, like)
+		assert.Nil(t, err)
+		assert.True(t, added)
+		added, err = storage.AddReaction(ctx, chat.Id, msg.Id, like)
+		assert.Nil(t, err)
+		assert.False(t, added)
+		_, err = storage.AddReaction(ctx, chat.Id, msg.Id, &Reaction{Emoji: "🎉", AccountId: chat.Members[1]})
+		assert.Nil(t, err)
+		_, err = storage.AddReaction(ctx, chat.Id, uuid.New(), like)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+
+		removed, err := storage.RemoveReaction(ctx, chat.Id, msg.Id, like)
+		assert.Nil(t, err)
+		assert.True(t, removed)
+		removed, err = storage.RemoveReaction(ctx, chat.Id, msg.Id, like)
+		assert.Nil(t, err)
+		assert.False(t, removed)
+
+		stored, err := storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, []*Reaction{{Emoji: "🎉", AccountId: chat.Members[1]}}, stored.ReactedBy)
+
+		// Edits keep the reactions, deleting drops them.
+		stored.Text = "edited"
+		assert.Nil(t, storage.UpdateMessage(ctx, stored))
+		stored, err = storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Len(t, stored.ReactedBy, 1)
+
+		stored.Deleted = true
+		assert.Nil(t, storage.UpdateMessage(ctx, stored))
+		stored, err = storage.GetMessage(ctx, chat.Id, msg.Id)
+		assert.Nil(t, err)
+		assert.Empty(t, stored.ReactedBy)
+	})
+	t.Run("duplicate client id", func(t *testing.T) {
+		first := &Message{FromAccountId: chat.Members[0], Text: "once", ClientId: "c1"}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, first))
+
+		again := &Message{FromAccountId: chat.Members[0], Text: "once", ClientId: "c1"}
+		assert.ErrorIs(t, storage.InsertMessage(ctx, chat.Id, again), ErrDuplicateMessage)
+
+		// Client ids are only unique per author.
+		other := &Message{FromAccountId: chat.Members[1], Text: "once", ClientId: "c1"}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, other))
+
+		stored, err := storage.GetMessageByClientId(ctx, chat.Id, chat.Members[0], "c1")
+		assert.Nil(t, err)
+		assert.Equal(t, first.Id, stored.Id)
+
+		_, err = storage.GetMessageByClientId(ctx, chat.Id, chat.Members[0], "c2")
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+	})
+}
+
+// testDeliveryCursors is run against every Storage implementation.
+func testDeliveryCursors(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	accountId := uuid.New()
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{accountId, uuid.New()}}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, &Message{FromAccountId: chat.Members[1], Text: fmt.Sprint(i)}))
+	}
+
+	t.Run("account chats", func(t *testing.T) {
+		chats, err := storage.GetAccountChats(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Len(t, chats, 1)
+		assert.Equal(t, chat.Id, chats[0].Id)
+		assert.Equal(t, int64(3), chats[0].LastSeq)
+	})
+	t.Run("messages after", func(t *testing.T) {
+		messages, err := storage.GetMessagesAfter(ctx, chat.Id, accountId, 1, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, int64(2), messages[0].Seq)
+		assert.Equal(t, int64(3), messages[1].Seq)
+
+		messages, err = storage.GetMessagesAfter(ctx, chat.Id, accountId, 0, 1)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 1)
+		assert.Equal(t, int64(1), messages[0].Seq)
+	})
+	t.Run("cursors", func(t *testing.T) {
+		_, err := storage.GetDeliveryCursors(ctx, accountId, "phone")
+		assert.ErrorIs(t, err, ErrCursorsNotFound)
+
+		assert.Nil(t, storage.InsertDeliveryCursors(ctx, accountId, "phone", map[uuid.UUID]int64{chat.Id: 1}))
+		// Existing cursors are kept.
+		assert.Nil(t, storage.InsertDeliveryCursors(ctx, accountId, "phone", map[uuid.UUID]int64{chat.Id: 0}))
+
+		cursors, err := storage.GetDeliveryCursors(ctx, accountId, "phone")
+		assert.Nil(t, err)
+		assert.Equal(t, map[uuid.UUID]int64{chat.Id: 1}, cursors)
+
+		otherChat := uuid.New()
+		assert.Nil(t, storage.UpdateDeliveryCursor(ctx, accountId, "phone", chat.Id, 3))
+		assert.Nil(t, storage.UpdateDeliveryCursor(ctx, accountId, "phone", chat.Id, 2))
+		assert.Nil(t, storage.UpdateDeliveryCursor(ctx, accountId, "phone", otherChat, 5))
+
+		cursors, err = storage.GetDeliveryCursors(ctx, accountId, "phone")
+		assert.Nil(t, err)
+		assert.Equal(t, map[uuid.UUID]int64{chat.Id: 3, otherChat: 5}, cursors)
+
+		// Devices have their own cursors.
+		_, err = storage.GetDeliveryCursors(ctx, accountId, "laptop")
+		assert.ErrorIs(t, err, ErrCursorsNotFound)
+	})
+}
+
+// testReceipts is run against every Storage implementation.
+func testReceipts(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	reader, sender := uuid.New(), uuid.New()
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{reader, sender}}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+	for _, from := range []uuid.UUID{sender, reader, sender, sender, sender} {
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, &Message{FromAccountId: from, Text: "hi"}))
+	}
+
+	t.Run("markers only move forward", func(t *testing.T) {
+		moved, err := storage.MarkDelivered(ctx, chat.Id, reader, 3)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+		moved, err = storage.MarkDelivered(ctx, chat.Id, reader, 2)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+
+		moved, err = storage.MarkRead(ctx, chat.Id, reader, 2)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+		moved, err = storage.MarkRead(ctx, chat.Id, reader, 2)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+
+		receipts, err := storage.GetReceipts(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, []*Receipt{{ChatId: chat.Id, AccountId: reader, LastReadSeq: 2, LastDeliveredSeq: 3}}, receipts)
+	})
+	t.Run("reading delivers", func(t *testing.T) {
+		moved, err := storage.MarkRead(ctx, chat.Id, reader, 4)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+		moved, err = storage.MarkDelivered(ctx, chat.Id, reader, 4)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+
+		receipts, err := storage.GetAccountReceipts(ctx, reader)
+		assert.Nil(t, err)
+		assert.Equal(t, []*Receipt{{ChatId: chat.Id, AccountId: reader, LastReadSeq: 4, LastDeliveredSeq: 4}}, receipts)
+
+		receipts, err = storage.GetAccountReceipts(ctx, sender)
+		assert.Nil(t, err)
+		assert.Empty(t, receipts)
+	})
+	t.Run("summaries", func(t *testing.T) {
+		unknown := uuid.New()
+		summaries, err := storage.GetChatSummaries(ctx, reader, []uuid.UUID{chat.Id, unknown})
+		assert.Nil(t, err)
+		assert.Len(t, summaries, 1)
+		summary := summaries[chat.Id]
+		assert.Equal(t, int64(4), summary.LastReadSeq)
+		assert.Equal(t, int64(1), summary.UnreadCount)
+		assert.Equal(t, int64(5), summary.LastMessage.Seq)
+
+		// Without a receipt everything from the others is unread.
+		summaries, err = storage.GetChatSummaries(ctx, sender, []uuid.UUID{chat.Id})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), summaries[chat.Id].LastReadSeq)
+		assert.Equal(t, int64(1), summaries[chat.Id].UnreadCount)
+	})
+	t.Run("unread count", func(t *testing.T) {
+		// Deleted and hidden messages don't count.
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, &Message{FromAccountId: sender, Text: "hi"}))
+		messages, err := storage.GetMessages(ctx, chat.Id, reader, 0, 2)
+		assert.Nil(t, err)
+		messages[0].Deleted = true
+		assert.Nil(t, storage.UpdateMessage(ctx, messages[0]))
+		assert.Nil(t, storage.HideMessage(ctx, chat.Id, messages[1].Id, reader))
+
+		summaries, err := storage.GetChatSummaries(ctx, reader, []uuid.UUID{chat.Id})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), summaries[chat.Id].UnreadCount)
+		// The last message is the deleted one, the hidden one is skipped.
+		assert.Equal(t, int64(6), summaries[chat.Id].LastMessage.Seq)
+
+		assert.Nil(t, storage.HideMessage(ctx, chat.Id, messages[0].Id, reader))
+		summaries, err = storage.GetChatSummaries(ctx, reader, []uuid.UUID{chat.Id})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(4), summaries[chat.Id].LastMessage.Seq)
+	})
+}
+
+// testPresenceStorage is run against every Storage implementation.
+func testPresenceStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	accountId := uuid.New()
+
+	t.Run("privacy settings", func(t *testing.T) {
+		settings, err := storage.GetPrivacySettings(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Equal(t, VisibleToEveryone, settings.Presence)
+
+		assert.Nil(t, storage.UpdatePrivacySettings(ctx, &PrivacySettings{AccountId: accountId, Presence: VisibleToNobody}))
+		settings, err = storage.GetPrivacySettings(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Equal(t, &PrivacySettings{AccountId: accountId, Presence: VisibleToNobody, DirectMessages: DMFromEveryone}, settings)
+
+		assert.Nil(t, storage.UpdatePrivacySettings(ctx, &PrivacySettings{AccountId: accountId, Presence: VisibleToNobody, DirectMessages: DMFromMutuals}))
+		settings, err = storage.GetPrivacySettings(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Equal(t, DMFromMutuals, settings.DirectMessages)
+	})
+	t.Run("last seen", func(t *testing.T) {
+		lastSeen, err := storage.GetLastSeen(ctx, uuid.New())
+		assert.Nil(t, err)
+		assert.Nil(t, lastSeen)
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		assert.Nil(t, storage.UpdateLastSeen(ctx, accountId, now))
+		assert.Nil(t, storage.UpdateLastSeen(ctx, accountId, now.Add(-time.Minute)))
+		lastSeen, err = storage.GetLastSeen(ctx, accountId)
+		assert.Nil(t, err)
+		assert.True(t, now.Equal(*lastSeen))
+
+		// Last seen doesn't touch the privacy settings.
+		settings, err := storage.GetPrivacySettings(ctx, accountId)
+		assert.Nil(t, err)
+		assert.Equal(t, VisibleToNobody, settings.Presence)
+	})
+}
+
+// testGroupStorage is run against every Storage implementation.
+func testGroupStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	owner, admin, member := uuid.New(), uuid.New(), uuid.New()
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{member, owner}, OwnerId: owner, Title: "group"}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+
+	t.Run("chat info", func(t *testing.T) {
+		assert.Nil(t, storage.UpdateChatInfo(ctx, &Chat{Id: chat.Id, Title: "renamed", Description: "about"}))
+		got, err := storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, "renamed", got.Title)
+		assert.Equal(t, "about", got.Description)
+		// Only the metadata changes.
+		assert.Equal(t, owner, got.OwnerId)
+		assert.ElementsMatch(t, []uuid.UUID{member, owner}, got.Members)
+
+		assert.ErrorIs(t, storage.UpdateChatInfo(ctx, &Chat{Id: uuid.New()}), ErrChatNotFound)
+	})
+	t.Run("membership", func(t *testing.T) {
+		assert.Nil(t, storage.AddMembers(ctx, chat.Id, []uuid.UUID{admin}))
+		assert.Nil(t, storage.SetAdmin(ctx, chat.Id, admin, true))
+		got, err := storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []uuid.UUID{member, owner, admin}, got.Members)
+		assert.Equal(t, RoleAdmin, got.RoleOf(admin))
+
+		// Removing an admin takes the role away too.
+		assert.Nil(t, storage.RemoveMember(ctx, chat.Id, admin))
+		got, err = storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []uuid.UUID{member, owner}, got.Members)
+		assert.Empty(t, got.Admins)
+
+		assert.ErrorIs(t, storage.AddMembers(ctx, uuid.New(), []uuid.UUID{admin}), ErrChatNotFound)
+	})
+	t.Run("ownership", func(t *testing.T) {
+		assert.Nil(t, storage.SetAdmin(ctx, chat.Id, member, true))
+		assert.Nil(t, storage.SetOwner(ctx, chat.Id, member))
+		got, err := storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, RoleOwner, got.RoleOf(member))
+		assert.Equal(t, RoleMember, got.RoleOf(owner))
+		assert.Empty(t, got.Admins)
+	})
+	t.Run("invites", func(t *testing.T) {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		invite := &Invite{Code: uuid.NewString(), ChatId: chat.Id, CreatedBy: owner, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		assert.Nil(t, storage.InsertInvite(ctx, invite))
+
+		got, err := storage.GetInvite(ctx, invite.Code)
+		assert.Nil(t, err)
+		assert.Equal(t, invite, got)
+		invites, err := storage.GetChatInvites(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, []*Invite{invite}, invites)
+
+		// Invites are only revoked through their own chat.
+		assert.ErrorIs(t, storage.DeleteInvite(ctx, uuid.New(), invite.Code), ErrInviteNotFound)
+		assert.Nil(t, storage.DeleteInvite(ctx, chat.Id, invite.Code))
+		_, err = storage.GetInvite(ctx, invite.Code)
+		assert.ErrorIs(t, err, ErrInviteNotFound)
+	})
+}
+
+// testDirectChats is run against every Storage implementation.
+func testDirectChats(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	a, b := uuid.New(), uuid.New()
+
+	_, err := storage.GetDirectChat(ctx, a, b, false)
+	assert.ErrorIs(t, err, ErrChatNotFound)
+
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{a, b}, IsPrivate: true}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+
+	t.Run("either order finds it", func(t *testing.T) {
+		for _, pair := range [][2]uuid.UUID{{a, b}, {b, a}} {
+			got, err := storage.GetDirectChat(ctx, pair[0], pair[1], false)
+			assert.Nil(t, err)
+			assert.Equal(t, chat.Id, got.Id)
+		}
+	})
+	t.Run("duplicates are rejected", func(t *testing.T) {
+		err := storage.InsertChat(ctx, &Chat{Id: uuid.New(), Members: []uuid.UUID{b, a}, IsPrivate: true})
+		assert.ErrorIs(t, err, ErrChatExists)
+		err = storage.InsertChat(ctx, &Chat{Id: chat.Id, Members: []uuid.UUID{a, uuid.New()}, IsPrivate: true})
+		assert.ErrorIs(t, err, ErrChatExists)
+	})
+	t.Run("message requests", func(t *testing.T) {
+		request := &MessageRequest{From: a, To: b, Status: RequestPending, CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+		assert.Nil(t, storage.UpdateMessageRequest(ctx, chat.Id, request))
+		got, err := storage.GetDirectChat(ctx, b, a, false)
+		assert.Nil(t, err)
+		assert.Equal(t, request, got.Request)
+		assert.True(t, got.IsRequestTo(b))
+		assert.False(t, got.IsRequestTo(a))
+
+		assert.Nil(t, storage.UpdateMessageRequest(ctx, chat.Id, nil))
+		got, err = storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Nil(t, got.Request)
+	})
+	t.Run("groups may share members", func(t *testing.T) {
+		assert.Nil(t, storage.InsertChat(ctx, &Chat{Id: uuid.New(), Members: []uuid.UUID{a, b}}))
+		assert.Nil(t, storage.InsertChat(ctx, &Chat{Id: uuid.New(), Members: []uuid.UUID{a, b}}))
+	})
+	t.Run("encrypted chats are separate", func(t *testing.T) {
+		_, err := storage.GetDirectChat(ctx, a, b, true)
+		assert.ErrorIs(t, err, ErrChatNotFound)
+
+		encrypted := &Chat{Id: uuid.New(), Members: []uuid.UUID{a, b}, IsPrivate: true, Encrypted: true}
+		assert.Nil(t, storage.InsertChat(ctx, encrypted))
+		err = storage.InsertChat(ctx, &Chat{Id: uuid.New(), Members: []uuid.UUID{b, a}, IsPrivate: true, Encrypted: true})
+		assert.ErrorIs(t, err, ErrChatExists)
+
+		got, err := storage.GetDirectChat(ctx, b, a, true)
+		assert.Nil(t, err)
+		assert.Equal(t, encrypted.Id, got.Id)
+		assert.True(t, got.Encrypted)
+		got, err = storage.GetDirectChat(ctx, b, a, false)
+		assert.Nil(t, err)
+		assert.Equal(t, chat.Id, got.Id)
+	})
+}
+
+// testDeviceKeys is run against every Storage implementation.
+func testDeviceKeys(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	account := uuid.New()
+	keys := &DeviceKeys{
+		AccountId:    account,
+		DeviceId:     "phone",
+		IdentityKey:  "identity",
+		SignedPreKey: &SignedPreKey{KeyId: 1, PublicKey: "signed", Signature: "signature"},
+		UpdatedAt:    time.Now().UTC().Round(time.Second),
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		devices, err := storage.GetDeviceKeys(ctx, account)
+		assert.Nil(t, err)
+		assert.Empty(t, devices)
+
+		assert.Nil(t, storage.UpsertDeviceKeys(ctx, keys))
+		laptop := *keys
+		laptop.DeviceId = "laptop"
+		assert.Nil(t, storage.UpsertDeviceKeys(ctx, &laptop))
+		// Publishing again replaces the keys.
+		keys.SignedPreKey = &SignedPreKey{KeyId: 2, PublicKey: "rotated", Signature: "signature"}
+		assert.Nil(t, storage.UpsertDeviceKeys(ctx, keys))
+
+		devices, err = storage.GetDeviceKeys(ctx, account)
+		assert.Nil(t, err)
+		assert.Equal(t, []*DeviceKeys{&laptop, keys}, devices)
+	})
+	t.Run("prekeys", func(t *testing.T) {
+		prekeys := []*PreKey{{KeyId: 2, PublicKey: "two"}, {KeyId: 1, PublicKey: "one"}}
+		assert.Nil(t, storage.AddPreKeys(ctx, account, "phone", prekeys))
+		// Duplicates are skipped, the new ones still added.
+		assert.Nil(t, storage.AddPreKeys(ctx, account, "phone", []*PreKey{{KeyId: 1, PublicKey: "again"}, {KeyId: 3, PublicKey: "three"}}))
+		count, err := storage.CountPreKeys(ctx, account, "phone")
+		assert.Nil(t, err)
+		assert.Equal(t, 3, count)
+		count, err = storage.CountPreKeys(ctx, account, "laptop")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+
+		for _, want := range []*PreKey{{KeyId: 1, PublicKey: "one"}, {KeyId: 2, PublicKey: "two"}, {KeyId: 3, PublicKey: "three"}} {
+			prekey, err := storage.ClaimPreKey(ctx, account, "phone")
+			assert.Nil(t, err)
+			assert.Equal(t, want, prekey)
+		}
+		_, err = storage.ClaimPreKey(ctx, account, "phone")
+		assert.ErrorIs(t, err, ErrNoPreKeys)
+	})
+	t.Run("delete", func(t *testing.T) {
+		assert.Nil(t, storage.AddPreKeys(ctx, account, "phone", []*PreKey{{KeyId: 4, PublicKey: "four"}}))
+		assert.Nil(t, storage.DeleteDeviceKeys(ctx, account, "phone"))
+
+		devices, err := storage.GetDeviceKeys(ctx, account)
+		assert.Nil(t, err)
+		assert.Len(t, devices, 1)
+		assert.Equal(t, "laptop", devices[0].DeviceId)
+		count, err := storage.CountPreKeys(ctx, account, "phone")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
+}
+
+// testSearch is run against every Storage implementation.
+func testSearch(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	viewer := uuid.New()
+	chats := []*Chat{
+		{Id: uuid.New(), Members: []uuid.UUID{viewer, uuid.New()}},
+		{Id: uuid.New(), Members: []uuid.UUID{viewer, uuid.New()}},
+	}
+	other := &Chat{Id: uuid.New(), Members: []uuid.UUID{uuid.New(), uuid.New()}}
+	for _, chat := range append(chats, other) {
+		assert.Nil(t, storage.InsertChat(ctx, chat))
+	}
+	start := time.Now().UTC().Round(time.Second)
+	send := func(chat *Chat, text string, minutes int) *Message {
+		msg := &Message{FromAccountId: chat.Members[1], Text: text, CreatedAt: start.Add(time.Duration(minutes) * time.Minute)}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+		return msg
+	}
+	lunch := send(chats[0], "Lunch on Friday?", 1)
+	pizza := send(chats[1], "pizza for lunch", 2)
+	send(chats[1], "dinner on friday", 3)
+	send(other, "lunch with someone else", 4)
+	hidden := send(chats[0], "lunch plans", 5)
+	assert.Nil(t, storage.HideMessage(ctx, chats[0].Id, hidden.Id, viewer))
+	ids := func(messages []*Message) []uuid.UUID {
+		ids := []uuid.UUID{}
+		for _, msg := range messages {
+			ids = append(ids, msg.Id)
+		}
+		return ids
+	}
+	chatIds := []uuid.UUID{chats[0].Id, chats[1].Id}
+
+	t.Run("every term", func(t *testing.T) {
+		messages, err := storage.SearchMessages(ctx, chatIds, viewer, []string{"lunch"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []uuid.UUID{pizza.Id, lunch.Id}, ids(messages))
+
+		messages, err = storage.SearchMessages(ctx, chatIds, viewer, []string{"lunch", "friday"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []uuid.UUID{lunch.Id}, ids(messages))
+
+		messages, err = storage.SearchMessages(ctx, chatIds, viewer, []string{"breakfast"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Empty(t, messages)
+	})
+	t.Run("scoped to chats", func(t *testing.T) {
+		messages, err := storage.SearchMessages(ctx, chatIds[1:], viewer, []string{"lunch"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []uuid.UUID{pizza.Id}, ids(messages))
+	})
+	t.Run("pages", func(t *testing.T) {
+		messages, err := storage.SearchMessages(ctx, chatIds, viewer, []string{"lunch"}, 1, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, []uuid.UUID{lunch.Id}, ids(messages))
+		messages, err = storage.SearchMessages(ctx, chatIds, viewer, []string{"lunch"}, 2, 1)
+		assert.Nil(t, err)
+		assert.Empty(t, messages)
+	})
+	t.Run("edits are reindexed", func(t *testing.T) {
+		edited := lunch.Clone()
+		edited.Text = "Brunch on Saturday?"
+		assert.Nil(t, storage.UpdateMessage(ctx, edited))
+
+		messages, err := storage.SearchMessages(ctx, chatIds, viewer, []string{"friday"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 1)
+		assert.NotEqual(t, lunch.Id, messages[0].Id)
+		messages, err = storage.SearchMessages(ctx, chatIds, viewer, []string{"brunch"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []uuid.UUID{lunch.Id}, ids(messages))
+	})
+}
+
+// testRetention is run against every Storage implementation.
+func testRetention(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	chat := &Chat{Id: uuid.New(), Members: []uuid.UUID{uuid.New(), uuid.New()}}
+	assert.Nil(t, storage.InsertChat(ctx, chat))
+	now := time.Now().UTC().Round(time.Second)
+	send := func(text string, age time.Duration, expiresIn time.Duration) *Message {
+		msg := &Message{FromAccountId: chat.Members[0], Text: text, CreatedAt: now.Add(-age)}
+		if expiresIn != 0 {
+			expiresAt := now.Add(expiresIn)
+			msg.ExpiresAt = &expiresAt
+		}
+		assert.Nil(t, storage.InsertMessage(ctx, chat.Id, msg))
+		return msg
+	}
+
+	t.Run("settings", func(t *testing.T) {
+		chat.Retention = 86400
+		chat.DisappearAfter = 3600
+		assert.Nil(t, storage.UpdateRetention(ctx, chat))
+		stored, err := storage.GetChat(ctx, chat.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(86400), stored.Retention)
+		assert.Equal(t, int64(3600), stored.DisappearAfter)
+
+		chats, err := storage.GetRetentionChats(ctx)
+		assert.Nil(t, err)
+		found := false
+		for _, retained := range chats {
+			found = found || retained.Id == chat.Id
+		}
+		assert.True(t, found)
+	})
+	t.Run("disappearing", func(t *testing.T) {
+		gone := send("gone soon", 0, -time.Second)
+		kept := send("not yet", 0, time.Hour)
+
+		deleted, err := storage.DeleteExpiredMessages(ctx, now)
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, deleted, 1)
+		_, err = storage.GetMessage(ctx, chat.Id, gone.Id)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+		_, err = storage.GetMessage(ctx, chat.Id, kept.Id)
+		assert.Nil(t, err)
+	})
+	t.Run("retention", func(t *testing.T) {
+		old := send("ancient history", 48*time.Hour, 0)
+		recent := send("fresh", time.Hour, 0)
+
+		deleted, err := storage.DeleteMessagesBefore(ctx, chat.Id, now.Add(-24*time.Hour))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, deleted)
+		_, err = storage.GetMessage(ctx, chat.Id, old.Id)
+		assert.ErrorIs(t, err, ErrMessageNotFound)
+		_, err = storage.GetMessage(ctx, chat.Id, recent.Id)
+		assert.Nil(t, err)
+
+		// Deleted messages can't be found anymore.
+		found, err := storage.SearchMessages(ctx, []uuid.UUID{chat.Id}, uuid.Nil, []string{"ancient"}, 0, 10)
+		assert.Nil(t, err)
+		assert.Empty(t, found)
+	})
+}
+
+func testScheduledMessages(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	accountId, chatId := uuid.New(), uuid.New()
+	now := time.Now().UTC().Round(time.Second)
+	schedule := func(text string, sendAt time.Time) *ScheduledMessage {
+		msg := &ScheduledMessage{
+			Id:        uuid.New(),
+			ChatId:    chatId,
+			AccountId: accountId,
+			Text:      text,
+			SendAt:    sendAt,
+			Status:    ScheduledPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		assert.Nil(t, storage.InsertScheduledMessage(ctx, msg))
+		return msg
+	}
+
+	later := schedule("later", now.Add(time.Hour))
+	due := schedule("due", now.Add(-time.Minute))
+	overdue := schedule("overdue", now.Add(-time.Hour))
+
+	t.Run("listing", func(t *testing.T) {
+		messages, err := storage.GetScheduledMessages(ctx, accountId, uuid.Nil)
+		assert.Nil(t, err)
+		texts := []string{}
+		for _, msg := range messages {
+			texts = append(texts, msg.Text)
+		}
+		assert.Equal(t, []string{"overdue", "due", "later"}, texts)
+
+		messages, err = storage.GetScheduledMessages(ctx, accountId, uuid.New())
+		assert.Nil(t, err)
+		assert.Empty(t, messages)
+		messages, err = storage.GetScheduledMessages(ctx, uuid.New(), chatId)
+		assert.Nil(t, err)
+		assert.Empty(t, messages)
+
+		_, err = storage.GetScheduledMessage(ctx, uuid.New())
+		assert.ErrorIs(t, err, ErrScheduledNotFound)
+	})
+	t.Run("claims", func(t *testing.T) {
+		claimed, err := storage.ClaimScheduledMessages(ctx, "a", now, now.Add(time.Minute), 1)
+		assert.Nil(t, err)
+		if assert.Len(t, claimed, 1) {
+			assert.Equal(t, overdue.Id, claimed[0].Id)
+			assert.Equal(t, "a", claimed[0].ClaimedBy)
+			assert.Equal(t, 1, claimed[0].Attempts)
+		}
+		claimed, err = storage.ClaimScheduledMessages(ctx, "b", now, now.Add(time.Minute), 10)
+		assert.Nil(t, err)
+		if assert.Len(t, claimed, 1) {
+			assert.Equal(t, due.Id, claimed[0].Id)
+		}
+
+		// Everything due is claimed.
+		claimed, err = storage.ClaimScheduledMessages(ctx, "c", now, now.Add(time.Minute), 10)
+		assert.Nil(t, err)
+		assert.Empty(t, claimed)
+
+		// Claimed messages can't be changed.
+		assert.ErrorIs(t, storage.DeleteScheduledMessage(ctx, due.Id, now), ErrScheduledClaimed)
+		assert.ErrorIs(t, storage.UpdateScheduledMessage(ctx, due, now), ErrScheduledClaimed)
+
+		// Once the claim runs out another owner takes over.
+		claimed, err = storage.ClaimScheduledMessages(ctx, "c", now.Add(time.Minute), now.Add(2*time.Minute), 10)
+		assert.Nil(t, err)
+		assert.Len(t, claimed, 2)
+	})
+	t.Run("release", func(t *testing.T) {
+		// The claim was taken over, nothing changes.
+		lost := *overdue
+		lost.ClaimedBy = "a"
+		lost.Status = ScheduledSent
+		assert.Nil(t, storage.ReleaseScheduledMessage(ctx, &lost))
+		_, err := storage.GetScheduledMessage(ctx, overdue.Id)
+		assert.Nil(t, err)
+
+		sent := *overdue
+		sent.ClaimedBy = "c"
+		sent.Status = ScheduledSent
+		assert.Nil(t, storage.ReleaseScheduledMessage(ctx, &sent))
+		_, err = storage.GetScheduledMessage(ctx, overdue.Id)
+		assert.ErrorIs(t, err, ErrScheduledNotFound)
+
+		failed := *due
+		failed.ClaimedBy = "c"
+		failed.Status = ScheduledFailed
+		failed.Error = "chat not found"
+		assert.Nil(t, storage.ReleaseScheduledMessage(ctx, &failed))
+		stored, err := storage.GetScheduledMessage(ctx, due.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, ScheduledFailed, stored.Status)
+		assert.Equal(t, "chat not found", stored.Error)
+		assert.Nil(t, stored.ClaimedUntil)
+
+		// Failed messages aren't claimed again.
+		claimed, err := storage.ClaimScheduledMessages(ctx, "a", now.Add(time.Minute), now.Add(2*time.Minute), 10)
+		assert.Nil(t, err)
+		assert.Empty(t, claimed)
+	})
+	t.Run("update", func(t *testing.T) {
+		due.Text = "retry"
+		due.Status = ScheduledPending
+		due.Error = ""
+		assert.Nil(t, storage.UpdateScheduledMessage(ctx, due, now.Add(time.Minute)))
+		stored, err := storage.GetScheduledMessage(ctx, due.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, "retry", stored.Text)
+		assert.Equal(t, ScheduledPending, stored.Status)
+		assert.Equal(t, 0, stored.Attempts)
+
+		unknown := *due
+		unknown.Id = uuid.New()
+		assert.ErrorIs(t, storage.UpdateScheduledMessage(ctx, &unknown, now), ErrScheduledNotFound)
+	})
+	t.Run("delete", func(t *testing.T) {
+		assert.Nil(t, storage.DeleteScheduledMessage(ctx, later.Id, now))
+		assert.ErrorIs(t, storage.DeleteScheduledMessage(ctx, later.Id, now), ErrScheduledNotFound)
+	})
+}
+
+func testDrafts(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	accountId := uuid.New()
+	now := time.Now().UTC().Round(time.Second)
+	first := &Draft{ChatId: uuid.New(), AccountId: accountId, Text: "first", UpdatedAt: now.Add(-time.Minute)}
+	second := &Draft{ChatId: uuid.New(), AccountId: accountId, Text: "second", UpdatedAt: now}
+	assert.Nil(t, storage.SaveDraft(ctx, first))
+	assert.Nil(t, storage.SaveDraft(ctx, second))
+	assert.Nil(t, storage.SaveDraft(ctx, &Draft{ChatId: first.ChatId, AccountId: uuid.New(), Text: "other", UpdatedAt: now}))
+
+	drafts, err := storage.GetDrafts(ctx, accountId)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Draft{second, first}, drafts)
+
+	first.Text = "first, changed"
+	first.UpdatedAt = now.Add(time.Minute)
+	assert.Nil(t, storage.SaveDraft(ctx, first))
+	assert.Nil(t, storage.DeleteDraft(ctx, accountId, second.ChatId))
+	drafts, err = storage.GetDrafts(ctx, accountId)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Draft{first}, drafts)
+
+	// Deleting twice is fine.
+	assert.Nil(t, storage.DeleteDraft(ctx, accountId, second.ChatId))
+}
+
+func testSocketTickets(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Second)
+	ticket := &SocketTicket{Id: uuid.NewString(), AccountId: uuid.New(), SealedToken: []byte("sealed"), ExpiresAt: now.Add(time.Minute)}
+	expired := &SocketTicket{Id: uuid.NewString(), AccountId: uuid.New(), SealedToken: []byte("sealed"), ExpiresAt: now}
+	assert.Nil(t, storage.InsertSocketTicket(ctx, ticket))
+	assert.Nil(t, storage.InsertSocketTicket(ctx, expired))
+
+	claimed, err := storage.ClaimSocketTicket(ctx, ticket.Id, now)
+	assert.Nil(t, err)
+	assert.Equal(t, ticket, claimed)
+
+	// Tickets are claimed once.
+	_, err = storage.ClaimSocketTicket(ctx, ticket.Id, now)
+	assert.ErrorIs(t, err, ErrTicketNotFound)
+	_, err = storage.ClaimSocketTicket(ctx, expired.Id, now)
+	assert.ErrorIs(t, err, ErrTicketNotFound)
+	_, err = storage.ClaimSocketTicket(ctx, uuid.NewString(), now)
+	assert.ErrorIs(t, err, ErrTicketNotFound)
 }
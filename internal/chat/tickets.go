@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// socketTicketTTL is how long a socket ticket can be redeemed, enough to
+// open the socket right after asking for it.
+const socketTicketTTL = 30 * time.Second
+
+func socketTicketId(ticket string) string {
+	hash := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(hash[:])
+}
+
+// ticketCipher seals the token of the ticket with a key derived from the
+// ticket, which can't be told from its id.
+func ticketCipher(ticket string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("socket ticket key:" + ticket))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealToken(ticket, token string) ([]byte, error) {
+	aead, err := ticketCipher(ticket)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+func openToken(ticket string, sealed []byte) (string, error) {
+	aead, err := ticketCipher(ticket)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed token is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// IssueSocketTicket issues a single use ticket to open the socket as the
+// account. The connection keeps checking token, the ticket is only good as
+// long as the session it was issued in.
+func (s *chatService) IssueSocketTicket(ctx context.Context, accountId uuid.UUID, token string) (*SocketTicket, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	ticket := &SocketTicket{
+		Ticket:    base64.RawURLEncoding.EncodeToString(raw),
+		AccountId: accountId,
+		ExpiresAt: s.now().Add(socketTicketTTL),
+	}
+	ticket.Id = socketTicketId(ticket.Ticket)
+	sealed, err := sealToken(ticket.Ticket, token)
+	if err != nil {
+		return nil, err
+	}
+	ticket.SealedToken = sealed
+	if err := s.store.InsertSocketTicket(ctx, ticket); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// RedeemSocketTicket uses up the ticket, it fails with ErrTicketNotFound
+// when it was redeemed before or expired.
+func (s *chatService) RedeemSocketTicket(ctx context.Context, ticket string) (*SocketTicket, error) {
+	redeemed, err := s.store.ClaimSocketTicket(ctx, socketTicketId(ticket), s.clock())
+	if err != nil {
+		return nil, err
+	}
+	redeemed.Token, err = openToken(ticket, redeemed.SealedToken)
+	if err != nil {
+		return nil, err
+	}
+	return redeemed, nil
+}
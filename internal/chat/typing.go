@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// typingInterval is the least time between two typing events of the
+	// same member in a chat, clients refresh more often while typing.
+	typingInterval = 3 * time.Second
+	// typingTimeout is how long a member is typing without a refresh.
+	typingTimeout = 6 * time.Second
+)
+
+type typingKey struct {
+	accountId uuid.UUID
+	chatId    uuid.UUID
+}
+
+type typingState struct {
+	sentAt time.Time
+	timer  *time.Timer
+}
+
+// typingTracker rate limits the typing events of this node's connections
+// and stops the ones that aren't refreshed in time.
+type typingTracker struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	typing map[typingKey]*typingState
+}
+
+func newTypingTracker(interval, timeout time.Duration) *typingTracker {
+	return &typingTracker{
+		interval: interval,
+		timeout:  timeout,
+		typing:   map[typingKey]*typingState{},
+	}
+}
+
+// Start reports whether a typing event should be sent to the chat. expire
+// is called if the member doesn't refresh or stop typing within the
+// timeout.
+func (t *typingTracker) Start(accountId, chatId uuid.UUID, expire func()) bool {
+	key := typingKey{accountId: accountId, chatId: chatId}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state, found := t.typing[key]; found {
+		state.timer.Reset(t.timeout)
+		if now.Sub(state.sentAt) < t.interval {
+			return false
+		}
+		state.sentAt = now
+		return true
+	}
+
+	state := &typingState{sentAt: now}
+	state.timer = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		expired := t.typing[key] == state
+		if expired {
+			delete(t.typing, key)
+		}
+		t.mu.Unlock()
+
+		if expired {
+			expire()
+		}
+	})
+	t.typing[key] = state
+	return true
+}
+
+// Stop reports whether the member was typing, only then the others need to
+// be told.
+func (t *typingTracker) Stop(accountId, chatId uuid.UUID) bool {
+	key := typingKey{accountId: accountId, chatId: chatId}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, found := t.typing[key]
+	if !found {
+		return false
+	}
+	state.timer.Stop()
+	delete(t.typing, key)
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypingTracker(t *testing.T) {
+	accountId, chatId := uuid.New(), uuid.New()
+	noExpire := func() { t.Error("typing shouldn't expire") }
+
+	t.Run("starts are rate limited", func(t *testing.T) {
+		tracker := newTypingTracker(50*time.Millisecond, time.Hour)
+		assert.True(t, tracker.Start(accountId, chatId, noExpire))
+		assert.False(t, tracker.Start(accountId, chatId, noExpire))
+		// Other chats have their own limit.
+		assert.True(t, tracker.Start(accountId, uuid.New(), noExpire))
+
+		time.Sleep(60 * time.Millisecond)
+		assert.True(t, tracker.Start(accountId, chatId, noExpire))
+	})
+	t.Run("stop only when typing", func(t *testing.T) {
+		tracker := newTypingTracker(time.Hour, time.Hour)
+		assert.False(t, tracker.Stop(accountId, chatId))
+		assert.True(t, tracker.Start(accountId, chatId, noExpire))
+		assert.True(t, tracker.Stop(accountId, chatId))
+		assert.False(t, tracker.Stop(accountId, chatId))
+		// Starting again after a stop isn't limited.
+		assert.True(t, tracker.Start(accountId, chatId, noExpire))
+	})
+	t.Run("expires without refresh", func(t *testing.T) {
+		tracker := newTypingTracker(time.Hour, 50*time.Millisecond)
+		expired := make(chan struct{})
+		assert.True(t, tracker.Start(accountId, chatId, func() { close(expired) }))
+
+		// Refreshing pushes the expiry back.
+		time.Sleep(30 * time.Millisecond)
+		assert.False(t, tracker.Start(accountId, chatId, noExpire))
+		select {
+		case <-expired:
+			t.Fatal("refreshed typing expired")
+		case <-time.After(30 * time.Millisecond):
+		}
+
+		select {
+		case <-expired:
+		case <-time.After(time.Second):
+			t.Fatal("typing didn't expire")
+		}
+		assert.False(t, tracker.Stop(accountId, chatId))
+	})
+	t.Run("stopped typing doesn't expire", func(t *testing.T) {
+		tracker := newTypingTracker(time.Hour, 10*time.Millisecond)
+		assert.True(t, tracker.Start(accountId, chatId, noExpire))
+		assert.True(t, tracker.Stop(accountId, chatId))
+		time.Sleep(30 * time.Millisecond)
+	})
+}
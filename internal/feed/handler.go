@@ -26,9 +26,12 @@ func (s *APIServer) CreatePostHandler(ctx context.Context, w http.ResponseWriter
 	if err := postReq.Validate(); err != nil {
 		return err
 	}
+	if !web.IsMediaURL(s.MediaURL, postReq.Image) {
+		return web.Errorf(http.StatusBadRequest, "image must be uploaded to the media service")
+	}
 
 	post := NewPost(account.Id, postReq.Caption, postReq.Image, postReq.Tags, nil)
-	err = s.Storage.InsertPost(post)
+	err = s.Storage.InsertPost(ctx, post)
 	if err != nil {
 		return err
 	}
@@ -42,7 +45,7 @@ func (s *APIServer) DeletePostHandler(ctx context.Context, w http.ResponseWriter
 	}
 
 	account := ctx.Value("Account").(*types.Account)
-	err = s.Storage.DeleteUserPost(account.Id, postId)
+	err = s.Storage.DeleteUserPost(ctx, account.Id, postId)
 	if err != nil {
 		return err
 	}
@@ -52,7 +55,7 @@ func (s *APIServer) DeletePostHandler(ctx context.Context, w http.ResponseWriter
 
 func (s *APIServer) GetUserPostsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	account := ctx.Value("Account").(*types.Account)
-	posts, err := s.Storage.GetUserPosts(account.Id)
+	posts, err := s.Storage.GetUserPosts(ctx, account.Id)
 	if err != nil {
 		return err
 	}
@@ -71,7 +74,7 @@ func (s *APIServer) AddLikeHandler(ctx context.Context, w http.ResponseWriter, r
 	if err != nil {
 		return err
 	}
-	err = s.Storage.InsertLike(postId, account.Id)
+	err = s.Storage.InsertLike(ctx, postId, account.Id)
 	if err != nil {
 		return err
 	}
@@ -82,7 +85,7 @@ func (s *APIServer) GetPosts(ctx context.Context, w http.ResponseWriter, r *http
 	tagsStr := r.URL.Query().Get("tags")
 	if tagsStr != "" {
 		tags := strings.Split(tagsStr, ",")
-		posts, err := s.Storage.GetPostsByTags(tags)
+		posts, err := s.Storage.GetPostsByTags(ctx, tags)
 		if err != nil {
 			return err
 		}
@@ -92,7 +95,7 @@ func (s *APIServer) GetPosts(ctx context.Context, w http.ResponseWriter, r *http
 
 	accountId := r.URL.Query().Get("account_id")
 	if accountId != "" {
-		posts, err := s.Storage.GetUserPosts(accountId)
+		posts, err := s.Storage.GetUserPosts(ctx, accountId)
 		if err != nil {
 			return err
 		}
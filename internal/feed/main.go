@@ -2,21 +2,28 @@ package main
 
 import (
 	"log"
+	"time"
 
 	env "github.com/Netflix/go-env"
 	"github.com/go-playground/validator"
 	web "github.com/sina-am/social-media/common"
 	"github.com/sina-am/social-media/internal/auth/client"
+	"go.uber.org/zap"
 )
 
 type Settings struct {
-	HTTPAddress string `env:"HTTP_ADDRESS,default=:8080"`
-	AuthAddress string `env:"AUTH_ADDRESS,default=localhost:5000"`
-	MongoURI    string `env:"MONGO_URI,default=mongodb://localhost"`
-	MongoDBName string `env:"MONGO_DBNAME,default=feeds"`
+	HTTPAddress    string        `env:"HTTP_ADDRESS,default=:8080"`
+	AuthAddress    string        `env:"AUTH_ADDRESS,default=localhost:5000"`
+	MongoURI       string        `env:"MONGO_URI,default=mongodb://localhost"`
+	MongoDBName    string        `env:"MONGO_DBNAME,default=feeds"`
+	MediaURL       string        `env:"MEDIA_URL,default=http://localhost:8090/media"`
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT,default=10s"`
+	DrainTimeout   time.Duration `env:"DRAIN_TIMEOUT,default=15s"`
 }
 
 func main() {
+	logger, _ := zap.NewProduction()
+
 	var settings Settings
 	_, err := env.UnmarshalFromEnviron(&settings)
 	if err != nil {
@@ -29,12 +36,25 @@ func main() {
 		log.Fatal(err)
 	}
 
+	auth := client.NewGRPCClient(settings.AuthAddress)
+
+	lifecycle := web.NewLifecycle(logger, settings.DrainTimeout)
+	lifecycle.AddReadinessCheck("mongo", storage.Ping)
+	lifecycle.AddReadinessCheck("auth", auth.CheckHealthRPC)
+	lifecycle.OnShutdown("mongo", storage.Close)
+
 	apiServer := APIServer{
 		APIServer: web.APIServer{
-			Addr: settings.HTTPAddress,
+			Addr:           settings.HTTPAddress,
+			Logger:         logger,
+			RequestTimeout: settings.RequestTimeout,
+			Lifecycle:      lifecycle,
 		},
-		Auth:    client.NewGRPCClient(settings.AuthAddress),
-		Storage: storage,
+		Auth:     auth,
+		Storage:  storage,
+		MediaURL: settings.MediaURL,
+	}
+	if err := apiServer.Run(); err != nil {
+		log.Fatal(err)
 	}
-	log.Fatal(apiServer.Run())
 }
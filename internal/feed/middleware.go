@@ -23,6 +23,9 @@ func (s *APIServer) AuthenticationMiddleware(f web.APIFunc) web.APIFunc {
 		if err != nil {
 			return err
 		}
+		if scope := types.MethodScope(r.Method); !account.HasScope(scope) {
+			return web.Errorf(http.StatusForbidden, "token doesn't have the %q scope", scope)
+		}
 
 		ctx = context.WithValue(ctx, "Account", account)
 		return f(ctx, w, r)
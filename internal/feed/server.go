@@ -11,9 +11,10 @@ import (
 
 type APIServer struct {
 	web.APIServer
-	Auth    client.GRPCClient
-	Storage Storage
-	Addr    string
+	Auth     client.GRPCClient
+	Storage  Storage
+	Addr     string
+	MediaURL string
 }
 
 func WriteJSON(w http.ResponseWriter, statusCode int, v any) error {
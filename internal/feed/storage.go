@@ -10,14 +10,14 @@ import (
 )
 
 type Storage interface {
-	InsertPost(*Post) error
-	DeletePost(postId primitive.ObjectID) error
-	InsertLike(postId primitive.ObjectID, accountId string) error
+	InsertPost(ctx context.Context, post *Post) error
+	DeletePost(ctx context.Context, postId primitive.ObjectID) error
+	InsertLike(ctx context.Context, postId primitive.ObjectID, accountId string) error
 
-	DeleteUserPost(accountId string, postId primitive.ObjectID) error
-	GetUserPosts(accountId string) ([]*Post, error)
+	DeleteUserPost(ctx context.Context, accountId string, postId primitive.ObjectID) error
+	GetUserPosts(ctx context.Context, accountId string) ([]*Post, error)
 
-	GetPostsByTags(tags []string) ([]*Post, error)
+	GetPostsByTags(ctx context.Context, tags []string) ([]*Post, error)
 }
 
 type mongoStorage struct {
@@ -37,19 +37,19 @@ func NewMongoStorage(uri, database string) (*mongoStorage, error) {
 	}, nil
 }
 
-func (s *mongoStorage) InsertPost(p *Post) error {
-	_, err := s.getPostCollection().InsertOne(context.TODO(), p)
+func (s *mongoStorage) InsertPost(ctx context.Context, p *Post) error {
+	_, err := s.getPostCollection().InsertOne(ctx, p)
 	return err
 }
 
-func (s *mongoStorage) DeletePost(postId primitive.ObjectID) error {
-	_, err := s.getPostCollection().DeleteOne(context.TODO(), bson.M{"_id": postId})
+func (s *mongoStorage) DeletePost(ctx context.Context, postId primitive.ObjectID) error {
+	_, err := s.getPostCollection().DeleteOne(ctx, bson.M{"_id": postId})
 	return err
 }
 
-func (s *mongoStorage) InsertLike(postId primitive.ObjectID, accountId string) error {
+func (s *mongoStorage) InsertLike(ctx context.Context, postId primitive.ObjectID, accountId string) error {
 	_, err := s.getPostCollection().UpdateByID(
-		context.TODO(), postId,
+		ctx, postId,
 		bson.M{
 			"$push": bson.M{"likes": accountId},
 			"$inc":  bson.M{"total_likes": 1},
@@ -65,9 +65,9 @@ func (s *mongoStorage) InsertLike(postId primitive.ObjectID, accountId string) e
 	return err
 }
 
-func (s *mongoStorage) DeleteUserPost(accountId string, postId primitive.ObjectID) error {
+func (s *mongoStorage) DeleteUserPost(ctx context.Context, accountId string, postId primitive.ObjectID) error {
 	_, err := s.getPostCollection().DeleteOne(
-		context.TODO(),
+		ctx,
 		bson.M{
 			"$and": []bson.M{
 				{"_id": postId},
@@ -79,34 +79,36 @@ func (s *mongoStorage) DeleteUserPost(accountId string, postId primitive.ObjectI
 	return err
 }
 
-func (s *mongoStorage) GetPostsByTags(tags []string) ([]*Post, error) {
+func (s *mongoStorage) GetPostsByTags(ctx context.Context, tags []string) ([]*Post, error) {
 	coll := s.getPostCollection()
 	cur, err := coll.Find(
-		context.TODO(),
+		ctx,
 		bson.M{"tags": bson.M{"$all": tags}},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.fetchPosts(cur)
+	return s.fetchPosts(ctx, cur)
 }
 
-func (s *mongoStorage) GetUserPosts(AccountID string) ([]*Post, error) {
+func (s *mongoStorage) GetUserPosts(ctx context.Context, AccountID string) ([]*Post, error) {
 	cur, err := s.getPostCollection().Find(
-		context.TODO(),
+		ctx,
 		bson.M{"account_id": AccountID},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.fetchPosts(cur)
+	return s.fetchPosts(ctx, cur)
 }
 
-func (s *mongoStorage) fetchPosts(cur *mongo.Cursor) ([]*Post, error) {
+func (s *mongoStorage) fetchPosts(ctx context.Context, cur *mongo.Cursor) ([]*Post, error) {
+	defer cur.Close(ctx)
+
 	posts := []*Post{}
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 		post := &Post{}
 		if err := cur.Decode(post); err != nil {
 			return nil, err
@@ -114,7 +116,15 @@ func (s *mongoStorage) fetchPosts(cur *mongo.Cursor) ([]*Post, error) {
 		posts = append(posts, post)
 	}
 
-	return posts, nil
+	return posts, cur.Err()
+}
+
+func (s *mongoStorage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *mongoStorage) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
 }
 
 func (s *mongoStorage) getPostCollection() *mongo.Collection {
@@ -131,12 +141,12 @@ func NewMemoryStorage() (*memoryStorage, error) {
 	}, nil
 }
 
-func (s *memoryStorage) InsertPost(p *Post) error {
+func (s *memoryStorage) InsertPost(ctx context.Context, p *Post) error {
 	s.posts = append(s.posts, p)
 	return nil
 }
 
-func (s *memoryStorage) GetUserPosts(AccountID string) ([]*Post, error) {
+func (s *memoryStorage) GetUserPosts(ctx context.Context, AccountID string) ([]*Post, error) {
 	myPosts := []*Post{}
 	for _, post := range s.posts {
 		if post.AccountID == AccountID {
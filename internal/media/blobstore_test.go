@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal stand-in for an S3 compatible server. It only checks
+// that requests are signed, not that the signature is right.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		f.types[r.URL.Path] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		body, found := f.objects[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[r.URL.Path])
+		w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	t.Run("put and get", func(t *testing.T) {
+		err := store.Put(ctx, "media/a/original.png", "image/png", strings.NewReader("content"))
+		assert.Nil(t, err)
+
+		r, contentType, err := store.Get(ctx, "media/a/original.png")
+		assert.Nil(t, err)
+		defer r.Close()
+		body, _ := io.ReadAll(r)
+		assert.Equal(t, "content", string(body))
+		assert.Equal(t, "image/png", contentType)
+	})
+	t.Run("get missing blob", func(t *testing.T) {
+		_, _, err := store.Get(ctx, "media/missing")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+	})
+	t.Run("delete", func(t *testing.T) {
+		assert.Nil(t, store.Put(ctx, "media/b", "text/plain", strings.NewReader("b")))
+		assert.Nil(t, store.Delete(ctx, "media/b"))
+
+		_, _, err := store.Get(ctx, "media/b")
+		assert.ErrorIs(t, err, ErrBlobNotFound)
+	})
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	assert.Nil(t, err)
+	testBlobStore(t, store)
+
+	t.Run("reject keys outside of root", func(t *testing.T) {
+		err := store.Put(context.Background(), "../escape", "text/plain", strings.NewReader("x"))
+		assert.NotNil(t, err)
+	})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+
+	testBlobStore(t, NewS3BlobStore(server.URL, "us-east-1", "media", "access", "secret"))
+
+	t.Run("unauthorized", func(t *testing.T) {
+		store := NewS3BlobStore(server.URL, "us-east-1", "media", "other", "secret")
+		err := store.Put(context.Background(), "x", "text/plain", strings.NewReader("x"))
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxFileNameLength = 255
+
+var ErrEmptyFile = errors.New("file is empty")
+
+// fileContentType sniffs the content type of an uploaded file. Audio,
+// video, images and PDFs keep theirs, anything else (HTML among them)
+// becomes application/octet-stream so it's downloaded and never rendered.
+func fileContentType(data []byte) string {
+	contentType := http.DetectContentType(data)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	switch {
+	case strings.HasPrefix(contentType, "audio/"),
+		strings.HasPrefix(contentType, "video/"),
+		contentType == "application/ogg",
+		contentType == "application/pdf":
+		return contentType
+	case contentType == "image/jpeg", contentType == "image/png",
+		contentType == "image/gif", contentType == "image/webp":
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// fileName keeps only the base name of what the client called the file.
+func fileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || !utf8.ValidString(name) {
+		return ""
+	}
+	for len(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
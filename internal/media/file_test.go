@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileContentType(t *testing.T) {
+	assert.Equal(t, "audio/mpeg", fileContentType([]byte("ID3\x03\x00\x00\x00\x00\x00\x00")))
+	assert.Equal(t, "application/ogg", fileContentType([]byte("OggS\x00\x02\x00\x00")))
+	assert.Equal(t, "application/pdf", fileContentType([]byte("%PDF-1.7\n")))
+	assert.Equal(t, "application/octet-stream", fileContentType([]byte("<html><script>alert(1)</script></html>")))
+	assert.Equal(t, "application/octet-stream", fileContentType([]byte("plain notes")))
+}
+
+func TestFileName(t *testing.T) {
+	assert.Equal(t, "report.pdf", fileName("report.pdf"))
+	assert.Equal(t, "passwd", fileName("../../etc/passwd"))
+	assert.Equal(t, "notes.txt", fileName(`C:\Users\me\notes.txt`))
+	assert.Equal(t, "", fileName(""))
+	assert.Len(t, fileName(string(make([]byte, 300))), maxFileNameLength)
+}
+
+func TestUploadFile(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	assert.Nil(t, err)
+	service := NewMediaService(store, "http://media.test/media", testMaxImagePixels)
+	ctx := context.Background()
+
+	_, err = service.UploadFile(ctx, "owner", "empty.txt", nil)
+	assert.ErrorIs(t, err, ErrEmptyFile)
+
+	data := []byte("OggS\x00\x02\x00\x00 voice")
+	media, err := service.UploadFile(ctx, "owner", "voice.ogg", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://media.test/media/"+media.ID.String()+"/file", media.URL)
+	assert.Equal(t, "voice.ogg", media.Name)
+	assert.Equal(t, len(data), media.Size)
+
+	stored, err := service.GetMedia(ctx, media.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/ogg", stored.ContentType)
+	assert.Equal(t, "voice.ogg", stored.Name)
+
+	file, contentType, err := service.OpenFile(ctx, media.ID, "file")
+	assert.Nil(t, err)
+	defer file.Close()
+	body, _ := io.ReadAll(file)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "application/ogg", contentType)
+}
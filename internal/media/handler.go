@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	web "github.com/sina-am/social-media/common"
+	"github.com/sina-am/social-media/internal/auth/types"
+)
+
+func (s *APIServer) UploadImageHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account := ctx.Value("Account").(*types.Account)
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	defer r.Body.Close()
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid upload: %s", err.Error())
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid upload: %s", err.Error())
+	}
+
+	media, err := s.Service.UploadImage(ctx, account.Id, data)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, media)
+}
+
+func (s *APIServer) UploadFileHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account := ctx.Value("Account").(*types.Account)
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	defer r.Body.Close()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid upload: %s", err.Error())
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return web.Errorf(http.StatusBadRequest, "invalid upload: %s", err.Error())
+	}
+
+	media, err := s.Service.UploadFile(ctx, account.Id, header.Filename, data)
+	if err != nil {
+		if errors.Is(err, ErrEmptyFile) {
+			return web.Errorf(http.StatusBadRequest, err.Error())
+		}
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusCreated, media)
+}
+
+func (s *APIServer) GetMediaHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	mediaId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return web.Errorf(http.StatusNotFound, "media not found")
+	}
+
+	media, err := s.Service.GetMedia(ctx, mediaId)
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			return web.Errorf(http.StatusNotFound, "media not found")
+		}
+		return err
+	}
+
+	return web.WriteJSON(w, http.StatusOK, media)
+}
+
+func (s *APIServer) GetFileHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	mediaId, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return web.Errorf(http.StatusNotFound, "file not found")
+	}
+
+	file, contentType, err := s.Service.OpenFile(ctx, mediaId, mux.Vars(r)["name"])
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			return web.Errorf(http.StatusNotFound, "file not found")
+		}
+		return err
+	}
+	defer file.Close()
+
+	// Files never change once uploaded, so they can be cached forever.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, file)
+	return err
+}
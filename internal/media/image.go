@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// Thumbnail sizes are the longest side in pixels.
+var thumbnailSizes = map[string]int{
+	"small":  64,
+	"medium": 256,
+	"large":  1024,
+}
+
+var imageFormats = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+}
+
+// ErrImageTooLarge is returned for images with more pixels than allowed.
+// A small compressed file can declare huge dimensions, so they're checked
+// before the pixels are decoded into memory.
+var ErrImageTooLarge = errors.New("image is too large")
+
+type processedImage struct {
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+	Original    []byte
+	Thumbnails  map[string][]byte
+}
+
+// processImage checks the image type by sniffing its content and re-encodes
+// it. Only pixel data survives re-encoding so EXIF and other metadata
+// (including GPS location) are dropped. Images with more than maxPixels
+// pixels are rejected with ErrImageTooLarge.
+func processImage(data []byte, maxPixels int64) (*processedImage, error) {
+	contentType := http.DetectContentType(data)
+	ext, ok := imageFormats[contentType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type: %s", contentType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("invalid image: %dx%d", config.Width, config.Height)
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	original, err := encodeImage(img, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	result := &processedImage{
+		ContentType: contentType,
+		Ext:         ext,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Original:    original,
+		Thumbnails:  map[string][]byte{},
+	}
+	for name, size := range thumbnailSizes {
+		thumbnail, err := encodeImage(resize(img, size), contentType)
+		if err != nil {
+			return nil, err
+		}
+		result.Thumbnails[name] = thumbnail
+	}
+	return result, nil
+}
+
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	switch contentType {
+	case "image/png":
+		err = png.Encode(buf, img)
+	default:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales the image down so its longest side is at most maxSide,
+// averaging the source pixels covered by each destination pixel. Images
+// that are already small enough are returned as they are.
+func resize(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+
+	dw, dh := maxSide, h*maxSide/w
+	if h > w {
+		dw, dh = w*maxSide/h, maxSide
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMaxImagePixels = 1000 * 1000
+
+func newTestImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	return img
+}
+
+// pngHeader is a PNG that only has its header, declaring the dimensions
+// without any pixel data to back them.
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+// withEXIF inserts an APP1 segment right after the JPEG SOI marker.
+func withEXIF(jpg []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), []byte("GPSLatitude secret location")...)
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestProcessImage(t *testing.T) {
+	t.Run("strip exif", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, jpeg.Encode(buf, newTestImage(40, 30), nil))
+		data := withEXIF(buf.Bytes())
+		assert.True(t, bytes.Contains(data, []byte("Exif")))
+
+		img, err := processImage(data, testMaxImagePixels)
+		assert.Nil(t, err)
+		assert.Equal(t, "image/jpeg", img.ContentType)
+		assert.False(t, bytes.Contains(img.Original, []byte("Exif")))
+		assert.False(t, bytes.Contains(img.Original, []byte("secret location")))
+	})
+	t.Run("thumbnails", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, png.Encode(buf, newTestImage(600, 300)))
+
+		img, err := processImage(buf.Bytes(), testMaxImagePixels)
+		assert.Nil(t, err)
+		assert.Equal(t, "image/png", img.ContentType)
+		assert.Equal(t, 600, img.Width)
+
+		small, err := png.Decode(bytes.NewReader(img.Thumbnails["small"]))
+		assert.Nil(t, err)
+		assert.Equal(t, image.Rect(0, 0, 64, 32), small.Bounds())
+
+		medium, err := png.Decode(bytes.NewReader(img.Thumbnails["medium"]))
+		assert.Nil(t, err)
+		assert.Equal(t, image.Rect(0, 0, 256, 128), medium.Bounds())
+
+		// Images aren't upscaled.
+		large, err := png.Decode(bytes.NewReader(img.Thumbnails["large"]))
+		assert.Nil(t, err)
+		assert.Equal(t, image.Rect(0, 0, 600, 300), large.Bounds())
+	})
+	t.Run("reject unsupported type", func(t *testing.T) {
+		_, err := processImage([]byte("<html>not an image</html>"), testMaxImagePixels)
+		assert.NotNil(t, err)
+	})
+	t.Run("reject decompression bomb", func(t *testing.T) {
+		_, err := processImage(pngHeader(100000, 100000), testMaxImagePixels)
+		assert.ErrorIs(t, err, ErrImageTooLarge)
+
+		// Over four billion pixels, more than 32 bits can count.
+		_, err = processImage(pngHeader(1<<16-1, 1<<16-1), testMaxImagePixels)
+		assert.ErrorIs(t, err, ErrImageTooLarge)
+	})
+	t.Run("reject too many pixels", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, png.Encode(buf, newTestImage(600, 300)))
+
+		_, err := processImage(buf.Bytes(), 600*300-1)
+		assert.ErrorIs(t, err, ErrImageTooLarge)
+		_, err = processImage(buf.Bytes(), 600*300)
+		assert.Nil(t, err)
+	})
+	t.Run("reject corrupted image", func(t *testing.T) {
+		_, err := processImage([]byte("\x89PNG\r\n\x1a\nbroken"), testMaxImagePixels)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestUploadImage(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	assert.Nil(t, err)
+	service := NewMediaService(store, "http://media.test/media/", testMaxImagePixels)
+	ctx := context.Background()
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, png.Encode(buf, newTestImage(100, 100)))
+
+	media, err := service.UploadImage(ctx, "owner", buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, "http://media.test/media/"+media.ID.String()+"/original.png", media.URL)
+	assert.Len(t, media.Thumbnails, len(thumbnailSizes))
+
+	stored, err := service.GetMedia(ctx, media.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, media.URL, stored.URL)
+	assert.Equal(t, "owner", stored.OwnerID)
+
+	file, contentType, err := service.OpenFile(ctx, media.ID, "small.png")
+	assert.Nil(t, err)
+	defer file.Close()
+	body, _ := io.ReadAll(file)
+	assert.NotEmpty(t, body)
+	assert.Equal(t, "image/png", contentType)
+}
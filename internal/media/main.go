@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+
+	env "github.com/Netflix/go-env"
+	web "github.com/sina-am/social-media/common"
+	"github.com/sina-am/social-media/internal/auth/client"
+	"go.uber.org/zap"
+)
+
+type Settings struct {
+	HTTPAddress    string        `env:"HTTP_ADDRESS,default=:8090"`
+	AuthAddress    string        `env:"AUTH_ADDRESS,default=localhost:5000"`
+	PublicURL      string        `env:"PUBLIC_URL,default=http://localhost:8090/media"`
+	MaxUploadSize  int64         `env:"MAX_UPLOAD_SIZE,default=10485760"`
+	MaxImagePixels int64         `env:"MAX_IMAGE_PIXELS,default=40000000"`
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT,default=30s"`
+	DrainTimeout   time.Duration `env:"DRAIN_TIMEOUT,default=15s"`
+
+	// Storage is either "local" or "s3".
+	Storage     string `env:"STORAGE,default=local"`
+	LocalRoot   string `env:"LOCAL_ROOT,default=./data/media"`
+	S3Endpoint  string `env:"S3_ENDPOINT,default=http://localhost:9000"`
+	S3Region    string `env:"S3_REGION,default=us-east-1"`
+	S3Bucket    string `env:"S3_BUCKET,default=media"`
+	S3AccessKey string `env:"S3_ACCESS_KEY,default=minioadmin"`
+	S3SecretKey string `env:"S3_SECRET_KEY,default=minioadmin"`
+}
+
+func NewBlobStore(settings *Settings) (BlobStore, error) {
+	if settings.Storage == "s3" {
+		return NewS3BlobStore(
+			settings.S3Endpoint,
+			settings.S3Region,
+			settings.S3Bucket,
+			settings.S3AccessKey,
+			settings.S3SecretKey,
+		), nil
+	}
+	return NewLocalBlobStore(settings.LocalRoot)
+}
+
+func main() {
+	logger, _ := zap.NewProduction()
+
+	var settings Settings
+	_, err := env.UnmarshalFromEnviron(&settings)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	store, err := NewBlobStore(&settings)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	auth := client.NewGRPCClient(settings.AuthAddress)
+
+	lifecycle := web.NewLifecycle(logger, settings.DrainTimeout)
+	lifecycle.AddReadinessCheck("auth", auth.CheckHealthRPC)
+
+	apiServer := APIServer{
+		APIServer: web.APIServer{
+			Addr:           settings.HTTPAddress,
+			Logger:         logger,
+			RequestTimeout: settings.RequestTimeout,
+			Lifecycle:      lifecycle,
+		},
+		Auth:          auth,
+		Service:       NewMediaService(store, settings.PublicURL, settings.MaxImagePixels),
+		MaxUploadSize: settings.MaxUploadSize,
+	}
+
+	if err := apiServer.Run(); err != nil {
+		logger.Fatal(err.Error())
+	}
+}
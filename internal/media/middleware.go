@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	web "github.com/sina-am/social-media/common"
+	"github.com/sina-am/social-media/internal/auth/types"
+)
+
+func (s *APIServer) AuthenticationMiddleware(f web.APIFunc) web.APIFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		if token == "" {
+			return web.Errorf(http.StatusUnauthorized, "unauthorized user")
+		}
+
+		account, err := s.Auth.ObtainAccountRPC(
+			ctx,
+			&types.JWTToken{Token: token, Type: "bearer"},
+		)
+		if err != nil {
+			return web.Errorf(http.StatusUnauthorized, "unauthorized user")
+		}
+		if scope := types.MethodScope(r.Method); !account.HasScope(scope) {
+			return web.Errorf(http.StatusForbidden, "token doesn't have the %q scope", scope)
+		}
+
+		ctx = context.WithValue(ctx, "Account", account)
+		return f(ctx, w, r)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	web "github.com/sina-am/social-media/common"
+	"github.com/sina-am/social-media/internal/auth/client"
+	"github.com/sina-am/social-media/internal/auth/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// scopedAuth authenticates tokens naming the scopes they were granted.
+type scopedAuth struct {
+	client.GRPCClient
+	scopes map[string][]string
+}
+
+func (a scopedAuth) ObtainAccountRPC(ctx context.Context, jwtToken *types.JWTToken) (*types.Account, error) {
+	scopes, ok := a.scopes[jwtToken.Token]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return &types.Account{Id: "owner", Scopes: scopes}, nil
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	server := &APIServer{Auth: scopedAuth{scopes: map[string][]string{
+		"reader": {types.ScopeRead},
+		"writer": {types.ScopeRead, types.ScopeWrite},
+	}}}
+	handler := server.AuthenticationMiddleware(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+	statusOf := func(method, token string) int {
+		r := httptest.NewRequest(method, "/media/images", nil)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		err := handler(context.Background(), httptest.NewRecorder(), r)
+		if err == nil {
+			return http.StatusOK
+		}
+		if httpErr, ok := err.(*web.HttpError); ok {
+			return httpErr.StatusCode
+		}
+		return 0
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, statusOf(http.MethodPost, ""))
+	assert.Equal(t, http.StatusUnauthorized, statusOf(http.MethodPost, "unknown"))
+	assert.Equal(t, http.StatusOK, statusOf(http.MethodPost, "writer"))
+	assert.Equal(t, http.StatusOK, statusOf(http.MethodGet, "reader"))
+	// Read tokens can't upload or delete.
+	assert.Equal(t, http.StatusForbidden, statusOf(http.MethodPost, "reader"))
+	assert.Equal(t, http.StatusForbidden, statusOf(http.MethodDelete, "reader"))
+}
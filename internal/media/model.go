@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Media struct {
+	ID          uuid.UUID `json:"id"`
+	OwnerID     string    `json:"owner_id"`
+	ContentType string    `json:"content_type"`
+	// Name is the name of an uploaded file, images don't keep theirs.
+	Name       string            `json:"name,omitempty"`
+	Size       int               `json:"size"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	URL        string            `json:"url"`
+	Thumbnails map[string]string `json:"thumbnails"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
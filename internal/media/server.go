@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	web "github.com/sina-am/social-media/common"
+	"github.com/sina-am/social-media/internal/auth/client"
+)
+
+type APIServer struct {
+	web.APIServer
+	Auth          client.GRPCClient
+	Service       Service
+	MaxUploadSize int64
+}
+
+func (s *APIServer) Run() error {
+	router := mux.NewRouter()
+	router.HandleFunc("/media/images", s.MakeHTTPHandler(s.AuthenticationMiddleware(s.UploadImageHandler))).Methods("POST")
+	router.HandleFunc("/media/files", s.MakeHTTPHandler(s.AuthenticationMiddleware(s.UploadFileHandler))).Methods("POST")
+	router.HandleFunc("/media/{id}", s.MakeHTTPHandler(s.GetMediaHandler)).Methods("GET")
+	router.HandleFunc("/media/{id}/{name}", s.MakeHTTPHandler(s.GetFileHandler)).Methods("GET")
+	return s.APIServer.Run(router)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Service interface {
+	UploadImage(ctx context.Context, ownerId string, data []byte) (*Media, error)
+	UploadFile(ctx context.Context, ownerId, name string, data []byte) (*Media, error)
+	GetMedia(ctx context.Context, mediaId uuid.UUID) (*Media, error)
+	OpenFile(ctx context.Context, mediaId uuid.UUID, name string) (io.ReadCloser, string, error)
+}
+
+type mediaService struct {
+	store          BlobStore
+	baseURL        string
+	maxImagePixels int64
+}
+
+// NewMediaService returns a service that stores media in store and builds
+// public URLs under baseURL, which must route back to this service. Images
+// with more than maxImagePixels pixels are refused.
+func NewMediaService(store BlobStore, baseURL string, maxImagePixels int64) *mediaService {
+	return &mediaService{
+		store:          store,
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		maxImagePixels: maxImagePixels,
+	}
+}
+
+func mediaKey(mediaId uuid.UUID, name string) string {
+	return fmt.Sprintf("media/%s/%s", mediaId, name)
+}
+
+func (s *mediaService) fileURL(mediaId uuid.UUID, name string) string {
+	return fmt.Sprintf("%s/%s/%s", s.baseURL, mediaId, name)
+}
+
+func (s *mediaService) UploadImage(ctx context.Context, ownerId string, data []byte) (*Media, error) {
+	img, err := processImage(data, s.maxImagePixels)
+	if err != nil {
+		return nil, err
+	}
+
+	media := &Media{
+		ID:          uuid.New(),
+		OwnerID:     ownerId,
+		ContentType: img.ContentType,
+		Size:        len(img.Original),
+		Width:       img.Width,
+		Height:      img.Height,
+		Thumbnails:  map[string]string{},
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	name := "original." + img.Ext
+	if err := s.store.Put(ctx, mediaKey(media.ID, name), img.ContentType, bytes.NewReader(img.Original)); err != nil {
+		return nil, err
+	}
+	media.URL = s.fileURL(media.ID, name)
+
+	for size, thumbnail := range img.Thumbnails {
+		name := size + "." + img.Ext
+		if err := s.store.Put(ctx, mediaKey(media.ID, name), img.ContentType, bytes.NewReader(thumbnail)); err != nil {
+			return nil, err
+		}
+		media.Thumbnails[size] = s.fileURL(media.ID, name)
+	}
+
+	meta, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.Put(ctx, mediaKey(media.ID, "meta.json"), "application/json", bytes.NewReader(meta)); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// UploadFile stores any other file, like a document or a voice note, as it
+// is. It's served with the sniffed content type only when browsers can't
+// be tricked into running it, otherwise as application/octet-stream.
+func (s *mediaService) UploadFile(ctx context.Context, ownerId, name string, data []byte) (*Media, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyFile
+	}
+
+	media := &Media{
+		ID:          uuid.New(),
+		OwnerID:     ownerId,
+		ContentType: fileContentType(data),
+		Name:        fileName(name),
+		Size:        len(data),
+		Thumbnails:  map[string]string{},
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.store.Put(ctx, mediaKey(media.ID, "file"), media.ContentType, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	media.URL = s.fileURL(media.ID, "file")
+
+	meta, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.Put(ctx, mediaKey(media.ID, "meta.json"), "application/json", bytes.NewReader(meta)); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+func (s *mediaService) GetMedia(ctx context.Context, mediaId uuid.UUID) (*Media, error) {
+	r, _, err := s.store.Get(ctx, mediaKey(mediaId, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	media := &Media{}
+	if err := json.NewDecoder(r).Decode(media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+func (s *mediaService) OpenFile(ctx context.Context, mediaId uuid.UUID, name string) (io.ReadCloser, string, error) {
+	if strings.ContainsAny(name, "/\\") {
+		return nil, "", ErrBlobNotFound
+	}
+	return s.store.Get(ctx, mediaKey(mediaId, name))
+}